@@ -768,11 +768,13 @@ func (c *Config) Desensitize() *Config {
 	// 处理API服务器配置
 	if c.APIServer != nil {
 		res.APIServer = &APIServerConfig{
-			Enable:      c.APIServer.Enable,
-			BindIPAddr:  c.APIServer.BindIPAddr,
-			Port:        c.APIServer.Port,
-			Verbosity:   c.APIServer.Verbosity,
-			CORSOrigins: c.APIServer.CORSOrigins,
+			Enable:       c.APIServer.Enable,
+			BindIPAddr:   c.APIServer.BindIPAddr,
+			Port:         c.APIServer.Port,
+			Verbosity:    c.APIServer.Verbosity,
+			CORSOrigins:  c.APIServer.CORSOrigins,
+			SymbolAllows: c.APIServer.SymbolAllows,
+			SymbolBlocks: c.APIServer.SymbolBlocks,
 		}
 		if c.APIServer.Users != nil {
 			res.APIServer.Users = make([]*UserConfig, len(c.APIServer.Users))
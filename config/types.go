@@ -192,6 +192,10 @@ type APIServerConfig struct {
 	JWTSecretKey string        `yaml:"jwt_secret_key,omitempty" mapstructure:"jwt_secret_key"` // Key used for password encryption 用于密码加密的密钥
 	CORSOrigins  []string      `yaml:"CORS_origins,flow" mapstructure:"CORS_origins"`          // When accessing banweb, you need to add the address of banweb here to allow access. banweb访问时，要这里添加banweb的地址放行
 	Users        []*UserConfig `yaml:"users" mapstructure:"users"`                             // Login user 登录用户
+	// Only symbols matching any of these patterns can be queried, empty for all, like "*USDT" 仅可查询匹配其中任一模式的品种，为空时全部
+	SymbolAllows []string `yaml:"symbol_allows,flow,omitempty" mapstructure:"symbol_allows"`
+	// Symbols matching any of these patterns can never be queried 匹配其中任一模式的品种不可查询
+	SymbolBlocks []string `yaml:"symbol_blocks,flow,omitempty" mapstructure:"symbol_blocks"`
 }
 
 type UserConfig struct {
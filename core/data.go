@@ -94,6 +94,8 @@ const (
 	WsSubKLine = "uohlcv"
 	WsSubDepth = "depth"
 	WsSubTrade = "trade"
+	// Latest candles of several timeframes bundled in one msg 多个周期的最新K线打包为一个消息
+	WsSubMultiTF = "mtf"
 )
 
 const (
@@ -7,6 +7,7 @@ const (
 	ErrMarshalFail    = -103
 	ErrCompressFail   = -104
 	ErrDeCompressFail = -105
+	ErrBusy           = -106
 
 	ErrBadConfig     = -110
 	ErrInvalidPath   = -111
@@ -15,6 +16,7 @@ const (
 	ErrInvalidBars   = -114
 	ErrInvalidAddr   = -115
 	ErrInvalidCost   = -116
+	ErrInvalidMsg    = -117
 
 	ErrDbConnFail        = -120
 	ErrDbReadFail        = -121
@@ -32,6 +34,11 @@ const (
 	ErrNetTimeout   = -143
 	ErrNetTemporary = -144
 	ErrNetConnect   = -145
+	ErrClosed       = -146
+	// handshake failures, never retried 握手失败，不会重试
+	ErrAuthFail        = -147
+	ErrVersionMismatch = -148
+	ErrCodecMismatch   = -149
 
 	ErrIOReadFail  = -150
 	ErrIOWriteFail = -151
@@ -57,11 +64,13 @@ var ErrCodeNames = map[int]string{
 	ErrInvalidSymbol:     "InvalidSymbol",
 	ErrInvalidBars:       "InvalidBars",
 	ErrInvalidAddr:       "InvalidAddr",
+	ErrInvalidMsg:        "InvalidMsg",
 	ErrRunTime:           "RunTime",
 	ErrMarshalFail:       "MarshalFail",
 	ErrCompressFail:      "CompressFail",
 	ErrDeCompressFail:    "DeCompressFail",
 	ErrTimeout:           "Timeout",
+	ErrBusy:              "Busy",
 	ErrEOF:               "EOF",
 	ErrNetWriteFail:      "NetWriteFail",
 	ErrNetReadFail:       "NetReadFail",
@@ -69,4 +78,8 @@ var ErrCodeNames = map[int]string{
 	ErrNetTimeout:        "NetTimeout",
 	ErrNetTemporary:      "NetTemporary",
 	ErrNetConnect:        "NetConnect",
+	ErrClosed:            "Closed",
+	ErrAuthFail:          "AuthFail",
+	ErrVersionMismatch:   "VersionMismatch",
+	ErrCodecMismatch:     "CodecMismatch",
 }
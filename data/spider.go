@@ -15,6 +15,7 @@ import (
 	"github.com/sasha-s/go-deadlock"
 	"go.uber.org/zap"
 	"maps"
+	"strings"
 	"time"
 )
 
@@ -90,6 +91,9 @@ func consumeWriteQ(workNum int) {
 			if err != nil {
 				log.Error("broadCast kline fail", zap.String("action", job.MsgAction), zap.Error(err))
 			}
+			if parts := strings.Split(job.MsgAction, "_"); job.TimeFrame == "1m" && len(parts) == 4 {
+				Spider.broadcastMultiTF(parts[1], parts[2], parts[3], job.Arr)
+			}
 		}(save)
 	}
 }
@@ -403,6 +407,10 @@ func (m *Miner) watchTrades(pairs []string) {
 				if err != nil {
 					log.Error("broadCast trade fail", zap.String("key", prefix), zap.Error(err))
 				}
+				err = m.spider.BroadcastTrades(pair, items)
+				if err != nil {
+					log.Error("broadCast trade fail", zap.String("pair", pair), zap.Error(err))
+				}
 			}
 		}
 	}()
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"fmt"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banbot/utils"
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/log"
+	utils2 "github.com/banbox/banexg/utils"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+	"strings"
+)
+
+/*
+NotifyMultiTF
+Latest candle of each subscribed timeframe, the last one may be unfinished.
+Higher timeframes are aggregated since the first subscription, so the first bar may be partial.
+每个订阅周期的最新K线，可能未完成。大周期从首次订阅开始归集，因此第一个bar可能不完整。
+*/
+type NotifyMultiTF struct {
+	Bars map[string]*banexg.Kline // timeframe -> latest bar 周期 -> 最新bar
+}
+
+/*
+MultiTFTag
+Return the tag to subscribe latest candles of several timeframes in one message: mtf_{exg}_{market}_{pair}_{tf1,tf2}
+返回在一个消息中订阅多个周期最新K线的tag：mtf_{exg}_{market}_{pair}_{tf1,tf2}
+*/
+func MultiTFTag(exgName, market, pair string, tfs ...string) string {
+	return fmt.Sprintf("%s_%s_%s_%s_%s", core.WsSubMultiTF, exgName, market, pair, strings.Join(tfs, ","))
+}
+
+// parseMultiTFTag return the pair prefix (mtf_{exg}_{market}_{pair}_) and timeframes of tag
+func parseMultiTFTag(tag string) (string, []string, bool) {
+	parts := strings.Split(tag, "_")
+	if len(parts) != 5 || parts[0] != core.WsSubMultiTF || parts[4] == "" {
+		return "", nil, false
+	}
+	tfs := strings.Split(parts[4], ",")
+	for _, tf := range tfs {
+		if utils2.TFToSecs(tf) <= 0 {
+			return "", nil, false
+		}
+	}
+	return tag[:len(tag)-len(parts[4])], tfs, true
+}
+
+/*
+multiTFBars
+Aggregate 1m candles into the latest candle of each requested timeframe, keyed by the pair prefix of MultiTFTag.
+将1m K线归集为每个请求周期的最新K线，键为MultiTFTag的品种前缀。
+*/
+type multiTFBars struct {
+	bars map[string]map[string]*banexg.Kline
+	lock deadlock.Mutex
+}
+
+var mtfBars = &multiTFBars{bars: make(map[string]map[string]*banexg.Kline)}
+
+// update merge arr (1m bars) into the latest bar of each tf, return copies of them
+func (m *multiTFBars) update(key string, tfs []string, arr []*banexg.Kline, infoBy string) map[string]*banexg.Kline {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	lasts, ok := m.bars[key]
+	if !ok {
+		lasts = make(map[string]*banexg.Kline)
+		m.bars[key] = lasts
+	}
+	res := make(map[string]*banexg.Kline, len(tfs))
+	for _, tf := range tfs {
+		var olds []*banexg.Kline
+		if last, ok := lasts[tf]; ok {
+			olds = append(olds, last)
+		}
+		tfMSecs := int64(utils2.TFToSecs(tf) * 1000)
+		merged, _ := utils.BuildOHLCV(arr, tfMSecs, 0, olds, 60000, 0, infoBy)
+		if len(merged) > 0 {
+			lasts[tf] = merged[len(merged)-1]
+		}
+		if last, ok := lasts[tf]; ok {
+			res[tf] = last.Clone()
+		}
+	}
+	return res
+}
+
+/*
+broadcastMultiTF
+Bundle the latest candles for every subscribed multi-timeframe tag of the pair after 1m candles are saved.
+1m K线保存后，为该品种每个已订阅的多周期tag打包最新K线并广播。
+*/
+func (s *LiveSpider) broadcastMultiTF(exgName, market, pair string, arr []*banexg.Kline) {
+	prefix := MultiTFTag(exgName, market, pair)
+	tagTFs := make(map[string][]string)
+	tfSet := make(map[string]bool)
+	for _, tags := range s.Subscriptions() {
+		for _, tag := range tags {
+			if _, ok := tagTFs[tag]; ok || !strings.HasPrefix(tag, prefix) {
+				continue
+			}
+			_, tfs, ok := parseMultiTFTag(tag)
+			if !ok {
+				continue
+			}
+			tagTFs[tag] = tfs
+			for _, tf := range tfs {
+				tfSet[tf] = true
+			}
+		}
+	}
+	if len(tagTFs) == 0 {
+		return
+	}
+	infoBy := "last"
+	if exs := orm.GetExSymbol2(exgName, market, pair); exs != nil {
+		infoBy = exs.InfoBy()
+	}
+	// update once for the union of timeframes, so overlapped tags won't merge twice
+	// 对所有周期的并集只更新一次，避免重叠的tag重复合并
+	lasts := mtfBars.update(prefix, utils2.KeysOfMap(tfSet), arr, infoBy)
+	for tag, tfs := range tagTFs {
+		bars := make(map[string]*banexg.Kline, len(tfs))
+		for _, tf := range tfs {
+			if bar, ok := lasts[tf]; ok {
+				bars[tf] = bar
+			}
+		}
+		err := s.Broadcast(&utils.IOMsg{Action: tag, Data: NotifyMultiTF{Bars: bars}})
+		if err != nil {
+			log.Error("broadCast multi tf fail", zap.String("tag", tag), zap.Error(err))
+		}
+	}
+}
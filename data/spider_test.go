@@ -14,7 +14,9 @@ import (
 	"github.com/banbox/banexg/log"
 	utils2 "github.com/banbox/banexg/utils"
 	"go.uber.org/zap"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestWatchOhlcv(t *testing.T) {
@@ -132,3 +134,69 @@ delete from khole where sid=%v;`, sid, sid, sid, sid, sid, sid, sid, sid))
 		}
 	}
 }
+
+func TestMultiTFBroadcast(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	server := utils.NewBanServer(ln.Addr().String(), "spider")
+	spider := &LiveSpider{ServerIO: server, miners: map[string]*Miner{}}
+	go server.Serve(ln)
+	client, err := utils.NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	defer client.Conn.Close()
+	got := make(chan NotifyMultiTF, 10)
+	client.Listens[core.WsSubMultiTF] = func(_ string, data []byte) {
+		var msg NotifyMultiTF
+		if err_ := utils2.Unmarshal(data, &msg, utils2.JsonNumDefault); err_ != nil {
+			t.Error(err_)
+		}
+		got <- msg
+	}
+	go client.RunForever()
+	tag := MultiTFTag("binance", "spot", "BTC/USDT", "1m", "5m", "1h")
+	if err = client.WriteMsg(&utils.IOMsg{Action: "subscribe", Data: []string{tag}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		subs := server.Subscriptions()
+		if len(subs) == 1 && len(utils2.ValsOfMap(subs)[0]) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	startMS := int64(1699999200000) // aligned to 1h
+	makeBar := func(i int64, price float64) *banexg.Kline {
+		return &banexg.Kline{Time: startMS + i*60000, Open: price, High: price + 2, Low: price - 1,
+			Close: price + 1, Volume: 10}
+	}
+	batches := [][]*banexg.Kline{{makeBar(0, 100), makeBar(1, 101)}, {makeBar(5, 110)}}
+	var last NotifyMultiTF
+	for i, arr := range batches {
+		spider.broadcastMultiTF("binance", "spot", "BTC/USDT", arr)
+		select {
+		case last = <-got:
+		case <-time.After(time.Second * 3):
+			t.Fatalf("multi tf msg %d not received", i)
+		}
+		if len(last.Bars) != 3 {
+			t.Fatalf("expect 3 timeframes, got %v", last.Bars)
+		}
+	}
+	m1, m5, h1 := last.Bars["1m"], last.Bars["5m"], last.Bars["1h"]
+	if m1.Time != startMS+5*60000 || m1.Close != 111 {
+		t.Fatalf("bad 1m bar: %+v", m1)
+	}
+	if m5.Time != startMS+5*60000 || m5.Open != 110 || m5.Volume != 10 {
+		t.Fatalf("bad 5m bar: %+v", m5)
+	}
+	if h1.Time != startMS || h1.Open != 100 || h1.High != 112 || h1.Low != 99 || h1.Close != 111 || h1.Volume != 30 {
+		t.Fatalf("bad 1h bar: %+v", h1)
+	}
+}
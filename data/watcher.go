@@ -22,6 +22,7 @@ type KLineWatcher struct {
 	OnKLineMsg func(msg *KLineMsg) // 收到爬虫K线消息
 	OnTrades   func(exgName, market, pair string, trades []*banexg.Trade)
 	OnDepth    func(dep *banexg.OrderBook)
+	OnMultiTF  func(exgName, market, pair string, bars map[string]*banexg.Kline) // 收到多周期最新K线
 }
 
 type WatchJob struct {
@@ -56,6 +57,7 @@ func NewKlineWatcher(addr string) (*KLineWatcher, *errs.Error) {
 	res.Listens["price"] = res.onPriceUpdate
 	res.Listens[core.WsSubTrade] = res.onTrades
 	res.Listens[core.WsSubDepth] = res.onBook
+	res.Listens[core.WsSubMultiTF] = res.onMultiTF
 	res.ReInitConn = func() {
 		if len(res.initMsgs) == 0 {
 			return
@@ -130,6 +132,22 @@ func (w *KLineWatcher) WatchJobs(exgName, marketType, jobType string, jobs ...Wa
 	return w.SendMsg("watch_pairs", args)
 }
 
+/*
+WatchMultiTF
+Subscribe the latest candles of several timeframes of a pair, received in one message by OnMultiTF.
+订阅一个品种多个周期的最新K线，通过OnMultiTF在一个消息中接收。
+*/
+func (w *KLineWatcher) WatchMultiTF(exgName, marketType, pair string, tfs ...string) *errs.Error {
+	if len(tfs) == 0 {
+		return errs.NewMsg(errs.CodeParamRequired, "timeframes required")
+	}
+	err := w.SendMsg("subscribe", []string{MultiTFTag(exgName, marketType, pair, tfs...)})
+	if err != nil {
+		return err
+	}
+	return w.SendMsg("watch_pairs", []string{exgName, marketType, "ohlcv", pair})
+}
+
 func (w *KLineWatcher) SendMsg(action string, data interface{}) *errs.Error {
 	msg := &utils.IOMsg{Action: action, Data: data}
 	err := w.WriteMsg(msg)
@@ -237,6 +255,24 @@ func (w *KLineWatcher) onSpiderBar(key string, data []byte) {
 	}
 }
 
+func (w *KLineWatcher) onMultiTF(key string, data []byte) {
+	if w.OnMultiTF == nil {
+		return
+	}
+	parts := strings.Split(key, "_")
+	if len(parts) != 5 {
+		log.Debug("invalid multi tf key", zap.String("key", key))
+		return
+	}
+	var msg NotifyMultiTF
+	err_ := utils2.Unmarshal(data, &msg, utils2.JsonNumDefault)
+	if err_ != nil {
+		log.Debug("onMultiTF decode fail", zap.String("key", key))
+		return
+	}
+	w.OnMultiTF(parts[1], parts[2], parts[3], msg.Bars)
+}
+
 func (w *KLineWatcher) onPriceUpdate(key string, data []byte) {
 	parts := strings.Split(key, "_")
 	exgName, market := parts[1], parts[2]
@@ -282,6 +282,12 @@ func init() {
 		Options: []string{"in", "out"},
 		Help:    "build backtest result from orders.gob and config",
 	})
+	AddCmdJob(&CmdJob{
+		Name:   "bench_io",
+		Parent: "tool",
+		RunRaw: runIOBench,
+		Help:   "benchmark throughput and latency of a running spider server",
+	})
 	AddCmdJob(&CmdJob{
 		Name:   "test_live_bars",
 		Parent: "tool",
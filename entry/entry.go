@@ -281,3 +281,24 @@ func runMergeAssets(args []string) error {
 	log.Info("assets merged", zap.String("to", outPath))
 	return nil
 }
+
+func runIOBench(args []string) error {
+	fs := flag.NewFlagSet("", flag.ExitOnError)
+	var bench utils.IOBenchArgs
+	fs.StringVar(&bench.Addr, "addr", "127.0.0.1:6789", "address of the running banio server")
+	fs.IntVar(&bench.Clients, "clients", 4, "number of concurrent clients")
+	fs.IntVar(&bench.Msgs, "msgs", 1000, "requests sent by each client")
+	fs.IntVar(&bench.Size, "size", 1024, "payload bytes of each response")
+	fs.IntVar(&bench.Timeout, "timeout", 5, "seconds to wait for each response")
+	err_ := fs.Parse(args)
+	if err_ != nil {
+		return err_
+	}
+	core.SetRunMode(core.RunModeLive)
+	res, err := utils.RunIOBench(&bench)
+	if err != nil {
+		return err
+	}
+	fmt.Println(res.String())
+	return nil
+}
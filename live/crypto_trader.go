@@ -18,6 +18,7 @@ import (
 	"github.com/banbox/banbot/rpc"
 	"github.com/banbox/banbot/strat"
 	"github.com/banbox/banbot/web"
+	"github.com/banbox/banbot/web/base"
 	"github.com/banbox/banexg/errs"
 	"github.com/banbox/banexg/log"
 	"go.uber.org/zap"
@@ -57,6 +58,7 @@ func (t *CryptoTrader) Init() *errs.Error {
 	if err != nil {
 		return err
 	}
+	base.RelayBanio(dp.ClientIO, base.EventBanioActions...)
 	// Order Manager initialization
 	// 订单管理器初始化
 	err = t.initOdMgr()
@@ -38,6 +38,19 @@ func (q *Queries) LoadExgSymbols(exgName string) *errs.Error {
 	return nil
 }
 
+/*
+CacheExSymbols
+Put symbols into the memory cache without touching the database, for tests and offline tools.
+将品种放入内存缓存而不访问数据库，用于测试和离线工具。
+*/
+func CacheExSymbols(items ...*ExSymbol) {
+	for _, exs := range items {
+		key := fmt.Sprintf("%s:%s:%s", exs.Exchange, exs.Market, exs.Symbol)
+		keySymbolMap[key] = exs
+		idSymbolMap[exs.ID] = exs
+	}
+}
+
 func GetExSymbols(exgName, market string) map[int32]*ExSymbol {
 	var res = make(map[int32]*ExSymbol)
 	for _, exs := range keySymbolMap {
@@ -72,6 +72,9 @@ func FetchApiOHLCV(ctx context.Context, exchange banexg.BanExchange, pair, timeF
 		since, until = nextRange(endMS, endMS)
 	}
 	for since > 0 && until > since {
+		if ctx.Err() != nil {
+			return nil
+		}
 		curSize := int((until - since) / tfMSecs)
 		data, err := exchange.FetchOHLCV(pair, timeFrame, since, curSize, map[string]interface{}{
 			banexg.ParamDebug: DebugDownKLine,
@@ -102,14 +105,24 @@ Download K-line to database. This method should be called in a transaction, othe
 */
 func (q *Queries) DownOHLCV2DB(exchange banexg.BanExchange, exs *ExSymbol, timeFrame string, startMS, endMS int64,
 	pBar *utils.PrgBar) (int, *errs.Error) {
-	return q.downOHLCV2DB(exchange, exs, timeFrame, startMS, endMS, 2, pBar)
+	return q.DownOHLCV2DBCtx(context.Background(), exchange, exs, timeFrame, startMS, endMS, pBar)
 }
 
-func (q *Queries) downOHLCV2DB(exchange banexg.BanExchange, exs *ExSymbol, timeFrame string, startMS, endMS int64,
-	retry int, pBar *utils.PrgBar) (int, *errs.Error) {
+/*
+DownOHLCV2DBCtx
+Same as DownOHLCV2DB, but stops fetching once ctx is done. Klines saved before are kept, and ErrRunTime is returned.
+同DownOHLCV2DB，但ctx结束后停止下载。之前已保存的K线会保留，并返回ErrRunTime。
+*/
+func (q *Queries) DownOHLCV2DBCtx(ctx context.Context, exchange banexg.BanExchange, exs *ExSymbol, timeFrame string,
+	startMS, endMS int64, pBar *utils.PrgBar) (int, *errs.Error) {
+	return q.downOHLCV2DB(ctx, exchange, exs, timeFrame, startMS, endMS, 2, pBar)
+}
+
+func (q *Queries) downOHLCV2DB(ctx context.Context, exchange banexg.BanExchange, exs *ExSymbol, timeFrame string,
+	startMS, endMS int64, retry int, pBar *utils.PrgBar) (int, *errs.Error) {
 	startMS = exs.GetValidStart(startMS)
 	oldStart, oldEnd := q.GetKlineRange(exs.ID, timeFrame)
-	return downOHLCV2DBRange(q, exchange, exs, timeFrame, startMS, endMS, oldStart, oldEnd, retry, pBar)
+	return downOHLCV2DBRange(ctx, q, exchange, exs, timeFrame, startMS, endMS, oldStart, oldEnd, retry, pBar)
 }
 
 /*
@@ -119,8 +132,8 @@ stepCB is used to update the progress. The total value is fixed at 1000 to preve
 此函数会用于多线程下载，一个数据库会话只能用于一个线程，所以不能传入Queries
 stepCB 用于更新进度，总值固定1000，避免内部下载区间大于传入区间
 */
-func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol, timeFrame string, startMS, endMS,
-	oldStart, oldEnd int64, retry int, pBar *utils.PrgBar) (int, *errs.Error) {
+func downOHLCV2DBRange(ctx context.Context, sess *Queries, exchange banexg.BanExchange, exs *ExSymbol, timeFrame string,
+	startMS, endMS, oldStart, oldEnd int64, retry int, pBar *utils.PrgBar) (int, *errs.Error) {
 	if oldStart <= startMS && endMS <= oldEnd || startMS <= exs.ListMs && endMS <= exs.ListMs ||
 		exs.Combined || exs.DelistMs > 0 {
 		// If you are completely in the downloaded interval or the download interval is less than the time of availability, you don't need to download it
@@ -199,7 +212,7 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 	wg.Add(2)
 	var outErr *errs.Error
 	saveNum := 0
-	ctx, cancel := context.WithCancel(context.Background())
+	downCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Start a goroutine to download the candlestick and write it to chanDown
@@ -211,7 +224,7 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 		}()
 		for {
 			select {
-			case <-ctx.Done():
+			case <-downCtx.Done():
 				return
 			case job, ok := <-chanDown:
 				if !ok {
@@ -227,7 +240,7 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 					endText := btime.ToDateStr(job.End, "")
 					log.Info(fmt.Sprintf("fetch %s %s  %s - %s, num: %d", exs.Symbol, timeFrame, startText, endText, barNum))
 				}
-				err = FetchApiOHLCV(ctx, exchange, exs.Symbol, timeFrame, start, stop, chanKline)
+				err = FetchApiOHLCV(downCtx, exchange, exs.Symbol, timeFrame, start, stop, chanKline)
 				if err != nil {
 					outErr = err
 					cancel()
@@ -244,7 +257,7 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 		var num int64
 		for {
 			select {
-			case <-ctx.Done():
+			case <-downCtx.Done():
 				return
 			case batch, ok := <-chanKline:
 				if !ok {
@@ -274,11 +287,15 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 	}()
 
 	wg.Wait()
+	if outErr == nil && ctx.Err() != nil {
+		// canceled by caller, saved klines are still recorded below 被调用方取消，已保存的K线仍在下面记录
+		outErr = errs.New(core.ErrRunTime, ctx.Err())
+	}
 	// 检查是否需要下载未完成bar
 	curMS := btime.UTCStamp()
 	tfMSecs := int64(tfSecs * 1000)
 	curAlignMS := utils2.AlignTfMSecs(curMS, tfMSecs)
-	if endMS > curAlignMS {
+	if endMS > curAlignMS && ctx.Err() == nil {
 		data, err := exchange.FetchOHLCV(exs.Symbol, timeFrame, curAlignMS, 1, nil)
 		if err != nil {
 			log.Warn("fetch unfinish bar fail", zap.Error(err))
@@ -300,7 +317,7 @@ func downOHLCV2DBRange(sess *Queries, exchange banexg.BanExchange, exs *ExSymbol
 		if err == nil {
 			log.Info("retry downOHLCV2DB after ErrDbUniqueViolation", zap.Int32("sid", exs.ID),
 				zap.String("tf", timeFrame))
-			return sess.downOHLCV2DB(exchange, exs, timeFrame, startMS, endMS, retry-1, pBar)
+			return sess.downOHLCV2DB(ctx, exchange, exs, timeFrame, startMS, endMS, retry-1, pBar)
 		} else {
 			log.Warn("updateKLineRange after ErrDbUniqueViolation fail", zap.Int32("sid", exs.ID),
 				zap.String("tf", timeFrame), zap.Error(err))
@@ -329,6 +346,16 @@ AutoFetchOHLCV
 */
 func AutoFetchOHLCV(exchange banexg.BanExchange, exs *ExSymbol, timeFrame string, startMS, endMS int64,
 	limit int, withUnFinish bool, pBar *utils.PrgBar) ([]*AdjInfo, []*banexg.Kline, *errs.Error) {
+	return AutoFetchOHLCVCtx(context.Background(), exchange, exs, timeFrame, startMS, endMS, limit, withUnFinish, pBar)
+}
+
+/*
+AutoFetchOHLCVCtx
+Same as AutoFetchOHLCV, but the download stops once ctx is done, see DownOHLCV2DBCtx.
+同AutoFetchOHLCV，但ctx结束后停止下载，见DownOHLCV2DBCtx。
+*/
+func AutoFetchOHLCVCtx(ctx context.Context, exchange banexg.BanExchange, exs *ExSymbol, timeFrame string, startMS,
+	endMS int64, limit int, withUnFinish bool, pBar *utils.PrgBar) ([]*AdjInfo, []*banexg.Kline, *errs.Error) {
 	tfMSecs := int64(utils2.TFToSecs(timeFrame) * 1000)
 	startMS, endMS = parseDownArgs(tfMSecs, startMS, endMS, limit, withUnFinish)
 	downTF, err := GetDownTF(timeFrame)
@@ -346,7 +373,7 @@ func AutoFetchOHLCV(exchange banexg.BanExchange, exs *ExSymbol, timeFrame string
 		return nil, nil, err
 	}
 	defer conn.Release()
-	_, err = sess.DownOHLCV2DB(exchange, exs, downTF, startMS, endMS, pBar)
+	_, err = sess.DownOHLCV2DBCtx(ctx, exchange, exs, downTF, startMS, endMS, pBar)
 	if err != nil {
 		// DownOHLCV2DB 内部已处理stepCB，这里无需处理
 		return nil, nil, err
@@ -655,7 +682,8 @@ func BulkDownOHLCV(exchange banexg.BanExchange, exsList map[int32]*ExSymbol, tim
 		if krange, ok := kRanges[exs.ID]; ok {
 			oldStart, oldEnd = krange[0], krange[1]
 		}
-		_, err = downOHLCV2DBRange(nil, exchange, exs, downTF, startMS, endMS, oldStart, oldEnd, 2, pBar)
+		_, err = downOHLCV2DBRange(context.Background(), nil, exchange, exs, downTF, startMS, endMS, oldStart, oldEnd, 2,
+			pBar)
 		return err
 	})
 }
@@ -1438,7 +1438,7 @@ func tryFillHoles(sess *Queries, sids map[int32]string, prg utils.PrgCB) *errs.E
 		}
 		// Download K-lines and also collect higher cycle K-lines
 		// 下载K线，同时也会归集更高周期K线
-		saveNum, err := downOHLCV2DBRange(sess, exchange, exs, row.Timeframe, start, stop, 0, 0, 2, nil)
+		saveNum, err := downOHLCV2DBRange(context.Background(), sess, exchange, exs, row.Timeframe, start, stop, 0, 0, 2, nil)
 		if err != nil {
 			if err.Code == errs.CodeNoMarketForPair {
 				log.Info("skip down no market symbol", zap.Int32("sid", exs.ID),
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"container/list"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -11,14 +14,24 @@ import (
 	"github.com/banbox/banbot/core"
 	"github.com/banbox/banexg/errs"
 	"github.com/banbox/banexg/log"
-	"github.com/banbox/banexg/utils"
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/sasha-s/go-deadlock"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"hash/fnv"
 	"io"
+	"maps"
+	"math"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -34,6 +47,7 @@ type IBanConn interface {
 	GetRemote() string
 	IsClosed() bool
 	HasTag(tag string) bool
+	IsPaused() bool
 	RunForever() *errs.Error
 }
 
@@ -41,38 +55,256 @@ type BanConn struct {
 	Conn        net.Conn          // Original socket connection 原始的socket连接
 	Tags        map[string]bool   // Message subscription list 消息订阅列表
 	Remote      string            // Remote Name 远端名称
+	RemoteAddr  string            // Network address of the remote 远端网络地址
+	Name        string            // Logical name declared by the client, empty if not declared 客户端声明的逻辑名称
 	Listens     map[string]ConnCB // Message processing function 消息处理函数
 	RefreshMS   int64             // Connection ready timestamp 连接就绪的时间戳
 	Ready       bool
 	IsReading   bool
+	Paused      atomic.Bool // Broadcasts are skipped while paused, tags are retained 暂停时跳过广播，保留订阅
 	lockConnect deadlock.Mutex
+	lockConn    deadlock.RWMutex // Guard replacing Conn and Ready while reconnecting 重连时保护Conn和Ready的替换
 	lockWrite   deadlock.Mutex
 	lockTag     deadlock.Mutex
-	heartBeatMs int64               // Timestamp of the latest received ping/pong
-	DoConnect   func(conn *BanConn) // Reconnect function, no attempt to reconnect provided 重新连接函数，未提供不尝试重新连接
-	ReInitConn  func()              // Initialize callback function after successful reconnection 重新连接成功后初始化回调函数
+	heartBeatMs int64 // Timestamp of the latest received ping/pong
+	// Reconnect function making one dial attempt, it runs without lockConn and should set the new conn by SetConn.
+	// No attempt to reconnect if not provided
+	// 重新连接函数，每次尝试拨号一次，运行时不持有lockConn，应通过SetConn设置新连接。未提供不尝试重新连接
+	DoConnect  func(conn *BanConn)
+	ReInitConn func() // Initialize callback function after successful reconnection 重新连接成功后初始化回调函数
+	// Max continuous reconnect attempts before giving up, 0 for unlimited 放弃前最大连续重连次数，0表示不限制
+	MaxReconnects int
+	// Wait before each reconnect attempt, default 3s for the first and 10s for later ones 每次重连前等待时间，默认首次3s，之后10s
+	RetryWait time.Duration
+	// Attempt the first reconnect at once, for recovering from momentary drops 首次重连立即尝试，用于从瞬时断开中快速恢复
+	RetryImmediate bool
+	// Max wait before each reconnect attempt, 0 for no cap 每次重连前的最长等待时间，0表示不限制
+	RetryMaxWait time.Duration
+	// Spread the first reconnect after a lost conn over this window, so clients of a restarted server don't dial at
+	// once. Added to the wait of the first attempt, 0 to disable
+	// 将断线后的首次重连分散到此时间窗口内，避免服务器重启后客户端同时拨号。加到首次尝试的等待时间上，0表示禁用
+	ReconnectSpread time.Duration
+	// Key choosing the offset within ReconnectSpread, e.g. a client id, so the offset is stable. Random if empty
+	// 决定ReconnectSpread内偏移的键，如客户端id，使偏移保持稳定。为空时随机
+	JitterKey string
+	// Callback when connection state changes, err is set when giving up 连接状态变化时回调，放弃重连时err非空
+	OnStateChange func(c *BanConn, state int, err *errs.Error)
+	stopped       atomic.Bool // Permanently closed, never reconnect 永久关闭，不再重连
+	// Callback when the server refuses to subscribe some tags, e.g. draining 服务器拒绝订阅某些tag时回调，如排空中
+	OnSubReject func(rej *SubReject)
+	// Callback when the server refuses a request action, e.g. draining 服务器拒绝请求action时回调，如排空中
+	OnReqReject func(rej *ReqReject)
+	// Max inbound messages per second, 0 for unlimited 每秒最大接收消息数，0表示不限制
+	MsgRateLimit float64
+	// Burst size of MsgRateLimit, default equals to MsgRateLimit 接收速率的突发容量，默认等于MsgRateLimit
+	MsgRateBurst int
+	// Close the conn when the rate is exceeded, otherwise drop the message 超出速率时关闭连接，否则丢弃消息
+	FloodClose bool
+	msgBucket  *rateBucket
+	// Log a warning when a handler runs longer than this, 0 to disable 处理函数运行超过此时间时记录警告，0禁用
+	SlowHandle time.Duration
+	// Run handlers in at most N goroutines so reading continues, 0 to run in the read loop (keeps order). Built-in
+	// control actions like subscribe and onPause always run in the read loop
+	// 最多N个协程异步运行处理函数以便持续读取，0表示在读取循环中运行（保持顺序）。subscribe、onPause等内置控制action总是在读取循环中运行
+	AsyncHandles int
+	// Reject msgs with unknown fields (for development), otherwise they are logged at debug level
+	// 拒绝带未知字段的消息（用于开发），否则在debug级别记录
+	StrictFields bool
+	// Disable Nagle's algorithm on TCP conns so small frames are sent at once, no-op for other transports
+	// 在TCP连接上禁用Nagle算法使小帧立即发送，对其他传输无效
+	NoDelay bool
+	// Buffer sizes of reading and writing the conn, 0 for unbuffered. Frames are flushed once written
+	// 读写连接的缓冲区大小，0表示不缓冲。帧写入后立即刷新
+	ReadBufSize  int
+	WriteBufSize int
+	// Write a marker ahead of each frame, so the reader can recover alignment after a corrupt length. Both sides
+	// must set it, costs 4 bytes per frame
+	// 在每帧前写入标记，使读取方能在长度损坏后恢复对齐。双方都必须设置，每帧多4字节
+	ResyncMarker bool
+	rbuf         *bufio.Reader // Read buffer of rbufConn, only used by the read loop 读缓冲，仅读取循环使用
+	rbufConn     net.Conn
+	wbuf         *bufio.Writer // Write buffer of wbufConn, guarded by lockWrite 写缓冲，由lockWrite保护
+	wbufConn     net.Conn
+	// Max bytes of a received msg after decompression, larger ones are rejected against zip bombs. 0 for MaxFrameSize
+	// 收到的消息解压后的最大字节数，超出的被拒绝以防压缩炸弹。0表示使用MaxFrameSize
+	MaxDecompressSize int
+	// Max bytes of a received frame before decompression, larger ones go by OversizePolicy. 0 to only limit by
+	// MaxFrameSize, frames over which are taken as corrupt
+	// 收到的帧解压前的最大字节数，超出的按OversizePolicy处理。0表示仅受MaxFrameSize限制，超过它的帧视为损坏
+	MaxMsgSize int
+	// OversizeClose(default) to drop the conn on a frame over MaxMsgSize, OversizeSkip to discard it and read on
+	// OversizeClose(默认)在帧超过MaxMsgSize时断开连接，OversizeSkip丢弃该帧并继续读取
+	OversizePolicy string
+	// Called with every received message before dispatching to Listens 每条收到的消息在分发到Listens前调用
+	OnMsg func(msg *IOMsgRaw)
+	// Called with broadcasts of tags subscribed by SubscribeRaw, still compressed 以仍为压缩状态的SubscribeRaw订阅tag的广播调用
+	OnRawFrame func(frame *RawFrame)
+	rawTags    map[string]bool // Tags delivered as raw frames, guarded by lockTag 以原始帧投递的tag，由lockTag保护
+	// Local capabilities announced by hello, nil for DefaultCaps 通过hello宣告的本地能力，nil为DefaultCaps
+	Caps     *ConnCaps
+	PeerCaps *ConnCaps // Capabilities announced by the peer 对端宣告的能力
+	Role     string    // Role announced to the peer by hello, see ConnCaps.Role 通过hello向对端宣告的角色
+	// Preferred format of received msgs announced by hello, one of RegSerializer, empty for json. Each conn negotiates
+	// its own, see NegotiateCaps
+	// 通过hello宣告的接收消息首选格式，为RegSerializer注册的格式之一，空表示json。每个连接独立协商，见NegotiateCaps
+	Format string
+	// Preferred codecs of frames written and read, CodecZlib or CodecNone, negotiated by hello so both sides agree on
+	// each direction, e.g. compress only the uplink. Empty to follow Caps.Codecs. See NegotiateCaps
+	// 写出和读取帧的首选编码，CodecZlib或CodecNone，通过hello协商使双方对每个方向达成一致，如仅压缩上行。空表示按Caps.Codecs
+	WriteCodec string
+	ReadCodec  string
+	Negotiated *ConnCaps // Intersection of Caps and PeerCaps 本地和对端能力的交集
+	// Receive window advertised to the peer, the peer waits for acks when it's full. 0 to disable
+	// 通告给对端的接收窗口，满时对端等待确认。0表示禁用
+	RecvWindow int
+	lockCredit deadlock.Mutex
+	flow       flowCredit
+	sendQ      sendQueue // Broadcast frames waiting to be sent 等待发送的广播帧
+	sendSeq    int64
+	sending    bool // Whether a goroutine is draining sendQ 是否有协程正在发送sendQ
+	lockSendQ  deadlock.Mutex
+	// Build a compression dictionary from the first N msgs sent, used once the peer negotiated zlib-dict. 0 to disable
+	// 从发送的前N条消息构建压缩字典，对端协商了zlib-dict后使用。0表示禁用
+	DictWarmup int
+	dict       connDict
+	lockDict   deadlock.Mutex
+	// Timestamp of the latest received msg 最近收到消息的时间戳
+	lastRecvMS atomic.Int64
+	batchPend  []*IOMsgRaw // Msgs of the last batch frame not read yet, only used by the read loop 最近批次帧中尚未读取的消息，仅读取循环使用
+	// Max msgs of each stream sent but not handled by the peer, writers wait when it's full. Both sides must set it
+	// the same, 0 to disable
+	// 每个流已发送但对端未处理的最大消息数，满时写入方等待。双方必须设为相同值，0表示禁用
+	StreamWindow int
+	streams      map[string]*BanStream
+	lockStream   deadlock.Mutex
+	reject       *ConnReject // Received onReject, taken when reconnecting, guarded by lockTag 收到的onReject，重连时取出
+	// Received or detected handshake failure, stops reconnecting, guarded by lockTag 收到或检测到的握手失败，停止重连，由lockTag保护
+	handshakeErr *errs.Error
+	// Token announced by hello, checked by ServerIO.AuthToken 通过hello宣告的令牌，由ServerIO.AuthToken检查
+	AuthToken string
+	// Id of the latest transfer sent by WriteChunked 最近由WriteChunked发送的传输id
+	chunkSeq  atomic.Uint32
+	chunks    map[uint32]*chunkBuf // Transfers being reassembled by id 按id正在重组的传输
+	lockChunk deadlock.Mutex
+	// Whether an uncompressed legacy frame was logged, see legacyRaw 是否已记录未压缩的旧版本帧，见legacyRaw
+	legacyLogged atomic.Bool
 }
 
+/*
+rateBucket
+A simple token bucket for limiting inbound message rate
+简单的令牌桶，用于限制接收消息速率
+*/
+type rateBucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	lastAt  time.Time
+	dropNum int
+}
+
+func newRateBucket(rate float64, burst int) *rateBucket {
+	if burst <= 0 {
+		burst = max(1, int(rate))
+	}
+	return &rateBucket{rate: rate, burst: float64(burst), tokens: float64(burst), lastAt: time.Now()}
+}
+
+func (b *rateBucket) allow() bool {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.lastAt).Seconds()*b.rate)
+	b.lastAt = now
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true
+	}
+	b.dropNum += 1
+	return false
+}
+
+const (
+	ConnStateReady  = 1 // connected or reconnected 已连接或重连成功
+	ConnStateLost   = 2 // connection lost, reconnecting 连接断开，正在重连
+	ConnStateClosed = 3 // permanently closed 永久关闭
+)
+
 type IOMsg struct {
-	Action string      `json:"action"`
-	Data   interface{} `json:"data"`
+	Action  string      `json:"action"`
+	Data    interface{} `json:"data"`
+	RawData []byte      `json:"-"` // Pre-encoded binary payload, sent as is without json when not empty 预编码的二进制数据，非空时不经json直接发送
+	// Broadcasts with higher priority jump ahead of queued ones of each conn 优先级更高的广播插队到每个连接已排队的广播前
+	Priority int `json:"-"`
+	// Broadcasts still queued after this 13 digit timestamp are dropped, 0 for never 排队超过此13位时间戳的广播被丢弃，0表示不丢弃
+	Deadline int64 `json:"-"`
+	// Logical stream of the msg, set by BanStream.WriteMsg, empty for the conn itself 消息所属的逻辑流，空表示连接本身
+	Stream string `json:"stream,omitempty"`
+	// W3C trace context of the request, set when BanTracer is set. Not sent by binary msgs
+	// 请求的W3C追踪上下文，设置BanTracer时填充。二进制消息不发送
+	Trace map[string]string `json:"trace,omitempty"`
 }
 
 type IOMsgRaw struct {
-	Action string          `json:"action"`
-	Data   json.RawMessage `json:"data"`
+	Action string            `json:"action"`
+	Data   json.RawMessage   `json:"data"`
+	Binary bool              `json:"-"` // Data is the binary payload from IOMsg.RawData Data是来自IOMsg.RawData的二进制数据
+	Stream string            `json:"stream,omitempty"`
+	Trace  map[string]string `json:"trace,omitempty"`
 }
 
+const (
+	// Codec id is the first byte of a frame. zlib streams always start with 0x78 (CMF byte),
+	// so it doubles as the zlib codec id and keeps frames compatible with older peers
+	// 编解码id是帧的首字节。zlib流总是以0x78(CMF字节)开头，因此直接作为zlib的编解码id，兼容旧版本
+	codecNone = 0x00 // uncompressed payload follows 后面是未压缩的数据
+	codecZlib = 0x78
+
+	// The first byte of a binary frame, json frames always start with '{'
+	// 二进制帧的首字节，json帧总是以'{'开头
+	msgFlagBinary = 0x01
+)
+
 var (
 	tipRetryTimes     = make(map[string]int64)
 	tipRetryTimesLock deadlock.Mutex
+	frameBufPool      = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, 0, 4096)
+			return &buf
+		},
+	}
 )
 
 func (c *BanConn) GetRemote() string {
+	c.lockTag.Lock()
+	defer c.lockTag.Unlock()
 	return c.Remote
 }
+
+// GetName the logical name declared by the client, empty if not declared 客户端声明的逻辑名称，未声明时为空
+func (c *BanConn) GetName() string {
+	c.lockTag.Lock()
+	defer c.lockTag.Unlock()
+	return c.Name
+}
 func (c *BanConn) IsClosed() bool {
-	return c.Conn == nil || !c.Ready
+	c.lockConn.RLock()
+	defer c.lockConn.RUnlock()
+	return c.Conn == nil || !c.Ready || c.stopped.Load()
+}
+
+func (c *BanConn) isReady() bool {
+	c.lockConn.RLock()
+	defer c.lockConn.RUnlock()
+	return c.Ready
+}
+
+func (c *BanConn) setReady(ready bool) {
+	c.lockConn.Lock()
+	c.Ready = ready
+	c.lockConn.Unlock()
+}
+func (c *BanConn) IsPaused() bool {
+	return c.Paused.Load()
 }
 func (c *BanConn) HasTag(tag string) bool {
 	c.lockTag.Lock()
@@ -82,91 +314,378 @@ func (c *BanConn) HasTag(tag string) bool {
 }
 
 func (c *BanConn) WriteMsg(msg *IOMsg) *errs.Error {
-	if c.Conn == nil {
+	if c.waitConn() == nil {
 		return errs.NewMsg(errs.CodeIOWriteFail, "write fail as disconnected")
 	}
-	raw, err_ := utils.Marshal(*msg)
-	if err_ != nil {
-		return errs.New(core.ErrMarshalFail, err_)
+	raw, err := encodeMsgAs(msg, c.msgFormat())
+	if err != nil {
+		return err
 	}
-	compressed, err := compress(raw)
+	codec, err := c.checkOutFrame(msg.Action, raw, len(msg.RawData) > 0)
 	if err != nil {
 		return err
 	}
-	return c.Write(compressed, false)
+	// Write is synchronous, so the compress buffer can be reused after it
+	// Write是同步的，因此之后可复用压缩缓冲区
+	bufPtr := frameBufPool.Get().(*[]byte)
+	var compressed []byte
+	if codec == codecNone {
+		compressed = append(append((*bufPtr)[:0], codecNone), raw...)
+	} else {
+		span := startMsgSpan(msg.Trace, "banio.compress")
+		compressed, err = c.encodeOut((*bufPtr)[:0], msg.Action, raw)
+		endSpan(span, err)
+	}
+	if err != nil {
+		frameBufPool.Put(bufPtr)
+		return err
+	}
+	if !flowFreeActions[msg.Action] {
+		c.takeCredit(0)
+	}
+	err = c.Write(compressed, false)
+	*bufPtr = compressed[:0]
+	frameBufPool.Put(bufPtr)
+	return err
+}
+
+/*
+encodeMsg
+Encode IOMsg as json, or as a binary frame when RawData is set: flag(1) + actionLen(2) + action + RawData
+将IOMsg编码为json，RawData非空时编码为二进制帧：flag(1) + actionLen(2) + action + RawData
+*/
+func encodeMsg(msg *IOMsg) ([]byte, *errs.Error) {
+	if len(msg.RawData) == 0 {
+		raw, err_ := MsgSerializer.Marshal(*msg)
+		if err_ != nil {
+			if bad := findUnmarshalable(reflect.ValueOf(msg.Data), "data"); bad != "" {
+				return nil, errs.NewMsg(core.ErrMarshalFail, "marshal %s fail, %s: %v", msg.Action, bad, err_)
+			}
+			return nil, errs.NewMsg(core.ErrMarshalFail, "marshal %s fail: %v", msg.Action, err_)
+		}
+		return raw, nil
+	}
+	if len(msg.Action) > math.MaxUint16 {
+		return nil, errs.NewMsg(core.ErrMarshalFail, "action too long: %d", len(msg.Action))
+	}
+	if msg.Stream != "" {
+		return nil, errs.NewMsg(core.ErrMarshalFail, "binary msg %s can't be sent on stream %s", msg.Action,
+			msg.Stream)
+	}
+	res := make([]byte, 3, 3+len(msg.Action)+len(msg.RawData))
+	res[0] = msgFlagBinary
+	binary.LittleEndian.PutUint16(res[1:3], uint16(len(msg.Action)))
+	res = append(res, msg.Action...)
+	return append(res, msg.RawData...), nil
+}
+
+/*
+findUnmarshalable
+Walk v and describe the first value json can't encode, like "data.items[2]: chan int". Return empty if none found.
+遍历v，描述第一个json无法编码的值，如"data.items[2]: chan int"。未找到时返回空。
+*/
+func findUnmarshalable(v reflect.Value, path string) string {
+	if !v.IsValid() {
+		return ""
+	}
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Sprintf("%s: %s", path, v.Type())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return ""
+		}
+		return findUnmarshalable(v.Elem(), path)
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if bad := findUnmarshalable(iter.Value(), fmt.Sprintf("%s.%v", path, iter.Key())); bad != "" {
+				return bad
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return ""
+		}
+		for i := 0; i < v.Len(); i++ {
+			if bad := findUnmarshalable(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); bad != "" {
+				return bad
+			}
+		}
+	case reflect.Struct:
+		tp := v.Type()
+		for i := 0; i < tp.NumField(); i++ {
+			field := tp.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			if bad := findUnmarshalable(v.Field(i), path+"."+field.Name); bad != "" {
+				return bad
+			}
+		}
+	}
+	return ""
+}
+
+func decodeMsg(data []byte) (*IOMsgRaw, *errs.Error) {
+	if len(data) > 0 && data[0] == msgFlagFormat {
+		return decodeFormatted(data)
+	}
+	if len(data) > 0 && data[0] == msgFlagBinary {
+		if len(data) < 3 {
+			return nil, errs.NewMsg(errs.CodeUnmarshalFail, "binary frame too short: %d", len(data))
+		}
+		actLen := int(binary.LittleEndian.Uint16(data[1:3]))
+		if len(data) < 3+actLen {
+			return nil, errs.NewMsg(errs.CodeUnmarshalFail, "binary frame action truncated")
+		}
+		return &IOMsgRaw{Action: string(data[3 : 3+actLen]), Data: data[3+actLen:], Binary: true}, nil
+	}
+	var msg IOMsgRaw
+	err_ := MsgSerializer.Unmarshal(data, &msg)
+	if err_ != nil {
+		return nil, errs.New(errs.CodeUnmarshalFail, err_)
+	}
+	return &msg, nil
 }
 
 func (c *BanConn) Write(data []byte, locked bool) *errs.Error {
-	if c.Conn == nil {
+	if c.waitConn() == nil {
 		return errs.NewMsg(errs.CodeIOWriteFail, "write fail as disconnected")
 	}
 	if !locked {
 		c.lockWrite.Lock()
 		defer c.lockWrite.Unlock()
 	}
-	dataLen := uint32(len(data))
-	lenBt := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenBt, dataLen)
-	if c.Conn != nil {
-		_, err_ := c.Conn.Write(lenBt)
+	lenBt := c.frameHeader(len(data))
+	if conn := c.getConn(); conn != nil {
+		if w := c.bufWriter(conn, len(lenBt)+len(data)); w != nil {
+			return c.writeBuffered(conn, w, lenBt, data)
+		}
+		_, err_ := conn.Write(lenBt)
 		if err_ != nil {
-			c.Ready = false
 			errCode, errType := getErrType(err_)
 			if c.DoConnect != nil && errCode == core.ErrNetConnect {
-				log.Warn("write fail, wait 3s and retry", zap.String("type", errType))
-				c.connect()
+				log.Warn("write fail, wait and retry", zap.String("type", errType))
+				if err := c.connect(conn); err != nil {
+					return err
+				}
 				return c.Write(data, true)
 			}
+			c.setReady(false)
 			return errs.New(errCode, err_)
 		}
-		if c.Conn != nil {
-			_, err_ = c.Conn.Write(data)
-			if err_ != nil {
-				c.Ready = false
-				errCode, _ := getErrType(err_)
-				return errs.New(errCode, err_)
-			}
-			return nil
+		_, err_ = conn.Write(data)
+		if err_ != nil {
+			c.setReady(false)
+			errCode, _ := getErrType(err_)
+			return errs.New(errCode, err_)
 		}
+		return nil
 	}
 	return errs.NewMsg(errs.CodeIOWriteFail, "write fail as disconnected")
 }
 
+func (c *BanConn) getConn() net.Conn {
+	c.lockConn.RLock()
+	defer c.lockConn.RUnlock()
+	return c.Conn
+}
+
+/*
+SetConn
+Swap in the conn dialed by DoConnect, it's closed instead if the BanConn was closed permanently meanwhile.
+换入DoConnect拨号得到的连接，如果期间BanConn已被永久关闭，则关闭该连接。
+*/
+func (c *BanConn) SetConn(conn net.Conn) {
+	c.lockConn.Lock()
+	defer c.lockConn.Unlock()
+	if c.stopped.Load() {
+		_ = conn.Close()
+		return
+	}
+	c.Conn = conn
+}
+
+// waitConn return the current conn, wait for the running reconnect if it's nil 返回当前连接，为空时等待进行中的重连
+func (c *BanConn) waitConn() net.Conn {
+	conn := c.getConn()
+	if conn == nil && c.DoConnect != nil {
+		// a running reconnect holds lockConnect 进行中的重连持有lockConnect
+		c.lockConnect.Lock()
+		conn = c.getConn()
+		c.lockConnect.Unlock()
+	}
+	return conn
+}
+
+// closeConn close and clear Conn 关闭并清空Conn
+func (c *BanConn) closeConn() error {
+	c.resetDict()
+	c.lockConn.Lock()
+	defer c.lockConn.Unlock()
+	if c.Conn == nil {
+		return nil
+	}
+	err_ := c.Conn.Close()
+	c.Conn = nil
+	return err_
+}
+
+// writeFrame write a length prefixed frame directly to a raw conn which is not shared yet
+func writeFrame(conn net.Conn, msg *IOMsg) *errs.Error {
+	raw, err := encodeMsg(msg)
+	if err != nil {
+		return err
+	}
+	compressed, err := compress(raw)
+	if err != nil {
+		return err
+	}
+	lenBt := make([]byte, 4, 4+len(compressed))
+	binary.LittleEndian.PutUint32(lenBt, uint32(len(compressed)))
+	_, err_ := conn.Write(append(lenBt, compressed...))
+	if err_ != nil {
+		errCode, _ := getErrType(err_)
+		return errs.New(errCode, err_)
+	}
+	return nil
+}
+
 func (c *BanConn) ReadMsg() (*IOMsgRaw, *errs.Error) {
+	if msg := c.popBatch(); msg != nil {
+		return msg, nil
+	}
 	compressed, err := c.Read()
 	if err != nil {
 		return nil, err
 	}
-	data, err := deCompress(compressed)
+	if len(compressed) > 0 && compressed[0] == codecBatch {
+		return c.parseBatch(compressed)
+	}
+	return c.parseMsg(compressed)
+}
+
+// parseMsg decompress and decode a frame read from the conn 解压并解码从连接读取的帧
+func (c *BanConn) parseMsg(compressed []byte) (*IOMsgRaw, *errs.Error) {
+	var start, end time.Time
+	if BanTracer != nil {
+		start = time.Now()
+	}
+	data, err := c.decodeIn(compressed)
 	if err != nil {
 		return nil, err
 	}
-	var msg IOMsgRaw
-	err_ := utils.Unmarshal(data, &msg, utils.JsonNumDefault)
-	if err_ != nil {
-		return nil, errs.New(errs.CodeUnmarshalFail, err_)
+	if BanTracer != nil {
+		end = time.Now()
 	}
-	return &msg, nil
+	msg, err := c.parseData(data)
+	if err == nil && len(msg.Trace) > 0 {
+		traceDecompress(msg, start, end)
+	}
+	return msg, err
+}
+
+// parseData decode a decompressed msg 解码解压后的消息
+func (c *BanConn) parseData(data []byte) (*IOMsgRaw, *errs.Error) {
+	msg, err := decodeMsg(data)
+	if err == nil {
+		c.trackDict(msg)
+	}
+	if err != nil || msg.Binary || !c.StrictFields && !log.L().Core().Enabled(zap.DebugLevel) {
+		return msg, err
+	}
+	if extra := unknownMsgFields(data); len(extra) > 0 {
+		if c.StrictFields {
+			return nil, errs.NewMsg(core.ErrInvalidMsg, "unknown fields %v in msg %s", extra, msg.Action)
+		}
+		log.Debug("unknown msg fields", zap.String("remote", c.GetRemote()), zap.String("action", msg.Action),
+			zap.Strings("fields", extra))
+	}
+	return msg, nil
+}
+
+/*
+unknownMsgFields
+Return top-level fields of a json msg other than action, data, stream and trace, which are dropped by decodeMsg.
+返回json消息中除action、data、stream和trace外的顶层字段，这些字段会被decodeMsg丢弃。
+*/
+func unknownMsgFields(data []byte) []string {
+	var fields map[string]json.RawMessage
+	if MsgSerializer.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	var res []string
+	for key := range fields {
+		if key != "action" && key != "data" && key != "stream" && key != "trace" {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res
 }
 
+/*
+Read
+Read one frame through the bufio reader of ReadBufSize. The buffer returns all bytes it holds before the read error
+of the conn, so every frame fully received before the peer drops is returned before the error that triggers
+reconnecting, only a partial frame is lost with the buffer. See DrainBuffered when closing the conn by yourself.
+通过ReadBufSize大小的bufio读取器读取一帧。缓冲在返回连接的读取错误前会先返回其持有的所有字节，因此对端断开前完整接收的帧
+都会在触发重连的错误之前返回，只有不完整的帧随缓冲丢失。自行关闭连接时见DrainBuffered。
+*/
 func (c *BanConn) Read() ([]byte, *errs.Error) {
-	if c.Conn == nil {
+	conn := c.waitConn()
+	if conn == nil {
 		return nil, errs.NewMsg(core.ErrRunTime, "BanConn Read nil, connection already closed")
 	}
-	lenBuf := make([]byte, 4)
-	_, err_ := c.Conn.Read(lenBuf)
+	in := c.bufReader(conn)
+	head := make([]byte, len(c.frameHeader(0)))
+	_, err_ := io.ReadFull(in, head)
 	if err_ != nil {
 		errCode, errType := getErrType(err_)
 		if c.DoConnect != nil && errCode == core.ErrNetConnect {
-			log.Warn("read fail, wait 3s and retry", zap.String("type", errType))
-			c.connect()
+			log.Warn("read fail, wait and retry", zap.String("type", errType))
+			if err := c.connect(conn); err != nil {
+				return nil, err
+			}
 			return c.Read()
 		}
 		return nil, errs.New(errCode, err_)
 	}
-	dataLen := binary.LittleEndian.Uint32(lenBuf)
+	var dataLen uint32
+	for {
+		if c.ResyncMarker && !bytes.Equal(head[:len(resyncMagic)], resyncMagic) {
+			log.Warn("banio stream desynced, resyncing", zap.String("remote", c.GetRemote()))
+			if err := c.resync(in, head); err != nil {
+				return nil, err
+			}
+		}
+		dataLen = binary.LittleEndian.Uint32(head[len(head)-4:])
+		if dataLen > 0 && int64(dataLen) <= int64(MaxFrameSize) {
+			break
+		}
+		if !c.ResyncMarker {
+			// the stream can't be resynced, the conn should be dropped 数据流无法重新同步，应断开连接
+			return nil, errs.NewMsg(core.ErrNetReadFail, "invalid frame size %d from %s", dataLen, c.GetRemote())
+		}
+		// the marker was a false match in garbage, scan from the next byte 标记是垃圾数据中的误匹配，从下一字节开始扫描
+		head[0] = 0
+	}
+	if c.MaxMsgSize > 0 && dataLen > uint32(c.MaxMsgSize) {
+		if c.OversizePolicy != OversizeSkip {
+			return nil, errs.NewMsg(core.ErrNetReadFail, "frame size %d exceeds %d from %s", dataLen, c.MaxMsgSize,
+				c.GetRemote())
+		}
+		log.Warn("skip oversized frame", zap.String("remote", c.GetRemote()), zap.Uint32("size", dataLen),
+			zap.Int("max", c.MaxMsgSize))
+		if _, err_ = io.CopyN(io.Discard, in, int64(dataLen)); err_ != nil {
+			return nil, errs.New(core.ErrNetReadFail, err_)
+		}
+		return c.Read()
+	}
 	buf := make([]byte, dataLen)
-	_, err_ = c.Conn.Read(buf)
+	_, err_ = io.ReadFull(in, buf)
 	if err_ != nil {
 		return nil, errs.New(core.ErrNetReadFail, err_)
 	}
@@ -180,14 +699,68 @@ func (c *BanConn) Subscribe(tags ...string) {
 	}
 	c.lockTag.Unlock()
 }
+
+/*
+UnSubscribe
+Remove the tags, a tag containing * or ? is a glob pattern removing all matching tags, see MatchTag.
+移除这些tag，包含*或?的tag是glob模式，移除所有匹配的tag，见MatchTag。
+*/
 func (c *BanConn) UnSubscribe(tags ...string) {
 	c.lockTag.Lock()
 	for _, tag := range tags {
-		delete(c.Tags, tag)
+		if !strings.ContainsAny(tag, "*?") {
+			delete(c.Tags, tag)
+			delete(c.rawTags, tag)
+			continue
+		}
+		for key := range c.Tags {
+			if MatchTag(tag, key) {
+				delete(c.Tags, key)
+				delete(c.rawTags, key)
+			}
+		}
 	}
 	c.lockTag.Unlock()
 }
 
+// UnSubscribeAll remove all subscribed tags 移除所有订阅的tag
+func (c *BanConn) UnSubscribeAll() {
+	c.lockTag.Lock()
+	clear(c.Tags)
+	clear(c.rawTags)
+	c.lockTag.Unlock()
+}
+
+/*
+MatchTag
+Report whether tag matches the glob pattern, * matches any sequence of chars and ? matches one char.
+Unlike path.Match, separators like / and _ are not special.
+判断tag是否匹配glob模式，*匹配任意字符序列，?匹配一个字符。与path.Match不同，/和_等分隔符没有特殊含义。
+*/
+func MatchTag(pattern, tag string) bool {
+	p, t := 0, 0
+	star, mark := -1, 0
+	for t < len(tag) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == tag[t]) {
+			p++
+			t++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, t
+			p++
+		} else if star >= 0 {
+			// let the last * take one more char 让最后一个*多匹配一个字符
+			mark++
+			p, t = star+1, mark
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
 /*
 RunForever
 Monitor the information sent by the connection and process it.
@@ -208,17 +781,20 @@ func (c *BanConn) RunForever() *errs.Error {
 		return errs.NewMsg(errs.CodeRunTime, "BanConn is unavailable in mode %s", core.RunMode)
 	}
 	defer func() {
-		c.Ready = false
+		c.setReady(false)
 		c.IsReading = false
-		if c.Conn != nil {
-			err_ := c.Conn.Close()
-			if err_ != nil {
-				log.Error("close conn fail", zap.String("remote", c.Remote), zap.Error(err_))
-			}
-			c.Conn = nil
+		if err_ := c.closeConn(); err_ != nil {
+			log.Error("close conn fail", zap.String("remote", c.GetRemote()), zap.Error(err_))
 		}
 	}()
 	c.IsReading = true
+	if c.MsgRateLimit > 0 && c.msgBucket == nil {
+		c.msgBucket = newRateBucket(c.MsgRateLimit, c.MsgRateBurst)
+	}
+	var handleSem chan struct{}
+	if c.AsyncHandles > 0 {
+		handleSem = make(chan struct{}, c.AsyncHandles)
+	}
 	for {
 		msg, err := c.ReadMsg()
 		if err != nil {
@@ -227,55 +803,260 @@ func (c *BanConn) RunForever() *errs.Error {
 				log.Error("invalid banIO msg, deCompress fail", zap.Error(err))
 				continue
 			}
+			if err.Code == core.ErrInvalidMsg {
+				log.Error("invalid banIO msg, skip", zap.String("remote", c.GetRemote()), zap.Error(err))
+				continue
+			}
 			return err
 		}
-		isMatch := false
-		for prefix, handle := range c.Listens {
-			if strings.HasPrefix(msg.Action, prefix) {
-				isMatch = true
-				handle(msg.Action, msg.Data)
-				break
+		c.lastRecvMS.Store(btime.UTCStamp())
+		if msg.Action == "onDict" {
+			// handled by ReadMsg 已由ReadMsg处理
+			continue
+		}
+		if c.msgBucket != nil && !c.msgBucket.allow() {
+			if c.FloodClose {
+				return errs.NewMsg(core.ErrNetReadFail, "inbound msg rate exceed %v/s, close %s",
+					c.MsgRateLimit, c.GetRemote())
 			}
+			if c.msgBucket.dropNum%1000 == 1 {
+				log.Warn("inbound msg rate exceeded, drop", zap.String("remote", c.GetRemote()),
+					zap.String("action", msg.Action), zap.Int("dropped", c.msgBucket.dropNum))
+			}
+			c.consumed(msg.Action)
+			continue
 		}
-		if !isMatch {
+		if c.OnMsg != nil {
+			c.OnMsg(msg)
+		}
+		listens := c.Listens
+		var stream *BanStream
+		if msg.Stream != "" {
+			// unknown streams are created to ack the peer 创建未知的流以便向对端确认
+			stream = c.Stream(msg.Stream)
+			listens = stream.Listens
+		}
+		handle := findHandle(listens, msg.Action)
+		if handle == nil {
 			log.Info("unhandle msg", zap.String("action", msg.Action))
+			c.consumed(msg.Action)
+			stream.consumed()
+			continue
+		}
+		if handleSem == nil || (stream == nil && ctrlActions[msg.Action]) {
+			c.callHandle(handle, msg)
+			c.consumed(msg.Action)
+			stream.consumed()
+			continue
+		}
+		handleSem <- struct{}{}
+		go func(m *IOMsgRaw) {
+			defer func() {
+				<-handleSem
+			}()
+			c.callHandle(handle, m)
+			c.consumed(m.Action)
+			stream.consumed()
+		}(msg)
+	}
+}
+
+// ctrlActions built-in actions changing the conn state, they run in the read loop even with AsyncHandles to keep
+// their order 改变连接状态的内置action，即使设置了AsyncHandles也在读取循环中运行以保持顺序
+var ctrlActions = map[string]bool{
+	"hello": true, "onHello": true, "onHandshake": true, "onHandshakeFail": true, "onSetName": true,
+	"subscribe": true, "subscribeRaw": true, "subscribeSnap": true, "unsubscribe": true, "unsubscribeAll": true,
+	"onPause": true, "onResume": true, "onReject": true, "onSubReject": true, "onReqReject": true,
+	"onAck": true, "onStreamAck": true,
+}
+
+// findHandle the handler of action in listens, exact match first, so "unsubscribeAll" never goes to "unsubscribe",
+// then the longest prefix, so "trade." wins over "trade" 查找action的处理函数，优先精确匹配，然后是最长的前缀
+func findHandle(listens map[string]ConnCB, action string) ConnCB {
+	if handle, ok := listens[action]; ok {
+		return handle
+	}
+	var handle ConnCB
+	matchLen := -1
+	for prefix, cb := range listens {
+		if len(prefix) > matchLen && strings.HasPrefix(action, prefix) {
+			handle = cb
+			matchLen = len(prefix)
+		}
+	}
+	return handle
+}
+
+/*
+ListActions
+Return the sorted action prefixes registered in Listens, including built-in ones.
+返回Listens中注册的已排序的action前缀，包括内置的。
+*/
+func (c *BanConn) ListActions() []string {
+	res := make([]string, 0, len(c.Listens))
+	for prefix := range c.Listens {
+		res = append(res, prefix)
+	}
+	sort.Strings(res)
+	return res
+}
+
+/*
+callHandle
+Call the handler, log a warning if it runs longer than SlowHandle
+调用处理函数，运行超过SlowHandle时记录警告
+*/
+func (c *BanConn) callHandle(handle ConnCB, msg *IOMsgRaw) {
+	span := startMsgSpan(msg.Trace, "banio.handle "+msg.Action, trace.WithSpanKind(trace.SpanKindServer))
+	if span != nil {
+		defer span.End()
+	}
+	if c.SlowHandle <= 0 {
+		handle(msg.Action, msg.Data)
+		return
+	}
+	start := time.Now()
+	timer := time.AfterFunc(c.SlowHandle, func() {
+		log.Warn("banio handler slow", zap.String("remote", c.GetRemote()), zap.String("action", msg.Action),
+			zap.Duration("limit", c.SlowHandle))
+	})
+	handle(msg.Action, msg.Data)
+	if !timer.Stop() {
+		log.Warn("banio handler slow done", zap.String("remote", c.GetRemote()), zap.String("action", msg.Action),
+			zap.Duration("cost", time.Since(start)))
+	}
+}
+
+/*
+RunForeverCtx
+Same as RunForever, but the connection is closed permanently when ctx is done.
+同RunForever，但ctx结束时永久关闭连接。
+*/
+func (c *BanConn) RunForeverCtx(ctx context.Context) *errs.Error {
+	stop := context.AfterFunc(ctx, func() {
+		c.stopped.Store(true)
+		if conn := c.getConn(); conn != nil {
+			_ = conn.Close()
 		}
+	})
+	defer stop()
+	err := c.RunForever()
+	if err != nil && ctx.Err() != nil {
+		return errs.New(core.ErrRunTime, ctx.Err())
+	}
+	return err
+}
+
+func (c *BanConn) setState(state int, err *errs.Error) {
+	if c.OnStateChange != nil {
+		c.OnStateChange(c, state, err)
 	}
 }
 
 /*
 connect
-A function used for reconnecting.
-用于重新连接的函数。
+A function used for reconnecting. Returns an error when reconnect is given up.
+failed is the conn the caller failed on, callers failed on the same conn share one reconnect:
+the first one dials, the others wait for it and reuse the new conn.
+用于重新连接的函数。放弃重连时返回错误。
+failed是调用方出错的连接，在同一连接上出错的调用方共享一次重连：第一个拨号，其他等待并复用新连接。
 */
-func (c *BanConn) connect() {
+func (c *BanConn) connect(failed net.Conn) *errs.Error {
 	c.lockConnect.Lock()
 	defer c.lockConnect.Unlock()
-	if c.Ready && btime.TimeMS()-c.RefreshMS < 2000 {
-		// 连接已经刷新，跳过本次重试
-		return
+	if c.stopped.Load() {
+		return errs.NewMsg(core.ErrNetConnect, "conn closed, skip reconnect: %s", c.GetRemote())
+	}
+	if conn := c.getConn(); c.isReady() && conn != nil && conn != failed {
+		// 连接已被其他调用方刷新，跳过本次重试
+		return nil
+	}
+	c.setReady(false)
+	_ = c.closeConn()
+	rejectErr, retryAfter := c.popReject()
+	if err := c.popHandshake(); err != nil {
+		// retrying can't fix it 重试无法解决
+		c.stopped.Store(true)
+		log.Error("handshake fail, stop reconnecting", zap.String("remote", c.GetRemote()), zap.Error(err))
+		c.setState(ConnStateClosed, err)
+		return err
 	}
-	c.Ready = false
-	if c.Conn != nil {
-		_ = c.Conn.Close()
-		c.Conn = nil
+	c.setState(ConnStateLost, rejectErr)
+	for attempt := 1; c.getConn() == nil; attempt++ {
+		if c.MaxReconnects > 0 && attempt > c.MaxReconnects {
+			c.stopped.Store(true)
+			err := errs.NewMsg(core.ErrNetConnect, "give up after %d reconnect attempts: %s",
+				c.MaxReconnects, c.GetRemote())
+			log.Error("reconnect fail", zap.Error(err))
+			c.setState(ConnStateClosed, err)
+			return err
+		}
+		wait := c.retryWait(attempt)
+		if attempt == 1 {
+			// back off as the server hinted 按服务器提示退避
+			wait = max(wait, retryAfter) + c.reconnectJitter()
+		}
+		if !core.Sleep(wait) {
+			c.stopped.Store(true)
+			err := errs.NewMsg(core.ErrNetConnect, "reconnect canceled: %s", c.GetRemote())
+			c.setState(ConnStateClosed, err)
+			return err
+		}
+		// dial without lockConn, so readers of the conn are not blocked 不持有lockConn拨号，避免阻塞连接的读取者
+		c.DoConnect(c)
+		if c.stopped.Load() {
+			return errs.NewMsg(core.ErrNetConnect, "conn closed while reconnecting: %s", c.GetRemote())
+		}
 	}
-	core.Sleep(time.Second * 3)
-	c.DoConnect(c)
 	c.RefreshMS = btime.TimeMS()
-	if c.Conn != nil {
-		if c.ReInitConn != nil {
-			c.ReInitConn()
+	if c.ReInitConn != nil {
+		c.ReInitConn()
+	}
+	c.setReady(true)
+	log.Info("reconnect ok", zap.String("remote", c.GetRemote()))
+	c.setState(ConnStateReady, nil)
+	return nil
+}
+
+// retryWait wait before the reconnect attempt, attempt starts from 1 重连前的等待时间，attempt从1开始
+func (c *BanConn) retryWait(attempt int) time.Duration {
+	if attempt == 1 && c.RetryImmediate {
+		return 0
+	}
+	wait := c.RetryWait
+	if wait == 0 {
+		wait = time.Second * 10
+		if attempt == 1 || attempt == 2 && c.RetryImmediate {
+			wait = time.Second * 3
 		}
-		c.Ready = true
-		log.Info("reconnect ok", zap.String("remote", c.Remote))
 	}
+	if c.RetryMaxWait > 0 {
+		wait = min(wait, c.RetryMaxWait)
+	}
+	return wait
+}
+
+/*
+reconnectJitter
+Offset of the first reconnect within ReconnectSpread, by the hash of JitterKey, or random if it's empty.
+首次重连在ReconnectSpread内的偏移，由JitterKey的哈希决定，为空时随机。
+*/
+func (c *BanConn) reconnectJitter() time.Duration {
+	if c.ReconnectSpread <= 0 {
+		return 0
+	}
+	if c.JitterKey == "" {
+		return time.Duration(rand.Int63n(int64(c.ReconnectSpread)))
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(c.JitterKey))
+	return time.Duration(h.Sum64() % uint64(c.ReconnectSpread))
 }
 
 func (c *BanConn) LoopPing(intvSecs int) {
 	id := 0
 	failNum := 0
-	addrField := zap.String("addr", c.Remote)
+	addrField := zap.String("addr", c.GetRemote())
 	for {
 		core.Sleep(time.Duration(intvSecs) * time.Second)
 		if !c.IsReading {
@@ -301,12 +1082,8 @@ func (c *BanConn) LoopPing(intvSecs int) {
 			failNum = 0
 		}
 	}
-	if c.Conn != nil {
-		err_ := c.Conn.Close()
-		if err_ != nil {
-			log.Warn("close ban conn error", addrField, zap.Error(err_))
-		}
-		c.Conn = nil
+	if err_ := c.closeConn(); err_ != nil {
+		log.Warn("close ban conn error", addrField, zap.Error(err_))
 	}
 }
 
@@ -317,9 +1094,12 @@ func (c *BanConn) initListens() {
 	c.Listens["unsubscribe"] = makeArrStrHandle(func(arr []string) {
 		c.UnSubscribe(arr...)
 	})
+	c.Listens["unsubscribeAll"] = func(string, []byte) {
+		c.UnSubscribeAll()
+	}
 	c.Listens["ping"] = func(s string, i []byte) {
 		var val int64
-		err_ := utils.Unmarshal(i, &val, utils.JsonNumDefault)
+		err_ := MsgSerializer.Unmarshal(i, &val)
 		if err_ != nil {
 			log.Warn("got bad ping", zap.ByteString("data", i))
 			return
@@ -329,33 +1109,118 @@ func (c *BanConn) initListens() {
 			log.Warn("write pong fail", zap.Int64("v", val), zap.Error(err))
 		} else {
 			c.heartBeatMs = btime.UTCStamp()
-			log.Debug("receive ping", zap.String("from", c.Remote), zap.Int64("v", val))
+			log.Debug("receive ping", zap.String("from", c.GetRemote()), zap.Int64("v", val))
 		}
 	}
 	c.Listens["pong"] = func(s string, i []byte) {
 		c.heartBeatMs = btime.UTCStamp()
-		log.Debug("receive pong", zap.String("from", c.Remote))
+		log.Debug("receive pong", zap.String("from", c.GetRemote()))
 	}
-}
-
-func makeArrStrHandle(cb func(arr []string)) func(s string, data []byte) {
-	return func(s string, data []byte) {
-		var tags = make([]string, 0, 8)
-		err := utils.Unmarshal(data, &tags, utils.JsonNumDefault)
-		if err != nil {
-			log.Error("receive invalid data", zap.String("n", s), zap.String("raw", string(data)),
-				zap.Error(err))
+	c.Listens["onAck"] = func(s string, i []byte) {
+		var num int
+		err_ := MsgSerializer.Unmarshal(i, &num)
+		if err_ != nil {
+			log.Warn("got bad ack", zap.ByteString("data", i))
 			return
 		}
-		if len(tags) > 0 {
-			cb(tags)
+		c.onAck(num)
+	}
+	c.Listens["onReject"] = func(s string, i []byte) {
+		c.onReject(i)
+	}
+	c.Listens["onSubReject"] = func(s string, i []byte) {
+		c.onSubReject(i)
+	}
+	c.Listens["onReqReject"] = func(s string, i []byte) {
+		c.onReqReject(i)
+	}
+	c.Listens["onHandshake"] = func(s string, i []byte) {}
+	c.Listens["onHandshakeFail"] = func(s string, i []byte) {
+		c.onHandshakeFail(i)
+	}
+	c.Listens["onChunk"] = func(s string, i []byte) {
+		c.onChunk(i)
+	}
+	c.Listens["onRawFrame"] = func(s string, i []byte) {
+		c.onRawFrame(i)
+	}
+	c.Listens["onStreamAck"] = func(s string, i []byte) {
+		var ack streamAck
+		err_ := MsgSerializer.Unmarshal(i, &ack)
+		if err_ != nil {
+			log.Warn("got bad stream ack", zap.ByteString("data", i))
+			return
+		}
+		if stream := c.getStream(ack.Stream); stream != nil {
+			stream.flow.ack(&stream.lock, ack.Num)
+		}
+	}
+}
+
+func makeArrStrHandle(cb func(arr []string)) func(s string, data []byte) {
+	return func(s string, data []byte) {
+		var tags = make([]string, 0, 8)
+		err := MsgSerializer.Unmarshal(data, &tags)
+		if err != nil {
+			log.Error("receive invalid data", zap.String("n", s), zap.String("raw", string(data)),
+				zap.Error(err))
+			return
+		}
+		if len(tags) > 0 {
+			cb(tags)
 		}
 	}
 }
 
 func compress(data []byte) ([]byte, *errs.Error) {
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
+	return compressTo(nil, data)
+}
+
+var (
+	// CompressMinSize payloads smaller than this are sent uncompressed when the peer accepts 小于此大小的数据在对端接受时不压缩发送
+	CompressMinSize = 256
+	// CompressMaxRatio compressed frame is used only if its size <= raw size * ratio 仅当压缩后大小<=原大小*比例时使用压缩帧
+	CompressMaxRatio = 0.9
+	// MaxFrameSize max bytes of a frame before and after decompression, larger ones are rejected
+	// 帧在解压前后的最大字节数，超出的被拒绝
+	MaxFrameSize = 64 << 20
+)
+
+// Policies of a received frame over BanConn.MaxMsgSize 收到超过BanConn.MaxMsgSize的帧时的处理策略
+const (
+	OversizeClose = "close" // fail the read so the conn is dropped 读取失败，连接被断开
+	OversizeSkip  = "skip"  // discard the frame and keep the conn 丢弃该帧并保留连接
+)
+
+/*
+encodeFrame
+Compress raw by zlib and append to dst. When allowRaw, tiny payloads or ones not shrunk enough by
+compression are appended uncompressed with the codecNone flag instead.
+用zlib压缩raw并追加到dst。allowRaw时，很小的数据或压缩效果不明显的数据改为带codecNone标记不压缩追加。
+*/
+func encodeFrame(dst, raw []byte, allowRaw bool) ([]byte, *errs.Error) {
+	if allowRaw && len(raw) < CompressMinSize {
+		return append(append(dst, codecNone), raw...), nil
+	}
+	start := len(dst)
+	res, err := compressTo(dst, raw)
+	if err != nil {
+		return nil, err
+	}
+	if allowRaw && float64(len(res)-start) > float64(len(raw))*CompressMaxRatio {
+		return append(append(res[:start], codecNone), raw...), nil
+	}
+	return res, nil
+}
+
+/*
+compressTo
+Compress data and append the result to dst, dst grows when needed, the extended slice is returned.
+压缩data并追加到dst，必要时扩容，返回扩展后的切片。
+*/
+func compressTo(dst []byte, data []byte) ([]byte, *errs.Error) {
+	b := bytes.NewBuffer(dst)
+	w := zlib.NewWriter(b)
 	_, err_ := w.Write(data)
 	if err_ != nil {
 		return nil, errs.New(core.ErrCompressFail, err_)
@@ -368,8 +1233,34 @@ func compress(data []byte) ([]byte, *errs.Error) {
 }
 
 func deCompress(compressed []byte) ([]byte, *errs.Error) {
-	var result bytes.Buffer
-	b := bytes.NewReader(compressed)
+	return decompressTo(nil, compressed, MaxFrameSize)
+}
+
+/*
+decompressTo
+Decompress src according to its codec id byte and append the result to dst,
+dst grows when needed, the extended slice is returned. Fails once the result exceeds limit bytes.
+根据编解码id字节解压src并追加到dst，必要时扩容，返回扩展后的切片。结果超过limit字节时失败。
+*/
+func decompressTo(dst []byte, src []byte, limit int) ([]byte, *errs.Error) {
+	if len(src) == 0 {
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "empty frame")
+	}
+	switch src[0] {
+	case codecZlib:
+		return zlibDecompressTo(dst, src, limit)
+	case codecNone:
+		if len(src)-1 > limit {
+			return nil, errs.NewMsg(core.ErrDeCompressFail, "decompressed size exceeds %d", limit)
+		}
+		return append(dst, src[1:]...), nil
+	default:
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "unknown codec id: 0x%02x", src[0])
+	}
+}
+
+func zlibDecompressTo(dst []byte, src []byte, limit int) ([]byte, *errs.Error) {
+	b := bytes.NewReader(src)
 
 	// Create zlib decompressor
 	// 创建 zlib 解压缩器
@@ -378,17 +1269,35 @@ func deCompress(compressed []byte) ([]byte, *errs.Error) {
 		return nil, errs.New(core.ErrDeCompressFail, err)
 	}
 	defer r.Close()
+	return readLimited(dst, r, limit)
+}
 
-	// Copy the decompressed data to the result
-	// 将解压后的数据复制到 result 中
-	_, err = io.Copy(&result, r)
+/*
+readLimited
+Copy the decompressed data of r to dst, stop once it exceeds limit bytes against zip bombs, so a tiny frame can't
+inflate to gigabytes in memory.
+将r解压后的数据复制到dst，超过limit字节时立即停止以防压缩炸弹，避免很小的帧在内存中膨胀到数GB。
+*/
+func readLimited(dst []byte, r io.Reader, limit int) ([]byte, *errs.Error) {
+	result := bytes.NewBuffer(dst)
+	num, err := io.Copy(result, io.LimitReader(r, int64(limit)+1))
 	if err != nil {
-		return nil, errs.New(core.ErrIOReadFail, err)
+		return nil, errs.New(core.ErrDeCompressFail, err)
+	}
+	if num > int64(limit) {
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "decompressed size exceeds %d", limit)
 	}
-
 	return result.Bytes(), nil
 }
 
+// maxDecompress max bytes of a received msg after decompression 收到的消息解压后的最大字节数
+func (c *BanConn) maxDecompress() int {
+	if c.MaxDecompressSize > 0 {
+		return c.MaxDecompressSize
+	}
+	return MaxFrameSize
+}
+
 func getErrType(err error) (int, string) {
 	if err == nil {
 		return 0, ""
@@ -420,6 +1329,10 @@ func getErrType(err error) (int, string) {
 	}
 	if errors.Is(err, io.EOF) {
 		return core.ErrNetConnect, "io_eof"
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// closed in the middle of a frame 在帧中间被关闭
+		return core.ErrNetConnect, "io_unexpected_eof"
 	} else if errors.Is(err, io.ErrClosedPipe) {
 		return core.ErrNetConnect, "pipe_closed"
 	} else {
@@ -434,6 +1347,90 @@ type ServerIO struct {
 	Data     map[string]string // Cache data available for remote access 缓存的数据，可供远程端访问
 	DataExp  map[string]int64  // Cache data expiration timestamp, 13 bits 缓存数据的过期时间戳，13位
 	InitConn func(*BanConn)
+	// Create the listener in RunForever, nil for DefaultTransport 在RunForever中创建监听，nil为DefaultTransport
+	Transport Transport
+	// Capabilities sent by hello to each accepted conn, nil for DefaultCaps 通过hello发送给每个连接的能力
+	Caps *ConnCaps
+	// Inbound rate limit applied to each accepted conn, see BanConn.MsgRateLimit 每个连接的接收速率限制
+	MsgRateLimit float64
+	MsgRateBurst int
+	FloodClose   bool
+	lastMsgs     map[string][]byte // The latest compressed broadcast of each tag 每个tag最新的已压缩广播
+	lastSeqs     map[string]int64  // Seq of the latest retained broadcast of each tag 每个tag最新保留广播的序号
+	failNums     map[string]int    // Broadcasts skipped for encoding failures of each tag 每个tag编码失败跳过的广播数
+	tagStats     map[string]*TagStat
+	lockMsgs     deadlock.Mutex
+	lockData     deadlock.Mutex // Guard Data and DataExp 保护Data和DataExp
+	// Max tags whose latest broadcast is retained for onResume and SubscribeWithSnapshot, the least recently
+	// broadcast ones are dropped. 0 for unlimited, default 1000
+	// 为onResume和SubscribeWithSnapshot保留最新广播的最大tag数，淘汰最久未广播的。0表示不限制，默认1000
+	MaxLastMsgs int
+	lastOrder   *list.List               // Tags of lastMsgs, most recently broadcast first 最近广播的tag在前
+	lastIdx     map[string]*list.Element // Element of each tag in lastOrder 每个tag在lastOrder中的元素
+	// Max number of keys in Data, least recently used ones except locks are evicted, 0 for unlimited
+	// Data中最大key数量，超出时淘汰最近最少使用的key（锁除外），0表示不限制
+	MaxKeys int
+	lruKeys *list.List               // Keys of Data, most recently used first 最近使用的key在前
+	lruIdx  map[string]*list.Element // Element of each key in lruKeys 每个key在lruKeys中的元素
+	pubJobs map[string]*PublishJob   // Periodic publish job of each tag 每个tag的定时发布任务
+	lockPub deadlock.Mutex           // Guard pubJobs 保护pubJobs
+	derived map[string][]*DerivedTag // Derived tags of each source tag 每个来源tag的派生tag
+	// Guard derived 保护derived
+	lockDerive deadlock.Mutex
+	// Interval of removing expired keys in background, 0 to only remove them lazily on read, default 1 minute
+	// 后台清理过期key的间隔，0表示仅在读取时惰性删除，默认1分钟
+	SweepInterval time.Duration
+	sweepStop     chan struct{} // Closed to stop the sweeper, guarded by lockData 关闭以停止清理协程
+	// 13-digit timestamp used for expiry of keys and IdemKeys, nil for btime.TimeMS. Tests may set a ManualClock.Now
+	// key和IdemKey过期使用的13位时间戳，nil时使用btime.TimeMS。测试中可设为ManualClock.Now
+	Clock func() int64
+	// Applied to each accepted conn, see BanConn.ReadBufSize, default ConnBufSize 应用于每个连接，默认ConnBufSize
+	ReadBufSize  int
+	WriteBufSize int
+	// Applied to each accepted conn, see BanConn.ResyncMarker 应用于每个连接
+	ResyncMarker bool
+	// Keep Nagle's algorithm on accepted conns, which get TCP_NODELAY by default, see BanConn.NoDelay
+	// 在接受的连接上保留Nagle算法，默认设置TCP_NODELAY，见BanConn.NoDelay
+	DelayWrites bool
+	// Applied to each accepted conn, see BanConn.MaxDecompressSize 应用于每个连接
+	MaxDecompressSize int
+	// Applied to each accepted conn, see BanConn.MaxMsgSize and OversizePolicy 应用于每个连接
+	MaxMsgSize     int
+	OversizePolicy string
+	// Applied to each accepted conn, see BanConn.WriteCodec and ReadCodec 应用于每个连接
+	WriteCodec string
+	ReadCodec  string
+	// Applied to each accepted conn, see BanConn.StreamWindow 应用于每个连接
+	StreamWindow int
+	// Max live conns, later ones get onReject and are closed. 0 for unlimited 最大活跃连接数，超出的收到onReject后被关闭。0表示不限制
+	MaxConns int
+	// Retry hint sent by onReject and onSubReject, 0 for none 通过onReject和onSubReject发送的重试提示，0表示不提示
+	RejectRetryAfter time.Duration
+	// Token clients must announce by hello, others get onHandshakeFail and are closed. Empty to skip
+	// 客户端必须通过hello宣告的令牌，否则收到onHandshakeFail后被关闭。空表示不检查
+	AuthToken string
+	draining  atomic.Bool // See SetDraining 见SetDraining
+	// Window of deduplicating sets by KeyValExpire.IdemKey, default 1 minute 按KeyValExpire.IdemKey对设置去重的时间窗口，默认1分钟
+	IdemWindow time.Duration
+	idemKeys   map[string]int64 // Expiration of each applied IdemKey, guarded by lockData 每个已生效IdemKey的过期时间
+	// Max broadcasts of each tag (exact or the longest prefix) buffered for a named subscriber whose conn is lost,
+	// delivered when it reconnects with the same name within LostGrace. Absent tags are dropped
+	// 按tag（精确或最长前缀）为连接断开的具名订阅者缓存的最大广播数，在LostGrace内以相同名称重连时送达。未配置的tag被丢弃
+	LostBuffer map[string]int
+	LostGrace  time.Duration       // How long to buffer for a lost subscriber, default 1 minute 为断开的订阅者缓存的时长，默认1分钟
+	lostSubs   map[string]*lostSub // Lost subscribers by name, guarded by lockSnap 按名称的断开订阅者
+	// Max live subscribers of each tag (exact or the longest prefix), more subscriptions get onSubReject with
+	// TagFullReason. Absent tags are unlimited
+	// 按tag（精确或最长前缀）的最大活跃订阅者数，更多的订阅收到带TagFullReason的onSubReject。未配置的tag不限制
+	MaxTagSubs map[string]int
+	lockSubCap deadlock.Mutex // Serialize subscriptions checked by MaxTagSubs 串行执行受MaxTagSubs检查的订阅
+	// Sources of streams replayed by ReplayCursor, see RegCursorStream 通过ReplayCursor重放的流的来源，见RegCursorStream
+	cursorStreams map[string]CursorLoader
+	// Serialize broadcasts against subscribeSnap, so no update falls between a snapshot and live ones
+	// 使广播与subscribeSnap串行，快照和实时更新之间不会遗漏更新
+	lockSnap deadlock.Mutex
+	// Guard adding and replacing Conns 保护Conns的添加和替换
+	lockConns deadlock.Mutex
 }
 
 var (
@@ -445,27 +1442,69 @@ func NewBanServer(addr, name string) *ServerIO {
 	server.Addr = addr
 	server.Name = name
 	server.Data = map[string]string{}
+	server.DataExp = map[string]int64{}
+	server.lastMsgs = map[string][]byte{}
+	server.lastSeqs = map[string]int64{}
+	server.MaxLastMsgs = 1000
+	server.failNums = map[string]int{}
+	server.tagStats = map[string]*TagStat{}
+	server.ReadBufSize = ConnBufSize
+	server.WriteBufSize = ConnBufSize
+	server.SweepInterval = time.Minute
+	server.IdemWindow = time.Minute
+	server.LostGrace = time.Minute
 	banServer = &server
 	return &server
 }
 
 func (s *ServerIO) RunForever() *errs.Error {
-	ln, err_ := net.Listen("tcp", s.Addr)
+	tr := s.Transport
+	if tr == nil {
+		tr = DefaultTransport
+	}
+	ln, err_ := tr.Listen(s.Addr)
 	if err_ != nil {
 		return errs.New(core.ErrNetConnect, err_)
 	}
 	defer ln.Close()
 	log.Info("banio started", zap.String("name", s.Name), zap.String("addr", s.Addr))
+	return s.Serve(ln)
+}
+
+/*
+Serve
+Accept connections from the listener and serve them until the listener is closed.
+从listener接受连接并处理，直到listener关闭。
+*/
+func (s *ServerIO) Serve(ln net.Listener) *errs.Error {
+	s.StartSweep()
+	defer s.StopSweep()
 	for {
 		conn_, err_ := ln.Accept()
 		if err_ != nil {
 			return errs.New(core.ErrNetConnect, err_)
 		}
+		if s.IsDraining() {
+			go s.rejectConn(conn_, DrainReason)
+			continue
+		}
+		if s.MaxConns > 0 && s.liveConnNum() >= s.MaxConns {
+			go s.rejectConn(conn_, fmt.Sprintf("server full, max %d conns", s.MaxConns))
+			continue
+		}
 		conn := s.WrapConn(conn_)
 		log.Info("receive client", zap.String("remote", conn.GetRemote()))
+		s.lockConns.Lock()
 		s.Conns = append(s.Conns, conn)
+		s.lockConns.Unlock()
 		go func() {
-			err := conn.RunForever()
+			caps := conn.localCaps()
+			caps.HandshakeAck = true
+			err := conn.WriteMsg(&IOMsg{Action: "hello", Data: caps})
+			if err != nil {
+				log.Warn("send hello fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+			}
+			err = conn.RunForever()
 			if err != nil {
 				log.Warn("read client fail", zap.String("remote", conn.GetRemote()),
 					zap.String("err", err.Message()))
@@ -474,10 +1513,158 @@ func (s *ServerIO) RunForever() *errs.Error {
 	}
 }
 
+/*
+StartSweep
+Start removing expired keys every SweepInterval in background, so keys never read again are freed. Called by Serve,
+no-op when SweepInterval is 0 or already started.
+在后台每隔SweepInterval删除过期的key，使不再被读取的key也能被释放。由Serve调用，SweepInterval为0或已启动时无操作。
+*/
+func (s *ServerIO) StartSweep() {
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	if s.SweepInterval <= 0 || s.sweepStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.sweepStop = stop
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if num := s.SweepExpired(); num > 0 {
+					log.Debug("sweep expired keys", zap.String("name", s.Name), zap.Int("num", num))
+				}
+			}
+		}
+	}(s.SweepInterval)
+}
+
+// StopSweep stop the sweeper started by StartSweep 停止StartSweep启动的清理协程
+func (s *ServerIO) StopSweep() {
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	if s.sweepStop != nil {
+		close(s.sweepStop)
+		s.sweepStop = nil
+	}
+}
+
+// SweepExpired remove all expired keys and IdemKeys, return the number of keys removed 删除所有过期的key和IdemKey，返回删除的key数量
+func (s *ServerIO) SweepExpired() int {
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	curMS := s.nowMS()
+	num := 0
+	for key, exp := range s.DataExp {
+		if curMS >= exp {
+			s.delVal(key)
+			num += 1
+		}
+	}
+	for key, exp := range s.idemKeys {
+		if curMS >= exp {
+			delete(s.idemKeys, key)
+		}
+	}
+	return num
+}
+
+// nowMS current time for expiry, see ServerIO.Clock 用于过期判断的当前时间
+func (s *ServerIO) nowMS() int64 {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return btime.TimeMS()
+}
+
+/*
+ManualClock
+A clock only moved by Advance, set its Now as ServerIO.Clock so tests replay expiry of keys without sleeping.
+仅通过Advance前进的时钟，将其Now设为ServerIO.Clock，使测试无需sleep即可重现key的过期。
+*/
+type ManualClock struct {
+	ms atomic.Int64
+}
+
+func NewManualClock(startMS int64) *ManualClock {
+	var c ManualClock
+	c.ms.Store(startMS)
+	return &c
+}
+
+// Now current 13-digit timestamp of the clock 时钟当前的13位时间戳
+func (c *ManualClock) Now() int64 {
+	return c.ms.Load()
+}
+
+// Advance move the clock forward by d 将时钟前移d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.ms.Add(d.Milliseconds())
+}
+
 type KeyValExpire struct {
 	Key        string
 	Val        string
 	ExpireSecs int `json:"expireSecs"`
+	// Sets with the same IdemKey are applied once within ServerIO.IdemWindow, so retried sets are deduplicated
+	// 相同IdemKey的设置在ServerIO.IdemWindow内只生效一次，从而对重试的设置去重
+	IdemKey string `json:"idemKey,omitempty"`
+}
+
+// MaxExpireSecs max ExpireSecs of KeyValExpire, larger ones are rejected rather than kept forever
+// KeyValExpire的最大ExpireSecs，更大的值被拒绝而不是永久保留
+var MaxExpireSecs = 365 * 24 * 3600
+
+/*
+Check
+Check ExpireSecs is within [0, MaxExpireSecs], 0 for never expire. A negative or huge value is usually a bug of the
+caller (e.g. a timestamp passed as seconds), which would make the key permanent silently.
+检查ExpireSecs在[0, MaxExpireSecs]之间，0表示永不过期。负数或过大的值通常是调用方的错误（如把时间戳当作秒数传入），
+会悄悄使key永久存在。
+*/
+func (a *KeyValExpire) Check() *errs.Error {
+	if a.ExpireSecs < 0 {
+		return errs.NewMsg(errs.CodeParamInvalid, "expireSecs of %s should not be negative: %d", a.Key, a.ExpireSecs)
+	}
+	if a.ExpireSecs > MaxExpireSecs {
+		return errs.NewMsg(errs.CodeParamInvalid, "expireSecs of %s exceeds %d: %d", a.Key, MaxExpireSecs,
+			a.ExpireSecs)
+	}
+	return nil
+}
+
+/*
+KeyIncr
+Args of IncrBy, Seq is set by ClientIO to match the response.
+IncrBy的参数，Seq由ClientIO设置用于匹配响应。
+*/
+type KeyIncr struct {
+	Key        string `json:"key"`
+	Delta      int64  `json:"delta"`
+	ExpireSecs int    `json:"expireSecs"` // Only applied when the key is created 仅在key被创建时生效
+	Seq        int64  `json:"seq,omitempty"`
+}
+
+// Check ExpireSecs is within [0, MaxExpireSecs] as KeyValExpire.Check 同KeyValExpire.Check检查ExpireSecs在[0, MaxExpireSecs]之间
+func (a *KeyIncr) Check() *errs.Error {
+	return (&KeyValExpire{Key: a.Key, ExpireSecs: a.ExpireSecs}).Check()
+}
+
+/*
+KeyLockRenew
+Args of RenewLock, Seq is set by ClientIO to match the response.
+RenewLock的参数，Seq由ClientIO设置用于匹配响应。
+*/
+type KeyLockRenew struct {
+	Key        string `json:"key"` // Name of the lock, without the lock_ prefix 锁名称，不含lock_前缀
+	Token      int32  `json:"token"`
+	Payload    string `json:"payload"`
+	ExpireSecs int    `json:"expireSecs"`
+	Seq        int64  `json:"seq,omitempty"`
 }
 
 type IOKeyVal struct {
@@ -485,27 +1672,234 @@ type IOKeyVal struct {
 	Val string `json:"val"`
 }
 
-func (s *ServerIO) SetVal(args *KeyValExpire) {
+func (s *ServerIO) SetVal(args *KeyValExpire) *errs.Error {
+	if err := args.Check(); err != nil {
+		return err
+	}
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	if s.seenIdem(args.IdemKey) {
+		log.Debug("skip duplicate set", zap.String("key", args.Key), zap.String("idem", args.IdemKey))
+		return nil
+	}
+	s.setVal(args)
+	return nil
+}
+
+// seenIdem whether idemKey was applied within IdemWindow, record it if not. lockData should be held
+// idemKey是否在IdemWindow内已生效，未生效时记录。应持有lockData
+func (s *ServerIO) seenIdem(idemKey string) bool {
+	if idemKey == "" || s.IdemWindow <= 0 {
+		return false
+	}
+	curMS := s.nowMS()
+	if exp, ok := s.idemKeys[idemKey]; ok && curMS < exp {
+		return true
+	}
+	if s.idemKeys == nil {
+		s.idemKeys = make(map[string]int64)
+	}
+	s.idemKeys[idemKey] = curMS + s.IdemWindow.Milliseconds()
+	return false
+}
+
+func (s *ServerIO) GetVal(key string) string {
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	return s.getVal(key)
+}
+
+type KVItem struct {
+	Key      string `json:"key"`
+	Val      string `json:"val"`
+	ExpireMS int64  `json:"expire_ms,omitempty"`
+}
+
+/*
+DumpKV
+Return live keys sorted by key, expired ones are dropped. values of keys with any of redacts prefixes are masked.
+返回按key排序的有效键值，已过期的被删除。以redacts任一前缀开头的key，值会被遮蔽。
+*/
+func (s *ServerIO) DumpKV(redacts ...string) []*KVItem {
+	s.lockData.Lock()
+	res := make([]*KVItem, 0, len(s.Data))
+	for key := range s.Data {
+		val := s.peekVal(key)
+		if val == "" {
+			continue
+		}
+		for _, prefix := range redacts {
+			if strings.HasPrefix(key, prefix) {
+				val = "***"
+				break
+			}
+		}
+		res = append(res, &KVItem{Key: key, Val: val, ExpireMS: s.DataExp[key]})
+	}
+	s.lockData.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+/*
+SetValNX
+Set the value only if the key is absent or expired, atomically. returns whether it's set.
+仅当key不存在或已过期时原子地设置值，返回是否设置成功。
+*/
+func (s *ServerIO) SetValNX(args *KeyValExpire) (bool, *errs.Error) {
+	if err := args.Check(); err != nil {
+		return false, err
+	}
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	if s.getVal(args.Key) != "" {
+		return false, nil
+	}
+	s.setVal(args)
+	return true, nil
+}
+
+/*
+IncrBy
+Add delta to the integer value of key atomically and return the new value, a missing or expired key starts from
+zero with ExpireSecs, the expiration of an existing key is kept. ExpireSecs out of [0, MaxExpireSecs] is rejected.
+原子地将key的整数值加上delta并返回新值，不存在或已过期的key从0开始并使用ExpireSecs，已存在key的过期时间保持不变。
+超出[0, MaxExpireSecs]的ExpireSecs被拒绝。
+*/
+func (s *ServerIO) IncrBy(args *KeyIncr) (int64, *errs.Error) {
+	if err := args.Check(); err != nil {
+		return 0, err
+	}
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	old := s.getVal(args.Key)
+	var num int64
+	if old != "" {
+		var err_ error
+		num, err_ = strconv.ParseInt(old, 10, 64)
+		if err_ != nil {
+			return 0, errs.NewMsg(errs.CodeParamInvalid, "value of %s is not an integer: %s", args.Key, old)
+		}
+	}
+	num += args.Delta
+	val := strconv.FormatInt(num, 10)
+	if old == "" {
+		s.setVal(&KeyValExpire{Key: args.Key, Val: val, ExpireSecs: args.ExpireSecs})
+	} else {
+		s.Data[args.Key] = val
+	}
+	return num, nil
+}
+
+/*
+RenewLock
+Replace the payload and expiration of the network lock atomically if it's still held by args.Token, returns false
+if the lock was released or taken by another holder.
+若网络锁仍由args.Token持有，原子地替换其附带数据和过期时间，锁已释放或被其他持有者获取时返回false。
+*/
+func (s *ServerIO) RenewLock(args *KeyLockRenew) (bool, *errs.Error) {
+	token := strconv.FormatInt(int64(args.Token), 10)
+	val := token
+	if args.Payload != "" {
+		val += ":" + args.Payload
+	}
+	kv := &KeyValExpire{Key: "lock_" + args.Key, Val: val, ExpireSecs: args.ExpireSecs}
+	if err := kv.Check(); err != nil {
+		return false, err
+	}
+	s.lockData.Lock()
+	defer s.lockData.Unlock()
+	if lockToken(s.getVal(kv.Key)) != token {
+		return false, nil
+	}
+	s.setVal(kv)
+	return true, nil
+}
+
+// lockToken the token part of a network lock value, which is token or token:payload 网络锁值中的token部分
+func lockToken(val string) string {
+	token, _, _ := strings.Cut(val, ":")
+	return token
+}
+
+func (s *ServerIO) setVal(args *KeyValExpire) {
 	if args.Val == "" {
 		// 删除值
-		delete(s.Data, args.Key)
+		s.delVal(args.Key)
 		return
 	}
+	if s.Data == nil {
+		s.Data = map[string]string{}
+	}
+	if s.DataExp == nil {
+		s.DataExp = map[string]int64{}
+	}
 	s.Data[args.Key] = args.Val
 	if args.ExpireSecs > 0 {
-		s.DataExp[args.Key] = btime.TimeMS() + int64(args.ExpireSecs*1000)
+		s.DataExp[args.Key] = s.nowMS() + int64(args.ExpireSecs)*1000
+	} else {
+		delete(s.DataExp, args.Key)
+	}
+	s.touchKey(args.Key)
+	if s.MaxKeys > 0 && len(s.Data) > s.MaxKeys {
+		s.evictKeys()
 	}
 }
 
-func (s *ServerIO) GetVal(key string) string {
+func (s *ServerIO) delVal(key string) {
+	delete(s.Data, key)
+	delete(s.DataExp, key)
+	if elem, ok := s.lruIdx[key]; ok {
+		s.lruKeys.Remove(elem)
+		delete(s.lruIdx, key)
+	}
+}
+
+// touchKey mark key as the most recently used 标记key为最近使用
+func (s *ServerIO) touchKey(key string) {
+	if s.lruKeys == nil {
+		s.lruKeys = list.New()
+		s.lruIdx = make(map[string]*list.Element)
+	}
+	if elem, ok := s.lruIdx[key]; ok {
+		s.lruKeys.MoveToFront(elem)
+		return
+	}
+	s.lruIdx[key] = s.lruKeys.PushFront(key)
+}
+
+// evictKeys evict least recently used keys until MaxKeys, locks are never evicted 淘汰最近最少使用的key直到MaxKeys，锁不会被淘汰
+func (s *ServerIO) evictKeys() {
+	elem := s.lruKeys.Back()
+	for elem != nil && len(s.Data) > s.MaxKeys {
+		prev := elem.Prev()
+		key := elem.Value.(string)
+		if !strings.HasPrefix(key, "lock_") {
+			s.delVal(key)
+		}
+		elem = prev
+	}
+}
+
+func (s *ServerIO) getVal(key string) string {
+	val := s.peekVal(key)
+	if val != "" {
+		s.touchKey(key)
+	}
+	return val
+}
+
+// peekVal get the value without marking it as recently used 获取值但不标记为最近使用
+func (s *ServerIO) peekVal(key string) string {
 	val, ok := s.Data[key]
 	if !ok {
 		return ""
 	}
 	if exp, ok := s.DataExp[key]; ok {
-		if btime.TimeMS() >= exp {
-			delete(s.Data, key)
-			delete(s.DataExp, key)
+		if s.nowMS() >= exp {
+			s.delVal(key)
 			return ""
 		}
 	}
@@ -513,76 +1907,619 @@ func (s *ServerIO) GetVal(key string) string {
 }
 
 func (s *ServerIO) Broadcast(msg *IOMsg) *errs.Error {
+	_, err := s.BroadcastNum(msg)
+	return err
+}
+
+/*
+BroadcastNum
+Same as Broadcast, but also return the number of subscribers of msg.Action (paused ones included),
+callers can alert when a critical message has no subscribers.
+同Broadcast，但同时返回msg.Action的订阅者数量（包括暂停的），调用方可在重要消息无人订阅时告警。
+*/
+func (s *ServerIO) BroadcastNum(msg *IOMsg) (int, *errs.Error) {
+	subNum, err := s.broadcast(msg, nil)
+	if err != nil {
+		// skip this broadcast only, later ones of the tag are still delivered 只跳过本次广播，该tag后续的广播仍会发送
+		s.onBroadcastFail(msg.Action, err)
+		return subNum, nil
+	}
+	s.feedDerived(msg)
+	return subNum, nil
+}
+
+/*
+broadcast
+Queue msg for all live subscribers and buffer it for lost ones (see LostBuffer), return the number of live
+subscribers (paused ones included) and the encoding error. track is called for each live subscriber before queueing,
+the returned func is called with the write result.
+为所有在线订阅者排队msg并为断开的订阅者缓存（见LostBuffer），返回在线订阅者数量（包括暂停的）和编码错误。track在排队前对每个
+在线订阅者调用，返回的函数以写入结果调用。
+*/
+func (s *ServerIO) broadcast(msg *IOMsg, track func(conn IBanConn) func(err *errs.Error)) (int, *errs.Error) {
+	s.lockSnap.Lock()
+	defer s.lockSnap.Unlock()
+	s.lockConns.Lock()
 	allConns := make([]IBanConn, 0, len(s.Conns))
 	curConns := make([]IBanConn, 0)
+	subNum := 0
+	allowRaw := true // whether all subscribers accept uncompressed frames 是否所有订阅者都接受未压缩帧
+	var closed []IBanConn
 	for _, conn := range s.Conns {
 		if conn.IsClosed() {
+			closed = append(closed, conn)
 			continue
 		}
 		allConns = append(allConns, conn)
 		if conn.HasTag(msg.Action) {
-			curConns = append(curConns, conn)
+			subNum += 1
+			if bc, ok := conn.(*BanConn); !ok || !bc.acceptsRaw() {
+				allowRaw = false
+			}
+			if !conn.IsPaused() {
+				curConns = append(curConns, conn)
+			}
 		}
 	}
 	s.Conns = allConns
-	if len(curConns) == 0 {
-		return nil
-	}
-	raw, err_ := utils.Marshal(*msg)
-	if err_ != nil {
-		return errs.New(core.ErrMarshalFail, err_)
+	s.lockConns.Unlock()
+	s.trackLost(closed, allConns)
+	lostSubs := s.lostSubsOf(msg.Action)
+	if len(lostSubs) > 0 {
+		// peers of reconnected conns are unknown yet 重连后的对端能力尚未知
+		allowRaw = false
+	}
+	if subNum == 0 && len(lostSubs) == 0 {
+		s.updateTagStat(msg.Action, 0, 0, 0)
+		return 0, nil
+	}
+	raw, err := encodeMsg(msg)
+	var compressed []byte
+	if err == nil {
+		compressed, err = encodeFrame(nil, raw, allowRaw)
 	}
-	compressed, err := compress(raw)
 	if err != nil {
-		return err
-	}
+		return subNum, err
+	}
+	s.updateTagStat(msg.Action, subNum, len(curConns), len(compressed))
+	// retain the latest value for paused subscribers 为暂停的订阅者保留最新值
+	s.retainLast(msg.Action, compressed)
+	s.bufferLost(lostSubs, compressed, msg)
+	// frames in formats of subscribers and onRawFrame wrapping them, built when first needed
+	// 订阅者各格式的帧及包装它们的onRawFrame，首次需要时构建
+	frames := &fmtFrames{msg: msg, allowRaw: allowRaw, frames: map[string][]byte{"": compressed}}
+	rawFrames := make(map[string][]byte)
 	for _, conn := range curConns {
+		var done func(err *errs.Error)
+		if track != nil {
+			done = track(conn)
+		}
+		if bc, ok := conn.(*BanConn); ok {
+			format := bc.msgFormat()
+			frame, err := frames.get(format, bc.writesRaw())
+			if err == nil && bc.isRawTag(msg.Action) {
+				key := string(frame[:1]) + format
+				rawFrame, has := rawFrames[key]
+				if !has {
+					rawFrame, err = wrapRawFrame(msg.Action, frame, allowRaw)
+					rawFrames[key] = rawFrame
+				}
+				frame = rawFrame
+			}
+			if err != nil {
+				log.Warn("encode broadcast fail", zap.String("tag", msg.Action), zap.String("format", format),
+					zap.Error(err))
+				if done != nil {
+					done(err)
+				}
+				continue
+			}
+			bc.enqueueDone(frame, msg, done)
+			continue
+		}
 		go func(c IBanConn) {
-			err = c.Write(compressed, false)
+			err := c.Write(compressed, false)
 			if err != nil {
 				log.Warn("broadcast fail", zap.String("remote", c.GetRemote()),
 					zap.String("tag", msg.Action), zap.Error(err))
 			}
+			if done != nil {
+				done(err)
+			}
 		}(conn)
 	}
-	return nil
+	return subNum, nil
 }
 
-func (s *ServerIO) WrapConn(conn net.Conn) *BanConn {
-	res := &BanConn{
-		Conn:      conn,
-		Tags:      map[string]bool{},
-		Listens:   map[string]ConnCB{},
-		RefreshMS: btime.TimeMS(),
-		Ready:     true,
-		Remote:    conn.RemoteAddr().String(),
-	}
-	res.Listens["onGetVal"] = func(action string, data []byte) {
-		var key string
-		err_ := utils.Unmarshal(data, &key, utils.JsonNumDefault)
-		if err_ != nil {
-			log.Error("unmarshal fail onGetVal", zap.String("raw", string(data)), zap.Error(err_))
-			return
-		}
-		val := s.GetVal(key)
-		err := res.WriteMsg(&IOMsg{Action: "onGetValRes", Data: &IOKeyVal{
-			Key: key,
-			Val: val,
-		}})
-		if err != nil {
-			log.Error("write val res fail", zap.Error(err))
+// BroadcastResult result of writing a BroadcastSync msg to a subscriber 向订阅者写入BroadcastSync消息的结果
+type BroadcastResult struct {
+	Remote string
+	Err    *errs.Error // nil when written 写出时为nil
+}
+
+/*
+BroadcastSync
+Same as Broadcast, but wait until the msg is written to all live subscribers or ctx is done. One result is returned
+for each live subscriber, those not written when ctx is done have an ErrTimeout error. Encoding errors are returned
+directly.
+同Broadcast，但等待消息写出到所有在线订阅者或ctx结束。每个在线订阅者返回一个结果，ctx结束时尚未写出的错误为ErrTimeout。
+编码错误直接返回。
+*/
+func (s *ServerIO) BroadcastSync(ctx context.Context, msg *IOMsg) ([]*BroadcastResult, *errs.Error) {
+	var lock sync.Mutex
+	var res []*BroadcastResult
+	pending := 0
+	allDone := make(chan struct{})
+	queued := false
+	_, err := s.broadcast(msg, func(conn IBanConn) func(err *errs.Error) {
+		item := &BroadcastResult{Remote: conn.GetRemote(),
+			Err: errs.NewMsg(core.ErrTimeout, "broadcast not written in time")}
+		lock.Lock()
+		res = append(res, item)
+		pending += 1
+		lock.Unlock()
+		return func(err *errs.Error) {
+			lock.Lock()
+			defer lock.Unlock()
+			item.Err = err
+			pending -= 1
+			if pending == 0 && queued {
+				close(allDone)
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
-	res.Listens["onSetVal"] = func(action string, data []byte) {
-		var args KeyValExpire
-		err := utils.Unmarshal(data, &args, utils.JsonNumDefault)
-		if err != nil {
-			log.Error("unmarshal fail onSetVal", zap.String("raw", string(data)), zap.Error(err))
-			return
+	s.feedDerived(msg)
+	lock.Lock()
+	queued = true
+	if pending == 0 {
+		close(allDone)
+	}
+	lock.Unlock()
+	select {
+	case <-allDone:
+	case <-ctx.Done():
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// copy so later writes don't change the returned results 复制以免之后的写入修改返回结果
+	out := make([]*BroadcastResult, len(res))
+	for i, item := range res {
+		out[i] = &BroadcastResult{Remote: item.Remote, Err: item.Err}
+	}
+	return out, nil
+}
+
+/*
+BroadcastToRole
+Send msg to all conns whose peer announced the role in hello, regardless of their subscribed tags. Paused conns are
+skipped. Return the number of conns with the role.
+向所有在hello中宣告了该角色的连接发送msg，不管其订阅的tag。跳过暂停的连接。返回具有该角色的连接数。
+*/
+func (s *ServerIO) BroadcastToRole(role string, msg *IOMsg) (int, *errs.Error) {
+	if role == "" {
+		return 0, errs.NewMsg(errs.CodeParamRequired, "role is required")
+	}
+	conns := make([]*BanConn, 0)
+	roleNum := 0
+	allowRaw := true
+	for _, conn := range s.getConns() {
+		c, ok := conn.(*BanConn)
+		if !ok || c.IsClosed() || c.PeerRole() != role {
+			continue
+		}
+		roleNum += 1
+		allowRaw = allowRaw && c.acceptsRaw()
+		if !c.IsPaused() {
+			conns = append(conns, c)
+		}
+	}
+	if len(conns) == 0 {
+		return roleNum, nil
+	}
+	frames := &fmtFrames{msg: msg, allowRaw: allowRaw}
+	for _, c := range conns {
+		compressed, err := frames.get(c.msgFormat(), c.writesRaw())
+		if err != nil {
+			return roleNum, err
+		}
+		c.enqueue(compressed, msg)
+	}
+	return roleNum, nil
+}
+
+func (s *ServerIO) onBroadcastFail(action string, err *errs.Error) {
+	s.lockMsgs.Lock()
+	num := s.failNums[action] + 1
+	s.failNums[action] = num
+	s.lockMsgs.Unlock()
+	if num%100 == 1 {
+		log.Error("broadcast skipped", zap.String("tag", action), zap.Int("fails", num), zap.Error(err))
+	}
+}
+
+/*
+BroadcastFails
+Return the number of broadcasts skipped for encoding failures of each tag.
+返回每个tag因编码失败而跳过的广播次数。
+*/
+func (s *ServerIO) BroadcastFails() map[string]int {
+	s.lockMsgs.Lock()
+	defer s.lockMsgs.Unlock()
+	return maps.Clone(s.failNums)
+}
+
+type TagStat struct {
+	Msgs    int64   // Broadcasts of the tag, including ones without subscribers 该tag的广播次数，包括无订阅者的
+	Bytes   int64   // Frame bytes sent to all subscribers 发送给所有订阅者的帧字节数
+	Subs    int     // Subscribers at the latest broadcast 最近一次广播时的订阅者数量
+	FirstMS int64   // Timestamp of the first broadcast 首次广播的时间戳
+	LastMS  int64   // Timestamp of the latest broadcast 最近一次广播的时间戳
+	Rate    float64 // Broadcasts per second between FirstMS and LastMS FirstMS到LastMS之间每秒广播次数
+}
+
+func (s *ServerIO) updateTagStat(tag string, subs, sent, size int) {
+	curMS := btime.TimeMS()
+	s.lockMsgs.Lock()
+	st, ok := s.tagStats[tag]
+	if !ok {
+		st = &TagStat{FirstMS: curMS}
+		s.tagStats[tag] = st
+	}
+	st.Msgs += 1
+	st.Bytes += int64(sent * size)
+	st.Subs = subs
+	st.LastMS = curMS
+	s.lockMsgs.Unlock()
+}
+
+/*
+TagStats
+Return broadcast metrics of each tag: messages, bytes sent, subscriber count, last broadcast time and rate.
+返回每个tag的广播指标：消息数、发送字节数、订阅者数量、最近广播时间和频率。
+*/
+func (s *ServerIO) TagStats() map[string]TagStat {
+	s.lockMsgs.Lock()
+	defer s.lockMsgs.Unlock()
+	res := make(map[string]TagStat, len(s.tagStats))
+	for tag, st := range s.tagStats {
+		item := *st
+		if item.LastMS > item.FirstMS {
+			item.Rate = float64(item.Msgs-1) * 1000 / float64(item.LastMS-item.FirstMS)
+		}
+		res[tag] = item
+	}
+	return res
+}
+
+/*
+Subscriptions
+Return subscribed tags of each live connection, keyed by the client name or address.
+返回每个活跃连接订阅的tag，键为客户端名称或地址。
+*/
+func (s *ServerIO) Subscriptions() map[string][]string {
+	s.lockConns.Lock()
+	defer s.lockConns.Unlock()
+	res := make(map[string][]string)
+	for _, conn := range s.Conns {
+		c, ok := conn.(*BanConn)
+		if !ok || c.IsClosed() {
+			continue
+		}
+		c.lockTag.Lock()
+		tags := make([]string, 0, len(c.Tags))
+		for tag := range c.Tags {
+			tags = append(tags, tag)
+		}
+		c.lockTag.Unlock()
+		sort.Strings(tags)
+		res[c.GetRemote()] = tags
+	}
+	return res
+}
+
+// BanConnInfo brief state of a live connection, see ServerIO.ConnInfo 活跃连接的简要状态
+type BanConnInfo struct {
+	Remote      string `json:"remote"` // Client name or address 客户端名称或地址
+	Role        string `json:"role"`   // Role announced by hello 通过hello宣告的角色
+	Ready       bool   `json:"ready"`
+	ConnectedAt int64  `json:"connected_at"` // 13 digit timestamp 13位时间戳
+	LastSeen    int64  `json:"last_seen"`    // Time of the latest received msg, 0 if none 最近收到消息的时间，没有时为0
+}
+
+/*
+ConnInfo
+Return the brief state of each live connection, lighter than Subscriptions for counting clients and health checks.
+返回每个活跃连接的简要状态，用于统计客户端数量和健康检查，比Subscriptions更轻量。
+*/
+func (s *ServerIO) ConnInfo() []*BanConnInfo {
+	s.lockConns.Lock()
+	defer s.lockConns.Unlock()
+	res := make([]*BanConnInfo, 0, len(s.Conns))
+	for _, conn := range s.Conns {
+		c, ok := conn.(*BanConn)
+		if !ok || c.IsClosed() {
+			continue
+		}
+		res = append(res, &BanConnInfo{
+			Remote:      c.GetRemote(),
+			Role:        c.PeerRole(),
+			Ready:       c.isReady(),
+			ConnectedAt: c.RefreshMS,
+			LastSeen:    c.lastRecvMS.Load(),
+		})
+	}
+	return res
+}
+
+// getConns a copy of Conns, safe to iterate while conns are added or removed 获取Conns的副本，可在连接增删时安全遍历
+func (s *ServerIO) getConns() []IBanConn {
+	s.lockConns.Lock()
+	defer s.lockConns.Unlock()
+	return slices.Clone(s.Conns)
+}
+
+/*
+ListenActions
+Return registered action prefixes of each live connection, keyed by the client name or address.
+返回每个活跃连接注册的action前缀，键为客户端名称或地址。
+*/
+func (s *ServerIO) ListenActions() map[string][]string {
+	res := make(map[string][]string)
+	for _, conn := range s.getConns() {
+		c, ok := conn.(*BanConn)
+		if !ok || c.IsClosed() {
+			continue
+		}
+		res[c.GetRemote()] = c.ListActions()
+	}
+	return res
+}
+
+/*
+SendTo
+Send a message to the connection with the given client name or address.
+发送消息到指定客户端名称或地址的连接。
+*/
+func (s *ServerIO) SendTo(remote string, msg *IOMsg) *errs.Error {
+	for _, conn := range s.getConns() {
+		c, ok := conn.(*BanConn)
+		if !ok || c.IsClosed() {
+			continue
+		}
+		if c.GetName() == remote || c.RemoteAddr == remote {
+			return c.WriteMsg(msg)
+		}
+	}
+	return errs.NewMsg(core.ErrNetWriteFail, "no conn for %s", remote)
+}
+
+/*
+Disconnect
+Close the conns with the given client name or address and remove them from Conns, their read loops exit at once.
+Returns the number of closed conns. Clients with DoConnect may reconnect later.
+关闭指定客户端名称或地址的连接并从Conns中移除，其读取循环立即退出。返回关闭的连接数。设置了DoConnect的客户端稍后可能重连。
+*/
+func (s *ServerIO) Disconnect(remote string) int {
+	return s.disconnectBy(func(c *BanConn) bool {
+		return c.GetName() == remote || c.RemoteAddr == remote
+	})
+}
+
+// DisconnectRole close all conns of the role announced by hello, see Disconnect 关闭通过hello宣告该角色的所有连接，见Disconnect
+func (s *ServerIO) DisconnectRole(role string) int {
+	return s.disconnectBy(func(c *BanConn) bool {
+		return c.PeerRole() == role
+	})
+}
+
+func (s *ServerIO) disconnectBy(match func(c *BanConn) bool) int {
+	s.lockConns.Lock()
+	var closing []*BanConn
+	s.Conns = slices.DeleteFunc(s.Conns, func(conn IBanConn) bool {
+		c, ok := conn.(*BanConn)
+		if ok && match(c) {
+			closing = append(closing, c)
+			return true
+		}
+		return false
+	})
+	s.lockConns.Unlock()
+	for _, c := range closing {
+		log.Info("disconnect client", zap.String("remote", c.GetRemote()), zap.String("name", c.GetName()))
+		if err_ := c.closeConn(); err_ != nil {
+			log.Warn("close conn fail", zap.String("remote", c.GetRemote()), zap.Error(err_))
+		}
+	}
+	return len(closing)
+}
+
+func (s *ServerIO) WrapConn(conn net.Conn) *BanConn {
+	res := &BanConn{
+		Conn:       conn,
+		Tags:       map[string]bool{},
+		Listens:    map[string]ConnCB{},
+		RefreshMS:  btime.TimeMS(),
+		Ready:      true,
+		Remote:     conn.RemoteAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+
+		MsgRateLimit: s.MsgRateLimit,
+		MsgRateBurst: s.MsgRateBurst,
+		FloodClose:   s.FloodClose,
+		Caps:         s.Caps,
+		NoDelay:      !s.DelayWrites,
+		ReadBufSize:  s.ReadBufSize,
+		WriteBufSize: s.WriteBufSize,
+		ResyncMarker: s.ResyncMarker,
+
+		MaxDecompressSize: s.MaxDecompressSize,
+		StreamWindow:      s.StreamWindow,
+		MaxMsgSize:        s.MaxMsgSize,
+		OversizePolicy:    s.OversizePolicy,
+		WriteCodec:        s.WriteCodec,
+		ReadCodec:         s.ReadCodec,
+	}
+	setNoDelay(conn, res.NoDelay)
+	res.Listens["onHello"] = func(action string, data []byte) {
+		res.onHello(data, false)
+		s.verifyHello(res)
+	}
+	res.Listens["onSetName"] = func(action string, data []byte) {
+		var name string
+		err_ := MsgSerializer.Unmarshal(data, &name)
+		if err_ != nil || name == "" {
+			log.Warn("invalid client name", zap.String("raw", string(data)))
+			return
+		}
+		log.Info("client named", zap.String("addr", res.RemoteAddr), zap.String("name", name))
+		res.lockTag.Lock()
+		res.Name = name
+		res.Remote = name
+		res.lockTag.Unlock()
+		s.resumeLost(res)
+	}
+	res.Listens["onGetVal"] = func(action string, data []byte) {
+		var key string
+		err_ := MsgSerializer.Unmarshal(data, &key)
+		if err_ != nil {
+			log.Error("unmarshal fail onGetVal", zap.String("raw", string(data)), zap.Error(err_))
+			return
+		}
+		if s.refuseReq(res, action, key) {
+			return
+		}
+		val := s.GetVal(key)
+		err := res.WriteMsg(&IOMsg{Action: "onGetValRes", Data: &IOKeyVal{
+			Key: key,
+			Val: val,
+		}})
+		if err != nil {
+			log.Error("write val res fail", zap.Error(err))
+		}
+	}
+	res.Listens["onSetVal"] = func(action string, data []byte) {
+		var args KeyValExpire
+		err := MsgSerializer.Unmarshal(data, &args)
+		if err != nil {
+			log.Error("unmarshal fail onSetVal", zap.String("raw", string(data)), zap.Error(err))
+			return
+		}
+		if s.refuseReq(res, action, "") {
+			return
+		}
+		if err := s.SetVal(&args); err != nil {
+			log.Warn("reject onSetVal", zap.String("remote", res.GetRemote()), zap.Error(err))
 		}
-		s.SetVal(&args)
+	}
+	res.Listens["onSetNX"] = func(action string, data []byte) {
+		var args KeyValExpire
+		err_ := MsgSerializer.Unmarshal(data, &args)
+		if err_ != nil {
+			log.Error("unmarshal fail onSetNX", zap.String("raw", string(data)), zap.Error(err_))
+			return
+		}
+		if s.refuseReq(res, action, "nx:"+args.Key) {
+			return
+		}
+		var ok string
+		if set, err := s.SetValNX(&args); err != nil {
+			log.Warn("reject onSetNX", zap.String("remote", res.GetRemote()), zap.Error(err))
+		} else if set {
+			ok = "1"
+		}
+		err := res.WriteMsg(&IOMsg{Action: "onSetNXRes", Data: &IOKeyVal{Key: args.Key, Val: ok}})
+		if err != nil {
+			log.Error("write setNX res fail", zap.Error(err))
+		}
+	}
+	res.Listens["onIncrBy"] = func(action string, data []byte) {
+		var args KeyIncr
+		err_ := MsgSerializer.Unmarshal(data, &args)
+		if err_ != nil {
+			log.Error("unmarshal fail onIncrBy", zap.String("raw", string(data)), zap.Error(err_))
+			return
+		}
+		seq := strconv.FormatInt(args.Seq, 10)
+		if s.refuseReq(res, action, "incr:"+seq) {
+			return
+		}
+		// empty val for failure 空值表示失败
+		var val string
+		num, err := s.IncrBy(&args)
+		if err != nil {
+			log.Warn("incr fail", zap.String("key", args.Key), zap.Error(err))
+		} else {
+			val = strconv.FormatInt(num, 10)
+		}
+		err = res.WriteMsg(&IOMsg{Action: "onIncrByRes", Data: &IOKeyVal{Key: seq, Val: val}})
+		if err != nil {
+			log.Error("write incr res fail", zap.Error(err))
+		}
+	}
+	res.Listens["onRenewLock"] = func(action string, data []byte) {
+		var args KeyLockRenew
+		err_ := MsgSerializer.Unmarshal(data, &args)
+		if err_ != nil {
+			log.Error("unmarshal fail onRenewLock", zap.String("raw", string(data)), zap.Error(err_))
+			return
+		}
+		seq := strconv.FormatInt(args.Seq, 10)
+		if s.refuseReq(res, action, "renew:"+seq) {
+			return
+		}
+		var ok string
+		if renewed, err := s.RenewLock(&args); err != nil {
+			log.Warn("reject onRenewLock", zap.String("remote", res.GetRemote()), zap.Error(err))
+		} else if renewed {
+			ok = "1"
+		}
+		err := res.WriteMsg(&IOMsg{Action: "onRenewLockRes", Data: &IOKeyVal{Key: seq, Val: ok}})
+		if err != nil {
+			log.Error("write renew lock res fail", zap.Error(err))
+		}
+	}
+	res.Listens["subscribeSnap"] = makeArrStrHandle(func(arr []string) {
+		s.subscribeBy(res, arr, func(tags []string) {
+			s.subscribeSnap(res, tags)
+		})
+	})
+	res.Listens["onPause"] = func(action string, data []byte) {
+		res.Paused.Store(true)
+	}
+	res.Listens["onResume"] = func(action string, data []byte) {
+		var withLast bool
+		if len(data) > 0 {
+			err_ := MsgSerializer.Unmarshal(data, &withLast)
+			if err_ != nil {
+				log.Warn("unmarshal fail onResume", zap.String("raw", string(data)), zap.Error(err_))
+			}
+		}
+		s.resume(res, withLast)
 	}
 	res.initListens()
+	res.Listens["subscribe"] = makeArrStrHandle(func(arr []string) {
+		s.subscribeBy(res, arr, func(tags []string) {
+			res.Subscribe(tags...)
+		})
+	})
+	res.Listens["onReplayCursor"] = func(action string, data []byte) {
+		var req CursorReq
+		err_ := MsgSerializer.Unmarshal(data, &req)
+		if err_ != nil || req.Stream == "" || req.Worker == "" {
+			log.Warn("invalid cursor replay", zap.String("raw", string(data)))
+			return
+		}
+		if s.refuseReq(res, action, "") {
+			return
+		}
+		s.replayCursor(res, &req)
+	}
+	res.Listens["subscribeRaw"] = makeArrStrHandle(func(arr []string) {
+		s.subscribeBy(res, arr, res.subscribeRaw)
+	})
 	if s.InitConn != nil {
 		s.InitConn(res)
 	}
@@ -592,99 +2529,429 @@ func (s *ServerIO) WrapConn(conn net.Conn) *BanConn {
 type ClientIO struct {
 	BanConn
 	Addr  string
+	name  string // Logical name declared to the server 向服务器声明的逻辑名称
 	waits map[string]chan string
+	// Called when the snapshot of a tag subscribed by SubscribeWithSnapshot arrives, before the tag msg carrying it
+	// 通过SubscribeWithSnapshot订阅的tag的快照到达时调用，在携带快照的tag消息之前
+	OnSnapshot func(snap *TagSnapshot)
+	// Seq of the latest IncrBy request 最近一次IncrBy请求的序号
+	incrSeq atomic.Int64
+	// Local cache of GetVal results, only for keys enabled by CacheVal 本地缓存的GetVal结果，仅对CacheVal启用的key
+	cache     map[string]*cachedVal
+	cacheTTLs map[string]time.Duration
+	cacheGen  int64 // Increased by each invalidation 每次失效时递增
+	lockCache deadlock.Mutex
+	// Rejects of waits refused by onReqReject, taken by the waiter 被onReqReject拒绝的等待的原因，由等待者取出
+	reqRejects map[string]*ReqReject
+	// Guard waits and reqRejects 保护waits和reqRejects
+	lockWaits deadlock.Mutex
+	closed    chan struct{} // Closed by Close to wake all waiters 由Close关闭以唤醒所有等待者
+	closeOnce sync.Once
 }
 
 func NewClientIO(addr string) (*ClientIO, *errs.Error) {
-	conn, err_ := net.Dial("tcp", addr)
+	return NewClientIOWith(addr, DefaultTransport)
+}
+
+/*
+NewClientIOWith
+Connect to the server at addr by the given transport, it's also used for reconnecting.
+通过指定的传输连接到addr的服务器，重连时也使用它。
+*/
+func NewClientIOWith(addr string, tr Transport) (*ClientIO, *errs.Error) {
+	conn, err_ := tr.Dial(addr)
 	if err_ != nil {
 		return nil, errs.New(core.ErrNetConnect, err_)
 	}
+	res := newClientIO(addr, tr, conn)
+	banClient = res
+	return res, nil
+}
+
+/*
+newClientIO
+Create a client of the dialed conn without registering it as the global client. conn is nil when the first dial
+failed, the client is closed then until connect succeeds.
+为已拨号的连接创建客户端，不注册为全局客户端。首次拨号失败时conn为nil，此时客户端处于关闭状态直到connect成功。
+*/
+func newClientIO(addr string, tr Transport, conn net.Conn) *ClientIO {
+	remote := addr
+	if conn != nil {
+		remote = conn.RemoteAddr().String()
+	}
 	res := &ClientIO{
 		Addr: addr,
 		BanConn: BanConn{
-			Conn:      conn,
-			Tags:      map[string]bool{},
-			Remote:    conn.RemoteAddr().String(),
-			Listens:   map[string]ConnCB{},
-			RefreshMS: btime.TimeMS(),
-			Ready:     true,
+			Conn:         conn,
+			Tags:         map[string]bool{},
+			Remote:       remote,
+			RemoteAddr:   remote,
+			Listens:      map[string]ConnCB{},
+			RefreshMS:    btime.TimeMS(),
+			Ready:        conn != nil,
+			NoDelay:      true,
+			ReadBufSize:  ConnBufSize,
+			WriteBufSize: ConnBufSize,
 		},
-		waits: map[string]chan string{},
-	}
-	res.Listens["onGetValRes"] = func(_ string, data []byte) {
-		var val IOKeyVal
-		err := utils.Unmarshal(data, &val, utils.JsonNumDefault)
-		if err != nil {
-			log.Error("onGetValRes unmarshal fail", zap.String("raw", string(data)), zap.Error(err))
-		} else {
-			out, ok := res.waits[val.Key]
-			if !ok {
-				return
-			}
-			out <- val.Val
+		waits:      map[string]chan string{},
+		reqRejects: map[string]*ReqReject{},
+		closed:     make(chan struct{}),
+	}
+	res.Listens["onGetValRes"] = res.makeResHandle("")
+	res.Listens["onSetNXRes"] = res.makeResHandle("nx:")
+	res.Listens["onIncrByRes"] = res.makeResHandle("incr:")
+	res.Listens["onRenewLockRes"] = res.makeResHandle("renew:")
+	res.Listens["hello"] = func(action string, data []byte) {
+		res.onHello(data, true)
+		_ = res.checkServerHello()
+	}
+	res.Listens["onSnapshot"] = res.onSnapshot
+	res.initListens()
+	res.Listens["onReqReject"] = func(action string, data []byte) {
+		if rej := res.onReqReject(data); rej != nil && rej.Key != "" {
+			res.rejectWait(rej)
 		}
 	}
-	res.initListens()
 	// This is only responsible for connection, no initialization required, leave it to connect for initialization
 	// 这里只负责连接，无需初始化，交给connect初始化
+	// Each call makes one dial attempt, retries are scheduled by connect
+	// 每次调用只尝试拨号一次，重试由connect调度
 	res.DoConnect = func(c *BanConn) {
-		for {
-			cn, err_ := net.Dial("tcp", addr)
-			if err_ != nil {
-				curMS := btime.TimeMS()
-				tipRetryTimesLock.Lock()
-				nextMS, _ := tipRetryTimes[addr]
-				if curMS > nextMS {
-					tipRetryTimes[addr] = curMS + 10000
-					log.Error("connect fail, sleep 10s and retry..", zap.String("addr", addr))
-				}
-				tipRetryTimesLock.Unlock()
-				core.Sleep(time.Second * 10)
-				continue
+		cn, err_ := tr.Dial(addr)
+		if err_ != nil {
+			curMS := btime.TimeMS()
+			tipRetryTimesLock.Lock()
+			nextMS, _ := tipRetryTimes[addr]
+			if curMS > nextMS {
+				tipRetryTimes[addr] = curMS + 10000
+				log.Error("connect fail, wait and retry..", zap.String("addr", addr))
 			}
-			c.Conn = cn
+			tipRetryTimesLock.Unlock()
 			return
 		}
+		if res.name != "" {
+			// declare the name before the conn is shared 在连接被共享前声明名称
+			err := writeFrame(cn, &IOMsg{Action: "onSetName", Data: res.name})
+			if err != nil {
+				log.Warn("declare name fail", zap.String("addr", addr), zap.Error(err))
+				_ = cn.Close()
+				return
+			}
+		}
+		setNoDelay(cn, c.NoDelay)
+		c.SetConn(cn)
 	}
-	banClient = res
-	return res, nil
+	return res
 }
 
 const (
 	readTimeout = 120
 )
 
-func (c *ClientIO) GetVal(key string, timeout int) (string, *errs.Error) {
-	err := c.WriteMsg(&IOMsg{
+// makeResHandle deliver IOKeyVal responses to the waiter of prefix+key
+func (c *ClientIO) makeResHandle(prefix string) ConnCB {
+	return func(action string, data []byte) {
+		var val IOKeyVal
+		err := MsgSerializer.Unmarshal(data, &val)
+		if err != nil {
+			log.Error(action+" unmarshal fail", zap.String("raw", string(data)), zap.Error(err))
+			return
+		}
+		if out, ok := c.popWait(prefix + val.Key); ok {
+			out <- val.Val
+		}
+	}
+}
+
+func (c *ClientIO) addWait(key string) chan string {
+	out := make(chan string, 1)
+	c.lockWaits.Lock()
+	c.waits[key] = out
+	c.lockWaits.Unlock()
+	return out
+}
+
+func (c *ClientIO) popWait(key string) (chan string, bool) {
+	c.lockWaits.Lock()
+	out, ok := c.waits[key]
+	delete(c.waits, key)
+	c.lockWaits.Unlock()
+	return out, ok
+}
+
+// rejectWait wake the waiter of rej.Key by closing its chan, the waiter takes rej by popReqReject
+// 关闭rej.Key的等待chan以唤醒等待者，等待者通过popReqReject取出rej
+func (c *ClientIO) rejectWait(rej *ReqReject) {
+	c.lockWaits.Lock()
+	out, ok := c.waits[rej.Key]
+	if ok {
+		delete(c.waits, rej.Key)
+		c.reqRejects[rej.Key] = rej
+	}
+	c.lockWaits.Unlock()
+	if ok {
+		close(out)
+	}
+}
+
+// popReqReject take the reject of the wait key as an error 取出等待键的拒绝原因作为错误返回
+func (c *ClientIO) popReqReject(key string) *errs.Error {
+	c.lockWaits.Lock()
+	rej := c.reqRejects[key]
+	delete(c.reqRejects, key)
+	c.lockWaits.Unlock()
+	if rej == nil {
+		return errs.NewMsg(core.ErrBusy, "%s refused by %s", key, c.GetRemote())
+	}
+	return errs.NewMsg(core.ErrBusy, "%s refused by %s: %s", rej.Action, c.GetRemote(), rej.Reason)
+}
+
+/*
+GetVal
+Get the value of key from server, returns "" if the key is missing or timeout. A key enabled by CacheVal is read from
+the local cache within its TTL.
+从服务器获取key的值，key不存在或超时返回""。通过CacheVal启用的key在TTL内从本地缓存读取。
+*/
+func (c *ClientIO) GetVal(key string, timeout int) (_ string, err *errs.Error) {
+	val, gen, hit := c.getCached(key)
+	if hit {
+		return val, nil
+	}
+	out := c.addWait(key)
+	msg := &IOMsg{
 		Action: "onGetVal",
 		Data:   key,
-	})
+	}
+	span := startRequestSpan(context.Background(), msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+	err = c.WriteMsg(msg)
 	if err != nil {
+		c.popWait(key)
 		return "", err
 	}
 	if timeout == 0 {
 		timeout = readTimeout
 	}
-	out := make(chan string)
-	c.waits[key] = out
 	var res string
 	select {
-	case res = <-out:
+	case got, ok := <-out:
+		if !ok {
+			return "", c.popReqReject(key)
+		}
+		res = got
+		c.setCached(key, res, gen)
 	case <-time.After(time.Second * time.Duration(timeout)):
-		close(out)
-		delete(c.waits, key)
+		c.popWait(key)
+	case <-c.closed:
+		return "", errClientClosed()
 	}
 	return res, nil
 }
 
+/*
+SetValNX
+Set the value on server only if the key is absent, returns whether it's set.
+仅当key不存在时在服务器设置值，返回是否设置成功。
+*/
+func (c *ClientIO) SetValNX(ctx context.Context, args *KeyValExpire) (_ bool, err *errs.Error) {
+	if err = args.Check(); err != nil {
+		return false, err
+	}
+	c.invalidCache(args.Key)
+	waitKey := "nx:" + args.Key
+	out := c.addWait(waitKey)
+	msg := &IOMsg{Action: "onSetNX", Data: *args}
+	span := startRequestSpan(ctx, msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+	err = c.WriteMsg(msg)
+	if err != nil {
+		c.popWait(waitKey)
+		return false, err
+	}
+	select {
+	case res, ok := <-out:
+		if !ok {
+			return false, c.popReqReject(waitKey)
+		}
+		return res != "", nil
+	case <-time.After(time.Second * readTimeout):
+		c.popWait(waitKey)
+		return false, errs.NewMsg(core.ErrTimeout, "SetValNX for %s", args.Key)
+	case <-ctx.Done():
+		c.popWait(waitKey)
+		return false, ctxErr(ctx, "SetValNX for %s", args.Key)
+	case <-c.closed:
+		return false, errClientClosed()
+	}
+}
+
+/*
+IncrBy
+Add args.Delta to the integer value of args.Key on server atomically, returns the new value.
+原子地将服务器上args.Key的整数值加上args.Delta，返回新值。
+*/
+func (c *ClientIO) IncrBy(ctx context.Context, args *KeyIncr) (_ int64, err *errs.Error) {
+	if err = args.Check(); err != nil {
+		return 0, err
+	}
+	c.invalidCache(args.Key)
+	req := *args
+	req.Seq = c.incrSeq.Add(1)
+	waitKey := "incr:" + strconv.FormatInt(req.Seq, 10)
+	out := c.addWait(waitKey)
+	msg := &IOMsg{Action: "onIncrBy", Data: req}
+	span := startRequestSpan(ctx, msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+	err = c.WriteMsg(msg)
+	if err != nil {
+		c.popWait(waitKey)
+		return 0, err
+	}
+	select {
+	case res, ok := <-out:
+		if !ok {
+			return 0, c.popReqReject(waitKey)
+		}
+		if res == "" {
+			return 0, errs.NewMsg(errs.CodeParamInvalid, "IncrBy for %s fail, value is not an integer", args.Key)
+		}
+		num, err_ := strconv.ParseInt(res, 10, 64)
+		if err_ != nil {
+			return 0, errs.New(errs.CodeParamInvalid, err_)
+		}
+		return num, nil
+	case <-time.After(time.Second * readTimeout):
+		c.popWait(waitKey)
+		return 0, errs.NewMsg(core.ErrTimeout, "IncrBy for %s", args.Key)
+	case <-ctx.Done():
+		c.popWait(waitKey)
+		return 0, ctxErr(ctx, "IncrBy for %s", args.Key)
+	case <-c.closed:
+		return 0, errClientClosed()
+	}
+}
+
+/*
+RenewLock
+Replace the payload and expiration of the network lock on server if it's still held by args.Token.
+see ServerIO.RenewLock
+若服务器上的网络锁仍由args.Token持有，替换其附带数据和过期时间。见ServerIO.RenewLock
+*/
+func (c *ClientIO) RenewLock(ctx context.Context, args *KeyLockRenew) (_ bool, err *errs.Error) {
+	req := *args
+	req.Seq = c.incrSeq.Add(1)
+	waitKey := "renew:" + strconv.FormatInt(req.Seq, 10)
+	out := c.addWait(waitKey)
+	msg := &IOMsg{Action: "onRenewLock", Data: req}
+	span := startRequestSpan(ctx, msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+	err = c.WriteMsg(msg)
+	if err != nil {
+		c.popWait(waitKey)
+		return false, err
+	}
+	select {
+	case res, ok := <-out:
+		if !ok {
+			return false, c.popReqReject(waitKey)
+		}
+		return res != "", nil
+	case <-time.After(time.Second * readTimeout):
+		c.popWait(waitKey)
+		return false, errs.NewMsg(core.ErrTimeout, "RenewLock for %s", args.Key)
+	case <-ctx.Done():
+		c.popWait(waitKey)
+		return false, ctxErr(ctx, "RenewLock for %s", args.Key)
+	case <-c.closed:
+		return false, errClientClosed()
+	}
+}
+
+/*
+Close
+Close the client permanently: stop reconnecting, close the conn, and fail all pending GetVal/SetValNX/IncrBy with
+core.ErrClosed at once. It's safe to call more than once.
+永久关闭客户端：停止重连，关闭连接，并立即以core.ErrClosed结束所有等待中的GetVal/SetValNX/IncrBy。可重复调用。
+*/
+func (c *ClientIO) Close() *errs.Error {
+	var err_ error
+	c.closeOnce.Do(func() {
+		c.stopped.Store(true)
+		close(c.closed)
+		c.lockWaits.Lock()
+		clear(c.waits)
+		clear(c.reqRejects)
+		c.lockWaits.Unlock()
+		err_ = c.closeConn()
+		c.setState(ConnStateClosed, nil)
+	})
+	if err_ != nil {
+		return errs.New(core.ErrNetConnect, err_)
+	}
+	return nil
+}
+
+func errClientClosed() *errs.Error {
+	return errs.NewMsg(core.ErrClosed, "client closed")
+}
+
 func (c *ClientIO) SetVal(args *KeyValExpire) *errs.Error {
+	if err := args.Check(); err != nil {
+		return err
+	}
+	c.invalidCache(args.Key)
 	return c.WriteMsg(&IOMsg{
 		Action: "onSetVal",
 		Data:   *args,
 	})
 }
 
+/*
+SetName
+Declare a logical name to the server, used in server logs and SendTo, it's re-declared after reconnect.
+向服务器声明逻辑名称，用于服务器日志和SendTo，重连后会重新声明。
+*/
+func (c *ClientIO) SetName(name string) *errs.Error {
+	c.name = name
+	return c.WriteMsg(&IOMsg{Action: "onSetName", Data: name})
+}
+
+/*
+Pause
+Ask the server to stop sending broadcasts without unsubscribing.
+请求服务器暂停发送广播，但不取消订阅。
+*/
+func (c *ClientIO) Pause() *errs.Error {
+	return c.WriteMsg(&IOMsg{Action: "onPause"})
+}
+
+/*
+UnSubscribeAll
+Ask the server to remove all tags subscribed by this client. Use WriteMsg with the "unsubscribe" action
+to remove tags by glob patterns.
+请求服务器移除此客户端订阅的所有tag。按glob模式移除tag时使用WriteMsg发送"unsubscribe"消息。
+*/
+func (c *ClientIO) UnSubscribeAll() *errs.Error {
+	return c.WriteMsg(&IOMsg{Action: "unsubscribeAll"})
+}
+
+/*
+Resume
+Ask the server to resume broadcasts, withLast to receive the latest value of each subscribed tag.
+请求服务器恢复广播，withLast为true时接收每个订阅tag的最新值。
+*/
+func (c *ClientIO) Resume(withLast bool) *errs.Error {
+	return c.WriteMsg(&IOMsg{Action: "onResume", Data: withLast})
+}
+
 var (
 	banClient *ClientIO
 )
@@ -704,10 +2971,43 @@ func GetServerData(key string) (string, *errs.Error) {
 	return banClient.GetVal(key, 0)
 }
 
+/*
+GetValOr
+Get the value of key from the KV store and decode it into T by mapstructure (weakly typed, json objects and arrays
+are parsed first), return def when the key is missing or fails to fetch or decode.
+从KV存储获取key的值并通过mapstructure解码为T（弱类型，json对象和数组先解析），key不存在、获取失败或解码失败时返回def。
+*/
+func GetValOr[T any](key string, def T) T {
+	val, err := GetServerData(key)
+	if err != nil {
+		log.Warn("get server data fail", zap.String("key", key), zap.Error(err))
+		return def
+	}
+	if val == "" {
+		return def
+	}
+	var input interface{} = val
+	if val[0] == '{' || val[0] == '[' {
+		var obj interface{}
+		if MsgSerializer.Unmarshal([]byte(val), &obj) == nil {
+			input = obj
+		}
+	}
+	var res T
+	dec, err_ := mapstructure.NewDecoder(&mapstructure.DecoderConfig{WeaklyTypedInput: true, Result: &res})
+	if err_ == nil {
+		err_ = dec.Decode(input)
+	}
+	if err_ != nil {
+		log.Warn("decode server data fail", zap.String("key", key), zap.String("val", val), zap.Error(err_))
+		return def
+	}
+	return res
+}
+
 func SetServerData(args *KeyValExpire) *errs.Error {
 	if banServer != nil {
-		banServer.SetVal(args)
-		return nil
+		return banServer.SetVal(args)
 	}
 	if banClient == nil {
 		return errs.NewMsg(core.ErrRunTime, "banClient not load")
@@ -715,34 +3015,149 @@ func SetServerData(args *KeyValExpire) *errs.Error {
 	return banClient.SetVal(args)
 }
 
+/*
+DumpServerData
+Dump the KV store of the local ban server, see ServerIO.DumpKV
+导出本地ban服务器的KV存储，见ServerIO.DumpKV
+*/
+func DumpServerData(redacts ...string) ([]*KVItem, *errs.Error) {
+	if banServer == nil {
+		return nil, errs.NewMsg(core.ErrRunTime, "banServer not load")
+	}
+	return banServer.DumpKV(redacts...), nil
+}
+
+func SetServerDataNX(ctx context.Context, args *KeyValExpire) (bool, *errs.Error) {
+	if banServer != nil {
+		return banServer.SetValNX(args)
+	}
+	if banClient == nil {
+		return false, errs.NewMsg(core.ErrRunTime, "banClient not load")
+	}
+	return banClient.SetValNX(ctx, args)
+}
+
+/*
+IncrServerData
+Atomically add args.Delta to the integer value of args.Key in the KV store, returns the new value.
+see ServerIO.IncrBy
+原子地将KV存储中args.Key的整数值加上args.Delta，返回新值。见ServerIO.IncrBy
+*/
+func IncrServerData(ctx context.Context, args *KeyIncr) (int64, *errs.Error) {
+	if banServer != nil {
+		return banServer.IncrBy(args)
+	}
+	if banClient == nil {
+		return 0, errs.NewMsg(core.ErrRunTime, "banClient not load")
+	}
+	return banClient.IncrBy(ctx, args)
+}
+
+// ctxErr convert the ctx error to ErrTimeout for deadline, or ErrRunTime for cancel
+func ctxErr(ctx context.Context, format string, args ...interface{}) *errs.Error {
+	code := core.ErrRunTime
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		code = core.ErrTimeout
+	}
+	return errs.NewMsg(code, format+": "+ctx.Err().Error(), args...)
+}
+
+/*
+GetNetLock
+Acquire the network lock of key, wait at most timeout secs (default 30)
+获取key的网络锁，最多等待timeout秒（默认30）
+*/
 func GetNetLock(key string, timeout int) (int32, *errs.Error) {
-	lockKey := "lock_" + key
-	val, err := GetServerData(lockKey)
-	if err != nil {
-		return 0, err
+	if timeout == 0 {
+		timeout = 30
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	defer cancel()
+	return GetNetLockCtx(ctx, key)
+}
+
+/*
+GetNetLockCtx
+Acquire the network lock of key until ctx is done, returns promptly when ctx is cancelled.
+获取key的网络锁直到ctx结束，ctx取消时立即返回。
+*/
+func GetNetLockCtx(ctx context.Context, key string) (int32, *errs.Error) {
 	lockVal := rand.Int31()
-	lockStr := fmt.Sprintf("%v", lockVal)
-	if val == "" {
-		err = SetServerData(&KeyValExpire{Key: lockKey, Val: lockStr})
-		return lockVal, err
+	args := &KeyValExpire{Key: "lock_" + key, Val: fmt.Sprintf("%v", lockVal)}
+	wait := time.Millisecond * 5
+	for {
+		ok, err := SetServerDataNX(ctx, args)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return lockVal, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctxErr(ctx, "GetNetLock for %s", key)
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, time.Millisecond*200)
+	}
+}
+
+/*
+RenewNetLock
+Replace the payload and expiration of the network lock of key atomically while it's still held by lockVal, so
+metadata like the holder's node id and deadline is kept with the lock. Returns false if the lock was released or
+taken by another holder. The lock never expires when expire is 0.
+在key的网络锁仍由lockVal持有时，原子地替换其附带数据和过期时间，从而将持有者节点id、截止时间等元数据随锁保存。
+锁已释放或被其他持有者获取时返回false。expire为0时锁永不过期。
+*/
+func RenewNetLock(ctx context.Context, key string, lockVal int32, payload string, expire int) (bool, *errs.Error) {
+	args := &KeyLockRenew{Key: key, Token: lockVal, Payload: payload, ExpireSecs: expire}
+	if banServer != nil {
+		return banServer.RenewLock(args)
+	}
+	if banClient == nil {
+		return false, errs.NewMsg(core.ErrRunTime, "banClient not load")
 	}
+	return banClient.RenewLock(ctx, args)
+}
+
+/*
+WaitLockFree
+Wait until the network lock of key is released, without acquiring it. wait at most timeout secs (default 30)
+等待key的网络锁被释放，不获取锁。最多等待timeout秒（默认30）
+*/
+func WaitLockFree(key string, timeout int) *errs.Error {
 	if timeout == 0 {
 		timeout = 30
 	}
-	stopAt := btime.Time() + float64(timeout)
-	for btime.Time() < stopAt {
-		core.Sleep(time.Microsecond * 10)
-		val, err = GetServerData(lockKey)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	defer cancel()
+	return WaitLockFreeCtx(ctx, key)
+}
+
+/*
+WaitLockFreeCtx
+Poll the network lock of key with backoff until it's released or ctx is done, for barrier-style coordination.
+The lock may be taken by others again right after this returns.
+以退避轮询key的网络锁直到其被释放或ctx结束，用于屏障式协调。返回后锁可能立刻被其他人再次获取。
+*/
+func WaitLockFreeCtx(ctx context.Context, key string) *errs.Error {
+	wait := time.Millisecond * 5
+	for {
+		val, err := GetServerData("lock_" + key)
 		if err != nil {
-			return 0, err
+			return err
 		}
 		if val == "" {
-			err = SetServerData(&KeyValExpire{Key: lockKey, Val: lockStr})
-			return lockVal, err
+			return nil
 		}
+		select {
+		case <-ctx.Done():
+			return ctxErr(ctx, "WaitLockFree for %s", key)
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, time.Millisecond*200)
 	}
-	return 0, errs.NewMsg(core.ErrTimeout, "GetNetLock for %s", key)
 }
 
 func DelNetLock(key string, lockVal int32) *errs.Error {
@@ -752,9 +3167,40 @@ func DelNetLock(key string, lockVal int32) *errs.Error {
 		return err
 	}
 	lockStr := fmt.Sprintf("%v", lockVal)
-	if val == lockStr {
+	if lockToken(val) == lockStr {
 		return SetServerData(&KeyValExpire{Key: lockKey, Val: ""})
 	}
 	log.Info("del lock fail", zap.String("val", val), zap.Int32("exp", lockVal))
 	return nil
 }
+
+/*
+WithServerLock
+Run fn while holding the network lock of key, for read-modify-write of server data beyond SetServerDataNX and
+IncrServerData. Wait at most timeout secs (default 30) for the lock, which is always released after fn, even when fn
+fails or panics (the panic is raised again after releasing).
+持有key的网络锁运行fn，用于SetServerDataNX和IncrServerData之外的服务器数据读-改-写。最多等待timeout秒（默认30）获取锁，
+fn执行后总会释放锁，即使fn失败或panic（释放后重新抛出panic）。
+*/
+func WithServerLock(key string, timeout int, fn func() error) (err *errs.Error) {
+	lockVal, err := GetNetLock(key, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := DelNetLock(key, lockVal); err2 != nil {
+			log.Warn("release net lock fail", zap.String("key", key), zap.Error(err2))
+			if err == nil {
+				err = err2
+			}
+		}
+	}()
+	if err_ := fn(); err_ != nil {
+		var banErr *errs.Error
+		if errors.As(err_, &banErr) {
+			return banErr
+		}
+		return errs.New(core.ErrRunTime, err_)
+	}
+	return nil
+}
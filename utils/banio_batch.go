@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+)
+
+const (
+	CodecZlibBatch = "zlib-batch"
+
+	// codecBatch frame: the id byte, then one zlib stream of records, each is len(4, little endian) + encoded msg
+	// 帧首字节，后面是一个记录的zlib流，每条记录为 长度(4字节小端) + 编码后的消息
+	codecBatch = 0x03
+)
+
+// useBatch whether the peer negotiated zlib-batch 对端是否协商了zlib-batch
+func (c *BanConn) useBatch() bool {
+	caps := c.NegotiatedCaps()
+	return caps != nil && slices.Contains(caps.Codecs, CodecZlibBatch)
+}
+
+/*
+WriteBatch
+Write msgs in one frame, compressed together as one zlib stream, which shrinks many similar small msgs far better
+than compressing each. The peer dispatches them one by one in order. Msgs are written separately if the peer
+didn't negotiate zlib-batch.
+将msgs写入一个帧，作为一个zlib流一起压缩，对大量相似的小消息压缩效果远好于逐条压缩。对端按顺序逐条分发。
+对端未协商zlib-batch时逐条写入。
+*/
+func (c *BanConn) WriteBatch(msgs []*IOMsg) *errs.Error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if !c.useBatch() {
+		for _, msg := range msgs {
+			if err := c.WriteMsg(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if c.waitConn() == nil {
+		return errs.NewMsg(errs.CodeIOWriteFail, "write fail as disconnected")
+	}
+	var records []byte
+	format := c.msgFormat()
+	for _, msg := range msgs {
+		raw, err := encodeMsgAs(msg, format)
+		if err != nil {
+			return err
+		}
+		if _, err = c.checkOutFrame(msg.Action, raw, len(msg.RawData) > 0); err != nil {
+			return err
+		}
+		records = binary.LittleEndian.AppendUint32(records, uint32(len(raw)))
+		records = append(records, raw...)
+	}
+	frame, err := encodeBatch(records)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if !flowFreeActions[msg.Action] {
+			c.takeCredit(0)
+		}
+	}
+	return c.Write(frame, false)
+}
+
+// encodeBatch compress concatenated records as a codecBatch frame 将拼接的记录压缩为codecBatch帧
+func encodeBatch(records []byte) ([]byte, *errs.Error) {
+	if len(records) > MaxFrameSize {
+		return nil, errs.NewMsg(core.ErrNetWriteFail, "batch too large: %d > %d", len(records), MaxFrameSize)
+	}
+	return compressTo([]byte{codecBatch}, records)
+}
+
+// decodeBatch decompress a codecBatch frame once, and split it into encoded msgs 一次解压codecBatch帧并拆分为编码后的消息
+func decodeBatch(frame []byte, limit int) ([][]byte, *errs.Error) {
+	data, err := zlibDecompressTo(nil, frame[1:], limit)
+	if err != nil {
+		return nil, err
+	}
+	var res [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errs.NewMsg(core.ErrInvalidMsg, "truncated batch record header")
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size > len(data)-4 {
+			return nil, errs.NewMsg(core.ErrInvalidMsg, "truncated batch record: %d > %d", size, len(data)-4)
+		}
+		res = append(res, data[4:4+size])
+		data = data[4+size:]
+	}
+	return res, nil
+}
+
+/*
+parseBatch
+Decode all msgs of a codecBatch frame, the first is returned and the others are queued for later ReadMsg calls.
+The whole batch is rejected if any record is invalid.
+解码codecBatch帧的所有消息，返回第一条，其余排队供之后的ReadMsg调用。任一记录无效时拒绝整个批次。
+*/
+func (c *BanConn) parseBatch(frame []byte) (*IOMsgRaw, *errs.Error) {
+	records, err := decodeBatch(frame, c.maxDecompress())
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errs.NewMsg(core.ErrInvalidMsg, "empty batch")
+	}
+	msgs := make([]*IOMsgRaw, 0, len(records))
+	for _, data := range records {
+		msg, err := c.parseData(data)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	c.batchPend = append(c.batchPend, msgs[1:]...)
+	return msgs[0], nil
+}
+
+// popBatch return the next queued msg of a batch, nil if none 返回批次中下一条排队的消息，没有时返回nil
+func (c *BanConn) popBatch() *IOMsgRaw {
+	if len(c.batchPend) == 0 {
+		return nil
+	}
+	msg := c.batchPend[0]
+	c.batchPend[0] = nil
+	c.batchPend = c.batchPend[1:]
+	return msg
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+)
+
+type IOBenchArgs struct {
+	Addr      string
+	Clients   int       // Number of concurrent clients 并发客户端数量
+	Msgs      int       // Requests sent by each client 每个客户端发送的请求数
+	Size      int       // Payload bytes of each response 每个响应的数据字节数
+	Timeout   int       // Seconds to wait for each response 每个响应的等待秒数
+	Transport Transport // nil for DefaultTransport 为nil时使用DefaultTransport
+}
+
+type IOBenchResult struct {
+	Msgs      int // Succeed round trips 成功的往返次数
+	Fails     int
+	Cost      time.Duration
+	MsgPerSec float64
+	P50       time.Duration
+	P99       time.Duration
+	BytesOut  int64 // Bytes written to the wire by clients 客户端写入网络的字节数
+	BytesIn   int64 // Bytes read from the wire by clients 客户端从网络读取的字节数
+}
+
+func (r *IOBenchResult) String() string {
+	return fmt.Sprintf("msgs: %d, fails: %d, cost: %v, msg/s: %.1f, p50: %v, p99: %v, out: %d B, in: %d B",
+		r.Msgs, r.Fails, r.Cost, r.MsgPerSec, r.P50, r.P99, r.BytesOut, r.BytesIn)
+}
+
+type countTransport struct {
+	Transport
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+func (t *countTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countConn{Conn: conn, tr: t}, nil
+}
+
+type countConn struct {
+	net.Conn
+	tr *countTransport
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tr.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tr.out.Add(int64(n))
+	return n, err
+}
+
+/*
+RunIOBench
+Benchmark a running banio server: store a value of args.Size bytes, then each of args.Clients clients reads it
+args.Msgs times by onGetVal, so every round trip goes through the real encode/compress/frame/decompress path.
+对运行中的banio服务器进行基准测试：先存储一个args.Size字节的值，然后args.Clients个客户端各通过onGetVal读取args.Msgs次，
+每次往返都经过真实的编码/压缩/分帧/解压路径。
+*/
+func RunIOBench(args *IOBenchArgs) (*IOBenchResult, *errs.Error) {
+	if args.Clients <= 0 || args.Msgs <= 0 {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "clients and msgs should be positive")
+	}
+	tr := &countTransport{Transport: args.Transport}
+	if tr.Transport == nil {
+		tr.Transport = DefaultTransport
+	}
+	clients := make([]*ClientIO, 0, args.Clients)
+	defer func() {
+		for _, c := range clients {
+			c.stopped.Store(true)
+			_ = c.closeConn()
+		}
+	}()
+	for i := 0; i < args.Clients; i++ {
+		client, err := NewClientIOWith(args.Addr, tr)
+		if err != nil {
+			return nil, err
+		}
+		client.DoConnect = nil
+		go client.RunForever()
+		clients = append(clients, client)
+	}
+	// random letters, so compression is realistic rather than trivial 随机字母，使压缩效果接近真实而非过于理想
+	payload := make([]byte, args.Size)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := range payload {
+		payload[i] = byte('a' + rnd.Intn(26))
+	}
+	key := fmt.Sprintf("bench_%d", rnd.Int63())
+	val := string(payload)
+	err := clients[0].SetVal(&KeyValExpire{Key: key, Val: val, ExpireSecs: 600})
+	if err != nil {
+		return nil, err
+	}
+	// onSetVal has no reply, confirm it's stored before timing onSetVal无回复，计时前确认已存储
+	if got, err := clients[0].GetVal(key, args.Timeout); err != nil {
+		return nil, err
+	} else if got != val {
+		return nil, errs.NewMsg(core.ErrTimeout, "bench value not stored on %s", args.Addr)
+	}
+	tr.in.Store(0)
+	tr.out.Store(0)
+	costs := make([][]time.Duration, len(clients))
+	var fails atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, c *ClientIO) {
+			defer wg.Done()
+			arr := make([]time.Duration, 0, args.Msgs)
+			for j := 0; j < args.Msgs; j++ {
+				stamp := time.Now()
+				got, err := c.GetVal(key, args.Timeout)
+				if err != nil || got != val {
+					fails.Add(1)
+					continue
+				}
+				arr = append(arr, time.Since(stamp))
+			}
+			costs[i] = arr
+		}(i, client)
+	}
+	wg.Wait()
+	res := &IOBenchResult{
+		Fails:    int(fails.Load()),
+		Cost:     time.Since(start),
+		BytesOut: tr.out.Load(),
+		BytesIn:  tr.in.Load(),
+	}
+	all := make([]time.Duration, 0, args.Clients*args.Msgs)
+	for _, arr := range costs {
+		all = append(all, arr...)
+	}
+	res.Msgs = len(all)
+	if res.Msgs > 0 {
+		sort.Slice(all, func(i, j int) bool {
+			return all[i] < all[j]
+		})
+		res.P50 = all[(len(all)-1)*50/100]
+		res.P99 = all[(len(all)-1)*99/100]
+		res.MsgPerSec = float64(res.Msgs) / res.Cost.Seconds()
+	}
+	return res, nil
+}
+
+// NetConn allows setNoDelay to reach the wrapped conn 使setNoDelay能访问被包装的连接
+func (c *countConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/banbox/banbot/btime"
+)
+
+type cachedVal struct {
+	val    string
+	expire int64 // 13 digit timestamp 13位时间戳
+}
+
+/*
+CacheVal
+Cache GetVal results of key locally for ttl, so rarely changed values like configs don't cost a round-trip on each
+read. Values set by others are only seen after ttl, SetVal/SetValNX/IncrBy of this client invalidate the key at once.
+ttl <= 0 disables caching of key, keys are never cached by default.
+在本地缓存key的GetVal结果ttl时长，使配置等很少变化的值无需每次读取都往返服务器。其他客户端设置的值在ttl后才可见，
+本客户端的SetVal/SetValNX/IncrBy会立即使key失效。ttl<=0时禁用key的缓存，默认不缓存任何key。
+*/
+func (c *ClientIO) CacheVal(key string, ttl time.Duration) {
+	c.lockCache.Lock()
+	defer c.lockCache.Unlock()
+	delete(c.cache, key)
+	if ttl <= 0 {
+		delete(c.cacheTTLs, key)
+		return
+	}
+	if c.cacheTTLs == nil {
+		c.cacheTTLs = make(map[string]time.Duration)
+	}
+	c.cacheTTLs[key] = ttl
+}
+
+// getCached return the cached value of key if not expired, and the generation to store a fresh one 返回未过期的缓存值
+func (c *ClientIO) getCached(key string) (string, int64, bool) {
+	c.lockCache.Lock()
+	defer c.lockCache.Unlock()
+	item, ok := c.cache[key]
+	if ok && btime.TimeMS() < item.expire {
+		return item.val, c.cacheGen, true
+	}
+	if ok {
+		delete(c.cache, key)
+	}
+	return "", c.cacheGen, false
+}
+
+/*
+setCached
+Cache the value fetched from server, skipped if any key was invalidated since gen, as the response may be older than
+the write.
+缓存从服务器获取的值，若gen之后有key失效则跳过，因为响应可能早于写入。
+*/
+func (c *ClientIO) setCached(key, val string, gen int64) {
+	c.lockCache.Lock()
+	defer c.lockCache.Unlock()
+	ttl, ok := c.cacheTTLs[key]
+	if !ok || gen != c.cacheGen {
+		return
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]*cachedVal)
+	}
+	c.cache[key] = &cachedVal{val: val, expire: btime.TimeMS() + ttl.Milliseconds()}
+}
+
+func (c *ClientIO) invalidCache(key string) {
+	c.lockCache.Lock()
+	c.cacheGen += 1
+	delete(c.cache, key)
+	c.lockCache.Unlock()
+}
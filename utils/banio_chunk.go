@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/banbox/banbot/btime"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+var (
+	// ChunkSize bytes of each chunk sent by WriteChunked 由WriteChunked发送的每个分块的字节数
+	ChunkSize = 256 << 10
+	// MaxChunkedSize max bytes of a reassembled transfer, larger ones are dropped 重组后传输的最大字节数，超出的被丢弃
+	MaxChunkedSize = 1 << 30
+	// MaxPendingChunked max transfers being reassembled on a conn, the least recently updated one is dropped for a new
+	// one beyond it 单个连接上正在重组的最大传输数，超出时丢弃最久未更新的以接收新的
+	MaxPendingChunked = 16
+	// ChunkedTimeout partial transfers not updated within it are dropped 超过此时间未更新的未完成传输被丢弃
+	ChunkedTimeout = time.Minute
+)
+
+const (
+	chunkHeadLen = 15 // id(4) + seq(4) + total(4) + flags(1) + actionLen(2)
+	chunkFinal   = 0x01
+)
+
+// chunkBuf parts of a transfer received so far, by seq 某个传输已收到的分块，按seq索引
+type chunkBuf struct {
+	action string
+	parts  map[int][]byte
+	total  int
+	size   int
+	lastMS int64 // time of the latest chunk 最新分块的时间
+}
+
+// maxChunks max chunks of a transfer allowed by MaxChunkedSize 由MaxChunkedSize允许的单个传输最大分块数
+func maxChunks() int {
+	size := max(1, ChunkSize)
+	return max(1, (MaxChunkedSize+size-1)/size)
+}
+
+/*
+WriteChunked
+Send data of a large response, like a history snapshot, as a sequence of onChunk frames of ChunkSize, each framed
+and compressed on its own so neither side holds one giant frame. The last chunk carries the final marker. The
+peer reassembles them and calls its Listens of action with the whole data, as if sent by one binary msg.
+Each chunk: id(4) + seq(4) + total(4) + flags(1) + actionLen(2) + action + part
+将历史快照等大型响应的数据按ChunkSize拆分为一系列onChunk帧发送，每帧独立分帧和压缩，双方都无需持有一个巨大的帧。最后一个
+分块带有结束标记。对端重组后以完整数据调用其action对应的Listens，如同通过一条二进制消息发送。
+*/
+func (c *BanConn) WriteChunked(action string, data []byte) *errs.Error {
+	if len(action) > math.MaxUint16 {
+		return errs.NewMsg(core.ErrMarshalFail, "action too long: %d", len(action))
+	}
+	size := max(1, ChunkSize)
+	total := max(1, (len(data)+size-1)/size)
+	if int64(total) > math.MaxUint32 {
+		return errs.NewMsg(core.ErrMarshalFail, "too many chunks for %s: %d", action, total)
+	}
+	id := c.chunkSeq.Add(1)
+	for seq := 0; seq < total; seq++ {
+		part := data[seq*size : min(len(data), (seq+1)*size)]
+		head := make([]byte, chunkHeadLen, chunkHeadLen+len(action)+len(part))
+		binary.LittleEndian.PutUint32(head[0:], id)
+		binary.LittleEndian.PutUint32(head[4:], uint32(seq))
+		binary.LittleEndian.PutUint32(head[8:], uint32(total))
+		if seq == total-1 {
+			head[12] = chunkFinal
+		}
+		binary.LittleEndian.PutUint16(head[13:], uint16(len(action)))
+		raw := append(append(head, action...), part...)
+		if err := c.WriteMsg(&IOMsg{Action: "onChunk", RawData: raw}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+onChunk
+Store a chunk of WriteChunked, dispatch the reassembled data once all chunks arrived. Chunks may be handled out of
+order when AsyncHandles is set, so parts are kept by seq.
+保存WriteChunked的一个分块，所有分块到达后分发重组的数据。设置AsyncHandles时分块可能乱序处理，因此按seq保存。
+*/
+func (c *BanConn) onChunk(data []byte) {
+	if len(data) < chunkHeadLen {
+		log.Warn("got bad chunk", zap.String("remote", c.GetRemote()), zap.Int("len", len(data)))
+		return
+	}
+	id := binary.LittleEndian.Uint32(data[0:])
+	seq := int(binary.LittleEndian.Uint32(data[4:]))
+	total := int(binary.LittleEndian.Uint32(data[8:]))
+	final := data[12]&chunkFinal != 0
+	actLen := int(binary.LittleEndian.Uint16(data[13:]))
+	if len(data) < chunkHeadLen+actLen || seq >= total || total > maxChunks() || final != (seq == total-1) {
+		log.Warn("got bad chunk", zap.String("remote", c.GetRemote()), zap.Uint32("id", id), zap.Int("seq", seq),
+			zap.Int("total", total))
+		return
+	}
+	action := string(data[chunkHeadLen : chunkHeadLen+actLen])
+	part := data[chunkHeadLen+actLen:]
+	c.lockChunk.Lock()
+	curMS := btime.TimeMS()
+	buf, ok := c.chunks[id]
+	if !ok {
+		if c.chunks == nil {
+			c.chunks = make(map[uint32]*chunkBuf)
+		}
+		c.trimChunks(curMS)
+		buf = &chunkBuf{action: action, parts: make(map[int][]byte), total: total}
+		c.chunks[id] = buf
+	}
+	buf.lastMS = curMS
+	if buf.total != total || buf.action != action || buf.parts[seq] != nil {
+		delete(c.chunks, id)
+		c.lockChunk.Unlock()
+		log.Warn("chunk mismatch, drop transfer", zap.String("remote", c.GetRemote()), zap.Uint32("id", id),
+			zap.String("action", action), zap.Int("seq", seq))
+		return
+	}
+	buf.size += len(part)
+	if buf.size > MaxChunkedSize {
+		delete(c.chunks, id)
+		c.lockChunk.Unlock()
+		log.Warn("chunked transfer too large, drop", zap.String("remote", c.GetRemote()), zap.String("action", action),
+			zap.Int("size", buf.size))
+		return
+	}
+	// the read buffer may be reused, keep a copy 读缓冲区可能被复用，保留副本
+	buf.parts[seq] = append(make([]byte, 0, len(part)), part...)
+	if len(buf.parts) < total {
+		c.lockChunk.Unlock()
+		return
+	}
+	delete(c.chunks, id)
+	c.lockChunk.Unlock()
+	res := make([]byte, 0, buf.size)
+	for i := 0; i < total; i++ {
+		res = append(res, buf.parts[i]...)
+	}
+	handle := findHandle(c.Listens, action)
+	if handle == nil {
+		log.Info("unhandle chunked msg", zap.String("action", action))
+		return
+	}
+	handle(action, res)
+}
+
+/*
+trimChunks
+Drop partial transfers idle over ChunkedTimeout, then the least recently updated ones until there is room for a new
+one within MaxPendingChunked. Must be called with lockChunk held.
+丢弃空闲超过ChunkedTimeout的未完成传输，然后丢弃最久未更新的，直到在MaxPendingChunked内有空间接收新传输。须持有lockChunk调用。
+*/
+func (c *BanConn) trimChunks(curMS int64) {
+	for id, buf := range c.chunks {
+		if curMS-buf.lastMS > ChunkedTimeout.Milliseconds() {
+			delete(c.chunks, id)
+			log.Warn("chunked transfer timeout, drop", zap.String("remote", c.GetRemote()), zap.Uint32("id", id),
+				zap.String("action", buf.action))
+		}
+	}
+	for MaxPendingChunked > 0 && len(c.chunks) >= MaxPendingChunked {
+		var oldID uint32
+		var old *chunkBuf
+		for id, buf := range c.chunks {
+			if old == nil || buf.lastMS < old.lastMS {
+				oldID, old = id, buf
+			}
+		}
+		delete(c.chunks, oldID)
+		log.Warn("too many chunked transfers, drop the oldest", zap.String("remote", c.GetRemote()),
+			zap.Uint32("id", oldID), zap.String("action", old.action))
+	}
+}
+
+// resetChunks drop partial transfers of the last session, their rest never arrives 丢弃上个会话未完成的传输，其余分块不会再到达
+func (c *BanConn) resetChunks() {
+	c.lockChunk.Lock()
+	c.chunks = nil
+	c.lockChunk.Unlock()
+}
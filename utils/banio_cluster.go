@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"net"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+)
+
+/*
+ClusterClient
+Connect to several replicated ban servers. All requests stick to the primary server,
+and only fail over to the next live one when the primary is down.
+Reads of a key written by this client are routed to the server which accepted the write (read-your-writes).
+连接多个副本ban服务器。所有请求固定发往主服务器，仅当主服务器断开时才切换到下一个可用服务器。
+本客户端写入过的key，读取时路由到接受该写入的服务器（读己之写）。
+*/
+type ClusterClient struct {
+	Clients []*ClientIO
+	// Max keys whose writing client is remembered for read-your-writes, arbitrary ones are forgotten beyond it and
+	// read from the primary, default 10000
+	// 为读己之写记住写入客户端的最大key数，超出时任意遗忘一些，其读取走主服务器，默认10000
+	MaxOwners int
+	primary   int
+	owners    map[string]int // key -> index of the client accepted its write
+	lock      deadlock.Mutex
+}
+
+/*
+NewClusterClient
+Connect to all addrs, fail only when none is reachable. Servers down at start are kept and retried by the reconnect
+logic of ClientIO. The cluster clients are never registered as the global client.
+连接所有addrs，仅当全部不可达时失败。启动时宕机的服务器会保留，并由ClientIO的重连逻辑重试。集群客户端不会注册为全局客户端。
+*/
+func NewClusterClient(addrs []string) (*ClusterClient, *errs.Error) {
+	if len(addrs) == 0 {
+		return nil, errs.NewMsg(core.ErrInvalidAddr, "no addr for cluster client")
+	}
+	conns := make([]net.Conn, len(addrs))
+	dialed := 0
+	for i, addr := range addrs {
+		conn, err_ := DefaultTransport.Dial(addr)
+		if err_ != nil {
+			log.Warn("connect cluster server fail, retry later", zap.String("addr", addr), zap.Error(err_))
+			continue
+		}
+		conns[i] = conn
+		dialed += 1
+	}
+	if dialed == 0 {
+		return nil, errs.NewMsg(core.ErrNetConnect, "connect all cluster servers fail: %v", addrs)
+	}
+	res := &ClusterClient{owners: map[string]int{}, MaxOwners: 10000}
+	for i, addr := range addrs {
+		client := newClientIO(addr, DefaultTransport, conns[i])
+		go runClusterNode(client)
+		res.Clients = append(res.Clients, client)
+	}
+	return res, nil
+}
+
+// runClusterNode read from the client until it stops, connect first if its dial failed 从客户端读取直到停止，拨号失败时先连接
+func runClusterNode(client *ClientIO) {
+	var err *errs.Error
+	if client.getConn() == nil {
+		err = client.connect(nil)
+	}
+	if err == nil {
+		err = client.RunForever()
+	}
+	if err != nil {
+		log.Warn("cluster client stopped", zap.String("addr", client.Addr), zap.Error(err))
+	}
+}
+
+// Primary returns the sticky client, failing over to the next live one when it's down
+func (c *ClusterClient) Primary() *ClientIO {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Clients[c.pickPrimary()]
+}
+
+func (c *ClusterClient) pickPrimary() int {
+	num := len(c.Clients)
+	for i := 0; i < num; i++ {
+		idx := (c.primary + i) % num
+		if !c.Clients[idx].IsClosed() {
+			if idx != c.primary {
+				log.Warn("cluster client fail over", zap.String("from", c.Clients[c.primary].Addr),
+					zap.String("to", c.Clients[idx].Addr))
+				c.primary = idx
+			}
+			return idx
+		}
+	}
+	return c.primary
+}
+
+func (c *ClusterClient) SetVal(args *KeyValExpire) *errs.Error {
+	c.lock.Lock()
+	idx := c.pickPrimary()
+	c.lock.Unlock()
+	err := c.Clients[idx].SetVal(args)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if args.Val == "" {
+		delete(c.owners, args.Key)
+	} else {
+		if _, ok := c.owners[args.Key]; !ok && c.MaxOwners > 0 && len(c.owners) >= c.MaxOwners {
+			for key := range c.owners {
+				delete(c.owners, key)
+				break
+			}
+		}
+		c.owners[args.Key] = idx
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *ClusterClient) GetVal(key string, timeout int) (string, *errs.Error) {
+	c.lock.Lock()
+	idx, ok := c.owners[key]
+	if ok && c.Clients[idx].IsClosed() {
+		// the write may be lost with the server 写入可能已随服务器丢失
+		delete(c.owners, key)
+		ok = false
+	}
+	if !ok {
+		idx = c.pickPrimary()
+	}
+	c.lock.Unlock()
+	return c.Clients[idx].GetVal(key, timeout)
+}
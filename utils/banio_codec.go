@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings of http bodies HTTP响应体的内容编码
+const (
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate" // zlib stream, same as the banio zlib codec 即zlib流，与banio的zlib编码相同
+	EncodingIdentity = "identity"
+)
+
+// BodyEncodings supported content codings, preferred first when the client accepts them equally
+// 支持的内容编码，客户端同等接受时优先使用靠前的
+var BodyEncodings = []string{EncodingZstd, EncodingGzip, EncodingDeflate}
+
+var (
+	zstdEnc, _ = zstd.NewWriter(nil)
+	zstdDec, _ = zstd.NewReader(nil)
+)
+
+type bodyCodec struct {
+	encode func(dst, raw []byte) ([]byte, *errs.Error)
+	decode func(dst, src []byte) ([]byte, *errs.Error)
+}
+
+var bodyCodecs = map[string]*bodyCodec{
+	EncodingZstd:    {encode: zstdCompressTo, decode: zstdDecompressTo},
+	EncodingGzip:    {encode: gzipCompressTo, decode: gzipDecompressTo},
+	EncodingDeflate: {encode: compressTo, decode: zlibDecompressBody},
+}
+
+func zlibDecompressBody(dst, src []byte) ([]byte, *errs.Error) {
+	return zlibDecompressTo(dst, src, MaxFrameSize)
+}
+
+/*
+NegotiateEncoding
+Pick the content coding for the Accept-Encoding header: the highest q value among BodyEncodings, ties broken by
+the order of BodyEncodings. "*" matches all of them. Return EncodingIdentity when none is acceptable.
+根据Accept-Encoding头选择内容编码：BodyEncodings中q值最高的，q值相同时按BodyEncodings的顺序。"*"匹配所有编码。
+没有可接受的编码时返回EncodingIdentity。
+*/
+func NegotiateEncoding(accept string) string {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if v, err_ := strconv.ParseFloat(strings.TrimSpace(val), 64); err_ == nil {
+					q = v
+				}
+			}
+		}
+		quality[name] = q
+	}
+	cands := make([]string, 0, len(BodyEncodings))
+	scores := make(map[string]float64, len(BodyEncodings))
+	for _, enc := range BodyEncodings {
+		q, ok := quality[enc]
+		if !ok {
+			q, ok = quality["*"]
+		}
+		if ok && q > 0 {
+			cands = append(cands, enc)
+			scores[enc] = q
+		}
+	}
+	if len(cands) == 0 {
+		return EncodingIdentity
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return scores[cands[i]] > scores[cands[j]]
+	})
+	return cands[0]
+}
+
+/*
+EncodeBody
+Compress raw by the content coding and append to dst, EncodingIdentity appends raw as is.
+按内容编码压缩raw并追加到dst，EncodingIdentity时原样追加。
+*/
+func EncodeBody(dst, raw []byte, encoding string) ([]byte, *errs.Error) {
+	if encoding == EncodingIdentity || encoding == "" {
+		return append(dst, raw...), nil
+	}
+	codec, ok := bodyCodecs[encoding]
+	if !ok {
+		return nil, errs.NewMsg(core.ErrCompressFail, "unsupported encoding: %s", encoding)
+	}
+	return codec.encode(dst, raw)
+}
+
+/*
+DecodeBody
+Decompress src encoded by the content coding and append to dst, EncodingIdentity appends src as is.
+解压按内容编码压缩的src并追加到dst，EncodingIdentity时原样追加。
+*/
+func DecodeBody(dst, src []byte, encoding string) ([]byte, *errs.Error) {
+	if encoding == EncodingIdentity || encoding == "" {
+		return append(dst, src...), nil
+	}
+	codec, ok := bodyCodecs[encoding]
+	if !ok {
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "unsupported encoding: %s", encoding)
+	}
+	return codec.decode(dst, src)
+}
+
+func zstdCompressTo(dst []byte, data []byte) ([]byte, *errs.Error) {
+	return zstdEnc.EncodeAll(data, dst), nil
+}
+
+func zstdDecompressTo(dst []byte, src []byte) ([]byte, *errs.Error) {
+	res, err_ := zstdDec.DecodeAll(src, dst)
+	if err_ != nil {
+		return nil, errs.New(core.ErrDeCompressFail, err_)
+	}
+	return res, nil
+}
+
+func gzipCompressTo(dst []byte, data []byte) ([]byte, *errs.Error) {
+	b := bytes.NewBuffer(dst)
+	w := gzip.NewWriter(b)
+	_, err_ := w.Write(data)
+	if err_ != nil {
+		return nil, errs.New(core.ErrCompressFail, err_)
+	}
+	err_ = w.Close()
+	if err_ != nil {
+		return nil, errs.New(core.ErrCompressFail, err_)
+	}
+	return b.Bytes(), nil
+}
+
+func gzipDecompressTo(dst []byte, src []byte) ([]byte, *errs.Error) {
+	r, err_ := gzip.NewReader(bytes.NewReader(src))
+	if err_ != nil {
+		return nil, errs.New(core.ErrDeCompressFail, err_)
+	}
+	defer r.Close()
+	result := bytes.NewBuffer(dst)
+	_, err_ = io.Copy(result, r)
+	if err_ != nil {
+		return nil, errs.New(core.ErrIOReadFail, err_)
+	}
+	return result.Bytes(), nil
+}
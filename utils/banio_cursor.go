@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"strconv"
+
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+// CursorLoader load candles of a stream after sinceMS, in time order 按时间顺序加载流在sinceMS之后的K线
+type CursorLoader func(sinceMS int64) ([]*banexg.Kline, *errs.Error)
+
+// CursorReq sent by ReplayCursor to replay a stream after the cursor of the worker 由ReplayCursor发送，重放工作者游标之后的流
+type CursorReq struct {
+	Stream string `json:"stream"`
+	Worker string `json:"worker"`
+}
+
+// CursorBatch candles of a stream replayed by onCursorKlines 通过onCursorKlines重放的流的K线
+type CursorBatch struct {
+	Stream string          `json:"stream"`
+	Klines []*banexg.Kline `json:"klines"`
+}
+
+// CursorKey KV key of the cursor: the time of the last candle processed by worker in stream
+// 游标的KV键：worker在stream中处理的最后一根K线的时间
+func CursorKey(stream, worker string) string {
+	return "cursor_" + stream + "_" + worker
+}
+
+/*
+RegCursorStream
+Register the source of a stream replayed to workers by ReplayCursor, a previous one of the same stream is replaced.
+Call it before Serve.
+注册通过ReplayCursor向工作者重放的流的来源，同一流之前的来源会被替换。应在Serve之前调用。
+*/
+func (s *ServerIO) RegCursorStream(stream string, load CursorLoader) {
+	if s.cursorStreams == nil {
+		s.cursorStreams = make(map[string]CursorLoader)
+	}
+	s.cursorStreams[stream] = load
+}
+
+/*
+replayCursor
+Send candles of the stream after the cursor of the worker stored in the KV, by WriteChunked so a long history is not
+one giant frame. Candles not after the cursor are skipped, so none is processed twice.
+通过WriteChunked发送KV中存储的工作者游标之后的流K线，长历史不会成为一个巨大的帧。不在游标之后的K线被跳过，因此不会重复处理。
+*/
+func (s *ServerIO) replayCursor(conn *BanConn, req *CursorReq) {
+	load, ok := s.cursorStreams[req.Stream]
+	if !ok {
+		log.Warn("replay unknown cursor stream", zap.String("remote", conn.GetRemote()),
+			zap.String("stream", req.Stream))
+		return
+	}
+	sinceMS, _ := strconv.ParseInt(s.GetVal(CursorKey(req.Stream, req.Worker)), 10, 64)
+	klines, err := load(sinceMS)
+	if err != nil {
+		log.Warn("load cursor stream fail", zap.String("stream", req.Stream), zap.Error(err))
+		return
+	}
+	start := 0
+	for start < len(klines) && klines[start].Time <= sinceMS {
+		start += 1
+	}
+	data, err_ := MsgSerializer.Marshal(&CursorBatch{Stream: req.Stream, Klines: klines[start:]})
+	if err_ != nil {
+		log.Warn("marshal cursor klines fail", zap.String("stream", req.Stream), zap.Error(err_))
+		return
+	}
+	log.Info("replay cursor stream", zap.String("stream", req.Stream), zap.String("worker", req.Worker),
+		zap.Int64("since", sinceMS), zap.Int("num", len(klines)-start))
+	if err = conn.WriteChunked("onCursorKlines", data); err != nil {
+		log.Warn("send cursor klines fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+	}
+}
+
+/*
+ReplayCursor
+Ask the server to replay the stream from the cursor of worker, cb is called with the candles after the last
+checkpoint. The handler is shared by all streams and replaced by later calls, call it before RunForever.
+请求服务器从worker的游标重放流，以最近检查点之后的K线调用cb。所有流共用一个处理函数，后续调用会替换它，应在RunForever之前调用。
+*/
+func (c *ClientIO) ReplayCursor(stream, worker string, cb func(stream string, klines []*banexg.Kline)) *errs.Error {
+	c.Listens["onCursorKlines"] = func(action string, data []byte) {
+		var batch CursorBatch
+		err_ := MsgSerializer.Unmarshal(data, &batch)
+		if err_ != nil {
+			log.Warn("receive invalid cursor klines", zap.Int("len", len(data)), zap.Error(err_))
+			return
+		}
+		cb(batch.Stream, batch.Klines)
+	}
+	return c.WriteMsg(&IOMsg{Action: "onReplayCursor", Data: &CursorReq{Stream: stream, Worker: worker}})
+}
+
+/*
+Checkpoint
+Save timeMS as the cursor of worker in stream, the time of the last candle processed. Later ReplayCursor resumes
+after it. Checkpoints follow earlier msgs of the conn, but not of other conns.
+将timeMS保存为worker在stream中的游标，即处理的最后一根K线的时间。之后的ReplayCursor从其之后恢复。检查点在本连接之前的消息之后
+生效，但不保证在其他连接的消息之后。
+*/
+func (c *ClientIO) Checkpoint(stream, worker string, timeMS int64) *errs.Error {
+	return c.SetVal(&KeyValExpire{Key: CursorKey(stream, worker), Val: strconv.FormatInt(timeMS, 10)})
+}
+
+// LoadCursor the time of the last candle processed by worker in stream, 0 if never saved 返回worker在stream中处理的最后一根K线时间，从未保存时为0
+func LoadCursor(stream, worker string) (int64, *errs.Error) {
+	val, err := GetServerData(CursorKey(stream, worker))
+	if err != nil || val == "" {
+		return 0, err
+	}
+	res, err_ := strconv.ParseInt(val, 10, 64)
+	if err_ != nil {
+		return 0, errs.New(errs.CodeUnmarshalFail, err_)
+	}
+	return res, nil
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"slices"
+
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+)
+
+/*
+DerivedTag
+A tag computed on the server from broadcasts of Sources, like the total volume of a basket. Compute is called with
+each msg broadcast to any source, and the msg it returns is broadcast under Tag, so clients subscribe to the
+aggregate instead of every source.
+在服务器端由Sources的广播计算得到的tag，如一篮子品种的总成交量。Compute以任一来源的每条广播消息调用，其返回的消息以Tag广播，
+使客户端订阅聚合值而不是每个来源。
+*/
+type DerivedTag struct {
+	Tag     string
+	Sources []string
+	// Return the msg to broadcast for a source msg, nil to skip. Action defaults to Tag. Calls are serialized, so
+	// state of the aggregate can be kept in the closure
+	// 为来源消息返回要广播的消息，nil表示跳过。Action默认为Tag。调用是串行的，因此聚合状态可保存在闭包中
+	Compute func(msg *IOMsg) *IOMsg
+	server  *ServerIO
+	lock    deadlock.Mutex // Serialize Compute and the broadcast of its result 串行执行Compute及其结果的广播
+}
+
+/*
+Derive
+Register a derived tag computed from broadcasts of sources, see DerivedTag. A previous one of the same tag is
+replaced. A derived tag can be the source of another, but not of itself.
+注册由sources的广播计算的派生tag，见DerivedTag。同一tag之前的派生会被替换。派生tag可以作为其他派生的来源，但不能是自身的来源。
+*/
+func (s *ServerIO) Derive(tag string, sources []string, compute func(msg *IOMsg) *IOMsg) (*DerivedTag, *errs.Error) {
+	if len(sources) == 0 || compute == nil {
+		return nil, errs.NewMsg(errs.CodeParamRequired, "sources and compute are required for %s", tag)
+	}
+	if slices.Contains(sources, tag) {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "derived tag %s can't be its own source", tag)
+	}
+	d := &DerivedTag{Tag: tag, Sources: slices.Clone(sources), Compute: compute, server: s}
+	s.lockDerive.Lock()
+	defer s.lockDerive.Unlock()
+	s.removeDerived(tag)
+	if s.derived == nil {
+		s.derived = make(map[string][]*DerivedTag)
+	}
+	for _, src := range d.Sources {
+		s.derived[src] = append(s.derived[src], d)
+	}
+	return d, nil
+}
+
+// RemoveDerived stop computing the derived tag 停止计算该派生tag
+func (s *ServerIO) RemoveDerived(tag string) {
+	s.lockDerive.Lock()
+	s.removeDerived(tag)
+	s.lockDerive.Unlock()
+}
+
+// removeDerived lockDerive should be held 应持有lockDerive
+func (s *ServerIO) removeDerived(tag string) {
+	for src, arr := range s.derived {
+		arr = slices.DeleteFunc(arr, func(d *DerivedTag) bool {
+			return d.Tag == tag
+		})
+		if len(arr) == 0 {
+			delete(s.derived, src)
+		} else {
+			s.derived[src] = arr
+		}
+	}
+}
+
+// feedDerived pass a broadcast msg to derived tags of its tag 将广播消息传给以其tag为来源的派生tag
+func (s *ServerIO) feedDerived(msg *IOMsg) {
+	s.lockDerive.Lock()
+	arr := slices.Clone(s.derived[msg.Action])
+	s.lockDerive.Unlock()
+	for _, d := range arr {
+		d.feed(msg)
+	}
+}
+
+func (d *DerivedTag) feed(msg *IOMsg) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := d.Compute(msg)
+	if out == nil {
+		return
+	}
+	if out.Action == "" {
+		out.Action = d.Tag
+	}
+	if err := d.server.Broadcast(out); err != nil {
+		log.Warn("broadcast derived fail", zap.String("tag", d.Tag), zap.Error(err))
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"slices"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	CodecZlibDict = "zlib-dict"
+
+	// DictMaxSize max bytes of a warmup dictionary, zlib only looks back 32KB 预热字典的最大字节数，zlib只回看32KB
+	DictMaxSize = 32 << 10
+
+	// codecZlibDict frame: the id byte, then a zlib stream using the dictionary announced by onDict
+	// 帧首字节，后面是使用onDict宣告的字典的zlib流
+	codecZlibDict = 0x02
+)
+
+/*
+connDict
+Compression dictionaries of a conn. The sender samples its first DictWarmup msgs, then announces the dictionary
+built from them by an onDict msg, and compresses later frames with it under the codecZlibDict id. The frame id is
+the switch point, so frames before and after onDict decode alike.
+连接的压缩字典。发送方采样自身的前DictWarmup条消息，然后通过onDict消息宣告由其构建的字典，之后的帧用该字典压缩并
+以codecZlibDict标识。帧首字节即切换点，因此onDict前后的帧都能正常解码。
+*/
+type connDict struct {
+	samples []byte // Payloads sampled for the dictionary 为字典采样的数据
+	num     int    // Msgs sampled 已采样的消息数
+	send    []byte // Dictionary announced to the peer, nil during warmup 已宣告给对端的字典，预热期间为nil
+	recv    []byte // Dictionary announced by the peer 对端宣告的字典
+}
+
+// useDict whether warmup is enabled and the peer negotiated zlib-dict 是否启用预热且对端协商了zlib-dict
+func (c *BanConn) useDict() bool {
+	if c.DictWarmup <= 0 {
+		return false
+	}
+	caps := c.NegotiatedCaps()
+	return caps != nil && slices.Contains(caps.Codecs, CodecZlibDict)
+}
+
+/*
+resetDict
+Drop the sending dictionary and warm up again, called when a new session starts. The peer dictionary is dropped
+by trackDict when the peer says hello.
+丢弃发送字典并重新预热，新会话开始时调用。对端字典在对端发送hello时由trackDict丢弃。
+*/
+func (c *BanConn) resetDict() {
+	c.lockDict.Lock()
+	c.dict.samples = nil
+	c.dict.num = 0
+	c.dict.send = nil
+	c.lockDict.Unlock()
+}
+
+/*
+warmDict
+Return the dictionary to compress raw with, nil during warmup. raw is sampled during warmup, and the dictionary is
+announced to the peer once DictWarmup msgs are sampled. It's only used after onDict is written.
+返回压缩raw使用的字典，预热期间为nil。预热期间采样raw，采样满DictWarmup条后向对端宣告字典。仅在onDict写出后才使用。
+*/
+func (c *BanConn) warmDict(action string, raw []byte) []byte {
+	if flowFreeActions[action] || !c.useDict() {
+		return nil
+	}
+	c.lockDict.Lock()
+	defer c.lockDict.Unlock()
+	if c.dict.send != nil {
+		return c.dict.send
+	}
+	if c.dict.num < c.DictWarmup {
+		c.dict.samples = append(c.dict.samples, raw...)
+		if len(c.dict.samples) > DictMaxSize {
+			// zlib matches best against the tail of the dictionary 字典末尾的匹配效果最好
+			c.dict.samples = append(c.dict.samples[:0], c.dict.samples[len(c.dict.samples)-DictMaxSize:]...)
+		}
+		c.dict.num += 1
+		if c.dict.num < c.DictWarmup {
+			return nil
+		}
+	}
+	dict := c.dict.samples
+	frame, err := encodeMsg(&IOMsg{Action: "onDict", Data: dict})
+	if err == nil {
+		frame, err = encodeFrame(nil, frame, c.acceptsRaw())
+	}
+	if err == nil {
+		err = c.Write(frame, false)
+	}
+	if err != nil {
+		// retry with the next msg 下一条消息时重试
+		log.Warn("send dict fail", zap.String("remote", c.GetRemote()), zap.Error(err))
+		return nil
+	}
+	c.dict.send = dict
+	c.dict.samples = nil
+	return nil
+}
+
+/*
+encodeOut
+Compress a msg sent by WriteMsg, the warmup dictionary is used once announced.
+压缩WriteMsg发送的消息，字典宣告后即使用。
+*/
+func (c *BanConn) encodeOut(dst []byte, action string, raw []byte) ([]byte, *errs.Error) {
+	allowRaw := c.acceptsRaw()
+	dict := c.warmDict(action, raw)
+	if dict == nil || allowRaw && len(raw) < CompressMinSize {
+		return encodeFrame(dst, raw, allowRaw)
+	}
+	start := len(dst)
+	res, err := compressDictTo(append(dst, codecZlibDict), raw, dict)
+	if err != nil {
+		return nil, err
+	}
+	if allowRaw && float64(len(res)-start) > float64(len(raw))*CompressMaxRatio {
+		return append(append(res[:start], codecNone), raw...), nil
+	}
+	return res, nil
+}
+
+// decodeIn decompress a received frame, codecZlibDict frames use the dictionary of the peer 解压收到的帧
+func (c *BanConn) decodeIn(frame []byte) ([]byte, *errs.Error) {
+	if len(frame) == 0 || frame[0] != codecZlibDict {
+		res, err := decompressTo(nil, frame, c.maxDecompress())
+		if err != nil {
+			return c.legacyRaw(frame, err)
+		}
+		return res, nil
+	}
+	c.lockDict.Lock()
+	dict := c.dict.recv
+	c.lockDict.Unlock()
+	if dict == nil {
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "dict frame before onDict")
+	}
+	return zlibDecompressDict(nil, frame[1:], dict, c.maxDecompress())
+}
+
+// trackDict update the peer dictionary by received msgs, run in the read loop before later frames 根据收到的消息更新对端字典
+func (c *BanConn) trackDict(msg *IOMsgRaw) {
+	switch msg.Action {
+	case "hello", "onHello":
+		// the peer starts a new session 对端开始新会话
+		c.lockDict.Lock()
+		c.dict.recv = nil
+		c.lockDict.Unlock()
+	case "onDict":
+		var dict []byte
+		err_ := MsgSerializer.Unmarshal(msg.Data, &dict)
+		if err_ != nil || len(dict) == 0 {
+			log.Warn("invalid dict", zap.String("remote", c.GetRemote()), zap.Int("len", len(msg.Data)))
+			return
+		}
+		c.lockDict.Lock()
+		c.dict.recv = dict
+		c.lockDict.Unlock()
+	}
+}
+
+func compressDictTo(dst, data, dict []byte) ([]byte, *errs.Error) {
+	b := bytes.NewBuffer(dst)
+	w, err_ := zlib.NewWriterLevelDict(b, zlib.DefaultCompression, dict)
+	if err_ != nil {
+		return nil, errs.New(core.ErrCompressFail, err_)
+	}
+	_, err_ = w.Write(data)
+	if err_ != nil {
+		return nil, errs.New(core.ErrCompressFail, err_)
+	}
+	err_ = w.Close()
+	if err_ != nil {
+		return nil, errs.New(core.ErrCompressFail, err_)
+	}
+	return b.Bytes(), nil
+}
+
+func zlibDecompressDict(dst, src, dict []byte, limit int) ([]byte, *errs.Error) {
+	r, err_ := zlib.NewReaderDict(bytes.NewReader(src), dict)
+	if err_ != nil {
+		return nil, errs.New(core.ErrDeCompressFail, err_)
+	}
+	defer r.Close()
+	return readLimited(dst, r, limit)
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// DrainReason reason sent to conns, subscriptions and requests refused while draining 排空期间拒绝连接、订阅和请求时发送的原因
+	DrainReason = "draining, reconnect elsewhere"
+	// TagFullReason reason sent to subscriptions refused by MaxTagSubs 因MaxTagSubs拒绝订阅时发送的原因
+	TagFullReason = "too many subscribers of the tag"
+)
+
+// SubReject sent by onSubReject for tags refused to subscribe 通过onSubReject发送，包含被拒绝订阅的tag
+type SubReject struct {
+	Tags         []string `json:"tags"`
+	Reason       string   `json:"reason"`
+	RetryAfterMS int64    `json:"retryAfterMS,omitempty"` // Wait before reconnecting, 0 for no hint 重连前等待的毫秒数，0表示无提示
+}
+
+/*
+ReqReject
+Sent by onReqReject for a request action refused by the server, Key is the key the client waits the response by,
+empty for actions without a response.
+通过onReqReject发送，表示服务器拒绝的请求action，Key是客户端等待响应使用的键，无响应的action为空。
+*/
+type ReqReject struct {
+	Action       string `json:"action"`
+	Key          string `json:"key,omitempty"`
+	Reason       string `json:"reason"`
+	RetryAfterMS int64  `json:"retryAfterMS,omitempty"` // Wait before reconnecting, 0 for no hint 重连前等待的毫秒数，0表示无提示
+}
+
+/*
+SetDraining
+Enter or leave the draining mode before maintenance. While draining, new conns get onReject with DrainReason, live
+conns get onSubReject when subscribing new tags and onReqReject for requests (get/set/incr, lock and replay),
+established subscriptions keep receiving broadcasts.
+在维护前进入或退出排空模式。排空期间新连接收到带DrainReason的onReject，活跃连接订阅新tag时收到onSubReject，发送请求
+（读写、自增、锁和重放）时收到onReqReject，已有订阅继续接收广播。
+*/
+func (s *ServerIO) SetDraining(draining bool) {
+	if s.draining.Swap(draining) != draining {
+		log.Info("server draining changed", zap.String("name", s.Name), zap.Bool("draining", draining))
+	}
+}
+
+func (s *ServerIO) IsDraining() bool {
+	return s.draining.Load()
+}
+
+/*
+allowSubs
+Return tags conn may subscribe, and rejects for the others to send by onSubReject. While draining only tags it already
+has are kept, tags whose subscribers reached MaxTagSubs are refused too.
+返回conn可以订阅的tag，以及其他tag通过onSubReject发送的拒绝。排空期间仅保留其已订阅的tag，订阅者已达MaxTagSubs的tag也被拒绝。
+*/
+func (s *ServerIO) allowSubs(conn *BanConn, tags []string) ([]string, []*SubReject) {
+	var rejects []*SubReject
+	if s.IsDraining() {
+		allows := make([]string, 0, len(tags))
+		refused := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if conn.HasTag(tag) {
+				allows = append(allows, tag)
+			} else {
+				refused = append(refused, tag)
+			}
+		}
+		if len(refused) > 0 {
+			rejects = append(rejects, &SubReject{Tags: refused, Reason: DrainReason,
+				RetryAfterMS: s.RejectRetryAfter.Milliseconds()})
+		}
+		tags = allows
+	}
+	if len(s.MaxTagSubs) == 0 {
+		return tags, rejects
+	}
+	allows := make([]string, 0, len(tags))
+	var full []string
+	for _, tag := range tags {
+		limit := s.maxTagSubs(tag)
+		if limit > 0 && !conn.HasTag(tag) && s.tagSubNum(tag) >= limit {
+			full = append(full, tag)
+		} else {
+			allows = append(allows, tag)
+		}
+	}
+	if len(full) > 0 {
+		rejects = append(rejects, &SubReject{Tags: full, Reason: TagFullReason,
+			RetryAfterMS: s.RejectRetryAfter.Milliseconds()})
+	}
+	return allows, rejects
+}
+
+/*
+subscribeBy
+Subscribe tags allowed by allowSubs for conn by sub, and send onSubReject for the refused. Checks and subscriptions
+are serialized when MaxTagSubs is set, so concurrent subscribers never exceed the limit.
+通过sub为conn订阅allowSubs允许的tag，并为被拒绝的发送onSubReject。设置MaxTagSubs时检查和订阅串行执行，并发订阅者不会超出限制。
+*/
+func (s *ServerIO) subscribeBy(conn *BanConn, tags []string, sub func(tags []string)) {
+	capped := len(s.MaxTagSubs) > 0
+	if capped {
+		s.lockSubCap.Lock()
+	}
+	allows, rejects := s.allowSubs(conn, tags)
+	if len(allows) > 0 {
+		sub(allows)
+	}
+	if capped {
+		s.lockSubCap.Unlock()
+	}
+	for _, rej := range rejects {
+		if err := conn.WriteMsg(&IOMsg{Action: "onSubReject", Data: rej}); err != nil {
+			log.Warn("send sub reject fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+		}
+	}
+}
+
+/*
+refuseReq
+Send onReqReject with DrainReason for the request action while draining, returns whether it's refused. key is the
+key the client waits the response by.
+排空期间为请求action发送带DrainReason的onReqReject，返回是否已拒绝。key是客户端等待响应使用的键。
+*/
+func (s *ServerIO) refuseReq(conn *BanConn, action, key string) bool {
+	if !s.IsDraining() {
+		return false
+	}
+	rej := &ReqReject{Action: action, Key: key, Reason: DrainReason, RetryAfterMS: s.RejectRetryAfter.Milliseconds()}
+	if err := conn.WriteMsg(&IOMsg{Action: "onReqReject", Data: rej}); err != nil {
+		log.Warn("send req reject fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+	}
+	return true
+}
+
+// maxTagSubs max subscribers of tag by MaxTagSubs, 0 for unlimited 按MaxTagSubs返回tag的最大订阅者数，0表示不限制
+func (s *ServerIO) maxTagSubs(tag string) int {
+	if num, ok := s.MaxTagSubs[tag]; ok {
+		return num
+	}
+	num, matchLen := 0, -1
+	for prefix, limit := range s.MaxTagSubs {
+		if len(prefix) > matchLen && strings.HasPrefix(tag, prefix) {
+			num, matchLen = limit, len(prefix)
+		}
+	}
+	return num
+}
+
+// tagSubNum live conns subscribing tag 订阅tag的活跃连接数
+func (s *ServerIO) tagSubNum(tag string) int {
+	num := 0
+	for _, conn := range s.getConns() {
+		if !conn.IsClosed() && conn.HasTag(tag) {
+			num += 1
+		}
+	}
+	return num
+}
+
+func (c *BanConn) onSubReject(data []byte) {
+	var rej SubReject
+	err_ := MsgSerializer.Unmarshal(data, &rej)
+	if err_ != nil {
+		log.Warn("got bad sub reject", zap.ByteString("data", data))
+		return
+	}
+	log.Warn("subscribe refused", zap.String("remote", c.GetRemote()), zap.Strings("tags", rej.Tags),
+		zap.String("reason", rej.Reason))
+	if c.OnSubReject != nil {
+		c.OnSubReject(&rej)
+	}
+}
+
+func (c *BanConn) onReqReject(data []byte) *ReqReject {
+	var rej ReqReject
+	err_ := MsgSerializer.Unmarshal(data, &rej)
+	if err_ != nil {
+		log.Warn("got bad req reject", zap.ByteString("data", data))
+		return nil
+	}
+	log.Warn("request refused", zap.String("remote", c.GetRemote()), zap.String("action", rej.Action),
+		zap.String("key", rej.Key), zap.String("reason", rej.Reason))
+	if c.OnReqReject != nil {
+		c.OnReqReject(&rej)
+	}
+	return &rej
+}
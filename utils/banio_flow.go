@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+// FlowWait max wait for credits before a broadcast frame is dropped 广播帧被丢弃前等待额度的最长时间
+var FlowWait = time.Second * 10
+
+// control actions are never counted by flow control 控制消息不计入流控
+var flowFreeActions = map[string]bool{
+	"hello":   true,
+	"onHello": true,
+	"onAck":   true,
+	"onDict":  true,
+	"ping":    true,
+	"pong":    true,
+
+	"onStreamAck": true,
+}
+
+/*
+flowCredit
+Credit based flow control state of a conn. The peer advertises its receive window by hello, each frame sent
+takes one credit, and the peer returns credits by onAck after handling them.
+连接的基于额度的流控状态。对端通过hello通告接收窗口，每发送一帧占用一个额度，对端处理后通过onAck归还额度。
+*/
+type flowCredit struct {
+	outstanding int           // Frames sent but not acked yet 已发送未确认的帧数
+	freed       chan struct{} // Closed and replaced when credits return 额度归还时关闭并替换
+	recvNum     int           // Frames handled but not acked yet 已处理未确认的帧数
+}
+
+// peerWindow receive window of the peer, 0 for no flow control 对端的接收窗口，0表示不流控
+func (c *BanConn) peerWindow() int {
+	c.lockTag.Lock()
+	defer c.lockTag.Unlock()
+	if c.PeerCaps == nil {
+		return 0
+	}
+	return c.PeerCaps.Window
+}
+
+/*
+takeCredit
+Take one credit for sending a frame to the peer. Wait up to `wait` for credits to return when the window is full,
+return false on timeout. wait=0 takes it without waiting, used by replies which must not block.
+为发送一帧占用一个额度。窗口满时最多等待wait直到额度归还，超时返回false。wait=0时不等待直接占用，用于不能阻塞的回复。
+*/
+func (c *BanConn) takeCredit(wait time.Duration) bool {
+	return c.flow.take(&c.lockCredit, c.peerWindow(), wait)
+}
+
+// take one credit of window, guarded by lock, see BanConn.takeCredit 占用window中的一个额度，由lock保护
+func (f *flowCredit) take(lock sync.Locker, window int, wait time.Duration) bool {
+	if window <= 0 {
+		return true
+	}
+	var deadline <-chan time.Time
+	for {
+		lock.Lock()
+		if wait <= 0 || f.outstanding < window {
+			f.outstanding += 1
+			lock.Unlock()
+			return true
+		}
+		if f.freed == nil {
+			f.freed = make(chan struct{})
+		}
+		freed := f.freed
+		lock.Unlock()
+		if deadline == nil {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-freed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// ack return num credits and wake the waiters, guarded by lock 归还num个额度并唤醒等待者，由lock保护
+func (f *flowCredit) ack(lock sync.Locker, num int) {
+	lock.Lock()
+	f.outstanding = max(0, f.outstanding-num)
+	if f.freed != nil {
+		close(f.freed)
+		f.freed = nil
+	}
+	lock.Unlock()
+}
+
+// onAck return num credits taken by frames the peer has handled 归还对端已处理的帧占用的num个额度
+func (c *BanConn) onAck(num int) {
+	c.flow.ack(&c.lockCredit, num)
+}
+
+/*
+Credits
+Return frames sent but not acked by the peer, and the receive window of the peer (0 for no flow control).
+返回已发送但对端未确认的帧数，和对端的接收窗口（0表示不流控）。
+*/
+func (c *BanConn) Credits() (int, int) {
+	window := c.peerWindow()
+	c.lockCredit.Lock()
+	defer c.lockCredit.Unlock()
+	return c.flow.outstanding, window
+}
+
+/*
+consumed
+Called after a received frame is handled, ack the peer once half of RecvWindow is handled.
+收到的帧处理后调用，处理完RecvWindow的一半时向对端确认。
+*/
+func (c *BanConn) consumed(action string) {
+	if c.RecvWindow <= 0 || flowFreeActions[action] {
+		return
+	}
+	c.lockCredit.Lock()
+	c.flow.recvNum += 1
+	num := c.flow.recvNum
+	if num < max(1, c.RecvWindow/2) {
+		c.lockCredit.Unlock()
+		return
+	}
+	c.flow.recvNum = 0
+	c.lockCredit.Unlock()
+	err := c.WriteMsg(&IOMsg{Action: "onAck", Data: num})
+	if err != nil {
+		log.Warn("send ack fail", zap.String("remote", c.GetRemote()), zap.Error(err))
+	}
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// MinProtoVersion peers announcing a lower version fail the handshake 宣告低于此版本的对端握手失败
+	MinProtoVersion = 1
+
+	HandshakeAuth    = "auth"
+	HandshakeVersion = "version"
+	HandshakeCodec   = "codec"
+)
+
+/*
+HandshakeFail
+Sent by onHandshakeFail when the hello of the peer is refused. Kind is one of HandshakeAuth, HandshakeVersion and
+HandshakeCodec, none of them is fixed by reconnecting, so clients stop retrying.
+对端的hello被拒绝时通过onHandshakeFail发送。Kind为HandshakeAuth、HandshakeVersion、HandshakeCodec之一，重连均无法解决，
+因此客户端停止重试。
+*/
+type HandshakeFail struct {
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+}
+
+// Err the error of the failure, coded by Kind 失败对应的错误，错误码由Kind决定
+func (f *HandshakeFail) Err() *errs.Error {
+	code := core.ErrAuthFail
+	switch f.Kind {
+	case HandshakeVersion:
+		code = core.ErrVersionMismatch
+	case HandshakeCodec:
+		code = core.ErrCodecMismatch
+	}
+	return errs.NewMsg(code, "handshake fail: %s", f.Reason)
+}
+
+/*
+checkHello
+Check the hello of the peer: version, a common frame codec, and the token when token is not empty.
+检查对端的hello：版本、共同的帧编码，token非空时检查令牌。
+*/
+func checkHello(local, peer *ConnCaps, token string) *HandshakeFail {
+	if peer.Version < MinProtoVersion {
+		return &HandshakeFail{Kind: HandshakeVersion,
+			Reason: fmt.Sprintf("protocol version %d < %d", peer.Version, MinProtoVersion)}
+	}
+	common := false
+	for _, c := range []string{CodecZlib, CodecNone} {
+		if slices.Contains(local.Codecs, c) && slices.Contains(peer.Codecs, c) {
+			common = true
+			break
+		}
+	}
+	if !common {
+		return &HandshakeFail{Kind: HandshakeCodec, Reason: "no common frame codec"}
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(peer.Token), []byte(token)) != 1 {
+		return &HandshakeFail{Kind: HandshakeAuth, Reason: "invalid token"}
+	}
+	return nil
+}
+
+/*
+verifyHello
+Check the hello replied by conn against AuthToken. The failure is sent by onHandshakeFail before closing the conn,
+otherwise onHandshake is sent to end the handshake.
+根据AuthToken检查conn回复的hello。失败时先通过onHandshakeFail发送再关闭连接，否则发送onHandshake结束握手。
+*/
+func (s *ServerIO) verifyHello(conn *BanConn) {
+	conn.lockTag.Lock()
+	peer := conn.PeerCaps
+	conn.lockTag.Unlock()
+	if peer == nil {
+		return
+	}
+	fail := checkHello(conn.localCaps(), peer, s.AuthToken)
+	if fail == nil {
+		if err := conn.WriteMsg(&IOMsg{Action: "onHandshake"}); err != nil {
+			log.Warn("send handshake fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+		}
+		return
+	}
+	log.Warn("refuse client hello", zap.String("remote", conn.GetRemote()), zap.String("kind", fail.Kind),
+		zap.String("reason", fail.Reason))
+	if err := conn.WriteMsg(&IOMsg{Action: "onHandshakeFail", Data: fail}); err != nil {
+		log.Warn("send handshake fail", zap.String("remote", conn.GetRemote()), zap.Error(err))
+	}
+	// let the peer read it and close first, close anyway after a while 让对端先读取并关闭，一段时间后强制关闭
+	if cw, ok := conn.getConn().(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	time.AfterFunc(time.Second*3, func() {
+		_ = conn.closeConn()
+	})
+}
+
+// checkServerHello check the hello of the server, the conn is closed on failure 检查服务器的hello，失败时关闭连接
+func (c *BanConn) checkServerHello() *errs.Error {
+	c.lockTag.Lock()
+	peer := c.PeerCaps
+	c.lockTag.Unlock()
+	if peer == nil {
+		return nil
+	}
+	fail := checkHello(c.localCaps(), peer, "")
+	if fail == nil {
+		return nil
+	}
+	err := fail.Err()
+	log.Error("refuse server hello", zap.String("remote", c.GetRemote()), zap.Error(err))
+	c.setHandshakeErr(err)
+	if conn := c.getConn(); conn != nil {
+		// the read loop fails and connect stops on the error 读取循环失败，connect因该错误停止
+		_ = conn.Close()
+	}
+	return err
+}
+
+func (c *BanConn) onHandshakeFail(data []byte) {
+	var fail HandshakeFail
+	err_ := MsgSerializer.Unmarshal(data, &fail)
+	if err_ != nil {
+		log.Warn("got bad handshake fail", zap.ByteString("data", data))
+		return
+	}
+	err := fail.Err()
+	log.Error("handshake refused by server", zap.String("remote", c.GetRemote()), zap.Error(err))
+	c.setHandshakeErr(err)
+}
+
+func (c *BanConn) setHandshakeErr(err *errs.Error) {
+	c.lockTag.Lock()
+	c.handshakeErr = err
+	c.lockTag.Unlock()
+}
+
+// popHandshake take the handshake failure of the lost conn, it's not retryable 取出断开连接的握手失败，不可重试
+func (c *BanConn) popHandshake() *errs.Error {
+	c.lockTag.Lock()
+	err := c.handshakeErr
+	c.handshakeErr = nil
+	c.lockTag.Unlock()
+	return err
+}
+
+/*
+handshake
+Exchange hello with the server before the read loop starts, wait for onHandshake when the server announced it.
+Other msgs received meanwhile are kept for the read loop.
+在读取循环开始前与服务器交换hello，服务器宣告会确认时等待onHandshake。期间收到的其他消息保留给读取循环。
+*/
+func (c *ClientIO) handshake(timeout time.Duration) *errs.Error {
+	conn := c.getConn()
+	if conn == nil {
+		return errs.NewMsg(core.ErrNetConnect, "handshake fail as disconnected")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var pend []*IOMsgRaw
+	defer func() {
+		c.batchPend = append(pend, c.batchPend...)
+	}()
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return err
+		}
+		switch msg.Action {
+		case "hello":
+			c.onHello(msg.Data, true)
+			if err = c.checkServerHello(); err != nil {
+				return err
+			}
+			c.lockTag.Lock()
+			ack := c.PeerCaps != nil && c.PeerCaps.HandshakeAck
+			c.lockTag.Unlock()
+			if !ack {
+				return nil
+			}
+		case "onHandshake":
+			return nil
+		case "onHandshakeFail":
+			c.onHandshakeFail(msg.Data)
+			return c.popHandshake()
+		case "onReject":
+			c.onReject(msg.Data)
+			err, _ = c.popReject()
+			return err
+		default:
+			pend = append(pend, msg)
+		}
+	}
+}
+
+// ClientOpts options of NewClientIOOpts, applied before the handshake NewClientIOOpts的选项，在握手前应用
+type ClientOpts struct {
+	Transport Transport // nil for DefaultTransport 为空时使用DefaultTransport
+	Token     string    // Checked by ServerIO.AuthToken 由ServerIO.AuthToken检查
+	Caps      *ConnCaps
+	Role      string
+	Format    string
+	// Max wait for the handshake, default 10s 握手的最长等待时间，默认10秒
+	HandshakeTimeout time.Duration
+}
+
+/*
+NewClientIOOpts
+Same as NewClientIOWith, but also complete the handshake before returning, so a refused hello is returned as
+ErrAuthFail, ErrVersionMismatch or ErrCodecMismatch instead of a later connection error. These are never retried
+when reconnecting.
+同NewClientIOWith，但在返回前完成握手，因此被拒绝的hello以ErrAuthFail、ErrVersionMismatch或ErrCodecMismatch返回，而不是之后的
+连接错误。重连时这些错误不会重试。
+*/
+func NewClientIOOpts(addr string, opts *ClientOpts) (*ClientIO, *errs.Error) {
+	if opts == nil {
+		opts = &ClientOpts{}
+	}
+	tr := opts.Transport
+	if tr == nil {
+		tr = DefaultTransport
+	}
+	res, err := NewClientIOWith(addr, tr)
+	if err != nil {
+		return nil, err
+	}
+	res.AuthToken = opts.Token
+	res.Caps = opts.Caps
+	res.Role = opts.Role
+	res.Format = opts.Format
+	timeout := opts.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	// no reconnecting in the handshake 握手期间不重连
+	doConnect := res.DoConnect
+	res.DoConnect = nil
+	err = res.handshake(timeout)
+	res.DoConnect = doConnect
+	if err != nil {
+		_ = res.Close()
+		return nil, err
+	}
+	return res, nil
+}
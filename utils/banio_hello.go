@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"math"
+	"slices"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	ProtoVersion = 1
+
+	CodecZlib = "zlib"
+	CodecNone = "none"
+
+	FormatJson   = "json"
+	FormatBinary = "binary"
+)
+
+/*
+ConnCaps
+Capabilities of a peer, exchanged by hello messages right after connected
+对端的能力，连接后立刻通过hello消息交换
+*/
+type ConnCaps struct {
+	Version    int      `json:"version"`
+	Codecs     []string `json:"codecs"`       // Supported frame codecs, preferred first 支持的帧编码，优先的在前
+	Formats    []string `json:"formats"`      // Supported message formats 支持的消息格式
+	MaxMsgSize int      `json:"max_msg_size"` // Max accepted frame size, 0 for unlimited 接受的最大帧大小，0不限制
+	// Receive window for flow control, 0 for unlimited. Not negotiated, each side honors the peer's
+	// 流控的接收窗口，0不限制。不协商，各方遵守对端的
+	Window int `json:"window,omitempty"`
+	// Role of the side for coarse routing like trader, dashboard, see ServerIO.BroadcastToRole
+	// 该端的角色，用于粗粒度路由，如trader、dashboard，见ServerIO.BroadcastToRole
+	Role string `json:"role,omitempty"`
+	// Preferred format of msgs received, one of RegSerializer, empty for json. See BanConn.Format
+	// 接收消息的首选格式，为RegSerializer注册的格式之一，空表示json。见BanConn.Format
+	Format string `json:"format,omitempty"`
+	// Preferred codec of frames written and read by the side, CodecZlib or CodecNone, empty to follow Codecs. In
+	// the negotiated caps they are the codecs both sides agreed for each direction, see NegotiateCaps
+	// 该端写出和读取帧的首选编码，CodecZlib或CodecNone，空表示按Codecs。协商后的能力中为双方对每个方向约定的编码，见NegotiateCaps
+	WriteCodec string `json:"write_codec,omitempty"`
+	ReadCodec  string `json:"read_codec,omitempty"`
+	// Token of the client checked by ServerIO.AuthToken, see checkHello 客户端的令牌，由ServerIO.AuthToken检查，见checkHello
+	Token string `json:"token,omitempty"`
+	// Set by the server when it replies onHandshake or onHandshakeFail to the hello 服务器会对hello回复onHandshake或onHandshakeFail时设置
+	HandshakeAck bool `json:"handshake_ack,omitempty"`
+}
+
+func DefaultCaps() *ConnCaps {
+	return &ConnCaps{
+		Version: ProtoVersion,
+		Codecs:  []string{CodecZlib, CodecZlibDict, CodecZlibBatch, CodecNone},
+		Formats: append([]string{FormatJson, FormatBinary}, serialFormats()...),
+	}
+}
+
+/*
+NegotiateCaps
+Return capabilities supported by both sides: the lower version, the common codecs and formats in the order of local,
+the smaller non-zero max msg size. Format is the one of msgs sent by local: the peer preferred if local supports it,
+otherwise the local preferred if the peer supports it, so both sides agree on the format of each direction.
+WriteCodec and ReadCodec are the codecs of frames sent and received by local, see dirCodec.
+返回双方都支持的能力：较低的版本，按local顺序的共同编码和格式，较小的非零最大消息大小。Format为local发送消息的格式：local支持时
+为对端首选的，否则为对端支持的local首选的，因此双方对每个方向的格式达成一致。WriteCodec和ReadCodec为local发送和接收帧的编码，
+见dirCodec。
+*/
+func NegotiateCaps(local, peer *ConnCaps) *ConnCaps {
+	res := &ConnCaps{
+		Version:    min(local.Version, peer.Version),
+		MaxMsgSize: local.MaxMsgSize,
+	}
+	for _, c := range local.Codecs {
+		if slices.Contains(peer.Codecs, c) {
+			res.Codecs = append(res.Codecs, c)
+		}
+	}
+	for _, f := range local.Formats {
+		if slices.Contains(peer.Formats, f) {
+			res.Formats = append(res.Formats, f)
+		}
+	}
+	if peer.MaxMsgSize > 0 && (res.MaxMsgSize == 0 || peer.MaxMsgSize < res.MaxMsgSize) {
+		res.MaxMsgSize = peer.MaxMsgSize
+	}
+	if peer.Format != "" && slices.Contains(local.Formats, peer.Format) {
+		res.Format = peer.Format
+	} else if local.Format != "" && slices.Contains(peer.Formats, local.Format) {
+		res.Format = local.Format
+	}
+	res.WriteCodec = dirCodec(local, peer)
+	res.ReadCodec = dirCodec(peer, local)
+	return res
+}
+
+/*
+dirCodec
+Codec of frames sent from writer to reader: the writer's WriteCodec, or else the reader's ReadCodec, or else the
+first common codec of the writer. CodecNone is used only when both support it, otherwise CodecZlib.
+从writer发送到reader的帧编码：writer的WriteCodec，否则reader的ReadCodec，否则writer的第一个共同编码。仅当双方都支持时使用
+CodecNone，否则为CodecZlib。
+*/
+func dirCodec(writer, reader *ConnCaps) string {
+	pref := writer.WriteCodec
+	if pref == "" {
+		pref = reader.ReadCodec
+	}
+	if pref == "" {
+		for _, c := range writer.Codecs {
+			if slices.Contains(reader.Codecs, c) {
+				pref = c
+				break
+			}
+		}
+	}
+	if pref == CodecNone && slices.Contains(writer.Codecs, CodecNone) && slices.Contains(reader.Codecs, CodecNone) {
+		return CodecNone
+	}
+	return CodecZlib
+}
+
+func (c *BanConn) localCaps() *ConnCaps {
+	caps := DefaultCaps()
+	if c.Caps != nil {
+		copied := *c.Caps
+		caps = &copied
+	}
+	caps.Window = c.RecvWindow
+	if c.Role != "" {
+		caps.Role = c.Role
+	}
+	if c.Format != "" {
+		caps.Format = c.Format
+	}
+	if c.WriteCodec != "" {
+		caps.WriteCodec = c.WriteCodec
+	}
+	if c.ReadCodec != "" {
+		caps.ReadCodec = c.ReadCodec
+	}
+	if c.AuthToken != "" {
+		caps.Token = c.AuthToken
+	}
+	return caps
+}
+
+/*
+onHello
+Handle hello of the peer, store and negotiate capabilities, reply own capabilities when reply is set.
+处理对端的hello，保存并协商能力，reply为true时回复自身能力。
+*/
+func (c *BanConn) onHello(data []byte, reply bool) {
+	var peer ConnCaps
+	err_ := MsgSerializer.Unmarshal(data, &peer)
+	if err_ != nil {
+		log.Warn("invalid hello", zap.String("remote", c.GetRemote()), zap.String("raw", string(data)))
+		return
+	}
+	local := c.localCaps()
+	if reply {
+		err := c.WriteMsg(&IOMsg{Action: "onHello", Data: local})
+		if err != nil {
+			log.Warn("reply hello fail", zap.String("remote", c.GetRemote()), zap.Error(err))
+		}
+	}
+	c.lockTag.Lock()
+	c.PeerCaps = &peer
+	c.Negotiated = NegotiateCaps(local, &peer)
+	c.lockTag.Unlock()
+	c.resetDict()
+	// a new session, credits of the previous one are void 新会话，之前的额度作废
+	c.onAck(math.MaxInt)
+	c.lockCredit.Lock()
+	c.flow.recvNum = 0
+	c.lockCredit.Unlock()
+	c.resetStreams()
+	c.resetChunks()
+}
+
+/*
+NegotiatedCaps
+Capabilities negotiated with the peer, nil before hello is exchanged.
+与对端协商的能力，交换hello前为nil。
+*/
+func (c *BanConn) NegotiatedCaps() *ConnCaps {
+	c.lockTag.Lock()
+	defer c.lockTag.Unlock()
+	return c.Negotiated
+}
+
+// PeerRole role announced by the peer in hello, empty before hello is exchanged 对端在hello中宣告的角色，交换hello前为空
+func (c *BanConn) PeerRole() string {
+	c.lockTag.Lock()
+	defer c.lockTag.Unlock()
+	if c.PeerCaps == nil {
+		return ""
+	}
+	return c.PeerCaps.Role
+}
+
+// writesRaw whether frames to the peer are negotiated to be uncompressed 发往对端的帧是否协商为不压缩
+func (c *BanConn) writesRaw() bool {
+	caps := c.NegotiatedCaps()
+	return caps != nil && caps.WriteCodec == CodecNone
+}
+
+// acceptsRaw whether the peer negotiated to accept uncompressed frames 对端是否协商接受未压缩帧
+func (c *BanConn) acceptsRaw() bool {
+	caps := c.NegotiatedCaps()
+	return caps != nil && slices.Contains(caps.Codecs, CodecNone)
+}
+
+/*
+checkOutFrame
+Check the encoded msg against the negotiated capabilities, return the codec to use.
+根据协商的能力检查编码后的消息，返回要使用的编码。
+*/
+func (c *BanConn) checkOutFrame(action string, raw []byte, binary bool) (byte, *errs.Error) {
+	caps := c.NegotiatedCaps()
+	if caps == nil {
+		return codecZlib, nil
+	}
+	if caps.MaxMsgSize > 0 && len(raw) > caps.MaxMsgSize {
+		return 0, errs.NewMsg(core.ErrNetWriteFail, "msg %s too large for peer: %d > %d",
+			action, len(raw), caps.MaxMsgSize)
+	}
+	if binary && !slices.Contains(caps.Formats, FormatBinary) {
+		return 0, errs.NewMsg(core.ErrNetWriteFail, "peer not support binary msg: %s", action)
+	}
+	if caps.WriteCodec == CodecNone {
+		return codecNone, nil
+	}
+	return codecZlib, nil
+}
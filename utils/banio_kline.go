@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+)
+
+const klineColNum = 6 // open, high, low, close, volume, info
+
+/*
+EncodeKlines
+Encode klines into a fixed column layout for binary broadcast, much cheaper than json for numeric data:
+count(uint32) + time(int64 x n) + open/high/low/close/volume/info(float64 x n each)
+将K线编码为固定列布局用于二进制广播，对纯数值数据比json更省：
+数量(uint32) + 时间(int64 x n) + open/high/low/close/volume/info(各float64 x n)
+*/
+func EncodeKlines(arr []*banexg.Kline) []byte {
+	num := len(arr)
+	res := make([]byte, 4+num*8*(klineColNum+1))
+	binary.LittleEndian.PutUint32(res, uint32(num))
+	pos := 4
+	for _, k := range arr {
+		binary.LittleEndian.PutUint64(res[pos:], uint64(k.Time))
+		pos += 8
+	}
+	for col := 0; col < klineColNum; col++ {
+		for _, k := range arr {
+			var v float64
+			switch col {
+			case 0:
+				v = k.Open
+			case 1:
+				v = k.High
+			case 2:
+				v = k.Low
+			case 3:
+				v = k.Close
+			case 4:
+				v = k.Volume
+			default:
+				v = k.Info
+			}
+			binary.LittleEndian.PutUint64(res[pos:], math.Float64bits(v))
+			pos += 8
+		}
+	}
+	return res
+}
+
+/*
+DecodeKlines
+Decode klines encoded by EncodeKlines
+解码EncodeKlines编码的K线
+*/
+func DecodeKlines(data []byte) ([]*banexg.Kline, *errs.Error) {
+	if len(data) < 4 {
+		return nil, errs.NewMsg(core.ErrInvalidBars, "kline data too short: %d", len(data))
+	}
+	num := int(binary.LittleEndian.Uint32(data))
+	if (len(data)-4)/8/(klineColNum+1) != num || (len(data)-4)%(8*(klineColNum+1)) != 0 {
+		return nil, errs.NewMsg(core.ErrInvalidBars, "kline data size mismatch, num: %d, len: %d", num, len(data))
+	}
+	res := make([]*banexg.Kline, num)
+	items := make([]banexg.Kline, num)
+	pos := 4
+	for i := range items {
+		items[i].Time = int64(binary.LittleEndian.Uint64(data[pos:]))
+		res[i] = &items[i]
+		pos += 8
+	}
+	for col := 0; col < klineColNum; col++ {
+		for i := range items {
+			v := math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+			pos += 8
+			k := &items[i]
+			switch col {
+			case 0:
+				k.Open = v
+			case 1:
+				k.High = v
+			case 2:
+				k.Low = v
+			case 3:
+				k.Close = v
+			case 4:
+				k.Volume = v
+			default:
+				k.Info = v
+			}
+		}
+	}
+	return res, nil
+}
+
+/*
+NewKlinesMsg
+Build an IOMsg carrying klines in binary layout, subscribers decode Data with DecodeKlines
+构建以二进制布局携带K线的IOMsg，订阅者使用DecodeKlines解码Data
+*/
+func NewKlinesMsg(action string, arr []*banexg.Kline) *IOMsg {
+	return &IOMsg{Action: action, RawData: EncodeKlines(arr)}
+}
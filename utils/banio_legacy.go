@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+/*
+isLegacyRaw
+Whether a frame without a known codec id looks like an uncompressed msg of a legacy peer: a valid json msg, or a
+binary msg whose action fits the frame. Codec ids never clash with '{' or msgFlagBinary.
+没有已知编解码id的帧是否像旧版本对端发送的未压缩消息：有效的json消息，或action在帧长度内的二进制消息。编解码id不会与'{'或
+msgFlagBinary冲突。
+*/
+func isLegacyRaw(frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	switch frame[0] {
+	case '{':
+		return json.Valid(frame)
+	case msgFlagBinary:
+		return len(frame) >= 3 && len(frame) >= 3+int(binary.LittleEndian.Uint16(frame[1:3]))
+	}
+	return false
+}
+
+/*
+legacyRaw
+Take a frame failed to decompress as uncompressed when it looks like a legacy one, so peers sending raw frames during
+a rolling upgrade keep working. Logged once per conn as a warning, later ones at debug level.
+解压失败的帧看起来像旧版本帧时按未压缩处理，使滚动升级期间发送原始帧的对端继续工作。每个连接以警告记录一次，之后以debug级别记录。
+*/
+func (c *BanConn) legacyRaw(frame []byte, err *errs.Error) ([]byte, *errs.Error) {
+	if !isLegacyRaw(frame) {
+		return nil, err
+	}
+	if len(frame) > c.maxDecompress() {
+		return nil, errs.NewMsg(core.ErrDeCompressFail, "decompressed size exceeds %d", c.maxDecompress())
+	}
+	if c.legacyLogged.CompareAndSwap(false, true) {
+		log.Warn("decompress fail, read as uncompressed legacy frame", zap.String("remote", c.GetRemote()),
+			zap.Int("len", len(frame)), zap.Error(err))
+	} else {
+		log.Debug("read uncompressed legacy frame", zap.String("remote", c.GetRemote()), zap.Int("len", len(frame)))
+	}
+	// the read buffer may be reused, keep a copy 读缓冲区可能被复用，保留副本
+	return append(make([]byte, 0, len(frame)), frame...), nil
+}
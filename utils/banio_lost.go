@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+// lostMsg a broadcast frame buffered for a lost subscriber 为断开的订阅者缓存的广播帧
+type lostMsg struct {
+	frame []byte
+	msg   *IOMsg
+}
+
+/*
+lostSub
+Broadcasts buffered for a named subscriber whose conn was lost, delivered when a conn declares the same name before
+expireMS.
+为连接断开的具名订阅者缓存的广播，在expireMS前有连接声明相同名称时送达。
+*/
+type lostSub struct {
+	tags     map[string]bool
+	rawTags  map[string]bool // Tags subscribed by SubscribeRaw 通过SubscribeRaw订阅的tag
+	msgs     []*lostMsg
+	expireMS int64
+}
+
+// lostBufSize max broadcasts of tag buffered for a lost subscriber, by LostBuffer 按LostBuffer为断开的订阅者缓存tag的最大广播数
+func (s *ServerIO) lostBufSize(tag string) int {
+	if size, ok := s.LostBuffer[tag]; ok {
+		return size
+	}
+	size, matchLen := 0, -1
+	for prefix, num := range s.LostBuffer {
+		if len(prefix) > matchLen && strings.HasPrefix(tag, prefix) {
+			size, matchLen = num, len(prefix)
+		}
+	}
+	return size
+}
+
+/*
+trackLost
+Start buffering for named conns just found closed, unless a live conn of the same name is back already. All tags
+are kept to restore on resume, conns without tags of LostBuffer are skipped. lockSnap should be held.
+为刚发现关闭的具名连接开始缓存，若相同名称的活跃连接已恢复则跳过。保留所有tag以便恢复时重新订阅，没有LostBuffer中tag的
+连接被跳过。应持有lockSnap。
+*/
+func (s *ServerIO) trackLost(closed, live []IBanConn) {
+	if len(s.LostBuffer) == 0 || len(closed) == 0 {
+		return
+	}
+	liveNames := make(map[string]bool, len(live))
+	for _, conn := range live {
+		if bc, ok := conn.(*BanConn); ok {
+			if name := bc.GetName(); name != "" {
+				liveNames[name] = true
+			}
+		}
+	}
+	for _, conn := range closed {
+		bc, ok := conn.(*BanConn)
+		if !ok {
+			continue
+		}
+		name := bc.GetName()
+		if name == "" || liveNames[name] {
+			continue
+		}
+		tags := make(map[string]bool)
+		rawTags := make(map[string]bool)
+		buffered := 0
+		bc.lockTag.Lock()
+		for tag := range bc.Tags {
+			tags[tag] = true
+			if bc.rawTags[tag] {
+				rawTags[tag] = true
+			}
+			if s.lostBufSize(tag) > 0 {
+				buffered += 1
+			}
+		}
+		bc.lockTag.Unlock()
+		if buffered == 0 {
+			continue
+		}
+		if s.lostSubs == nil {
+			s.lostSubs = make(map[string]*lostSub)
+		}
+		sub, ok := s.lostSubs[name]
+		if !ok {
+			sub = &lostSub{tags: tags, rawTags: rawTags}
+			s.lostSubs[name] = sub
+		} else {
+			for tag := range tags {
+				sub.tags[tag] = true
+				sub.rawTags[tag] = rawTags[tag]
+			}
+		}
+		sub.expireMS = s.nowMS() + s.LostGrace.Milliseconds()
+		log.Info("buffer broadcasts for lost client", zap.String("name", name), zap.Int("tags", buffered))
+	}
+}
+
+// lostSubsOf lost subscribers of tag not expired, expired ones are dropped. lockSnap should be held
+// 返回tag未过期的断开订阅者，删除已过期的。应持有lockSnap
+func (s *ServerIO) lostSubsOf(tag string) []*lostSub {
+	if len(s.lostSubs) == 0 {
+		return nil
+	}
+	curMS := s.nowMS()
+	var res []*lostSub
+	for name, sub := range s.lostSubs {
+		if curMS >= sub.expireMS {
+			log.Info("drop broadcasts of lost client", zap.String("name", name), zap.Int("num", len(sub.msgs)))
+			delete(s.lostSubs, name)
+			continue
+		}
+		if sub.tags[tag] && s.lostBufSize(tag) > 0 {
+			res = append(res, sub)
+		}
+	}
+	return res
+}
+
+// bufferLost append the frame of msg to the lost subscribers, the oldest of the tag is dropped beyond lostBufSize
+// 将msg的帧追加到断开的订阅者，超出lostBufSize时丢弃该tag最早的
+func (s *ServerIO) bufferLost(subs []*lostSub, frame []byte, msg *IOMsg) {
+	if len(subs) == 0 {
+		return
+	}
+	size := s.lostBufSize(msg.Action)
+	item := &lostMsg{frame: frame, msg: &IOMsg{Action: msg.Action, Priority: msg.Priority, Deadline: msg.Deadline}}
+	for _, sub := range subs {
+		sub.msgs = append(sub.msgs, item)
+		num, first := 0, -1
+		for i, m := range sub.msgs {
+			if m.msg.Action == msg.Action {
+				num += 1
+				if first < 0 {
+					first = i
+				}
+			}
+		}
+		if num > size {
+			sub.msgs = append(sub.msgs[:first], sub.msgs[first+1:]...)
+		}
+	}
+}
+
+/*
+resumeLost
+Called when conn declares its name, restore subscriptions of the lost conn of the same name and queue the buffered
+broadcasts ahead of later ones, re-encoded for conn by replayFrame.
+连接声明名称时调用，恢复同名断开连接的订阅，并将缓存的广播排在之后的广播之前，通过replayFrame为conn重新编码。
+*/
+func (s *ServerIO) resumeLost(conn *BanConn) {
+	s.lockSnap.Lock()
+	defer s.lockSnap.Unlock()
+	name := conn.GetName()
+	sub, ok := s.lostSubs[name]
+	if !ok {
+		return
+	}
+	delete(s.lostSubs, name)
+	if s.nowMS() >= sub.expireMS {
+		return
+	}
+	tags := make([]string, 0, len(sub.tags))
+	rawTags := make([]string, 0, len(sub.rawTags))
+	for tag := range sub.tags {
+		if sub.rawTags[tag] {
+			rawTags = append(rawTags, tag)
+		} else {
+			tags = append(tags, tag)
+		}
+	}
+	conn.Subscribe(tags...)
+	conn.subscribeRaw(rawTags)
+	for _, m := range sub.msgs {
+		frame, err := conn.replayFrame(m.msg.Action, m.frame)
+		if err != nil {
+			log.Warn("encode lost broadcast fail", zap.String("name", name), zap.String("tag", m.msg.Action),
+				zap.Error(err))
+			continue
+		}
+		conn.enqueue(frame, m.msg)
+	}
+	log.Info("resume lost client", zap.String("name", name), zap.Int("msgs", len(sub.msgs)))
+}
@@ -0,0 +1,330 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+)
+
+/*
+Recorder
+Record received broadcasts of chosen tags to a file for offline replay.
+Each record is: received time in ms (int64) + payload length (uint32) + encoded IOMsg.
+将选定tag收到的广播记录到文件，用于离线回放。
+每条记录为：接收时间毫秒(int64) + 数据长度(uint32) + 编码后的IOMsg。
+*/
+type Recorder struct {
+	Num    int // Number of recorded messages 已记录的消息数
+	tags   map[string]bool
+	file   *os.File
+	writer *bufio.Writer
+	lock   deadlock.Mutex
+}
+
+/*
+NewRecorder
+Subscribe tags on the client and record the received messages to path. Call Close to flush the file.
+It installs handlers on the client, so call it before client.RunForever.
+在客户端上订阅tags并将收到的消息记录到path。调用Close刷新文件。
+它会在客户端上安装处理函数，因此需在client.RunForever之前调用。
+*/
+func NewRecorder(client *ClientIO, path string, tags ...string) (*Recorder, *errs.Error) {
+	file, err_ := os.Create(path)
+	if err_ != nil {
+		return nil, errs.New(core.ErrIOWriteFail, err_)
+	}
+	res := &Recorder{
+		tags:   make(map[string]bool),
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+	for _, tag := range tags {
+		res.tags[tag] = true
+		if _, ok := client.Listens[tag]; !ok {
+			// avoid "unhandle msg" logs, messages are taken by OnMsg
+			client.Listens[tag] = func(string, []byte) {}
+		}
+	}
+	prevOnMsg := client.OnMsg
+	client.OnMsg = func(msg *IOMsgRaw) {
+		if prevOnMsg != nil {
+			prevOnMsg(msg)
+		}
+		if res.tags[msg.Action] {
+			res.write(msg)
+		}
+	}
+	err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: tags})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *Recorder) write(msg *IOMsgRaw) {
+	raw, err := encodeMsg(rawToMsg(msg))
+	if err != nil {
+		log.Warn("record msg fail", zap.String("action", msg.Action), zap.Error(err))
+		return
+	}
+	r.writeRecord(msg.Action, raw)
+}
+
+func (r *Recorder) writeRecord(action string, payload []byte) {
+	head := make([]byte, 12)
+	binary.LittleEndian.PutUint64(head, uint64(time.Now().UnixMilli()))
+	binary.LittleEndian.PutUint32(head[8:], uint32(len(payload)))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.writer == nil {
+		return
+	}
+	_, err_ := r.writer.Write(head)
+	if err_ == nil {
+		_, err_ = r.writer.Write(payload)
+	}
+	if err_ != nil {
+		log.Warn("write record fail", zap.String("action", action), zap.Error(err_))
+		return
+	}
+	r.Num += 1
+}
+
+func (r *Recorder) Close() *errs.Error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.writer == nil {
+		return nil
+	}
+	err_ := r.writer.Flush()
+	r.writer = nil
+	if err2 := r.file.Close(); err_ == nil {
+		err_ = err2
+	}
+	if err_ != nil {
+		return errs.New(core.ErrIOWriteFail, err_)
+	}
+	return nil
+}
+
+// rawToMsg convert a received message back to IOMsg which encodes to the same payload
+func rawToMsg(msg *IOMsgRaw) *IOMsg {
+	if msg.Binary {
+		return &IOMsg{Action: msg.Action, RawData: msg.Data}
+	}
+	return &IOMsg{Action: msg.Action, Data: json.RawMessage(msg.Data)}
+}
+
+/*
+ReplayFile
+Broadcast recorded messages through server. speed scales the original timing: 1 for original,
+2 for twice as fast, <= 0 to replay without waiting. Returns the number of replayed messages.
+通过server广播记录的消息。speed缩放原始时间间隔：1为原速，2为两倍速，<=0为不等待。返回回放的消息数。
+*/
+func ReplayFile(ctx context.Context, path string, server *ServerIO, speed float64) (int, *errs.Error) {
+	return replayRecords(ctx, path, server, speed, decodeMsg)
+}
+
+/*
+ReplayRawFile
+Same as ReplayFile, for files of NewRawRecorder, each frame is decoded by the normal path before broadcasting.
+同ReplayFile，用于NewRawRecorder的文件，每帧广播前按常规路径解码。
+*/
+func ReplayRawFile(ctx context.Context, path string, server *ServerIO, speed float64) (int, *errs.Error) {
+	return replayRecords(ctx, path, server, speed, func(frame []byte) (*IOMsgRaw, *errs.Error) {
+		return (&RawFrame{Frame: frame}).Decode()
+	})
+}
+
+func replayRecords(ctx context.Context, path string, server *ServerIO, speed float64,
+	decode func(data []byte) (*IOMsgRaw, *errs.Error)) (int, *errs.Error) {
+	file, err_ := os.Open(path)
+	if err_ != nil {
+		return 0, errs.New(core.ErrIOReadFail, err_)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	head := make([]byte, 12)
+	num := 0
+	var lastMS int64
+	for {
+		_, err_ = io.ReadFull(reader, head)
+		if err_ == io.EOF {
+			return num, nil
+		} else if err_ != nil {
+			return num, errs.New(core.ErrIOReadFail, err_)
+		}
+		timeMS := int64(binary.LittleEndian.Uint64(head))
+		size := binary.LittleEndian.Uint32(head[8:])
+		if int64(size) > int64(MaxFrameSize) {
+			return num, errs.NewMsg(core.ErrInvalidMsg, "record too large at %d: %d", num, size)
+		}
+		raw := make([]byte, size)
+		if _, err_ = io.ReadFull(reader, raw); err_ != nil {
+			return num, errs.New(core.ErrIOReadFail, err_)
+		}
+		msg, err := decode(raw)
+		if err != nil {
+			return num, err
+		}
+		if speed > 0 && lastMS > 0 && timeMS > lastMS {
+			wait := time.Duration(float64(timeMS-lastMS)/speed) * time.Millisecond
+			select {
+			case <-ctx.Done():
+				return num, ctxErr(ctx, "replay %s", path)
+			case <-time.After(wait):
+			}
+		}
+		lastMS = timeMS
+		if err = server.Broadcast(rawToMsg(msg)); err != nil {
+			return num, err
+		}
+		num += 1
+	}
+}
+
+/*
+RawFrame
+A broadcast delivered by SubscribeRaw as the compressed frame sent by the server, so an archival client can store it
+as-is without decompressing and compressing again. Codec is the first byte of Frame, see decompressTo.
+通过SubscribeRaw投递的广播，为服务器发送的压缩帧，使归档客户端可原样存储而无需解压再压缩。Codec为Frame的首字节，见decompressTo。
+*/
+type RawFrame struct {
+	Action string
+	Codec  byte
+	Frame  []byte
+}
+
+// Decode decompress and decode the frame to the msg, the same as a normal received one 解压并解码为消息，与常规接收的相同
+func (f *RawFrame) Decode() (*IOMsgRaw, *errs.Error) {
+	data, err := decompressTo(nil, f.Frame, MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMsg(data)
+}
+
+/*
+SubscribeRaw
+Subscribe the tags and receive their broadcasts by OnRawFrame still compressed, instead of Listens. Subscribe or
+unsubscribe the tag to switch back.
+订阅这些tag，通过OnRawFrame接收仍为压缩状态的广播，而不是Listens。重新subscribe或unsubscribe该tag以切换回来。
+*/
+func (c *ClientIO) SubscribeRaw(tags ...string) *errs.Error {
+	return c.WriteMsg(&IOMsg{Action: "subscribeRaw", Data: tags})
+}
+
+// subscribeRaw subscribe tags delivered as raw frames 订阅以原始帧投递的tag
+func (c *BanConn) subscribeRaw(tags []string) {
+	c.lockTag.Lock()
+	if c.rawTags == nil {
+		c.rawTags = make(map[string]bool)
+	}
+	for _, tag := range tags {
+		c.Tags[tag] = true
+		c.rawTags[tag] = true
+	}
+	c.lockTag.Unlock()
+}
+
+func (c *BanConn) isRawTag(tag string) bool {
+	c.lockTag.Lock()
+	ok := c.rawTags[tag]
+	c.lockTag.Unlock()
+	return ok
+}
+
+/*
+wrapRawFrame
+Build the onRawFrame frame carrying the compressed broadcast frame of action.
+Payload: actionLen(2) + action + frame
+构建携带action压缩广播帧的onRawFrame帧。
+*/
+func wrapRawFrame(action string, frame []byte, allowRaw bool) ([]byte, *errs.Error) {
+	if len(action) > math.MaxUint16 {
+		return nil, errs.NewMsg(core.ErrMarshalFail, "action too long: %d", len(action))
+	}
+	data := make([]byte, 2, 2+len(action)+len(frame))
+	binary.LittleEndian.PutUint16(data, uint16(len(action)))
+	data = append(append(data, action...), frame...)
+	raw, err := encodeMsg(&IOMsg{Action: "onRawFrame", RawData: data})
+	if err != nil {
+		return nil, err
+	}
+	// the frame is compressed already, avoid compressing again when the peer allows
+	// 帧已压缩，对端允许时避免再次压缩
+	return encodeFrame(nil, raw, allowRaw)
+}
+
+func (c *BanConn) onRawFrame(data []byte) {
+	if len(data) < 2 {
+		log.Warn("got bad raw frame", zap.String("remote", c.GetRemote()), zap.Int("len", len(data)))
+		return
+	}
+	actLen := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+actLen+1 {
+		log.Warn("got bad raw frame", zap.String("remote", c.GetRemote()), zap.Int("len", len(data)))
+		return
+	}
+	frame := data[2+actLen:]
+	res := &RawFrame{
+		Action: string(data[2 : 2+actLen]),
+		Codec:  frame[0],
+		// the read buffer may be reused, keep a copy 读缓冲区可能被复用，保留副本
+		Frame: append(make([]byte, 0, len(frame)), frame...),
+	}
+	if c.OnRawFrame == nil {
+		log.Info("unhandle raw frame", zap.String("action", res.Action))
+		return
+	}
+	c.OnRawFrame(res)
+}
+
+/*
+NewRawRecorder
+Subscribe tags by SubscribeRaw and record the compressed frames as-is to path, without decompressing. Use
+ReplayRawFile to replay. Records have the same layout as NewRecorder with the frame as payload.
+Like NewRecorder, call it before client.RunForever.
+通过SubscribeRaw订阅tags，将压缩帧原样记录到path，无需解压。使用ReplayRawFile回放。记录布局同NewRecorder，数据为帧。
+与NewRecorder一样，需在client.RunForever之前调用。
+*/
+func NewRawRecorder(client *ClientIO, path string, tags ...string) (*Recorder, *errs.Error) {
+	file, err_ := os.Create(path)
+	if err_ != nil {
+		return nil, errs.New(core.ErrIOWriteFail, err_)
+	}
+	res := &Recorder{
+		tags:   make(map[string]bool),
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+	for _, tag := range tags {
+		res.tags[tag] = true
+	}
+	prevOnRaw := client.OnRawFrame
+	client.OnRawFrame = func(frame *RawFrame) {
+		if prevOnRaw != nil {
+			prevOnRaw(frame)
+		}
+		if res.tags[frame.Action] {
+			res.writeRecord(frame.Action, frame.Frame)
+		}
+	}
+	if err := client.SubscribeRaw(tags...); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return res, nil
+}
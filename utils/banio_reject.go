@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+/*
+ConnReject
+Sent by onReject before the server closes an accepted conn, so the client knows why and when to retry.
+服务器关闭已接受的连接前通过onReject发送，使客户端知道原因和何时重试。
+*/
+type ConnReject struct {
+	Reason       string `json:"reason"`
+	RetryAfterMS int64  `json:"retryAfterMS,omitempty"` // Wait before reconnecting, 0 for no hint 重连前等待的毫秒数，0表示无提示
+}
+
+// liveConnNum number of conns not closed 未关闭的连接数
+func (s *ServerIO) liveConnNum() int {
+	s.lockConns.Lock()
+	defer s.lockConns.Unlock()
+	num := 0
+	for _, conn := range s.Conns {
+		if !conn.IsClosed() {
+			num += 1
+		}
+	}
+	return num
+}
+
+/*
+rejectConn
+Send onReject with the reason and RejectRetryAfter, then close the conn. The write side is closed first and the
+peer's pending data drained, so the close doesn't reset the conn before onReject is read.
+发送带原因和RejectRetryAfter的onReject，然后关闭连接。先关闭写端并读尽对端待处理的数据，避免onReject被读取前连接被重置。
+*/
+func (s *ServerIO) rejectConn(conn net.Conn, reason string) {
+	remote := conn.RemoteAddr().String()
+	log.Warn("reject client", zap.String("remote", remote), zap.String("reason", reason))
+	c := &BanConn{Conn: conn, Remote: remote, RemoteAddr: remote, Ready: true, ResyncMarker: s.ResyncMarker}
+	data := &ConnReject{Reason: reason, RetryAfterMS: s.RejectRetryAfter.Milliseconds()}
+	if err := c.WriteMsg(&IOMsg{Action: "onReject", Data: data}); err != nil {
+		log.Warn("send reject fail", zap.String("remote", remote), zap.Error(err))
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+		_, _ = io.Copy(io.Discard, conn)
+	}
+	_ = conn.Close()
+}
+
+func (c *BanConn) onReject(data []byte) {
+	var rej ConnReject
+	err_ := MsgSerializer.Unmarshal(data, &rej)
+	if err_ != nil {
+		log.Warn("got bad reject", zap.ByteString("data", data))
+		return
+	}
+	log.Warn("rejected by server", zap.String("remote", c.GetRemote()), zap.String("reason", rej.Reason),
+		zap.Int64("retryAfterMS", rej.RetryAfterMS))
+	c.lockTag.Lock()
+	c.reject = &rej
+	c.lockTag.Unlock()
+}
+
+/*
+popReject
+Take the onReject received before the conn was lost, returns it as an error for OnStateChange, and the retry hint.
+取出连接断开前收到的onReject，作为OnStateChange的错误返回，同时返回重试提示。
+*/
+func (c *BanConn) popReject() (*errs.Error, time.Duration) {
+	c.lockTag.Lock()
+	rej := c.reject
+	c.reject = nil
+	c.lockTag.Unlock()
+	if rej == nil {
+		return nil, 0
+	}
+	err := errs.NewMsg(core.ErrBusy, "rejected by %s: %s", c.GetRemote(), rej.Reason)
+	return err, time.Duration(rej.RetryAfterMS) * time.Millisecond
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+/*
+PublishJob
+Broadcast the msg returned by Produce to subscribers of Tag every Interval. A tick is skipped while the previous
+publish is still running.
+每隔Interval将Produce返回的消息广播给Tag的订阅者。上一次发布仍在运行时跳过本次。
+*/
+type PublishJob struct {
+	Tag      string
+	Interval time.Duration
+	// Return the msg to broadcast, nil to skip this tick. Action defaults to Tag
+	// 返回要广播的消息，nil跳过本次。Action默认为Tag
+	Produce func() *IOMsg
+	server  *ServerIO
+	stop    chan struct{}
+	running atomic.Bool
+	sent    atomic.Int64
+	skipped atomic.Int64
+}
+
+/*
+SchedulePublish
+Create a job publishing the result of produce to tag every interval, call Start to run it. A previous job of the
+same tag is stopped and replaced. A non-positive interval is rejected.
+创建一个每隔interval将produce的结果发布到tag的任务，调用Start运行。同一tag之前的任务会被停止并替换。interval非正数时被拒绝。
+*/
+func (s *ServerIO) SchedulePublish(tag string, interval time.Duration, produce func() *IOMsg) (*PublishJob, *errs.Error) {
+	if interval <= 0 {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "publish interval of %s should be positive: %v", tag, interval)
+	}
+	job := &PublishJob{Tag: tag, Interval: interval, Produce: produce, server: s}
+	s.lockPub.Lock()
+	if s.pubJobs == nil {
+		s.pubJobs = make(map[string]*PublishJob)
+	}
+	old := s.pubJobs[tag]
+	s.pubJobs[tag] = job
+	s.lockPub.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+	return job, nil
+}
+
+// Start run the job in background, no-op if it's running or Interval is not positive 在后台运行任务，已运行或Interval非正数时无操作
+func (j *PublishJob) Start() {
+	j.server.lockPub.Lock()
+	defer j.server.lockPub.Unlock()
+	if j.stop != nil {
+		return
+	}
+	if j.Interval <= 0 {
+		log.Error("skip publish job of non-positive interval", zap.String("tag", j.Tag),
+			zap.Duration("interval", j.Interval))
+		return
+	}
+	j.stop = make(chan struct{})
+	go j.loop(j.stop)
+}
+
+// Stop stop publishing, a publish in progress is not interrupted 停止发布，不中断进行中的发布
+func (j *PublishJob) Stop() {
+	j.server.lockPub.Lock()
+	defer j.server.lockPub.Unlock()
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+}
+
+// Counts return the number of publishes sent and ticks skipped 返回已发送的发布次数和跳过的次数
+func (j *PublishJob) Counts() (int64, int64) {
+	return j.sent.Load(), j.skipped.Load()
+}
+
+func (j *PublishJob) loop(stop chan struct{}) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !j.running.CompareAndSwap(false, true) {
+				j.skipped.Add(1)
+				continue
+			}
+			go j.publish()
+		}
+	}
+}
+
+func (j *PublishJob) publish() {
+	defer j.running.Store(false)
+	msg := j.Produce()
+	if msg == nil {
+		return
+	}
+	if msg.Action == "" {
+		msg.Action = j.Tag
+	}
+	if err := j.server.Broadcast(msg); err != nil {
+		log.Warn("scheduled publish fail", zap.String("tag", j.Tag), zap.Error(err))
+		return
+	}
+	j.sent.Add(1)
+}
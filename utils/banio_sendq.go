@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"container/heap"
+
+	"github.com/banbox/banbot/btime"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+// MaxSendQueue max frames queued for a conn, beyond it expired then the lowest priority ones are dropped, 0 for no limit
+// 每个连接最多排队的帧数，超出时先丢弃已过期的，再丢弃优先级最低的。0表示不限制
+var MaxSendQueue = 10000
+
+type sendItem struct {
+	frame    []byte
+	action   string
+	priority int
+	deadline int64 // 13 digit timestamp, 0 for never expire 13位时间戳，0表示不过期
+	seq      int64
+	done     func(err *errs.Error) // Called once the frame is written or dropped 帧写出或丢弃后调用
+}
+
+func (it *sendItem) finish(err *errs.Error) {
+	if it.done != nil {
+		it.done(err)
+	}
+}
+
+/*
+sendQueue
+Frames waiting to be sent to a conn, higher priority first, FIFO for the same priority.
+等待发送到连接的帧，优先级高的在前，同优先级先进先出。
+*/
+type sendQueue []*sendItem
+
+func (q sendQueue) Len() int { return len(q) }
+
+func (q sendQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q sendQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *sendQueue) Push(x any) { *q = append(*q, x.(*sendItem)) }
+
+func (q *sendQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+/*
+enqueue
+Queue a broadcast frame for the conn, a sender goroutine is started if none is running, and exits when the queue
+is drained. Frames beyond MaxSendQueue are dropped by trimSendQ.
+为连接排队一个广播帧，没有运行中的发送协程时启动一个，队列清空后退出。超出MaxSendQueue的帧由trimSendQ丢弃。
+*/
+func (c *BanConn) enqueue(frame []byte, msg *IOMsg) {
+	c.enqueueDone(frame, msg, nil)
+}
+
+// enqueueDone same as enqueue, done is called with the result once the frame is written or dropped 同enqueue，帧写出或丢弃后以结果调用done
+func (c *BanConn) enqueueDone(frame []byte, msg *IOMsg, done func(err *errs.Error)) {
+	c.lockSendQ.Lock()
+	c.sendSeq += 1
+	item := &sendItem{frame: frame, action: msg.Action, priority: msg.Priority, deadline: msg.Deadline,
+		seq: c.sendSeq, done: done}
+	expired, full := c.trimSendQ(item)
+	if full != item {
+		heap.Push(&c.sendQ, item)
+	}
+	start := !c.sending
+	c.sending = true
+	c.lockSendQ.Unlock()
+	for _, it := range expired {
+		it.finish(errs.NewMsg(core.ErrTimeout, "broadcast expired"))
+	}
+	if full != nil {
+		log.Warn("send queue full, drop broadcast", zap.String("remote", c.GetRemote()),
+			zap.String("action", full.action), zap.Int("max", MaxSendQueue))
+		full.finish(errs.NewMsg(core.ErrNetWriteFail, "send queue full"))
+	}
+	if start {
+		go c.drainSendQ()
+	}
+}
+
+/*
+trimSendQ
+Make room for item when sendQ reached MaxSendQueue: expired items are removed first, then the lowest priority one is
+dropped, which is item itself unless it has a higher priority. Returns the expired and the dropped. Should be called
+with lockSendQ.
+sendQ达到MaxSendQueue时为item腾出空间：先移除已过期的，再丢弃优先级最低的，除非item优先级更高否则丢弃的是item本身。
+返回已过期的和被丢弃的。应在持有lockSendQ时调用。
+*/
+func (c *BanConn) trimSendQ(item *sendItem) ([]*sendItem, *sendItem) {
+	if MaxSendQueue <= 0 || len(c.sendQ) < MaxSendQueue {
+		return nil, nil
+	}
+	var expired []*sendItem
+	curMS := btime.TimeMS()
+	live := c.sendQ[:0]
+	for _, it := range c.sendQ {
+		if it.deadline > 0 && curMS > it.deadline {
+			expired = append(expired, it)
+		} else {
+			live = append(live, it)
+		}
+	}
+	if len(expired) > 0 {
+		clear(c.sendQ[len(live):])
+		c.sendQ = live
+		heap.Init(&c.sendQ)
+	}
+	if len(c.sendQ) < MaxSendQueue {
+		return expired, nil
+	}
+	// the last one in the send order 发送顺序中最后的一个
+	worst := 0
+	for i := range c.sendQ {
+		if c.sendQ.Less(worst, i) {
+			worst = i
+		}
+	}
+	if item.priority <= c.sendQ[worst].priority {
+		return expired, item
+	}
+	return expired, heap.Remove(&c.sendQ, worst).(*sendItem)
+}
+
+func (c *BanConn) drainSendQ() {
+	for {
+		c.lockSendQ.Lock()
+		if len(c.sendQ) == 0 {
+			c.sending = false
+			c.lockSendQ.Unlock()
+			return
+		}
+		item := heap.Pop(&c.sendQ).(*sendItem)
+		c.lockSendQ.Unlock()
+		if item.deadline > 0 && btime.TimeMS() > item.deadline {
+			log.Debug("broadcast expired, drop", zap.String("remote", c.GetRemote()),
+				zap.String("action", item.action))
+			item.finish(errs.NewMsg(core.ErrTimeout, "broadcast expired"))
+			continue
+		}
+		if !c.takeCredit(FlowWait) {
+			log.Warn("flow window full, drop broadcast", zap.String("remote", c.GetRemote()),
+				zap.String("action", item.action))
+			item.finish(errs.NewMsg(core.ErrNetWriteFail, "flow window full"))
+			continue
+		}
+		err := c.Write(item.frame, false)
+		item.finish(err)
+		if err != nil {
+			// later frames would fail too, drop them 后续的帧也会失败，丢弃
+			c.lockSendQ.Lock()
+			dropped := c.sendQ
+			c.sendQ = nil
+			c.lockSendQ.Unlock()
+			for _, it := range dropped {
+				it.finish(err)
+			}
+			log.Warn("broadcast fail", zap.String("remote", c.GetRemote()),
+				zap.String("tag", item.action), zap.Int("dropped", len(dropped)), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/utils"
+)
+
+/*
+Serializer
+Encode and decode json messages of BanConn, the same one is used for reading and writing.
+BanConn的json消息编解码器，读写使用同一个。
+*/
+type Serializer interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// SonicSerializer encode by sonic, NaN/Inf floats are encoded as null 使用sonic编码，NaN/Inf编码为null
+type SonicSerializer struct{}
+
+func (SonicSerializer) Marshal(v any) ([]byte, error) {
+	return utils.Marshal(v)
+}
+
+func (SonicSerializer) Unmarshal(data []byte, v any) error {
+	return utils.Unmarshal(data, v, utils.JsonNumDefault)
+}
+
+// StdJsonSerializer encode by encoding/json, for interop with strict json peers 使用encoding/json编码，用于和严格json对端互通
+type StdJsonSerializer struct{}
+
+func (StdJsonSerializer) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (StdJsonSerializer) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+/*
+MsgSerializer
+Serializer for all messages of banio, should be set before any connection is made and be the same on both peers.
+A conn may negotiate another format registered by RegSerializer, see BanConn.Format.
+banio所有消息的编解码器，应在建立连接前设置，且两端一致。连接可协商使用RegSerializer注册的其他格式，见BanConn.Format。
+*/
+var MsgSerializer Serializer = SonicSerializer{}
+
+// msgFlagFormat the first byte of a msg encoded by a serializer of RegSerializer 由RegSerializer的编解码器编码的消息首字节
+const msgFlagFormat = 0x02
+
+// serializers registered by RegSerializer, keyed by format 通过RegSerializer注册的编解码器，以格式为键
+var serializers = map[string]Serializer{}
+
+/*
+RegSerializer
+Register a serializer of format which conns can negotiate by hello to use instead of MsgSerializer, see
+BanConn.Format. Should be called before any connection is made, on each side supporting the format.
+注册format格式的编解码器，连接可通过hello协商使用它代替MsgSerializer，见BanConn.Format。应在建立连接前于每个支持该格式的一端调用。
+*/
+func RegSerializer(format string, ser Serializer) *errs.Error {
+	if format == "" || format == FormatJson || format == FormatBinary || len(format) > 255 {
+		return errs.NewMsg(errs.CodeParamInvalid, "invalid serializer format: %s", format)
+	}
+	if ser == nil {
+		return errs.NewMsg(errs.CodeParamRequired, "serializer of %s is required", format)
+	}
+	serializers[format] = ser
+	return nil
+}
+
+// serialFormats formats of registered serializers, sorted 已注册编解码器的格式，已排序
+func serialFormats() []string {
+	res := make([]string, 0, len(serializers))
+	for format := range serializers {
+		res = append(res, format)
+	}
+	sort.Strings(res)
+	return res
+}
+
+/*
+encodeMsgAs
+Encode msg by the serializer of format: flag(1) + formatLen(1) + format + serialized IOMsg. The format is carried in
+each msg, so the peer decodes it without tracking when the format was switched. Binary msgs and the default format
+are encoded by encodeMsg.
+用format的编解码器编码msg：flag(1) + formatLen(1) + format + 序列化的IOMsg。每条消息都携带格式，因此对端解码时无需跟踪格式
+何时切换。二进制消息和默认格式由encodeMsg编码。
+*/
+func encodeMsgAs(msg *IOMsg, format string) ([]byte, *errs.Error) {
+	if format == "" || len(msg.RawData) > 0 {
+		return encodeMsg(msg)
+	}
+	ser, ok := serializers[format]
+	if !ok {
+		return nil, errs.NewMsg(core.ErrMarshalFail, "unknown serializer format: %s", format)
+	}
+	raw, err_ := ser.Marshal(*msg)
+	if err_ != nil {
+		return nil, errs.NewMsg(core.ErrMarshalFail, "marshal %s as %s fail: %v", msg.Action, format, err_)
+	}
+	res := make([]byte, 0, 2+len(format)+len(raw))
+	res = append(res, msgFlagFormat, byte(len(format)))
+	res = append(res, format...)
+	return append(res, raw...), nil
+}
+
+/*
+decodeFormatted
+Decode a msg of encodeMsgAs. Data is converted to json by MsgSerializer, so Listens handle it as usual.
+解码encodeMsgAs的消息。Data通过MsgSerializer转为json，因此Listens照常处理。
+*/
+func decodeFormatted(data []byte) (*IOMsgRaw, *errs.Error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, errs.NewMsg(errs.CodeUnmarshalFail, "formatted msg truncated: %d", len(data))
+	}
+	format := string(data[2 : 2+int(data[1])])
+	ser, ok := serializers[format]
+	if !ok {
+		return nil, errs.NewMsg(errs.CodeUnmarshalFail, "unknown serializer format: %s", format)
+	}
+	var msg struct {
+		Action string            `json:"action"`
+		Data   any               `json:"data"`
+		Stream string            `json:"stream,omitempty"`
+		Trace  map[string]string `json:"trace,omitempty"`
+	}
+	if err_ := ser.Unmarshal(data[2+int(data[1]):], &msg); err_ != nil {
+		return nil, errs.New(errs.CodeUnmarshalFail, err_)
+	}
+	raw, err_ := MsgSerializer.Marshal(msg.Data)
+	if err_ != nil {
+		return nil, errs.New(errs.CodeUnmarshalFail, err_)
+	}
+	return &IOMsgRaw{Action: msg.Action, Data: raw, Stream: msg.Stream, Trace: msg.Trace}, nil
+}
+
+// msgFormat format of msgs sent to the peer, empty for MsgSerializer 发送给对端的消息格式，空表示MsgSerializer
+func (c *BanConn) msgFormat() string {
+	caps := c.NegotiatedCaps()
+	if caps == nil || caps.Format == FormatJson {
+		return ""
+	}
+	return caps.Format
+}
+
+/*
+fmtFrames
+Frames of a broadcast msg in each format and codec of subscribers, each encoded once when first needed. The frame
+compressed as usual of the default format can be preset with the empty key.
+广播消息在订阅者各格式和编码下的帧，每种在首次需要时编码一次。默认格式常规压缩的帧可用空键预设。
+*/
+type fmtFrames struct {
+	msg      *IOMsg
+	allowRaw bool
+	frames   map[string][]byte
+}
+
+// get the frame in format, uncompressed when raw 获取format格式的帧，raw时不压缩
+func (f *fmtFrames) get(format string, raw bool) ([]byte, *errs.Error) {
+	key := format
+	if raw {
+		key = CodecNone + ":" + format
+	}
+	if frame, ok := f.frames[key]; ok {
+		return frame, nil
+	}
+	data, err := encodeMsgAs(f.msg, format)
+	if err != nil {
+		return nil, err
+	}
+	var frame []byte
+	if raw {
+		frame = append([]byte{codecNone}, data...)
+	} else if frame, err = encodeFrame(nil, data, f.allowRaw); err != nil {
+		return nil, err
+	}
+	if f.frames == nil {
+		f.frames = make(map[string][]byte)
+	}
+	f.frames[key] = frame
+	return frame, nil
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"container/list"
+	"math"
+
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+/*
+TagSnapshot
+Sent by onSnapshot ahead of the latest broadcast of the tag. Seq counts retained broadcasts of the tag, so the n-th
+live update after the snapshot has Seq+n. Has is false when nothing was broadcast yet or the latest one was dropped by
+MaxLastMsgs, and no tag msg follows.
+通过onSnapshot在tag最新广播之前发送。Seq为该tag保留的广播计数，快照后第n条实时更新的序号为Seq+n。尚无广播或最新广播已被
+MaxLastMsgs淘汰时Has为false，且后面没有tag消息。
+*/
+type TagSnapshot struct {
+	Tag string `json:"tag"`
+	Seq int64  `json:"seq"`
+	Has bool   `json:"has"`
+}
+
+/*
+subscribeSnap
+Subscribe the tags and queue the snapshot of each ahead of any later broadcast, broadcasts are held meanwhile so
+no update is missed or duplicated between the snapshot and live ones.
+订阅这些tag，并将每个tag的快照排在之后所有广播之前，期间广播被阻塞，因此快照与实时更新之间不会遗漏或重复。
+*/
+func (s *ServerIO) subscribeSnap(conn *BanConn, tags []string) {
+	s.lockSnap.Lock()
+	defer s.lockSnap.Unlock()
+	conn.Subscribe(tags...)
+	allowRaw := conn.acceptsRaw()
+	for _, tag := range tags {
+		s.lockMsgs.Lock()
+		last, has := s.lastMsgs[tag]
+		snap := &TagSnapshot{Tag: tag, Seq: s.lastSeqs[tag], Has: has}
+		s.lockMsgs.Unlock()
+		msg := &IOMsg{Action: "onSnapshot", Data: snap, Priority: math.MaxInt}
+		raw, err := encodeMsg(msg)
+		var frame []byte
+		if err == nil {
+			frame, err = encodeFrame(nil, raw, allowRaw)
+		}
+		if err != nil {
+			log.Warn("encode snapshot fail", zap.String("remote", conn.GetRemote()), zap.String("tag", tag),
+				zap.Error(err))
+			continue
+		}
+		// the top priority puts them before live updates queued later 最高优先级使其排在之后的实时更新前
+		conn.enqueue(frame, msg)
+		if !has {
+			continue
+		}
+		if last, err = conn.replayFrame(tag, last); err != nil {
+			log.Warn("encode snapshot fail", zap.String("remote", conn.GetRemote()), zap.String("tag", tag),
+				zap.Error(err))
+			continue
+		}
+		conn.enqueue(last, &IOMsg{Action: tag, Priority: math.MaxInt})
+	}
+}
+
+/*
+retainLast
+Retain frame as the latest broadcast of tag, tags beyond MaxLastMsgs are dropped from the least recently broadcast.
+The seq of a dropped tag is kept, so snapshots after it are still in order.
+保留frame作为tag的最新广播，超出MaxLastMsgs的tag从最久未广播的开始淘汰。被淘汰tag的序号保留，因此之后的快照仍然有序。
+*/
+func (s *ServerIO) retainLast(tag string, frame []byte) {
+	s.lockMsgs.Lock()
+	defer s.lockMsgs.Unlock()
+	if s.lastMsgs == nil {
+		s.lastMsgs = map[string][]byte{}
+		s.lastSeqs = map[string]int64{}
+	}
+	s.lastMsgs[tag] = frame
+	s.lastSeqs[tag] += 1
+	if s.lastOrder == nil {
+		s.lastOrder = list.New()
+		s.lastIdx = make(map[string]*list.Element)
+	}
+	if elem, ok := s.lastIdx[tag]; ok {
+		s.lastOrder.MoveToFront(elem)
+	} else {
+		s.lastIdx[tag] = s.lastOrder.PushFront(tag)
+	}
+	for s.MaxLastMsgs > 0 && len(s.lastMsgs) > s.MaxLastMsgs {
+		elem := s.lastOrder.Back()
+		old := s.lastOrder.Remove(elem).(string)
+		delete(s.lastIdx, old)
+		delete(s.lastMsgs, old)
+	}
+}
+
+/*
+replayFrame
+Re-encode a retained broadcast frame of action for conn. The frame was encoded for all subscribers at that time, so
+an uncompressed one is compressed when conn doesn't accept raw frames, and it's wrapped in onRawFrame like broadcast
+when conn subscribed the tag by SubscribeRaw.
+为conn重新编码action保留的广播帧。该帧是按当时所有订阅者编码的，因此conn不接受未压缩帧时压缩未压缩的帧；conn通过
+SubscribeRaw订阅该tag时，像广播一样包装为onRawFrame。
+*/
+func (c *BanConn) replayFrame(action string, frame []byte) ([]byte, *errs.Error) {
+	allowRaw := c.acceptsRaw()
+	if len(frame) > 0 && frame[0] == codecNone && !allowRaw {
+		var err *errs.Error
+		if frame, err = encodeFrame(nil, frame[1:], false); err != nil {
+			return nil, err
+		}
+	}
+	if c.isRawTag(action) {
+		return wrapRawFrame(action, frame, allowRaw)
+	}
+	return frame, nil
+}
+
+/*
+resume
+Resume broadcasts to conn, the latest broadcast of each subscribed tag is queued first when withLast. Broadcasts are
+held meanwhile, so none falls between the replayed ones and live ones.
+恢复向conn广播，withLast时先排队每个订阅tag的最新广播。期间广播被阻塞，因此重放的和实时的之间不会遗漏广播。
+*/
+func (s *ServerIO) resume(conn *BanConn, withLast bool) {
+	s.lockSnap.Lock()
+	defer s.lockSnap.Unlock()
+	if withLast {
+		conn.lockTag.Lock()
+		frames := make(map[string][]byte, len(conn.Tags))
+		s.lockMsgs.Lock()
+		for tag := range conn.Tags {
+			if raw, ok := s.lastMsgs[tag]; ok {
+				frames[tag] = raw
+			}
+		}
+		s.lockMsgs.Unlock()
+		conn.lockTag.Unlock()
+		for tag, raw := range frames {
+			frame, err := conn.replayFrame(tag, raw)
+			if err != nil {
+				log.Warn("encode last broadcast fail", zap.String("remote", conn.GetRemote()), zap.String("tag", tag),
+					zap.Error(err))
+				continue
+			}
+			// the top priority puts them before live updates queued later 最高优先级使其排在之后的实时更新前
+			conn.enqueue(frame, &IOMsg{Action: tag, Priority: math.MaxInt})
+		}
+	}
+	conn.Paused.Store(false)
+}
+
+/*
+SubscribeWithSnapshot
+Subscribe the tags and receive the latest broadcast of each at once, atomically on the server. OnSnapshot is
+called with the seq of each snapshot, then the tag msg is dispatched to Listens like live ones.
+订阅这些tag并立刻接收每个tag的最新广播，在服务器端原子执行。每个快照先以其序号调用OnSnapshot，然后tag消息像实时消息一样
+分发到Listens。
+*/
+func (c *ClientIO) SubscribeWithSnapshot(tags ...string) *errs.Error {
+	return c.WriteMsg(&IOMsg{Action: "subscribeSnap", Data: tags})
+}
+
+func (c *ClientIO) onSnapshot(action string, data []byte) {
+	var snap TagSnapshot
+	err_ := MsgSerializer.Unmarshal(data, &snap)
+	if err_ != nil {
+		log.Warn("receive invalid snapshot", zap.String("raw", string(data)), zap.Error(err_))
+		return
+	}
+	if c.OnSnapshot != nil {
+		c.OnSnapshot(&snap)
+	}
+}
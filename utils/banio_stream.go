@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"math"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+)
+
+// StreamWriteWait max wait for credits of a stream before BanStream.WriteMsg fails 流写入前等待额度的最长时间
+var StreamWriteWait = time.Second * 30
+
+/*
+BanStream
+A logical stream multiplexed over a BanConn, so independent concerns like klines, orders and control share one
+socket. Msgs of a stream are dispatched to its own Listens, and each stream has its own flow control by
+BanConn.StreamWindow, so a slow stream doesn't hold back others. Register Listens before the peer sends msgs.
+在BanConn上多路复用的逻辑流，使K线、订单、控制等相互独立的部分共享一个socket。流的消息分发到其自身的Listens，
+每个流按BanConn.StreamWindow独立流控，慢的流不会拖慢其他流。需在对端发送消息前注册Listens。
+*/
+type BanStream struct {
+	ID      string
+	Listens map[string]ConnCB
+	conn    *BanConn
+	flow    flowCredit
+	lock    deadlock.Mutex // Guard flow 保护flow
+}
+
+// streamAck data of onStreamAck, return Num credits of Stream 归还Stream的Num个额度
+type streamAck struct {
+	Stream string `json:"stream"`
+	Num    int    `json:"num"`
+}
+
+/*
+Stream
+Return the stream of id on this conn, created on first use. Both sides use the same id to talk on a stream.
+返回此连接上id对应的流，首次使用时创建。双方使用相同的id在流上通信。
+*/
+func (c *BanConn) Stream(id string) *BanStream {
+	c.lockStream.Lock()
+	defer c.lockStream.Unlock()
+	if s, ok := c.streams[id]; ok {
+		return s
+	}
+	if c.streams == nil {
+		c.streams = make(map[string]*BanStream)
+	}
+	s := &BanStream{ID: id, Listens: map[string]ConnCB{}, conn: c}
+	c.streams[id] = s
+	return s
+}
+
+func (c *BanConn) getStream(id string) *BanStream {
+	c.lockStream.Lock()
+	defer c.lockStream.Unlock()
+	return c.streams[id]
+}
+
+// resetStreams void credits of all streams when a new session starts 新会话开始时作废所有流的额度
+func (c *BanConn) resetStreams() {
+	c.lockStream.Lock()
+	streams := make([]*BanStream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.lockStream.Unlock()
+	for _, s := range streams {
+		s.flow.ack(&s.lock, math.MaxInt)
+		s.lock.Lock()
+		s.flow.recvNum = 0
+		s.lock.Unlock()
+	}
+}
+
+/*
+WriteMsg
+Send msg on the stream. Wait up to StreamWriteWait when StreamWindow msgs of the stream are not handled by the peer
+yet, and fail with ErrTimeout then. Binary msgs (RawData) are not supported.
+在流上发送消息。该流有StreamWindow条消息尚未被对端处理时最多等待StreamWriteWait，之后以ErrTimeout失败。不支持二进制消息(RawData)。
+*/
+func (s *BanStream) WriteMsg(msg *IOMsg) *errs.Error {
+	if !s.flow.take(&s.lock, s.conn.StreamWindow, StreamWriteWait) {
+		return errs.NewMsg(core.ErrTimeout, "wait credits of stream %s timeout", s.ID)
+	}
+	out := *msg
+	out.Stream = s.ID
+	err := s.conn.WriteMsg(&out)
+	if err != nil {
+		// never reaches the peer, so no ack returns it 不会到达对端，因此不会有确认归还额度
+		s.flow.ack(&s.lock, 1)
+	}
+	return err
+}
+
+/*
+Credits
+Return msgs of the stream sent but not handled by the peer, and the window (0 for no flow control).
+返回该流已发送但对端未处理的消息数，以及窗口大小（0表示不流控）。
+*/
+func (s *BanStream) Credits() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flow.outstanding, s.conn.StreamWindow
+}
+
+// consumed called after a msg of the stream is handled, ack the peer once half of StreamWindow is handled
+// 流的消息处理后调用，处理完StreamWindow的一半时向对端确认
+func (s *BanStream) consumed() {
+	if s == nil || s.conn.StreamWindow <= 0 {
+		return
+	}
+	s.lock.Lock()
+	s.flow.recvNum += 1
+	num := s.flow.recvNum
+	if num < max(1, s.conn.StreamWindow/2) {
+		s.lock.Unlock()
+		return
+	}
+	s.flow.recvNum = 0
+	s.lock.Unlock()
+	err := s.conn.WriteMsg(&IOMsg{Action: "onStreamAck", Data: &streamAck{Stream: s.ID, Num: num}})
+	if err != nil {
+		log.Warn("send stream ack fail", zap.String("remote", s.conn.GetRemote()), zap.String("stream", s.ID),
+			zap.Error(err))
+	}
+}
@@ -1,10 +1,36 @@
 package utils
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/banbox/banbot/btime"
 	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
 	"github.com/banbox/banexg/log"
+	"github.com/banbox/banexg/utils"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +41,7 @@ func TestBanServer(t *testing.T) {
 	go func() {
 		for {
 			time.Sleep(time.Millisecond * 300)
-			for _, conn := range server.Conns {
+			for _, conn := range server.getConns() {
 				if conn.IsClosed() {
 					continue
 				}
@@ -77,3 +103,4614 @@ func TestBanClient(t *testing.T) {
 	}
 	log.Info("lock val after del", zap.String("val", val))
 }
+
+func TestMaxReconnects(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	accepted := make(chan bool)
+	go func() {
+		conn, err_ := ln.Accept()
+		if err_ == nil {
+			_ = conn.Close()
+		}
+		_ = ln.Close()
+		close(accepted)
+	}()
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	dialNum := 0
+	doConnect := client.DoConnect
+	client.DoConnect = func(c *BanConn) {
+		dialNum += 1
+		doConnect(c)
+	}
+	var states []int
+	client.OnStateChange = func(c *BanConn, state int, err *errs.Error) {
+		states = append(states, state)
+	}
+	client.MaxReconnects = 3
+	client.RetryWait = time.Millisecond * 10
+	client.RefreshMS = 0
+	err = client.RunForeverCtx(context.Background())
+	if err == nil || err.Code != core.ErrNetConnect {
+		t.Fatalf("expect give up error, got %v", err)
+	}
+	if dialNum != 3 {
+		t.Fatalf("expect 3 dial attempts, got %d", dialNum)
+	}
+	if len(states) == 0 || states[len(states)-1] != ConnStateClosed {
+		t.Fatalf("expect closed state at last, got %v", states)
+	}
+	if !client.IsClosed() {
+		t.Fatal("client should be closed after give up")
+	}
+}
+
+func TestRetryImmediate(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	accepted := make(chan bool)
+	go func() {
+		conn, err_ := ln.Accept()
+		if err_ == nil {
+			_ = conn.Close()
+		}
+		_ = ln.Close()
+		close(accepted)
+	}()
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	var stamps []time.Time
+	doConnect := client.DoConnect
+	client.DoConnect = func(c *BanConn) {
+		stamps = append(stamps, time.Now())
+		doConnect(c)
+	}
+	client.MaxReconnects = 3
+	client.RetryWait = time.Millisecond * 200
+	client.RetryImmediate = true
+	client.RefreshMS = 0
+	start := time.Now()
+	err = client.RunForeverCtx(context.Background())
+	if err == nil || err.Code != core.ErrNetConnect {
+		t.Fatalf("expect give up error, got %v", err)
+	}
+	if len(stamps) != 3 {
+		t.Fatalf("expect 3 dial attempts, got %d", len(stamps))
+	}
+	if cost := stamps[0].Sub(start); cost > time.Millisecond*100 {
+		t.Fatalf("first retry should be immediate, waited %v", cost)
+	}
+	for i := 1; i < len(stamps); i++ {
+		if cost := stamps[i].Sub(stamps[i-1]); cost < time.Millisecond*180 {
+			t.Fatalf("retry %d should back off, waited %v", i+1, cost)
+		}
+	}
+	// default waits are capped by RetryMaxWait 默认等待时间受RetryMaxWait限制
+	conn := &BanConn{RetryMaxWait: time.Second}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if wait := conn.retryWait(attempt); wait != time.Second {
+			t.Fatalf("attempt %d should wait 1s, got %v", attempt, wait)
+		}
+	}
+}
+
+func TestDialWithoutConnLock(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	conn := &BanConn{Remote: "test", RetryImmediate: true}
+	conn.DoConnect = func(c *BanConn) {
+		close(dialing)
+		<-release
+		cn, _ := net.Pipe()
+		c.SetConn(cn)
+	}
+	done := make(chan *errs.Error, 1)
+	go func() {
+		done <- conn.connect(nil)
+	}()
+	<-dialing
+	// readers of the conn are not blocked by a slow dial 连接的读取者不被缓慢的拨号阻塞
+	checked := make(chan bool, 1)
+	go func() {
+		checked <- conn.IsClosed()
+	}()
+	select {
+	case closed := <-checked:
+		if !closed {
+			t.Fatal("conn should be closed while dialing")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("IsClosed blocked by dialing")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if conn.IsClosed() {
+		t.Fatal("conn should be ready after dialing")
+	}
+	_ = conn.closeConn()
+}
+
+func TestReconnectSpread(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	const num = 40
+	spread := time.Millisecond * 400
+	start := time.Now()
+	offsets := make([]time.Duration, num)
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		conn := &BanConn{Remote: "test", RetryImmediate: true, ReconnectSpread: spread,
+			JitterKey: fmt.Sprintf("client-%d", i)}
+		conn.DoConnect = func(c *BanConn) {
+			offsets[i] = time.Since(start)
+			cn, _ := net.Pipe()
+			c.SetConn(cn)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conn.connect(nil); err != nil {
+				t.Error(err)
+			}
+			_ = conn.closeConn()
+		}()
+	}
+	wg.Wait()
+	// all first attempts fall in the window, and each quarter of it has some
+	// 所有首次尝试都在窗口内，且每个四分之一区间都有
+	quarters := make([]int, 4)
+	for i, off := range offsets {
+		if off > spread+time.Millisecond*100 {
+			t.Fatalf("client %d dialed after the window: %v", i, off)
+		}
+		quarters[min(3, int(off*4/spread))] += 1
+	}
+	for i, n := range quarters {
+		if n == 0 {
+			t.Fatalf("no first attempt in quarter %d of the window: %v", i, quarters)
+		}
+	}
+	// the offset is stable for a key, random without key 同一键的偏移稳定，无键时随机
+	a := &BanConn{ReconnectSpread: spread, JitterKey: "bot-1"}
+	b := &BanConn{ReconnectSpread: spread, JitterKey: "bot-1"}
+	if a.reconnectJitter() != b.reconnectJitter() {
+		t.Fatal("jitter should be stable for the same key")
+	}
+	c := &BanConn{ReconnectSpread: spread}
+	if off := c.reconnectJitter(); off < 0 || off >= spread {
+		t.Fatalf("random jitter out of window: %v", off)
+	}
+	if (&BanConn{JitterKey: "bot-1"}).reconnectJitter() != 0 {
+		t.Fatal("jitter should be 0 without spread")
+	}
+}
+
+// setLiveMode switch to live mode only once, as conns of earlier tests may still be reading RunMode
+func setLiveMode() {
+	if !core.LiveMode {
+		core.SetRunMode(core.RunModeLive)
+	}
+}
+
+// startTestServer serve a ban server on a random local port
+func startTestServer(t *testing.T) (*ServerIO, string) {
+	return startTestServerWith(t, nil)
+}
+
+// startTestServerWith same as startTestServer, init configures the server before serving
+func startTestServerWith(t *testing.T, init func(s *ServerIO)) (*ServerIO, string) {
+	setLiveMode()
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	addr := ln.Addr().String()
+	server := NewBanServer(addr, "test")
+	if init != nil {
+		init(server)
+	}
+	go server.Serve(ln)
+	return server, addr
+}
+
+func startTestClient(t *testing.T, addr string) *ClientIO {
+	client := newTestClient(t, addr)
+	go client.RunForever()
+	return client
+}
+
+// newTestClient same as startTestClient, but reading is left to the caller after hooks are set
+func newTestClient(t *testing.T, addr string) *ClientIO {
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+func waitFor(t *testing.T, name string, cond func() bool) {
+	stopAt := time.Now().Add(time.Second * 3)
+	for time.Now().Before(stopAt) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("wait for %s timeout", name)
+}
+
+func TestPauseResume(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan int, 10)
+	client.Listens["tk1"] = func(_ string, data []byte) {
+		var v int
+		_ = utils.Unmarshal(data, &v, utils.JsonNumDefault)
+		got <- v
+	}
+	err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk1")
+	})
+	conn := server.getConns()[0]
+	if err = client.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "pause", conn.IsPaused)
+	for i := 1; i <= 3; i++ {
+		if err = server.Broadcast(&IOMsg{Action: "tk1", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = client.Resume(true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "resume", func() bool { return !conn.IsPaused() })
+	if err = server.Broadcast(&IOMsg{Action: "tk1", Data: 4}); err != nil {
+		t.Fatal(err)
+	}
+	var vals []int
+	for len(vals) < 2 {
+		select {
+		case v := <-got:
+			vals = append(vals, v)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("receive timeout, got %v", vals)
+		}
+	}
+	if vals[0] != 3 || vals[1] != 4 {
+		t.Fatalf("expect [3 4], got %v", vals)
+	}
+}
+
+func TestMaxLastMsgs(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.MaxLastMsgs = 2
+	for _, tag := range []string{"a", "b", "a", "c"} {
+		server.retainLast(tag, []byte(tag))
+	}
+	server.lockMsgs.Lock()
+	_, hasA := server.lastMsgs["a"]
+	_, hasB := server.lastMsgs["b"]
+	_, hasC := server.lastMsgs["c"]
+	num, seqA := server.lastOrder.Len(), server.lastSeqs["a"]
+	server.lockMsgs.Unlock()
+	if !hasA || hasB || !hasC || num != 2 {
+		t.Fatalf("expect b dropped as least recently broadcast, a: %v, b: %v, c: %v, order: %d", hasA, hasB, hasC, num)
+	}
+	if seqA != 2 {
+		t.Fatalf("expect seq 2 of a, got %d", seqA)
+	}
+}
+
+func TestReplayFrame(t *testing.T) {
+	raw, err := encodeMsg(&IOMsg{Action: "tk", Data: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retained := append([]byte{codecNone}, raw...)
+	// a peer not accepting raw frames gets it compressed 不接受未压缩帧的对端收到压缩后的帧
+	conn := &BanConn{Tags: map[string]bool{}}
+	frame, err := conn.replayFrame("tk", retained)
+	if err != nil || frame[0] != codecZlib {
+		t.Fatalf("expect a compressed frame, got %v %v", frame[:1], err)
+	}
+	if data, err := decompressTo(nil, frame, MaxFrameSize); err != nil || !bytes.Equal(data, raw) {
+		t.Fatalf("compressed frame should carry the msg: %v", err)
+	}
+	// a raw tag gets it wrapped in onRawFrame 原始tag收到包装为onRawFrame的帧
+	conn.subscribeRaw([]string{"tk"})
+	if frame, err = conn.replayFrame("tk", retained); err != nil {
+		t.Fatal(err)
+	}
+	data, err := decompressTo(nil, frame, MaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := decodeMsg(data)
+	if err != nil || msg.Action != "onRawFrame" {
+		t.Fatalf("expect onRawFrame, got %v %v", msg, err)
+	}
+}
+
+func TestResumeRawTag(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan *RawFrame, 10)
+	client.OnRawFrame = func(f *RawFrame) {
+		got <- f
+	}
+	client.Listens["tk"] = func(string, []byte) {
+		t.Error("raw tag should not be dispatched to Listens")
+	}
+	if err := client.SubscribeRaw("tk"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		conns := server.getConns()
+		return len(conns) == 1 && conns[0].(*BanConn).isRawTag("tk")
+	})
+	conn := server.getConns()[0]
+	if err := client.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "pause", conn.IsPaused)
+	if err := server.Broadcast(&IOMsg{Action: "tk", Data: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Resume(true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-got:
+		msg, err := f.Decode()
+		if err != nil || f.Action != "tk" || string(msg.Data) != "7" {
+			t.Fatalf("bad raw frame: %+v %v", f, err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("last broadcast should arrive as raw frame")
+	}
+}
+
+func makeTestKlines(num int) []*banexg.Kline {
+	res := make([]*banexg.Kline, 0, num)
+	for i := 0; i < num; i++ {
+		price := 100 + float64(i%50)*0.13
+		res = append(res, &banexg.Kline{Time: 1700000000000 + int64(i)*60000, Open: price, High: price + 1,
+			Low: price - 1, Close: price + 0.5, Volume: float64(i) * 3.7, Info: float64(i % 7)})
+	}
+	return res
+}
+
+func TestKlinesMsgRoundTrip(t *testing.T) {
+	arr := makeTestKlines(1000)
+	raw, err := encodeMsg(NewKlinesMsg("ohlcv_binance_spot_BTC/USDT", arr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := decodeMsg(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Binary || msg.Action != "ohlcv_binance_spot_BTC/USDT" {
+		t.Fatalf("bad binary msg: %v %s", msg.Binary, msg.Action)
+	}
+	res, err := DecodeKlines(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(arr) {
+		t.Fatalf("expect %d klines, got %d", len(arr), len(res))
+	}
+	for i, k := range res {
+		if *k != *arr[i] {
+			t.Fatalf("kline %d mismatch: %v != %v", i, *k, *arr[i])
+		}
+	}
+	if _, err = DecodeKlines(msg.Data[:len(msg.Data)-3]); err == nil {
+		t.Fatal("truncated kline data should fail")
+	}
+	// json frames keep working
+	raw, err = encodeMsg(&IOMsg{Action: "ping", Data: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = decodeMsg(raw)
+	if err != nil || msg.Binary || string(msg.Data) != "3" {
+		t.Fatalf("bad json msg: %v", err)
+	}
+}
+
+func BenchmarkKlinesBinary(b *testing.B) {
+	arr := makeTestKlines(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		raw, _ := encodeMsg(NewKlinesMsg("ohlcv", arr))
+		msg, _ := decodeMsg(raw)
+		_, _ = DecodeKlines(msg.Data)
+		b.SetBytes(int64(len(raw)))
+	}
+}
+
+func BenchmarkKlinesJson(b *testing.B) {
+	arr := makeTestKlines(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		raw, _ := encodeMsg(&IOMsg{Action: "ohlcv", Data: arr})
+		msg, _ := decodeMsg(raw)
+		var res []*banexg.Kline
+		_ = utils.Unmarshal(msg.Data, &res, utils.JsonNumDefault)
+		b.SetBytes(int64(len(raw)))
+	}
+}
+
+func TestServerSetValExpire(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.SetVal(&KeyValExpire{Key: "k1", Val: "v1", ExpireSecs: 10})
+	if val := server.GetVal("k1"); val != "v1" {
+		t.Fatalf("expect v1, got %s", val)
+	}
+	if _, ok := server.DataExp["k1"]; !ok {
+		t.Fatal("expire time should be recorded")
+	}
+	server.DataExp["k1"] = btime.TimeMS() - 1
+	if val := server.GetVal("k1"); val != "" {
+		t.Fatalf("expired key should be empty, got %s", val)
+	}
+	// setting without expiry clears the old expire time
+	server.SetVal(&KeyValExpire{Key: "k2", Val: "v2", ExpireSecs: 10})
+	server.SetVal(&KeyValExpire{Key: "k2", Val: "v2"})
+	if _, ok := server.DataExp["k2"]; ok {
+		t.Fatal("expire time should be cleared")
+	}
+	var empty ServerIO
+	empty.SetVal(&KeyValExpire{Key: "k3", Val: "v3", ExpireSecs: 1})
+	if val := empty.GetVal("k3"); val != "v3" {
+		t.Fatalf("expect v3, got %s", val)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan string, 1)
+	client.Listens["direct"] = func(_ string, data []byte) {
+		got <- string(data)
+	}
+	if err := client.SetName("live-trader-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk1"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "named subscription", func() bool {
+		tags := server.Subscriptions()["live-trader-1"]
+		return len(tags) == 1 && tags[0] == "tk1"
+	})
+	if err := server.SendTo("live-trader-1", &IOMsg{Action: "direct", Data: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-got:
+		if v != `"hi"` {
+			t.Fatalf("unexpected data %s", v)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("SendTo not received")
+	}
+	if err := server.SendTo("unknown", &IOMsg{Action: "direct"}); err == nil {
+		t.Fatal("SendTo unknown should fail")
+	}
+}
+
+func TestInboundRateLimit(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	for _, floodClose := range []bool{false, true} {
+		server := NewBanServer("127.0.0.1:0", "test")
+		server.MsgRateLimit = 10
+		server.MsgRateBurst = 5
+		server.FloodClose = floodClose
+		local, remote := net.Pipe()
+		conn := server.WrapConn(local)
+		handled := 0
+		conn.Listens["flood"] = func(_ string, _ []byte) {
+			handled += 1
+		}
+		done := make(chan *errs.Error, 1)
+		go func() {
+			done <- conn.RunForever()
+		}()
+		sent := 0
+		for i := 0; i < 50; i++ {
+			if writeFrame(remote, &IOMsg{Action: "flood", Data: i}) != nil {
+				break
+			}
+			sent += 1
+		}
+		if floodClose {
+			select {
+			case err := <-done:
+				if err == nil || err.Code != core.ErrNetReadFail {
+					t.Fatalf("expect rate exceed error, got %v", err)
+				}
+			case <-time.After(time.Second * 3):
+				t.Fatal("flooded conn should be closed")
+			}
+			if sent == 50 {
+				t.Fatal("writes should fail after conn closed")
+			}
+		} else {
+			_ = remote.Close()
+			<-done
+			if sent != 50 || handled < 5 || handled > 10 {
+				t.Fatalf("expect about 5 handled of 50, got %d of %d", handled, sent)
+			}
+		}
+	}
+}
+
+func TestCompressTo(t *testing.T) {
+	data := []byte(strings.Repeat("banbot kline payload ", 500))
+	expect, err := compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := make([]byte, 0, 8)
+	got, err := compressTo(small[:0], data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expect) {
+		t.Fatal("compressTo result differs from compress")
+	}
+	// buffers large enough are reused without allocation
+	big := make([]byte, 0, len(expect)*2)
+	got, err = compressTo(big, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &got[0] != &big[:1][0] || !bytes.Equal(got, expect) {
+		t.Fatal("compressTo should reuse the big buffer")
+	}
+	// appends after existing content
+	prefixed, err := compressTo([]byte("ab"), data)
+	if err != nil || string(prefixed[:2]) != "ab" || !bytes.Equal(prefixed[2:], expect) {
+		t.Fatal("compressTo should append to dst")
+	}
+	plain, err := decompressTo(make([]byte, 0, 4), expect, MaxFrameSize)
+	if err != nil || !bytes.Equal(plain, data) {
+		t.Fatal("decompressTo result mismatch")
+	}
+	plain2, err := deCompress(expect)
+	if err != nil || !bytes.Equal(plain2, plain) {
+		t.Fatal("deCompress result mismatch")
+	}
+}
+
+func TestGetNetLockCtx(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	lockVal, err := GetNetLockCtx(context.Background(), "lk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = GetNetLockCtx(ctx, "lk1")
+	if err == nil || err.Code != core.ErrRunTime {
+		t.Fatalf("expect cancel error, got %v", err)
+	}
+	if cost := time.Since(start); cost > time.Millisecond*500 {
+		t.Fatalf("cancel should return promptly, cost %v", cost)
+	}
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*30)
+	defer cancel2()
+	_, err = GetNetLockCtx(ctx2, "lk1")
+	if err == nil || err.Code != core.ErrTimeout {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+	if err = DelNetLock("lk1", lockVal); err != nil {
+		t.Fatal(err)
+	}
+	if server.GetVal("lock_lk1") != "" {
+		t.Fatal("lock should be released")
+	}
+	if _, err = GetNetLock("lk1", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitLockFree(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	if err := WaitLockFree("lk2", 1); err != nil {
+		t.Fatalf("free lock should return at once: %v", err)
+	}
+	lockVal, err := GetNetLock("lk2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var releasedAt time.Time
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		releasedAt = time.Now()
+		if err := DelNetLock("lk2", lockVal); err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	if err = WaitLockFree("lk2", 3); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < time.Millisecond*150 {
+		t.Fatalf("should wait for the release, returned after %v", cost)
+	}
+	if delay := time.Since(releasedAt); delay > time.Millisecond*300 {
+		t.Fatalf("should return promptly after release, delayed %v", delay)
+	}
+	if server.GetVal("lock_lk2") != "" {
+		t.Fatal("waiting should not acquire the lock")
+	}
+	if _, err = GetNetLock("lk2", 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*30)
+	defer cancel()
+	if err = WaitLockFreeCtx(ctx, "lk2"); err == nil || err.Code != core.ErrTimeout {
+		t.Fatalf("expect timeout error, got %v", err)
+	}
+}
+
+func TestWithServerLock(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	var active, maxActive atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := WithServerLock("lk4", 5, func() error {
+				num := active.Add(1)
+				defer active.Add(-1)
+				if num > maxActive.Load() {
+					maxActive.Store(num)
+				}
+				val, err := GetServerData("cnt")
+				if err != nil {
+					return err
+				}
+				cnt, _ := strconv.Atoi(val)
+				time.Sleep(time.Millisecond * 2)
+				return SetServerData(&KeyValExpire{Key: "cnt", Val: strconv.Itoa(cnt + 1)})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxActive.Load() != 1 {
+		t.Fatalf("callbacks should be mutually exclusive, %d ran at once", maxActive.Load())
+	}
+	if val := server.GetVal("cnt"); val != "8" {
+		t.Fatalf("lost updates, cnt: %s", val)
+	}
+	err := WithServerLock("lk4", 1, func() error {
+		return errors.New("bad")
+	})
+	if err == nil || !strings.Contains(err.Short(), "bad") {
+		t.Fatalf("expect the callback error, got %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic should be raised again")
+			}
+		}()
+		_ = WithServerLock("lk4", 1, func() error {
+			panic("boom")
+		})
+	}()
+	if server.GetVal("lock_lk4") != "" {
+		t.Fatal("lock should be released after panic")
+	}
+}
+
+func TestRenewNetLock(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	ctx := context.Background()
+	lockVal, err := GetNetLock("lk3", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := RenewNetLock(ctx, "lk3", lockVal, "node1", 60)
+	if err != nil || !ok {
+		t.Fatalf("renew held lock fail: %v %v", ok, err)
+	}
+	if val := server.GetVal("lock_lk3"); val != fmt.Sprintf("%v:node1", lockVal) {
+		t.Fatalf("unexpected lock val: %s", val)
+	}
+	ok, err = client.RenewLock(ctx, &KeyLockRenew{Key: "lk3", Token: lockVal, Payload: "node2", ExpireSecs: 60})
+	if err != nil || !ok {
+		t.Fatalf("renew held lock by client fail: %v %v", ok, err)
+	}
+	if val := server.GetVal("lock_lk3"); val != fmt.Sprintf("%v:node2", lockVal) {
+		t.Fatalf("unexpected lock val: %s", val)
+	}
+	// the payload should not block releasing 附带数据不应阻止释放
+	if err = DelNetLock("lk3", lockVal); err != nil {
+		t.Fatal(err)
+	}
+	if server.GetVal("lock_lk3") != "" {
+		t.Fatal("lock should be released")
+	}
+	ok, err = RenewNetLock(ctx, "lk3", lockVal, "node1", 60)
+	if err != nil || ok {
+		t.Fatalf("renew released lock should fail: %v %v", ok, err)
+	}
+	other, err := GetNetLock("lk3", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = client.RenewLock(ctx, &KeyLockRenew{Key: "lk3", Token: lockVal, Payload: "node1", ExpireSecs: 60})
+	if err != nil || ok {
+		t.Fatalf("renew lock taken by another holder should fail: %v %v", ok, err)
+	}
+	if val := server.GetVal("lock_lk3"); val != fmt.Sprintf("%v", other) {
+		t.Fatalf("failed renew should keep the lock: %s", val)
+	}
+	if _, err = RenewNetLock(ctx, "lk3", other, "", -1); err == nil {
+		t.Fatal("negative expire should be rejected")
+	}
+}
+
+func TestClientSetValNX(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	ok, err := client.SetValNX(context.Background(), &KeyValExpire{Key: "nx1", Val: "a"})
+	if err != nil || !ok {
+		t.Fatalf("first SetValNX should succeed: %v", err)
+	}
+	ok, err = client.SetValNX(context.Background(), &KeyValExpire{Key: "nx1", Val: "b"})
+	if err != nil || ok {
+		t.Fatalf("second SetValNX should fail: %v", err)
+	}
+	if val := server.GetVal("nx1"); val != "a" {
+		t.Fatalf("expect a, got %s", val)
+	}
+}
+
+func TestDumpKV(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.SetVal(&KeyValExpire{Key: "live", Val: "1", ExpireSecs: 60})
+	server.SetVal(&KeyValExpire{Key: "expired", Val: "2", ExpireSecs: 60})
+	server.SetVal(&KeyValExpire{Key: "token_a", Val: "secret"})
+	server.DataExp["expired"] = btime.TimeMS() - 1
+	items, err := DumpServerData("token_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Key != "live" || items[1].Key != "token_a" {
+		t.Fatalf("unexpected items: %v", items)
+	}
+	if items[0].ExpireMS == 0 || items[1].Val != "***" {
+		t.Fatalf("bad item detail: %v %v", *items[0], *items[1])
+	}
+	if _, ok := server.Data["expired"]; ok {
+		t.Fatal("expired key should be removed")
+	}
+}
+
+func TestDeCompressCodec(t *testing.T) {
+	data := []byte(`{"action":"ping","data":1}`)
+	zipped, err := compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zipped[0] != codecZlib {
+		t.Fatalf("zlib frame should start with codec id, got 0x%02x", zipped[0])
+	}
+	frames := map[string][]byte{
+		"zlib": zipped,
+		"none": append([]byte{codecNone}, data...),
+	}
+	for name, frame := range frames {
+		res, err := deCompress(frame)
+		if err != nil {
+			t.Fatalf("%s decode fail: %v", name, err)
+		}
+		if !bytes.Equal(res, data) {
+			t.Fatalf("%s decode mismatch: %s", name, res)
+		}
+	}
+	for _, frame := range [][]byte{{0x5a, 1, 2}, {}} {
+		_, err = deCompress(frame)
+		if err == nil || err.Code != core.ErrDeCompressFail {
+			t.Fatalf("invalid frame %v should fail with ErrDeCompressFail, got %v", frame, err)
+		}
+	}
+	_, err = deCompress([]byte{0x5a, 1})
+	if !strings.Contains(err.Message(), "unknown codec id: 0x5a") {
+		t.Fatalf("unexpected err msg: %s", err.Message())
+	}
+}
+
+func TestSlowHandle(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	obCore, logs := observer.New(zap.WarnLevel)
+	log.Setup("info", "", obCore)
+	defer log.Setup("info", "")
+	server := NewBanServer("127.0.0.1:0", "test")
+	local, remote := net.Pipe()
+	conn := server.WrapConn(local)
+	conn.SlowHandle = time.Millisecond * 20
+	conn.AsyncHandles = 2
+	release := make(chan struct{})
+	fastDone := make(chan struct{})
+	conn.Listens["slow"] = func(_ string, _ []byte) {
+		<-release
+	}
+	conn.Listens["fast"] = func(_ string, _ []byte) {
+		close(fastDone)
+	}
+	go conn.RunForever()
+	defer remote.Close()
+	for _, act := range []string{"slow", "slow", "fast"} {
+		if err := writeFrame(remote, &IOMsg{Action: act}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-fastDone:
+		t.Fatal("fast should wait as all workers are busy")
+	default:
+	}
+	release <- struct{}{}
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second * 3):
+		t.Fatal("fast handler not called after a worker is free")
+	}
+	close(release)
+	waitFor(t, "slow logs", func() bool {
+		return logs.FilterMessage("banio handler slow").Len() == 2
+	})
+}
+
+func TestAsyncCtrlOrder(t *testing.T) {
+	setLiveMode()
+	server := NewBanServer("127.0.0.1:0", "test")
+	local, remote := net.Pipe()
+	conn := server.WrapConn(local)
+	conn.AsyncHandles = 1
+	release := make(chan struct{})
+	defer close(release)
+	conn.Listens["block"] = func(_ string, _ []byte) {
+		<-release
+	}
+	go conn.RunForever()
+	defer remote.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, remote)
+	}()
+	// control actions run in the read loop in order, not queued behind the busy worker
+	// 控制action在读取循环中按顺序运行，不排在忙碌的工作协程之后
+	msgs := []*IOMsg{{Action: "block"}, {Action: "subscribe", Data: []string{"tk", "end"}},
+		{Action: "onPause"}, {Action: "unsubscribe", Data: []string{"tk"}}}
+	go func() {
+		// blocked when control actions wait for the worker, ends as remote is closed 控制action等待工作协程时阻塞
+		for _, msg := range msgs {
+			if err := writeFrame(remote, msg); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "unsubscribe", func() bool {
+		return conn.HasTag("end") && !conn.HasTag("tk")
+	})
+	if !conn.IsPaused() {
+		t.Fatal("conn should be paused")
+	}
+}
+
+func TestClusterAffinity(t *testing.T) {
+	server1, addr1 := startTestServer(t)
+	server2, addr2 := startTestServer(t)
+	cluster, err := NewClusterClient([]string{addr1, addr2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.SetVal(&KeyValExpire{Key: "k1", Val: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "write on primary", func() bool {
+		return server1.GetVal("k1") == "v1"
+	})
+	if server2.GetVal("k1") != "" {
+		t.Fatal("write should only go to the primary server")
+	}
+	// switch primary, the key is still read from the server accepted its write
+	cluster.primary = 1
+	val, err := cluster.GetVal("k1", 3)
+	if err != nil || val != "v1" {
+		t.Fatalf("read your writes fail: %s %v", val, err)
+	}
+	if err = cluster.SetVal(&KeyValExpire{Key: "k2", Val: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "write on new primary", func() bool {
+		return server2.GetVal("k2") == "v2"
+	})
+	// fail over when the primary is down
+	cluster.Clients[1].stopped.Store(true)
+	if cluster.Primary() != cluster.Clients[0] {
+		t.Fatal("should fail over to the live server")
+	}
+}
+
+func TestClusterDownNode(t *testing.T) {
+	_, addr1 := startTestServer(t)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	addr2 := ln.Addr().String()
+	_ = ln.Close()
+	oldClient := banClient
+	cluster, err := NewClusterClient([]string{addr1, addr2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range cluster.Clients {
+			_ = c.Close()
+		}
+	})
+	if banClient != oldClient {
+		t.Fatal("cluster client should not be registered as the global client")
+	}
+	if len(cluster.Clients) != 2 || cluster.Clients[1].Addr != addr2 {
+		t.Fatal("the down server should be kept for reconnecting")
+	}
+	// start the down server, it's connected by the first retry in about 3s
+	ln, err_ = net.Listen("tcp", addr2)
+	if err_ != nil {
+		t.Skip("port taken: ", err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	server2 := NewBanServer(addr2, "test")
+	go server2.Serve(ln)
+	stopAt := time.Now().Add(time.Second * 10)
+	for len(server2.getConns()) == 0 {
+		if time.Now().After(stopAt) {
+			t.Fatal("the down server should be reconnected")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestClusterMaxOwners(t *testing.T) {
+	_, addr := startTestServer(t)
+	cluster, err := NewClusterClient([]string{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cluster.Clients[0].Close()
+	})
+	cluster.MaxOwners = 3
+	for i := 0; i < 10; i++ {
+		err = cluster.SetVal(&KeyValExpire{Key: fmt.Sprintf("k%d", i), Val: "v"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cluster.lock.Lock()
+	num := len(cluster.owners)
+	cluster.lock.Unlock()
+	if num != 3 {
+		t.Fatalf("owners should be capped at 3, got %d", num)
+	}
+}
+
+func TestWriteChunked(t *testing.T) {
+	oldSize := ChunkSize
+	ChunkSize = 64 << 10
+	t.Cleanup(func() {
+		ChunkSize = oldSize
+	})
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan []byte, 2)
+	var chunkNum atomic.Int32
+	client.OnMsg = func(msg *IOMsgRaw) {
+		if msg.Action == "onChunk" {
+			chunkNum.Add(1)
+		}
+	}
+	client.Listens["history"] = func(_ string, data []byte) {
+		got <- data
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk")
+	})
+	conn := server.getConns()[0].(*BanConn)
+	history := EncodeKlines(makeTestKlines(20000))
+	if err := conn.WriteChunked("history", history); err != nil {
+		t.Fatal(err)
+	}
+	// an empty response is still delivered by one final chunk 空响应仍通过一个结束分块送达
+	if err := conn.WriteChunked("history", nil); err != nil {
+		t.Fatal(err)
+	}
+	var first []byte
+	for i, expect := range [][]byte{history, nil} {
+		select {
+		case data := <-got:
+			if !bytes.Equal(data, expect) {
+				t.Fatalf("transfer %d mismatch, len %d != %d", i, len(data), len(expect))
+			}
+			if i == 0 {
+				first = data
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("transfer %d not reassembled", i)
+		}
+	}
+	if num, expect := int(chunkNum.Load()), (len(history)+ChunkSize-1)/ChunkSize+1; num != expect {
+		t.Fatalf("expect %d chunks, got %d", expect, num)
+	}
+	klines, err := DecodeKlines(first)
+	if err != nil || len(klines) != 20000 {
+		t.Fatalf("decode reassembled history fail: %v", err)
+	}
+}
+
+func TestChunkLimits(t *testing.T) {
+	oldPending := MaxPendingChunked
+	MaxPendingChunked = 3
+	t.Cleanup(func() {
+		MaxPendingChunked = oldPending
+	})
+	chunk := func(id, seq, total uint32) []byte {
+		head := make([]byte, chunkHeadLen)
+		binary.LittleEndian.PutUint32(head[0:], id)
+		binary.LittleEndian.PutUint32(head[4:], seq)
+		binary.LittleEndian.PutUint32(head[8:], total)
+		if seq == total-1 {
+			head[12] = chunkFinal
+		}
+		binary.LittleEndian.PutUint16(head[13:], 1)
+		return append(head, "a"...)
+	}
+	conn := &BanConn{Remote: "test"}
+	// a total beyond MaxChunkedSize/ChunkSize is rejected before allocating 超出MaxChunkedSize/ChunkSize的total在分配前被拒绝
+	conn.onChunk(chunk(1, 0, math.MaxUint32))
+	if len(conn.chunks) != 0 {
+		t.Fatal("oversized total should be dropped")
+	}
+	for id := uint32(1); id <= 5; id++ {
+		conn.onChunk(chunk(id, 0, uint32(maxChunks())))
+		// make earlier ones older 使之前的更旧
+		for _, buf := range conn.chunks {
+			buf.lastMS -= 1
+		}
+	}
+	if len(conn.chunks) != 3 || conn.chunks[5] == nil || conn.chunks[1] != nil {
+		t.Fatalf("pending transfers should be capped by dropping the oldest, got %d", len(conn.chunks))
+	}
+	for _, buf := range conn.chunks {
+		buf.lastMS -= ChunkedTimeout.Milliseconds() + 1
+	}
+	conn.onChunk(chunk(9, 0, 2))
+	if len(conn.chunks) != 1 || conn.chunks[9] == nil {
+		t.Fatalf("idle transfers should expire, got %d", len(conn.chunks))
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := newTestClient(t, addr)
+	path := filepath.Join(t.TempDir(), "stream.rec")
+	rec, err := NewRecorder(client, path, "tk1", "bars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.RunForever()
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("bars")
+	})
+	msgs := []*IOMsg{
+		{Action: "tk1", Data: map[string]interface{}{"a": 1}},
+		NewKlinesMsg("bars", makeTestKlines(3)),
+		{Action: "other", Data: 2},
+		{Action: "tk1", Data: "x"},
+	}
+	for _, msg := range msgs {
+		if err = server.Broadcast(msg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	waitFor(t, "record", func() bool {
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		return rec.Num == 3
+	})
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	server2, addr2 := startTestServer(t)
+	client2 := startTestClient(t, addr2)
+	got := make(chan *IOMsgRaw, 10)
+	client2.OnMsg = func(msg *IOMsgRaw) {
+		if msg.Action == "tk1" || msg.Action == "bars" {
+			got <- msg
+		}
+	}
+	client2.Listens["tk1"] = func(string, []byte) {}
+	client2.Listens["bars"] = func(string, []byte) {}
+	if err = client2.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk1", "bars"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe2", func() bool {
+		return len(server2.Conns) == 1 && server2.Conns[0].HasTag("bars")
+	})
+	num, err := ReplayFile(context.Background(), path, server2, 10)
+	if err != nil || num != 3 {
+		t.Fatalf("replay fail, num: %d, err: %v", num, err)
+	}
+	// Broadcast writes asynchronously, compare regardless of order
+	expects := make(map[string]bool)
+	for _, i := range []int{0, 1, 3} {
+		raw, _ := encodeMsg(msgs[i])
+		expects[string(raw)] = true
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-got:
+			raw, _ := encodeMsg(rawToMsg(msg))
+			if !expects[string(raw)] {
+				t.Fatalf("unexpected replayed msg: %s", msg.Action)
+			}
+			delete(expects, string(raw))
+		case <-time.After(time.Second * 3):
+			t.Fatalf("replayed msg %d not received", i)
+		}
+	}
+}
+
+func TestRawRecordReplay(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := newTestClient(t, addr)
+	var listened atomic.Int32
+	client.Listens["bars"] = func(string, []byte) {
+		listened.Add(1)
+	}
+	codecs := make(chan byte, 10)
+	client.OnRawFrame = func(frame *RawFrame) {
+		codecs <- frame.Codec
+	}
+	path := filepath.Join(t.TempDir(), "stream.raw")
+	rec, err := NewRawRecorder(client, path, "bars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.RunForever()
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("bars")
+	})
+	msgs := []*IOMsg{
+		NewKlinesMsg("bars", makeTestKlines(200)),
+		{Action: "other", Data: 2},
+		NewKlinesMsg("bars", makeTestKlines(3)),
+	}
+	for _, msg := range msgs {
+		if err = server.Broadcast(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "record", func() bool {
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		return rec.Num == 2
+	})
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if codec := <-codecs; codec != codecZlib {
+		t.Fatalf("large frame should stay compressed, codec: 0x%02x", codec)
+	}
+	if listened.Load() != 0 {
+		t.Fatalf("raw tag should not be dispatched to Listens")
+	}
+
+	server2, addr2 := startTestServer(t)
+	client2 := startTestClient(t, addr2)
+	got := make(chan *IOMsgRaw, 10)
+	client2.OnMsg = func(msg *IOMsgRaw) {
+		if msg.Action == "bars" {
+			got <- msg
+		}
+	}
+	client2.Listens["bars"] = func(string, []byte) {}
+	if err = client2.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"bars"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe2", func() bool {
+		return len(server2.Conns) == 1 && server2.Conns[0].HasTag("bars")
+	})
+	num, err := ReplayRawFile(context.Background(), path, server2, 0)
+	if err != nil || num != 2 {
+		t.Fatalf("replay fail, num: %d, err: %v", num, err)
+	}
+	expects := make(map[string]bool)
+	for _, i := range []int{0, 2} {
+		raw, _ := encodeMsg(msgs[i])
+		expects[string(raw)] = true
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-got:
+			raw, _ := encodeMsg(rawToMsg(msg))
+			if !expects[string(raw)] {
+				t.Fatalf("unexpected replayed msg: %s", msg.Action)
+			}
+			delete(expects, string(raw))
+		case <-time.After(time.Second * 3):
+			t.Fatalf("replayed msg %d not received", i)
+		}
+	}
+}
+
+func TestEncodeMsgSanitize(t *testing.T) {
+	raw, err := encodeMsg(&IOMsg{Action: "ind", Data: map[string]interface{}{
+		"vals": []float64{1.5, math.NaN(), math.Inf(1)},
+	}})
+	if err != nil {
+		t.Fatalf("marshal NaN fail: %v", err)
+	}
+	if !strings.Contains(string(raw), `[1.5,null,null]`) {
+		t.Fatalf("NaN/Inf should be null, got: %s", raw)
+	}
+	type item struct {
+		Name string
+		Ch   chan int
+	}
+	_, err = encodeMsg(&IOMsg{Action: "bad", Data: map[string]interface{}{
+		"items": []interface{}{"a", &item{Name: "b", Ch: make(chan int)}},
+	}})
+	if err == nil {
+		t.Fatal("marshal chan should fail")
+	}
+	if err.Code != core.ErrMarshalFail || !strings.Contains(err.Message(), "bad") ||
+		!strings.Contains(err.Message(), "data.items[1].Ch: chan int") {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestHelloNegotiate(t *testing.T) {
+	server, addr := startTestServerWith(t, func(s *ServerIO) {
+		s.Caps = &ConnCaps{
+			Version:    2,
+			Codecs:     []string{CodecNone, CodecZlib},
+			Formats:    []string{FormatJson, FormatBinary},
+			MaxMsgSize: 1000,
+		}
+	})
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	client.Caps = &ConnCaps{
+		Version:    ProtoVersion,
+		Codecs:     []string{CodecZlib, CodecNone},
+		Formats:    []string{FormatJson},
+		MaxMsgSize: 500,
+	}
+	go client.RunForever()
+	t.Cleanup(func() {
+		_ = client.Conn.Close()
+	})
+	waitFor(t, "negotiate", func() bool {
+		return client.NegotiatedCaps() != nil && len(server.getConns()) == 1 &&
+			server.getConns()[0].(*BanConn).NegotiatedCaps() != nil
+	})
+	cliCaps := client.NegotiatedCaps()
+	srvCaps := server.getConns()[0].(*BanConn).NegotiatedCaps()
+	if cliCaps.Version != ProtoVersion || srvCaps.Version != ProtoVersion {
+		t.Fatalf("version should be the lower one: %d %d", cliCaps.Version, srvCaps.Version)
+	}
+	if strings.Join(cliCaps.Codecs, ",") != "zlib,none" || strings.Join(srvCaps.Codecs, ",") != "none,zlib" {
+		t.Fatalf("codecs should keep local preference: %v %v", cliCaps.Codecs, srvCaps.Codecs)
+	}
+	if strings.Join(cliCaps.Formats, ",") != "json" || strings.Join(srvCaps.Formats, ",") != "json" {
+		t.Fatalf("formats mismatch: %v %v", cliCaps.Formats, srvCaps.Formats)
+	}
+	if cliCaps.MaxMsgSize != 500 || srvCaps.MaxMsgSize != 500 {
+		t.Fatalf("max msg size should be the smaller: %d %d", cliCaps.MaxMsgSize, srvCaps.MaxMsgSize)
+	}
+	// server replies with uncompressed frames now 服务端现在回复未压缩的帧
+	ok, err := client.SetValNX(context.Background(), &KeyValExpire{Key: "k", Val: "v"})
+	if err != nil || !ok {
+		t.Fatalf("setNX over negotiated codec fail: %v %v", ok, err)
+	}
+	if err = client.WriteMsg(NewKlinesMsg("bars", makeTestKlines(2))); err == nil {
+		t.Fatal("binary msg should be rejected by peer formats")
+	}
+	if err = client.WriteMsg(&IOMsg{Action: "big", Data: strings.Repeat("x", 600)}); err == nil {
+		t.Fatal("msg over max size should be rejected")
+	}
+}
+
+// b64Serializer json in base64, stands for a non-json format like msgpack 以base64编码的json，代表msgpack等非json格式
+type b64Serializer struct{}
+
+func (b64Serializer) Marshal(v any) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(raw)), nil
+}
+
+func (b64Serializer) Unmarshal(data []byte, v any) error {
+	raw, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func TestConnFormat(t *testing.T) {
+	if err := RegSerializer("b64", b64Serializer{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		delete(serializers, "b64")
+	})
+	if err := RegSerializer(FormatJson, b64Serializer{}); err == nil {
+		t.Fatal("json should be reserved")
+	}
+	server, addr := startTestServer(t)
+	b64Cli, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64Cli.DoConnect = nil
+	b64Cli.Format = "b64"
+	go b64Cli.RunForever()
+	t.Cleanup(func() {
+		_ = b64Cli.Conn.Close()
+	})
+	jsonCli := startTestClient(t, addr)
+	waitFor(t, "negotiate", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		if len(server.Conns) != 2 || b64Cli.NegotiatedCaps() == nil || jsonCli.NegotiatedCaps() == nil {
+			return false
+		}
+		for _, conn := range server.Conns {
+			if conn.(*BanConn).NegotiatedCaps() == nil {
+				return false
+			}
+		}
+		return true
+	})
+	if b64Cli.msgFormat() != "b64" || jsonCli.msgFormat() != "" {
+		t.Fatalf("bad client formats: %q %q", b64Cli.msgFormat(), jsonCli.msgFormat())
+	}
+	// msgs sent by b64Cli are in b64 now and decoded by the server 此后b64Cli发送的消息为b64格式，由服务器解码
+	type recv struct {
+		format byte
+		msg    *IOMsgRaw
+	}
+	watch := func(client *ClientIO) chan recv {
+		ch := make(chan recv, 10)
+		client.OnRawFrame = func(frame *RawFrame) {
+			data, err := decompressTo(nil, frame.Frame, MaxFrameSize)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg, err := frame.Decode()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ch <- recv{format: data[0], msg: msg}
+		}
+		if err := client.SubscribeRaw("tk"); err != nil {
+			t.Fatal(err)
+		}
+		return ch
+	}
+	b64Ch, jsonCh := watch(b64Cli), watch(jsonCli)
+	waitFor(t, "subscribe", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		return server.Conns[0].HasTag("tk") && server.Conns[1].HasTag("tk")
+	})
+	if err = server.Broadcast(&IOMsg{Action: "tk", Data: map[string]int{"a": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, item := range map[string]struct {
+		ch   chan recv
+		flag byte
+	}{"b64": {b64Ch, msgFlagFormat}, "json": {jsonCh, '{'}} {
+		select {
+		case got := <-item.ch:
+			if got.format != item.flag || got.msg.Action != "tk" || string(got.msg.Data) != `{"a":1}` {
+				t.Fatalf("%s client got bad msg: %c %s %s", name, got.format, got.msg.Action, got.msg.Data)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s client got no broadcast", name)
+		}
+	}
+}
+
+func TestDirCodec(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	// the client compresses only the uplink 客户端仅压缩上行
+	cli := &BanConn{Conn: left, Remote: "left", Ready: true, WriteCodec: CodecZlib, ReadCodec: CodecNone}
+	srv := &BanConn{Conn: right, Remote: "right", Ready: true}
+	hello := func(c *BanConn) []byte {
+		raw, _ := MsgSerializer.Marshal(c.localCaps())
+		return raw
+	}
+	cliHello, srvHello := hello(cli), hello(srv)
+	cli.onHello(srvHello, false)
+	srv.onHello(cliHello, false)
+	cliCaps, srvCaps := cli.NegotiatedCaps(), srv.NegotiatedCaps()
+	if cliCaps.WriteCodec != CodecZlib || srvCaps.ReadCodec != CodecZlib {
+		t.Fatalf("uplink should be zlib: %s %s", cliCaps.WriteCodec, srvCaps.ReadCodec)
+	}
+	if cliCaps.ReadCodec != CodecNone || srvCaps.WriteCodec != CodecNone {
+		t.Fatalf("downlink should be raw: %s %s", cliCaps.ReadCodec, srvCaps.WriteCodec)
+	}
+	data := strings.Repeat("compressible ", 100)
+	send := func(from, to *BanConn, codec byte) {
+		go func() {
+			_ = from.WriteMsg(&IOMsg{Action: "big", Data: data})
+		}()
+		frame, err := to.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame[0] != codec {
+			t.Fatalf("%s should write codec 0x%02x, got 0x%02x", from.Remote, codec, frame[0])
+		}
+		msg, err := to.parseMsg(frame)
+		if err != nil || msg.Action != "big" || string(msg.Data) != strconv.Quote(data) {
+			t.Fatalf("%s got bad msg: %v %v", to.Remote, msg, err)
+		}
+	}
+	send(cli, srv, codecZlib)
+	send(srv, cli, codecNone)
+	// raw is refused when the reader doesn't support it 读取方不支持时不使用未压缩
+	strict := &ConnCaps{Codecs: []string{CodecZlib}}
+	if codec := dirCodec(&ConnCaps{WriteCodec: CodecNone, Codecs: DefaultCaps().Codecs}, strict); codec != CodecZlib {
+		t.Fatalf("expect zlib for strict reader, got %s", codec)
+	}
+}
+
+func TestBroadcastSkipBadMsg(t *testing.T) {
+	obCore, logs := observer.New(zap.WarnLevel)
+	log.Setup("info", "", obCore)
+	defer log.Setup("info", "")
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan string, 10)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		got <- string(data)
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk")
+	})
+	for i := 0; i < 2; i++ {
+		if err := server.Broadcast(&IOMsg{Action: "tk", Data: make(chan int)}); err != nil {
+			t.Fatalf("bad broadcast should be skipped, got: %v", err)
+		}
+	}
+	if err := server.Broadcast(&IOMsg{Action: "tk", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-got:
+		if data != "1" {
+			t.Fatalf("unexpected msg: %s", data)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("good broadcast not delivered after bad one")
+	}
+	if fails := server.BroadcastFails(); fails["tk"] != 2 {
+		t.Fatalf("expect 2 fails, got: %v", fails)
+	}
+	entries := logs.FilterMessage("broadcast skipped").All()
+	if len(entries) != 1 || entries[0].ContextMap()["tag"] != "tk" {
+		t.Fatalf("expect one throttled log with tag, got: %v", entries)
+	}
+}
+
+type countSerializer struct {
+	Serializer
+	marshals   atomic.Int32
+	unmarshals atomic.Int32
+}
+
+func (s *countSerializer) Marshal(v any) ([]byte, error) {
+	s.marshals.Add(1)
+	return s.Serializer.Marshal(v)
+}
+
+func (s *countSerializer) Unmarshal(data []byte, v any) error {
+	s.unmarshals.Add(1)
+	return s.Serializer.Unmarshal(data, v)
+}
+
+func TestSerializers(t *testing.T) {
+	defer func(old Serializer) {
+		MsgSerializer = old
+	}(MsgSerializer)
+	for _, ser := range []Serializer{SonicSerializer{}, StdJsonSerializer{}} {
+		MsgSerializer = ser
+		raw, err := encodeMsg(&IOMsg{Action: "tk", Data: map[string]interface{}{"a": 1.5, "b": []string{"x"}}})
+		if err != nil {
+			t.Fatalf("%T marshal fail: %v", ser, err)
+		}
+		msg, err := decodeMsg(raw)
+		if err != nil {
+			t.Fatalf("%T unmarshal fail: %v", ser, err)
+		}
+		var data struct {
+			A float64
+			B []string
+		}
+		if err_ := ser.Unmarshal(msg.Data, &data); err_ != nil {
+			t.Fatal(err_)
+		}
+		if msg.Action != "tk" || data.A != 1.5 || len(data.B) != 1 || data.B[0] != "x" {
+			t.Fatalf("%T round trip mismatch: %s %+v", ser, msg.Action, data)
+		}
+	}
+	// the configured serializer is used for both writing and reading 配置的编解码器同时用于读写
+	counter := &countSerializer{Serializer: StdJsonSerializer{}}
+	MsgSerializer = counter
+	_, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	ok, err := client.SetValNX(context.Background(), &KeyValExpire{Key: "ser", Val: "1"})
+	if err != nil || !ok {
+		t.Fatalf("setNX fail: %v %v", ok, err)
+	}
+	if counter.marshals.Load() == 0 || counter.unmarshals.Load() == 0 {
+		t.Fatalf("serializer not used on both sides: %d marshals, %d unmarshals",
+			counter.marshals.Load(), counter.unmarshals.Load())
+	}
+}
+
+func TestReconnectSingleFlight(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err_ := ln.Accept()
+			if err_ != nil {
+				return
+			}
+			// send a frame so the reader on the new conn returns
+			_ = writeFrame(conn, &IOMsg{Action: "ping", Data: 1})
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	addr := ln.Addr().String()
+	old, err_ := net.Dial("tcp", addr)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	_ = old.Close()
+	var dials atomic.Int32
+	c := &BanConn{
+		Conn:      old,
+		Tags:      map[string]bool{},
+		Listens:   map[string]ConnCB{},
+		Remote:    addr,
+		Ready:     true,
+		RetryWait: time.Millisecond * 10,
+		DoConnect: func(c *BanConn) {
+			dials.Add(1)
+			cn, err_ := net.Dial("tcp", addr)
+			if err_ == nil {
+				c.SetConn(cn)
+			}
+		},
+	}
+	defer func() {
+		if conn := c.getConn(); conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	start := make(chan struct{})
+	errOut := make(chan *errs.Error, 2)
+	go func() {
+		<-start
+		_, err := c.Read()
+		errOut <- err
+	}()
+	go func() {
+		<-start
+		errOut <- c.WriteMsg(&IOMsg{Action: "ping", Data: 2})
+	}()
+	close(start)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errOut:
+			if err != nil {
+				t.Fatalf("read/write after reconnect fail: %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("read/write not finished after reconnect")
+		}
+	}
+	if num := dials.Load(); num != 1 {
+		t.Fatalf("expect exactly one dial, got %d", num)
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	tr := NewMemTransport()
+	server := NewBanServer("mem-test", "test")
+	server.Transport = tr
+	go server.RunForever()
+	var client *ClientIO
+	waitFor(t, "listen", func() bool {
+		var err *errs.Error
+		client, err = NewClientIOWith("mem-test", tr)
+		return err == nil
+	})
+	client.DoConnect = nil
+	defer client.Conn.Close()
+	got := make(chan string, 1)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		got <- string(data)
+	}
+	go client.RunForever()
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk")
+	})
+	if err := server.Broadcast(&IOMsg{Action: "tk", Data: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-got:
+		if data != `"v1"` {
+			t.Fatalf("unexpected broadcast: %s", data)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("broadcast not received")
+	}
+	server.SetVal(&KeyValExpire{Key: "k", Val: "v"})
+	val, err := client.GetVal("k", 3)
+	if err != nil || val != "v" {
+		t.Fatalf("GetVal over mem transport fail: %v %v", val, err)
+	}
+	if _, err_ := tr.Dial("mem-none"); err_ == nil {
+		t.Fatal("dial unknown addr should fail")
+	}
+}
+
+func TestServerKVEvict(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.MaxKeys = 3
+	server.SetVal(&KeyValExpire{Key: "lock_a", Val: "1"})
+	server.SetVal(&KeyValExpire{Key: "k1", Val: "1"})
+	server.SetVal(&KeyValExpire{Key: "k2", Val: "2"})
+	// k1 becomes the most recently used, k2 is the oldest non-lock key now
+	if server.GetVal("k1") != "1" {
+		t.Fatal("k1 should exist")
+	}
+	server.SetVal(&KeyValExpire{Key: "k3", Val: "3"})
+	if server.GetVal("k2") != "" {
+		t.Fatal("k2 should be evicted as least recently used")
+	}
+	for _, key := range []string{"lock_a", "k1", "k3"} {
+		if server.GetVal(key) == "" {
+			t.Fatalf("%s should survive", key)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		server.SetVal(&KeyValExpire{Key: fmt.Sprintf("n%d", i), Val: "v"})
+	}
+	if len(server.Data) != 3 || server.GetVal("lock_a") != "1" || server.GetVal("n9") != "v" {
+		t.Fatalf("unexpected keys after filling: %v", server.Data)
+	}
+	server.SetVal(&KeyValExpire{Key: "n9", Val: ""})
+	if _, ok := server.lruIdx["n9"]; ok || server.lruKeys.Len() != len(server.Data) {
+		t.Fatal("deleted key should be removed from lru")
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.SweepInterval = time.Millisecond * 10
+	server.SetVal(&KeyValExpire{Key: "k1", Val: "1", ExpireSecs: 60})
+	server.SetVal(&KeyValExpire{Key: "k2", Val: "2", ExpireSecs: 60})
+	server.SetVal(&KeyValExpire{Key: "k3", Val: "3", ExpireSecs: 3600})
+	server.SetVal(&KeyValExpire{Key: "k4", Val: "4"})
+	// move the clock past the expiry of k1 and k2 时钟越过k1和k2的过期时间
+	server.lockData.Lock()
+	past := btime.TimeMS() - 1
+	server.DataExp["k1"] = past
+	server.DataExp["k2"] = past
+	server.lockData.Unlock()
+	server.StartSweep()
+	defer server.StopSweep()
+	numKeys := func() int {
+		server.lockData.Lock()
+		defer server.lockData.Unlock()
+		return len(server.Data)
+	}
+	waitFor(t, "sweep", func() bool {
+		return numKeys() == 2
+	})
+	server.lockData.Lock()
+	_, has1 := server.Data["k1"]
+	_, has2 := server.DataExp["k2"]
+	lruNum := server.lruKeys.Len()
+	server.lockData.Unlock()
+	if has1 || has2 || lruNum != 2 {
+		t.Fatalf("expired keys should be removed without read, lru: %d", lruNum)
+	}
+	if server.GetVal("k3") != "3" || server.GetVal("k4") != "4" {
+		t.Fatal("live keys should survive")
+	}
+	// lazy deletion still works on read 读取时惰性删除仍然有效
+	server.StopSweep()
+	server.lockData.Lock()
+	server.DataExp["k3"] = past
+	server.lockData.Unlock()
+	if server.GetVal("k3") != "" || server.SweepExpired() != 0 {
+		t.Fatal("k3 should be removed on read")
+	}
+}
+
+func TestManualClockExpire(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	clock := NewManualClock(1700000000000)
+	server.Clock = clock.Now
+	server.IdemWindow = time.Minute
+	server.SetVal(&KeyValExpire{Key: "k1", Val: "1", ExpireSecs: 60})
+	server.SetVal(&KeyValExpire{Key: "k2", Val: "2", ExpireSecs: 3600})
+	server.SetVal(&KeyValExpire{Key: "k3", Val: "3", IdemKey: "set-k3"})
+	clock.Advance(time.Second * 59)
+	if val := server.GetVal("k1"); val != "1" {
+		t.Fatalf("k1 should live before expiry, got %q", val)
+	}
+	clock.Advance(time.Second)
+	if val := server.GetVal("k1"); val != "" {
+		t.Fatalf("k1 should expire at 60s, got %q", val)
+	}
+	// the sweeper drops keys never read again 清理协程删除不再读取的key
+	clock.Advance(time.Hour)
+	if num := server.SweepExpired(); num != 1 {
+		t.Fatalf("expect 1 key swept, got %d", num)
+	}
+	server.lockData.Lock()
+	_, has2 := server.Data["k2"]
+	idemNum := len(server.idemKeys)
+	server.lockData.Unlock()
+	if has2 || idemNum != 0 {
+		t.Fatalf("k2 and idem keys should be swept, k2: %v, idem: %d", has2, idemNum)
+	}
+	// IdemKey is applied again after its window 超过窗口后IdemKey可再次生效
+	server.SetVal(&KeyValExpire{Key: "k3", Val: "4", IdemKey: "set-k3"})
+	if val := server.GetVal("k3"); val != "4" {
+		t.Fatalf("expect 4 after idem window, got %q", val)
+	}
+}
+
+func TestSetValIdem(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	// an increment emulated as set, replayed after reconnect 以设置模拟的自增，重连后被重放
+	set := &KeyValExpire{Key: "cnt", Val: "1", IdemKey: "cnt-1"}
+	for i := 0; i < 3; i++ {
+		if err := client.SetVal(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.SetVal(&KeyValExpire{Key: "cnt", Val: "2", IdemKey: "cnt-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetVal(&KeyValExpire{Key: "done", Val: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "sets", func() bool {
+		return server.GetVal("done") == "1"
+	})
+	if val := server.GetVal("cnt"); val != "1" {
+		t.Fatalf("replayed set should apply once, got %s", val)
+	}
+	server.SetVal(&KeyValExpire{Key: "cnt", Val: "2", IdemKey: "cnt-2"})
+	if val := server.GetVal("cnt"); val != "2" {
+		t.Fatalf("new idem key should apply, got %s", val)
+	}
+	// applied again after the window 窗口过后再次生效
+	server.lockData.Lock()
+	server.idemKeys["cnt-1"] = btime.TimeMS() - 1
+	server.lockData.Unlock()
+	server.SetVal(&KeyValExpire{Key: "cnt", Val: "3", IdemKey: "cnt-1"})
+	if val := server.GetVal("cnt"); val != "3" {
+		t.Fatalf("set after window should apply, got %s", val)
+	}
+	server.lockData.Lock()
+	server.idemKeys["cnt-2"] = btime.TimeMS() - 1
+	server.lockData.Unlock()
+	server.SweepExpired()
+	server.lockData.Lock()
+	_, ok := server.idemKeys["cnt-2"]
+	server.lockData.Unlock()
+	if ok {
+		t.Fatal("expired idem key should be swept")
+	}
+}
+
+func TestBroadcastCompressAuto(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan string, 10)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		got <- string(data)
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk") &&
+			server.getConns()[0].(*BanConn).NegotiatedCaps() != nil
+	})
+	noise := make([]byte, 2000)
+	_, _ = rand.New(rand.NewSource(1)).Read(noise)
+	text := strings.Repeat("abcd", 500)
+	cases := []struct {
+		name  string
+		msg   *IOMsg
+		want  string
+		codec byte
+	}{
+		{"compressible", &IOMsg{Action: "tk", Data: text}, strconv.Quote(text), codecZlib},
+		{"incompressible", &IOMsg{Action: "tk", RawData: noise}, string(noise), codecNone},
+		{"tiny", &IOMsg{Action: "tk", Data: 1}, "1", codecNone},
+	}
+	for _, c := range cases {
+		if err := server.Broadcast(c.msg); err != nil {
+			t.Fatal(err)
+		}
+		server.lockMsgs.Lock()
+		codec := server.lastMsgs["tk"][0]
+		server.lockMsgs.Unlock()
+		if codec != c.codec {
+			t.Fatalf("%s: expect codec %x, got %x", c.name, c.codec, codec)
+		}
+		select {
+		case data := <-got:
+			if data != c.want {
+				t.Fatalf("%s: payload mismatch", c.name)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s: broadcast not delivered", c.name)
+		}
+	}
+}
+
+func TestListActions(t *testing.T) {
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	setLiveMode()
+	server := NewBanServer(ln.Addr().String(), "test")
+	server.InitConn = func(c *BanConn) {
+		c.Listens["custom_"] = func(string, []byte) {}
+	}
+	go server.Serve(ln)
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	client.Listens["myAction"] = func(string, []byte) {}
+	go client.RunForever()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	waitFor(t, "connect", func() bool {
+		return len(server.getConns()) == 1
+	})
+	hasAll := func(got []string, want ...string) {
+		for _, w := range want {
+			if !slices.Contains(got, w) {
+				t.Fatalf("missing action %s in %v", w, got)
+			}
+		}
+		if !slices.IsSorted(got) {
+			t.Fatalf("actions should be sorted: %v", got)
+		}
+	}
+	hasAll(client.ListActions(), "subscribe", "unsubscribe", "hello", "onGetValRes", "myAction")
+	res := server.ListenActions()
+	if len(res) != 1 {
+		t.Fatalf("expect 1 conn, got: %v", res)
+	}
+	for _, actions := range res {
+		hasAll(actions, "subscribe", "unsubscribe", "onGetVal", "onSetVal", "custom_")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	server, addr := startTestServer(t)
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	client.RecvWindow = 2
+	release := make(chan struct{})
+	var got atomic.Int32
+	client.Listens["tk"] = func(_ string, _ []byte) {
+		<-release
+		got.Add(1)
+	}
+	go client.RunForever()
+	t.Cleanup(func() {
+		_ = client.Conn.Close()
+	})
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk") &&
+			server.getConns()[0].(*BanConn).NegotiatedCaps() != nil
+	})
+	conn := server.getConns()[0].(*BanConn)
+	if _, window := conn.Credits(); window != 2 {
+		t.Fatalf("expect peer window 2, got %d", window)
+	}
+	var maxOut atomic.Int32
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if out, _ := conn.Credits(); int32(out) > maxOut.Load() {
+				maxOut.Store(int32(out))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	const num = 10
+	for i := 0; i < num; i++ {
+		if err = server.Broadcast(&IOMsg{Action: "tk", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	if out, _ := conn.Credits(); out != 2 {
+		t.Fatalf("sender should stop at window with slow consumer, outstanding: %d", out)
+	}
+	close(release)
+	waitFor(t, "all delivered", func() bool {
+		return got.Load() == num
+	})
+	if maxOut.Load() > 2 {
+		t.Fatalf("outstanding exceeded window: %d", maxOut.Load())
+	}
+}
+
+func TestRunIOBench(t *testing.T) {
+	_, addr := startTestServer(t)
+	res, err := RunIOBench(&IOBenchArgs{Addr: addr, Clients: 2, Msgs: 20, Size: 2000, Timeout: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Msgs != 40 || res.Fails != 0 {
+		t.Fatalf("expect 40 round trips without fail, got: %s", res)
+	}
+	if res.MsgPerSec <= 0 || res.P50 <= 0 || res.P99 < res.P50 {
+		t.Fatalf("bad latency metrics: %s", res)
+	}
+	// each response carries the payload, compressed random letters still take more than half
+	// 每个响应都携带数据，压缩后的随机字母仍超过一半大小
+	if res.BytesOut <= 0 || res.BytesIn < int64(res.Msgs*1000) {
+		t.Fatalf("bad wire bytes: %s", res)
+	}
+}
+
+func TestBroadcastNum(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan string, 1)
+	client.Listens["alert"] = func(_ string, data []byte) {
+		got <- string(data)
+	}
+	num, err := server.BroadcastNum(&IOMsg{Action: "alert", Data: 1})
+	if err != nil || num != 0 {
+		t.Fatalf("expect no subscribers, got %d %v", num, err)
+	}
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"alert"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("alert")
+	})
+	num, err = server.BroadcastNum(&IOMsg{Action: "alert", Data: 2})
+	if err != nil || num != 1 {
+		t.Fatalf("expect 1 subscriber, got %d %v", num, err)
+	}
+	select {
+	case data := <-got:
+		if data != "2" {
+			t.Fatalf("unexpected msg: %s", data)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("broadcast not delivered")
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	server, addr := startTestServer(t)
+	c1 := startTestClient(t, addr)
+	c2 := startTestClient(t, addr)
+	if err := c1.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"ta", "tb"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"ta"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		subs := server.Subscriptions()
+		return len(subs) == 2 && len(subs[c1.Conn.LocalAddr().String()]) == 2
+	})
+	// frame sizes depend on the negotiated codecs, wait for both hellos
+	waitFor(t, "hello", func() bool {
+		for _, conn := range server.getConns() {
+			if conn.(*BanConn).NegotiatedCaps() == nil {
+				return false
+			}
+		}
+		return true
+	})
+	for i := 0; i < 3; i++ {
+		if err := server.Broadcast(&IOMsg{Action: "ta", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Broadcast(&IOMsg{Action: "tb", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Broadcast(&IOMsg{Action: "tc", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	stats := server.TagStats()
+	if len(stats) != 3 {
+		t.Fatalf("expect stats of 3 tags, got %v", stats)
+	}
+	ta, tb, tc := stats["ta"], stats["tb"], stats["tc"]
+	// ta: 3 broadcasts to 2 subscribers, same frame size as tb
+	if ta.Msgs != 3 || ta.Subs != 2 || ta.Bytes != tb.Bytes*6 || ta.LastMS < ta.FirstMS || ta.LastMS == 0 {
+		t.Fatalf("bad stat of ta: %+v", ta)
+	}
+	if tb.Msgs != 1 || tb.Subs != 1 || tb.Bytes <= 0 {
+		t.Fatalf("bad stat of tb: %+v", tb)
+	}
+	if tc.Msgs != 1 || tc.Subs != 0 || tc.Bytes != 0 || tc.LastMS == 0 {
+		t.Fatalf("tag without subscribers should still be counted: %+v", tc)
+	}
+}
+
+func TestUnknownMsgFields(t *testing.T) {
+	defer log.Setup("info", "")
+	for _, strict := range []bool{false, true} {
+		obCore, logs := observer.New(zap.DebugLevel)
+		log.Setup("debug", "", obCore)
+		server, addr := startTestServer(t)
+		client, err := NewClientIO(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DoConnect = nil
+		client.StrictFields = strict
+		got := make(chan string, 2)
+		client.Listens["tk"] = func(_ string, data []byte) {
+			got <- string(data)
+		}
+		go client.RunForever()
+		waitFor(t, "connect", func() bool {
+			return len(server.getConns()) == 1
+		})
+		conn := server.getConns()[0]
+		bad := append([]byte{codecNone}, `{"action":"tk","data":1,"extra":2,"ver":3}`...)
+		if err = conn.Write(bad, false); err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.WriteMsg(&IOMsg{Action: "tk", Data: 2}); err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for len(res) < 2 {
+			select {
+			case data := <-got:
+				res = append(res, data)
+			case <-time.After(time.Millisecond * 300):
+				res = append(res, "")
+			}
+		}
+		_ = client.Close()
+		if strict {
+			if res[0] != "2" || res[1] != "" {
+				t.Fatalf("strict mode should skip the msg and keep the conn, got %v", res)
+			}
+			if logs.FilterMessage("invalid banIO msg, skip").Len() != 1 {
+				t.Fatal("strict mode should log the rejected msg")
+			}
+			continue
+		}
+		if res[0] != "1" || res[1] != "2" {
+			t.Fatalf("lenient mode should deliver all msgs, got %v", res)
+		}
+		entries := logs.FilterMessage("unknown msg fields").All()
+		if len(entries) != 1 {
+			t.Fatalf("expect one debug log of unknown fields, got %d", len(entries))
+		}
+		if fields := entries[0].ContextMap()["fields"]; fmt.Sprint(fields) != "[extra ver]" {
+			t.Fatalf("unexpected fields: %v", fields)
+		}
+	}
+}
+
+func TestSendQueueLimit(t *testing.T) {
+	old := MaxSendQueue
+	MaxSendQueue = 3
+	defer func() {
+		MaxSendQueue = old
+	}()
+	// no sender runs, so items stay queued 没有发送协程运行，条目保留在队列中
+	conn := &BanConn{sending: true}
+	dropped := make(map[string]int)
+	push := func(action string, priority int, deadline int64) {
+		conn.enqueueDone(nil, &IOMsg{Action: action, Priority: priority, Deadline: deadline}, func(err *errs.Error) {
+			dropped[action] = err.Code
+		})
+	}
+	push("expired", 9, btime.TimeMS()-1)
+	push("low", 0, 0)
+	push("mid", 1, 0)
+	// the expired one is removed first 先移除已过期的
+	push("high", 2, 0)
+	if dropped["expired"] != core.ErrTimeout || len(conn.sendQ) != 3 {
+		t.Fatalf("expired should be dropped, dropped: %v, queued: %d", dropped, len(conn.sendQ))
+	}
+	// the lowest priority is evicted by a higher one 更高优先级的挤出最低优先级的
+	push("top", 3, 0)
+	if _, ok := dropped["low"]; !ok || len(conn.sendQ) != 3 {
+		t.Fatalf("low should be dropped, dropped: %v, queued: %d", dropped, len(conn.sendQ))
+	}
+	// a new one not higher than all queued is dropped itself 不高于所有已排队的新条目自身被丢弃
+	push("late", 1, 0)
+	if _, ok := dropped["late"]; !ok || len(conn.sendQ) != 3 {
+		t.Fatalf("late should be dropped, dropped: %v, queued: %d", dropped, len(conn.sendQ))
+	}
+	var order []string
+	for len(conn.sendQ) > 0 {
+		order = append(order, heap.Pop(&conn.sendQ).(*sendItem).action)
+	}
+	if strings.Join(order, ",") != "top,high,mid" {
+		t.Fatalf("unexpected queue: %v", order)
+	}
+}
+
+func TestBroadcastPriority(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	tr := NewMemTransport()
+	server := NewBanServer("mem-prio", "test")
+	server.Transport = tr
+	go server.RunForever()
+	var client *ClientIO
+	waitFor(t, "listen", func() bool {
+		var err *errs.Error
+		client, err = NewClientIOWith("mem-prio", tr)
+		return err == nil
+	})
+	client.DoConnect = nil
+	defer client.Conn.Close()
+	release := make(chan struct{})
+	got := make(chan string, 20)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		if string(data) == `"block"` {
+			<-release
+		}
+		got <- string(data)
+	}
+	go client.RunForever()
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("tk")
+	})
+	// the consumer is stuck on the first msg, so later ones queue up on the server
+	// 消费者卡在第一条消息上，后续消息在服务端排队
+	if err := server.Broadcast(&IOMsg{Action: "tk", Data: "block"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "blocked", func() bool {
+		conn := server.getConns()[0].(*BanConn)
+		conn.lockSendQ.Lock()
+		defer conn.lockSendQ.Unlock()
+		return !conn.sending
+	})
+	for i := 0; i < 5; i++ {
+		if err := server.Broadcast(&IOMsg{Action: "tk", Data: fmt.Sprintf("low%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := &IOMsg{Action: "tk", Data: "expired", Priority: 5, Deadline: btime.TimeMS() + 50}
+	if err := server.Broadcast(expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Broadcast(&IOMsg{Action: "tk", Data: "high", Priority: 10}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	close(release)
+	var res []string
+	for len(res) < 7 {
+		select {
+		case data := <-got:
+			res = append(res, strings.Trim(data, `"`))
+		case <-time.After(time.Second * 3):
+			t.Fatalf("not all delivered: %v", res)
+		}
+	}
+	highIdx := slices.Index(res, "high")
+	// one low msg may be in flight on the pipe before high is queued 在high排队前可能有一条low消息正在管道中发送
+	if res[0] != "block" || highIdx < 0 || highIdx > 2 {
+		t.Fatalf("high priority msg should jump ahead of queued ones: %v", res)
+	}
+	lows := slices.DeleteFunc(slices.Clone(res[1:]), func(s string) bool {
+		return s == "high"
+	})
+	if strings.Join(lows, ",") != "low0,low1,low2,low3,low4" {
+		t.Fatalf("low msgs should keep order: %v", res)
+	}
+	select {
+	case data := <-got:
+		t.Fatalf("expired msg should be dropped, got %s", data)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	core.SetRunMode(core.RunModeLive)
+	server := NewBanServer(ln.Addr().String(), "test")
+	if server.DelayWrites {
+		t.Fatal("NoDelay should be enabled by default")
+	}
+	accepted := make(chan *BanConn, 1)
+	server.InitConn = func(c *BanConn) {
+		accepted <- c
+	}
+	go server.Serve(ln)
+	client := startTestClient(t, ln.Addr().String())
+	if !client.NoDelay {
+		t.Fatal("client NoDelay should be enabled by default")
+	}
+	var conn *BanConn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second * 3):
+		t.Fatal("conn not accepted")
+	}
+	if !conn.NoDelay {
+		t.Fatal("server NoDelay not applied to accepted conn")
+	}
+	if !setNoDelay(conn.Conn, true) {
+		t.Fatal("setNoDelay should apply to tcp conns")
+	}
+	wrapped := &countConn{Conn: conn.Conn, tr: &countTransport{}}
+	if !setNoDelay(wrapped, true) {
+		t.Fatal("setNoDelay should reach the wrapped tcp conn")
+	}
+	// non-TCP conns are left untouched 非TCP连接不做处理
+	pa, pb := net.Pipe()
+	defer pa.Close()
+	defer pb.Close()
+	if setNoDelay(pa, true) {
+		t.Fatal("setNoDelay should be a no-op for pipes")
+	}
+	// servers not built by NewBanServer keep the default too 非NewBanServer创建的服务器同样保持默认
+	if c := (&ServerIO{}).WrapConn(pa); !c.NoDelay {
+		t.Fatal("NoDelay should be enabled for a zero ServerIO")
+	}
+	// small msgs go out at once, without waiting for the ack of the previous one
+	// 小消息立即发出，无需等待上一条的确认
+	err := client.SetVal(&KeyValExpire{Key: "nodelay", Val: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	costs := make([]time.Duration, 0, 21)
+	for i := 0; i < 21; i++ {
+		stamp := time.Now()
+		val, err := client.GetVal("nodelay", 3)
+		if err != nil || val != "1" {
+			t.Fatalf("get val fail: %v %v", val, err)
+		}
+		costs = append(costs, time.Since(stamp))
+	}
+	// Nagle with delayed ack costs ~40ms per round trip Nagle加延迟确认每次往返约40ms
+	slices.Sort(costs)
+	if costs[10] > time.Millisecond*30 {
+		t.Fatalf("small msgs delayed on loopback, median round trip: %v", costs[10])
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                      EncodingIdentity,
+		"br":                    EncodingIdentity,
+		"gzip":                  EncodingGzip,
+		"deflate, gzip":         EncodingGzip,
+		"gzip, zstd":            EncodingZstd,
+		"ZSTD;q=0.8, gzip":      EncodingGzip,
+		"zstd;q=0, *":           EncodingGzip,
+		"*;q=0.1, deflate;q=.5": EncodingDeflate,
+		"identity, *;q=0":       EncodingIdentity,
+	}
+	for accept, want := range cases {
+		if got := NegotiateEncoding(accept); got != want {
+			t.Errorf("accept %q expect %s, got %s", accept, want, got)
+		}
+	}
+	raw := []byte(strings.Repeat("banbot kline ", 100))
+	for _, enc := range append(BodyEncodings, EncodingIdentity) {
+		body, err := EncodeBody(nil, raw, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeBody(nil, body, enc)
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("%s round trip fail: %v", enc, err)
+		}
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	server, addr := startTestServer(t)
+	clients := []*ClientIO{startTestClient(t, addr), startTestClient(t, addr)}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var fails atomic.Int64
+	var want int64
+	for i, client := range clients {
+		for j := 0; j < 4; j++ {
+			delta := int64(i*10 + j + 1)
+			want += delta * 25
+			wg.Add(1)
+			go func(c *ClientIO) {
+				defer wg.Done()
+				for k := 0; k < 25; k++ {
+					if _, err := c.IncrBy(ctx, &KeyIncr{Key: "cnt", Delta: delta}); err != nil {
+						fails.Add(1)
+					}
+				}
+			}(client)
+		}
+	}
+	// local increments race with remote ones too 本地递增也与远程递增并发
+	for k := 0; k < 50; k++ {
+		wg.Add(1)
+		want -= 2
+		go func() {
+			defer wg.Done()
+			if _, err := server.IncrBy(&KeyIncr{Key: "cnt", Delta: -2}); err != nil {
+				fails.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if fails.Load() > 0 {
+		t.Fatalf("%d increments failed", fails.Load())
+	}
+	if got := server.GetVal("cnt"); got != strconv.FormatInt(want, 10) {
+		t.Fatalf("expect %d, got %s", want, got)
+	}
+	num, err := clients[0].IncrBy(ctx, &KeyIncr{Key: "cnt", Delta: 0})
+	if err != nil || num != want {
+		t.Fatalf("expect %d, got %d, err: %v", want, num, err)
+	}
+	// missing key starts from zero with expiration 不存在的key从0开始并设置过期
+	num, err = clients[1].IncrBy(ctx, &KeyIncr{Key: "fresh", Delta: 3, ExpireSecs: 60})
+	if err != nil || num != 3 || server.DataExp["fresh"] == 0 {
+		t.Fatalf("fresh key expect 3 with expiration, got %d, err: %v", num, err)
+	}
+	server.SetVal(&KeyValExpire{Key: "text", Val: "abc"})
+	if _, err = clients[1].IncrBy(ctx, &KeyIncr{Key: "text", Delta: 1}); err == nil {
+		t.Fatal("incr of non-integer value should fail")
+	}
+	if got := server.GetVal("text"); got != "abc" {
+		t.Fatalf("non-integer value should be kept, got %s", got)
+	}
+}
+
+func TestUnSubscribePattern(t *testing.T) {
+	matches := []struct {
+		pattern, tag string
+		ok           bool
+	}{
+		{"*", "ohlcv_binance_linear_BTC/USDT:USDT", true},
+		{"ohlcv_binance_*", "ohlcv_binance_linear_BTC/USDT:USDT", true},
+		{"ohlcv_*_ETH/*", "ohlcv_binance_spot_ETH/USDT", true},
+		{"ohlcv_*_ETH/*", "ohlcv_binance_spot_BTC/USDT", false},
+		{"trade_?", "trade_a", true},
+		{"trade_?", "trade_ab", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYcZ", false},
+	}
+	for _, m := range matches {
+		if got := MatchTag(m.pattern, m.tag); got != m.ok {
+			t.Errorf("MatchTag(%q, %q) expect %v", m.pattern, m.tag, m.ok)
+		}
+	}
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	core.SetRunMode(core.RunModeLive)
+	server := NewBanServer(ln.Addr().String(), "test")
+	accepted := make(chan *BanConn, 1)
+	server.InitConn = func(c *BanConn) {
+		accepted <- c
+	}
+	go server.Serve(ln)
+	client := startTestClient(t, ln.Addr().String())
+	var conn *BanConn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second * 3):
+		t.Fatal("conn not accepted")
+	}
+	tags := []string{"ohlcv_binance_spot_BTC/USDT", "ohlcv_binance_spot_ETH/USDT", "ohlcv_okx_spot_BTC/USDT",
+		"trade_binance_spot_BTC/USDT"}
+	err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return conn.HasTag(tags[3])
+	})
+	err = client.WriteMsg(&IOMsg{Action: "unsubscribe", Data: []string{"ohlcv_binance_*", "trade_okx_*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unsubscribe pattern", func() bool {
+		return !conn.HasTag(tags[0])
+	})
+	for i, tag := range tags {
+		if want := i >= 2; conn.HasTag(tag) != want {
+			t.Fatalf("tag %s subscribed should be %v", tag, want)
+		}
+	}
+	if err = client.UnSubscribeAll(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unsubscribe all", func() bool {
+		return !conn.HasTag(tags[2]) && !conn.HasTag(tags[3])
+	})
+}
+
+// readerConn serves Read from r, other methods of net.Conn are not used 从r读取，net.Conn的其他方法不会被调用
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// lenFrame prefix payload with its length 为payload加上长度前缀
+func lenFrame(payload []byte) []byte {
+	res := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	return append(res, payload...)
+}
+
+// readAllMsgs read msgs from data like RunForever until a fatal error 像RunForever一样读取消息直到致命错误
+func readAllMsgs(data []byte) ([]*IOMsgRaw, *errs.Error) {
+	conn := &BanConn{Conn: &readerConn{r: bytes.NewReader(data)}, Remote: "fuzz", Ready: true}
+	var res []*IOMsgRaw
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			if err.Code == core.ErrDeCompressFail || err.Code == core.ErrInvalidMsg {
+				continue
+			}
+			return res, err
+		}
+		res = append(res, msg)
+	}
+}
+
+func fuzzSeeds(t testing.TB) [][]byte {
+	raw, err := encodeMsg(&IOMsg{Action: "tick", Data: map[string]int{"a": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zlibFrame, err := compress(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binRaw, err := encodeMsg(NewKlinesMsg("kl", []*banexg.Kline{{Time: 1699999200000, Close: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binFrame, err := compress(binRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1MB of zeros shrinks to about 1KB 1MB的0压缩后约1KB
+	bomb, err := compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{
+		lenFrame(zlibFrame),
+		lenFrame(append([]byte{codecNone}, raw...)),
+		lenFrame(binFrame),
+		append(lenFrame(zlibFrame), lenFrame(binFrame)...),
+		lenFrame(zlibFrame)[:len(zlibFrame)/2], // truncated body 截断的帧体
+		{0x10, 0x00},                           // truncated length 截断的长度
+		{0xff, 0xff, 0xff, 0xff, 0x78},         // huge length 超大长度
+		{0, 0, 0, 0},                           // empty frame 空帧
+		lenFrame([]byte{0x78, 0x9c, 0x01}),     // corrupt zlib 损坏的zlib
+		lenFrame([]byte{0x42, 'x'}),            // unknown codec 未知编码
+		lenFrame([]byte{codecNone, msgFlagBinary, 0xff, 0xff}),
+		lenFrame(append([]byte{codecNone}, `{"action":1}`...)),
+		lenFrame(bomb),
+	}
+}
+
+func TestReadMalformedFrames(t *testing.T) {
+	oldMax := MaxFrameSize
+	MaxFrameSize = 1 << 16
+	defer func() {
+		MaxFrameSize = oldMax
+	}()
+	seeds := fuzzSeeds(t)
+	cases := []struct {
+		data []byte
+		msgs int
+		code int
+	}{
+		{seeds[3], 2, core.ErrNetConnect},  // valid frames then EOF 有效帧后EOF
+		{seeds[4], 0, core.ErrNetReadFail}, // truncated body 截断的帧体
+		{seeds[5], 0, core.ErrNetConnect},  // truncated length 截断的长度
+		{seeds[6], 0, core.ErrNetReadFail}, // huge length is rejected before allocating 分配前拒绝超大长度
+		{seeds[7], 0, core.ErrNetReadFail}, // empty frame 空帧
+		{seeds[10], 0, errs.CodeUnmarshalFail},
+		{append(seeds[8], seeds[0]...), 1, core.ErrNetConnect},  // corrupt zlib is skipped 跳过损坏的zlib
+		{append(seeds[12], seeds[0]...), 1, core.ErrNetConnect}, // zip bomb is skipped 跳过压缩炸弹
+	}
+	for i, c := range cases {
+		msgs, err := readAllMsgs(c.data)
+		if len(msgs) != c.msgs || err == nil || err.Code != c.code {
+			t.Errorf("case %d expect %d msgs and code %d, got %d msgs, err: %v", i, c.msgs, c.code, len(msgs), err)
+		}
+	}
+}
+
+func TestMaxDecompressSize(t *testing.T) {
+	bombRaw, err := encodeMsg(&IOMsg{Action: "big", Data: strings.Repeat("a", 1<<20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bomb, err := compress(bombRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRaw, err := encodeMsg(&IOMsg{Action: "small", Data: strings.Repeat("a", 1<<10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := compress(smallRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.MaxDecompressSize = 1 << 16
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := server.WrapConn(local)
+	if conn.MaxDecompressSize != 1<<16 {
+		t.Fatalf("limit should be applied to conn, got %d", conn.MaxDecompressSize)
+	}
+	// 1MB decompressed from a few KB is rejected 从几KB解压出1MB被拒绝
+	if len(bomb) > 1<<12 {
+		t.Fatalf("bomb should be tiny, got %d", len(bomb))
+	}
+	if _, err = conn.parseMsg(bomb); err == nil || err.Code != core.ErrDeCompressFail {
+		t.Fatalf("expect ErrDeCompressFail, got %v", err)
+	}
+	msg, err := conn.parseMsg(small)
+	if err != nil || msg.Action != "small" {
+		t.Fatalf("msg under limit should pass, got %v %v", msg, err)
+	}
+	// default to MaxFrameSize 默认使用MaxFrameSize
+	conn.MaxDecompressSize = 0
+	if msg, err = conn.parseMsg(bomb); err != nil || msg.Action != "big" {
+		t.Fatalf("msg under MaxFrameSize should pass, got %v %v", msg, err)
+	}
+}
+
+func FuzzReadMsg(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	oldMax := MaxFrameSize
+	MaxFrameSize = 1 << 16
+	defer func() {
+		MaxFrameSize = oldMax
+	}()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msgs, err := readAllMsgs(data)
+		if err == nil || err.Code == 0 {
+			t.Fatalf("read should end with a coded error, got: %v", err)
+		}
+		if len(msgs)*5 > len(data) {
+			t.Fatalf("%d msgs from %d bytes", len(msgs), len(data))
+		}
+	})
+}
+
+func TestGetValOr(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	server.SetVal(&KeyValExpire{Key: "num", Val: "42"})
+	server.SetVal(&KeyValExpire{Key: "text", Val: "abc"})
+	server.SetVal(&KeyValExpire{Key: "obj", Val: `{"name":"bot","limit":3}`})
+	server.SetVal(&KeyValExpire{Key: "arr", Val: `[1,2,3]`})
+	if got := GetValOr("num", 0); got != 42 {
+		t.Fatalf("present int expect 42, got %d", got)
+	}
+	if got := GetValOr("num", ""); got != "42" {
+		t.Fatalf("present str expect 42, got %s", got)
+	}
+	if got := GetValOr("missing", 7); got != 7 {
+		t.Fatalf("missing expect default 7, got %d", got)
+	}
+	if got := GetValOr("text", int32(-1)); got != -1 {
+		t.Fatalf("un-decodable expect default -1, got %d", got)
+	}
+	type limitCfg struct {
+		Name  string
+		Limit int
+	}
+	if got := GetValOr("obj", limitCfg{}); got.Name != "bot" || got.Limit != 3 {
+		t.Fatalf("bad struct decode: %+v", got)
+	}
+	if got := GetValOr("arr", []int(nil)); fmt.Sprint(got) != "[1 2 3]" {
+		t.Fatalf("bad slice decode: %v", got)
+	}
+	if got := GetValOr("text", limitCfg{Limit: 1}); got.Limit != 1 {
+		t.Fatalf("un-decodable struct expect default, got %+v", got)
+	}
+}
+
+func TestSchedulePublish(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan time.Time, 100)
+	client.Listens["stats"] = func(_ string, data []byte) {
+		got <- time.Now()
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"stats"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 1 && server.getConns()[0].HasTag("stats")
+	})
+	var num atomic.Int64
+	produce := func() *IOMsg {
+		return &IOMsg{Data: num.Add(1)}
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := server.SchedulePublish("stats", interval, produce); err == nil {
+			t.Fatalf("interval %v should be rejected", interval)
+		}
+	}
+	job, err := server.SchedulePublish("stats", 50*time.Millisecond, produce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Start()
+	job.Start()
+	var stamps []time.Time
+	for len(stamps) < 4 {
+		select {
+		case stamp := <-got:
+			stamps = append(stamps, stamp)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("only %d publishes arrived", len(stamps))
+		}
+	}
+	for i := 1; i < len(stamps); i++ {
+		if gap := stamps[i].Sub(stamps[i-1]); gap < 25*time.Millisecond || gap > 300*time.Millisecond {
+			t.Fatalf("publish %d arrived %v after the previous, expect about 50ms", i, gap)
+		}
+	}
+	job.Stop()
+	time.Sleep(30 * time.Millisecond)
+	for len(got) > 0 {
+		<-got
+	}
+	select {
+	case <-got:
+		t.Fatal("publish arrived after Stop")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// a slow producer never runs concurrently, ticks are skipped 慢的生产者不会并发运行，跳过tick
+	var active, maxActive atomic.Int64
+	slow, err := server.SchedulePublish("slow", 10*time.Millisecond, func() *IOMsg {
+		cur := active.Add(1)
+		defer active.Add(-1)
+		if cur > maxActive.Load() {
+			maxActive.Store(cur)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.Start()
+	time.Sleep(200 * time.Millisecond)
+	slow.Stop()
+	if _, skipped := slow.Counts(); skipped == 0 || maxActive.Load() != 1 {
+		t.Fatalf("expect skipped ticks and no overlap, skipped: %d, max active: %d", skipped, maxActive.Load())
+	}
+}
+
+func TestDeliverBeforeReconnect(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err_ := ln.Accept()
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	var got atomic.Int64
+	client.Listens["tick"] = func(string, []byte) {
+		got.Add(1)
+	}
+	lostAt := make(chan int64, 2)
+	client.OnStateChange = func(c *BanConn, state int, err *errs.Error) {
+		if state == ConnStateLost {
+			lostAt <- got.Load()
+		}
+	}
+	client.MaxReconnects = 1
+	client.RetryWait = time.Millisecond
+	client.DoConnect = func(c *BanConn) {}
+	// frames are fully received by the client before the peer closes 对端关闭前客户端已完整接收所有帧
+	const num = 20
+	for i := 0; i < num; i++ {
+		if err = writeFrame(peer, &IOMsg{Action: "tick", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = peer.Close()
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan *errs.Error, 1)
+	go func() {
+		done <- client.RunForever()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("RunForever should give up reconnecting")
+	}
+	select {
+	case n := <-lostAt:
+		if n != num {
+			t.Fatalf("all %d frames should be delivered before reconnect, got %d", num, n)
+		}
+	default:
+		t.Fatal("conn lost not reported")
+	}
+}
+
+func TestDrainBuffered(t *testing.T) {
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	raw, err_ := net.Dial("tcp", ln.Addr().String())
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer raw.Close()
+	peer, err_ := ln.Accept()
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	const num = 10
+	for i := 0; i < num; i++ {
+		if err := writeFrame(peer, &IOMsg{Action: "tick", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a partial frame stays in the buffer 不完整的帧保留在缓冲中
+	if _, err_ = peer.Write([]byte{8, 0, 0, 0, 1}); err_ != nil {
+		t.Fatal(err_)
+	}
+	_ = peer.Close()
+	time.Sleep(50 * time.Millisecond)
+	conn := &BanConn{Conn: raw, Remote: "peer", Ready: true, ReadBufSize: ConnBufSize}
+	msg, err := conn.ReadMsg()
+	if err != nil || msg.Action != "tick" {
+		t.Fatalf("read first frame fail: %v %v", msg, err)
+	}
+	msgs, err := conn.DrainBuffered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != num-1 {
+		t.Fatalf("expect %d buffered msgs, got %d", num-1, len(msgs))
+	}
+	for i, m := range msgs {
+		var val int
+		if err_ = MsgSerializer.Unmarshal(m.Data, &val); err_ != nil || val != i+1 {
+			t.Fatalf("msg %d: expect %d, got %d %v", i, i+1, val, err_)
+		}
+	}
+	if msgs, err = conn.DrainBuffered(); err != nil || len(msgs) != 0 {
+		t.Fatalf("nothing left to drain, got %d %v", len(msgs), err)
+	}
+}
+
+func TestSubscribeTrades(t *testing.T) {
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	core.SetRunMode(core.RunModeLive)
+	server := NewBanServer(ln.Addr().String(), "test")
+	accepted := make(chan *BanConn, 1)
+	server.InitConn = func(c *BanConn) {
+		accepted <- c
+	}
+	go server.Serve(ln)
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	t.Cleanup(func() {
+		_ = client.Conn.Close()
+	})
+	type recv struct {
+		symbol string
+		trades []*banexg.Trade
+	}
+	got := make(chan recv, 10)
+	// the legacy prefix must not steal trade.* messages 旧的前缀不应截获trade.*消息
+	client.Listens[core.WsSubTrade] = func(action string, data []byte) {
+		t.Errorf("%s dispatched to %s", action, core.WsSubTrade)
+	}
+	err = client.SubscribeTrades(func(symbol string, trades []*banexg.Trade) {
+		got <- recv{symbol: symbol, trades: trades}
+	}, "BTC/USDT", "ETH/USDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.RunForever()
+	var conn *BanConn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second * 3):
+		t.Fatal("conn not accepted")
+	}
+	waitFor(t, "subscribe", func() bool {
+		return conn.HasTag(TradeTag("ETH/USDT"))
+	})
+	trades := []*banexg.Trade{
+		{ID: "1", Symbol: "BTC/USDT", Side: banexg.OdSideBuy, Amount: 0.5, Price: 35000.5, Timestamp: 1700000000123},
+		{ID: "2", Symbol: "BTC/USDT", Side: banexg.OdSideSell, Amount: 1.25, Price: 34999, Timestamp: 1700000000456,
+			Maker: true},
+	}
+	if err = server.BroadcastTrades("SOL/USDT", trades[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.BroadcastTrades("BTC/USDT", trades); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-got:
+		if r.symbol != "BTC/USDT" || len(r.trades) != len(trades) {
+			t.Fatalf("expect 2 trades of BTC/USDT, got %d of %s", len(r.trades), r.symbol)
+		}
+		for i, tr := range r.trades {
+			want := trades[i]
+			if tr.ID != want.ID || tr.Side != want.Side || tr.Amount != want.Amount || tr.Price != want.Price ||
+				tr.Timestamp != want.Timestamp || tr.Maker != want.Maker {
+				t.Fatalf("trade %d mismatch: %+v", i, tr)
+			}
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("trades not received")
+	}
+	select {
+	case r := <-got:
+		t.Fatalf("unsubscribed %s should not be received", r.symbol)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestBroadcastToRole(t *testing.T) {
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	core.SetRunMode(core.RunModeLive)
+	addr := ln.Addr().String()
+	server := NewBanServer(addr, "test")
+	accepted := make(chan *BanConn, 3)
+	server.InitConn = func(c *BanConn) {
+		accepted <- c
+	}
+	go server.Serve(ln)
+	roles := []string{"trader", "dashboard", ""}
+	gots := make([]chan string, len(roles))
+	for i, role := range roles {
+		client, err := NewClientIO(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DoConnect = nil
+		client.Role = role
+		got := make(chan string, 10)
+		gots[i] = got
+		client.Listens["alert"] = func(_ string, data []byte) {
+			got <- string(data)
+		}
+		go client.RunForever()
+		t.Cleanup(func() {
+			_ = client.Conn.Close()
+		})
+	}
+	for range roles {
+		select {
+		case conn := <-accepted:
+			waitFor(t, "hello", func() bool {
+				return conn.NegotiatedCaps() != nil
+			})
+		case <-time.After(time.Second * 3):
+			t.Fatal("conn not accepted")
+		}
+	}
+	for i, role := range roles[:2] {
+		num, err := server.BroadcastToRole(role, &IOMsg{Action: "alert", Data: role})
+		if err != nil || num != 1 {
+			t.Fatalf("%s expect 1 conn, got %d, err: %v", role, num, err)
+		}
+		select {
+		case data := <-gots[i]:
+			if data != `"`+role+`"` {
+				t.Fatalf("%s got %s", role, data)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s not received", role)
+		}
+	}
+	if num, _ := server.BroadcastToRole("logger", &IOMsg{Action: "alert", Data: "x"}); num != 0 {
+		t.Fatalf("no conn has role logger, got %d", num)
+	}
+	if _, err := server.BroadcastToRole("", &IOMsg{Action: "alert"}); err == nil {
+		t.Fatal("empty role should fail")
+	}
+	time.Sleep(time.Millisecond * 100)
+	for i, got := range gots {
+		if len(got) > 0 {
+			t.Fatalf("%q received a msg of another role: %s", roles[i], <-got)
+		}
+	}
+}
+
+// writeCountConn count Write calls, each is a write syscall on a real conn 统计Write调用次数，真实连接上每次对应一次写系统调用
+type writeCountConn struct {
+	net.Conn
+	w      io.Writer
+	writes atomic.Int64
+}
+
+func (c *writeCountConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.w.Write(b)
+}
+
+func TestBufferedConn(t *testing.T) {
+	for _, size := range []int{0, 4096} {
+		left, right := net.Pipe()
+		out := &writeCountConn{Conn: left, w: left}
+		sender := &BanConn{Conn: out, Remote: "left", Ready: true, WriteBufSize: size}
+		recver := &BanConn{Conn: right, Remote: "right", Ready: true, ReadBufSize: size}
+		frames := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 100), bytes.Repeat([]byte("c"), 10000),
+			[]byte("d")}
+		go func() {
+			for _, f := range frames {
+				if err := sender.Write(f, false); err != nil {
+					t.Errorf("write fail: %v", err)
+					return
+				}
+			}
+		}()
+		for i, want := range frames {
+			got := make(chan []byte, 1)
+			go func() {
+				data, err := recver.Read()
+				if err != nil {
+					t.Errorf("read fail: %v", err)
+				}
+				got <- data
+			}()
+			select {
+			case data := <-got:
+				if !bytes.Equal(data, want) {
+					t.Fatalf("buf %d frame %d mismatch, len %d", size, i, len(data))
+				}
+			case <-time.After(time.Second * 3):
+				// frames must not wait in the buffer 帧不应停留在缓冲区中
+				t.Fatalf("buf %d frame %d not flushed", size, i)
+			}
+		}
+		// small frames take one write when buffered, the big one is written directly 缓冲时小帧一次写出，大帧直接写
+		want := int64(len(frames) * 2)
+		if size > 0 {
+			want = int64(len(frames) + 1)
+		}
+		if got := out.writes.Load(); got != want {
+			t.Fatalf("buf %d expect %d writes, got %d", size, want, got)
+		}
+		_ = left.Close()
+		_ = right.Close()
+	}
+}
+
+func BenchmarkConnWrite(b *testing.B) {
+	frame := bytes.Repeat([]byte("k"), 200)
+	for _, size := range []int{0, ConnBufSize} {
+		b.Run(fmt.Sprintf("buf_%d", size), func(b *testing.B) {
+			out := &writeCountConn{w: io.Discard}
+			conn := &BanConn{Conn: out, Remote: "bench", Ready: true, WriteBufSize: size}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.Write(frame, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(out.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestDictWarmup(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	sender := &BanConn{Conn: left, Remote: "left", Ready: true, DictWarmup: 5}
+	sender.Negotiated = NegotiateCaps(DefaultCaps(), DefaultCaps())
+	recver := &BanConn{Conn: right, Remote: "right", Ready: true}
+	// a long random part shared by msgs, which zlib can't shrink within one msg 消息间共享的长随机部分，单条消息内zlib无法压缩
+	rnd := rand.New(rand.NewSource(1))
+	shared := make([]byte, 600)
+	for i := range shared {
+		shared[i] = byte('a' + rnd.Intn(26))
+	}
+	msgNum := 15
+	go func() {
+		for i := 0; i < msgNum; i++ {
+			err := sender.WriteMsg(&IOMsg{Action: "tick", Data: string(shared) + strconv.Itoa(i)})
+			if err != nil {
+				t.Errorf("write %d fail: %v", i, err)
+				return
+			}
+		}
+	}()
+	var before, after []int
+	for i := 0; i < msgNum; {
+		frame, err := recver.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec, size := frame[0], len(frame)
+		msg, err := recver.parseMsg(frame)
+		if err != nil {
+			t.Fatalf("decode frame %d (codec 0x%02x) fail: %v", i, codec, err)
+		}
+		if msg.Action == "onDict" {
+			// announced while sending the last warmup msg 在发送最后一条预热消息时宣告
+			if len(before) != sender.DictWarmup-1 {
+				t.Fatalf("dict should follow %d msgs, got %d", sender.DictWarmup-1, len(before))
+			}
+			continue
+		}
+		var val string
+		if err_ := MsgSerializer.Unmarshal(msg.Data, &val); err_ != nil || val != string(shared)+strconv.Itoa(i) {
+			t.Fatalf("msg %d mismatch: %v", i, err_)
+		}
+		if codec == codecZlibDict {
+			after = append(after, size)
+		} else {
+			if len(after) > 0 {
+				t.Fatalf("msg %d not compressed by dict after switch", i)
+			}
+			before = append(before, size)
+		}
+		i += 1
+	}
+	if len(before) != sender.DictWarmup || len(after) != msgNum-sender.DictWarmup {
+		t.Fatalf("switch point mismatch: %d before, %d after", len(before), len(after))
+	}
+	if after[0]*3 > before[0] {
+		t.Fatalf("dict should improve ratio: %d bytes before, %d after", before[0], after[0])
+	}
+}
+
+func TestSubscribeWithSnapshot(t *testing.T) {
+	server, addr := startTestServer(t)
+	// keep tk subscribed so each broadcast is retained, the data of the n-th one is n 保持tk被订阅使每次广播都被保留
+	holder := startTestClient(t, addr)
+	if err := holder.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	snaps := make(chan *TagSnapshot, 1)
+	client.OnSnapshot = func(snap *TagSnapshot) {
+		snaps <- snap
+	}
+	got := make(chan int64, 1000)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		var v int64
+		_ = utils.Unmarshal(data, &v, utils.JsonNumDefault)
+		got <- v
+	}
+	go client.RunForever()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	waitFor(t, "subscribe", func() bool {
+		return len(server.getConns()) == 2 && server.getConns()[0].HasTag("tk")
+	})
+	total := int64(500)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(1); i <= total; i++ {
+			if err := server.Broadcast(&IOMsg{Action: "tk", Data: i}); err != nil {
+				t.Error(err)
+				return
+			}
+			if i == total/5 {
+				// subscribe in the middle of broadcasting 在广播过程中订阅
+				go func() {
+					if err := client.SubscribeWithSnapshot("tk"); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			time.Sleep(time.Microsecond * 50)
+		}
+	}()
+	var snap *TagSnapshot
+	select {
+	case snap = <-snaps:
+	case <-time.After(time.Second * 5):
+		t.Fatal("snapshot not received")
+	}
+	<-done
+	if !snap.Has || snap.Tag != "tk" || snap.Seq < total/5 {
+		t.Fatalf("bad snapshot: %+v", snap)
+	}
+	// the snapshot itself, then every later update exactly once 先是快照本身，然后之后的每个更新恰好一次
+	for want := snap.Seq; want <= total; want++ {
+		select {
+		case v := <-got:
+			if v != want {
+				t.Fatalf("expect update %d after snapshot %d, got %d", want, snap.Seq, v)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("update %d missed after snapshot %d", want, snap.Seq)
+		}
+	}
+	select {
+	case v := <-got:
+		t.Fatalf("unexpected update %d", v)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	// a server which never replies 从不回复的服务器
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	client, err := NewClientIO(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.RunForever()
+	ctx := context.Background()
+	calls := []func() *errs.Error{
+		func() *errs.Error {
+			_, err := client.GetVal("a", 60)
+			return err
+		},
+		func() *errs.Error {
+			_, err := client.GetVal("b", 60)
+			return err
+		},
+		func() *errs.Error {
+			_, err := client.SetValNX(ctx, &KeyValExpire{Key: "c", Val: "1"})
+			return err
+		},
+		func() *errs.Error {
+			_, err := client.IncrBy(ctx, &KeyIncr{Key: "d", Delta: 1})
+			return err
+		},
+	}
+	results := make(chan *errs.Error, len(calls))
+	for _, call := range calls {
+		go func() {
+			results <- call()
+		}()
+	}
+	waitFor(t, "pending waits", func() bool {
+		client.lockWaits.Lock()
+		defer client.lockWaits.Unlock()
+		return len(client.waits) == len(calls)
+	})
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(time.Second)
+	for range calls {
+		select {
+		case err = <-results:
+			if err == nil || err.Code != core.ErrClosed {
+				t.Fatalf("expect closed error, got %v", err)
+			}
+		case <-deadline:
+			t.Fatal("pending call not woken by Close")
+		}
+	}
+	if err = client.Close(); err != nil {
+		t.Fatalf("second close should be no-op: %v", err)
+	}
+	if _, err = client.GetVal("e", 60); err == nil {
+		t.Fatal("call after close should fail")
+	}
+}
+
+func TestSetValExpire(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	cases := []struct {
+		secs int
+		ok   bool
+	}{
+		{-1, false},
+		{0, true},
+		{60, true},
+		{MaxExpireSecs, true},
+		{MaxExpireSecs + 1, false},
+		{math.MaxInt, false},
+	}
+	for i, c := range cases {
+		key := fmt.Sprintf("k%d", i)
+		args := &KeyValExpire{Key: key, Val: "v", ExpireSecs: c.secs}
+		stamp := btime.TimeMS()
+		err := server.SetVal(args)
+		if (err == nil) != c.ok {
+			t.Fatalf("expire %d: expect ok %v, got %v", c.secs, c.ok, err)
+		}
+		if !c.ok {
+			if err.Code != errs.CodeParamInvalid || server.GetVal(key) != "" {
+				t.Fatalf("expire %d should be rejected with nothing stored: %v", c.secs, err)
+			}
+			if _, err = server.SetValNX(args); err == nil {
+				t.Fatalf("expire %d should be rejected by SetValNX", c.secs)
+			}
+			incr := &KeyIncr{Key: key, Delta: 1, ExpireSecs: c.secs}
+			if _, err = server.IncrBy(incr); err == nil || server.GetVal(key) != "" {
+				t.Fatalf("expire %d should be rejected by IncrBy", c.secs)
+			}
+			if _, err = (&ClientIO{}).IncrBy(context.Background(), incr); err == nil {
+				t.Fatalf("expire %d should be rejected by client IncrBy", c.secs)
+			}
+			// the client rejects it before sending 客户端在发送前拒绝
+			if err = (&ClientIO{}).SetVal(args); err == nil {
+				t.Fatalf("expire %d should be rejected by client", c.secs)
+			}
+			continue
+		}
+		server.lockData.Lock()
+		exp, hasExp := server.DataExp[key]
+		server.lockData.Unlock()
+		if c.secs == 0 {
+			if hasExp {
+				t.Fatalf("expire 0 should never expire, got %d", exp)
+			}
+		} else if exp < stamp+int64(c.secs)*1000 || exp <= stamp {
+			t.Fatalf("expire %d: bad expiration %d at %d", c.secs, exp, stamp)
+		}
+	}
+}
+
+func TestBroadcastSync(t *testing.T) {
+	server := NewBanServer("127.0.0.1:0", "test")
+	// subscribers behind pipes, read after delay, never read when delay < 0 管道后的订阅者，延迟后读取，delay<0时从不读取
+	addSub := func(name string, delay time.Duration) {
+		left, right := net.Pipe()
+		t.Cleanup(func() {
+			_ = left.Close()
+			_ = right.Close()
+		})
+		server.Conns = append(server.Conns, &BanConn{Conn: left, Remote: name, Ready: true,
+			Tags: map[string]bool{"sync": true}})
+		if delay < 0 {
+			return
+		}
+		go func() {
+			time.Sleep(delay)
+			_, _ = io.Copy(io.Discard, right)
+		}()
+	}
+	delay := 150 * time.Millisecond
+	addSub("slow", delay)
+	addSub("fast", 0)
+	start := time.Now()
+	res, err := server.BroadcastSync(context.Background(), &IOMsg{Action: "sync", Data: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < delay {
+		t.Fatalf("should return after all writes, got %v", cost)
+	}
+	if len(res) != 2 || res[0].Err != nil || res[1].Err != nil {
+		t.Fatalf("expect 2 written, got %v", res)
+	}
+	// a stuck subscriber is reported when ctx expires 卡住的订阅者在ctx到期时报告
+	addSub("stuck", -1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, err = server.BroadcastSync(ctx, &IOMsg{Action: "sync", Data: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(map[string]bool)
+	for _, r := range res {
+		if r.Err == nil {
+			written[r.Remote] = true
+		} else if r.Err.Code != core.ErrTimeout {
+			t.Fatalf("unexpected error of %s: %v", r.Remote, r.Err)
+		}
+	}
+	if len(res) != 3 || !written["fast"] || !written["slow"] || written["stuck"] {
+		t.Fatalf("expect fast and slow written only, got %v", written)
+	}
+	// no subscribers returns at once 无订阅者时立即返回
+	res, err = server.BroadcastSync(context.Background(), &IOMsg{Action: "none"})
+	if err != nil || len(res) != 0 {
+		t.Fatalf("expect no results, got %v %v", res, err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	msgs := make([]*IOMsg, 0, 50)
+	for i := 0; i < 50; i++ {
+		msgs = append(msgs, &IOMsg{Action: "price", Data: map[string]interface{}{
+			"symbol": "BTC/USDT:USDT", "price": 65000.5 + float64(i), "seq": i}})
+	}
+	var records []byte
+	single := 0
+	for _, msg := range msgs {
+		raw, err := encodeMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := compressTo(nil, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		single += len(frame)
+		records = binary.LittleEndian.AppendUint32(records, uint32(len(raw)))
+		records = append(records, raw...)
+	}
+	batch, err := encodeBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch)*3 > single {
+		t.Fatalf("batch should compress far better, batch %d, individually %d", len(batch), single)
+	}
+	// written in one frame, read back one by one in order 在一个帧中写出，按顺序逐条读回
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	out := &writeCountConn{Conn: left, w: left}
+	sender := &BanConn{Conn: out, Remote: "left", Ready: true, Negotiated: DefaultCaps()}
+	recver := &BanConn{Conn: right, Remote: "right", Ready: true}
+	go func() {
+		if err := sender.WriteBatch(msgs); err != nil {
+			t.Errorf("write batch fail: %v", err)
+		}
+	}()
+	for i := range msgs {
+		msg, err := recver.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data map[string]interface{}
+		if err_ := utils.Unmarshal(msg.Data, &data, utils.JsonNumDefault); err_ != nil {
+			t.Fatal(err_)
+		}
+		if msg.Action != "price" || data["seq"] != float64(i) {
+			t.Fatalf("msg %d mismatch: %s %v", i, msg.Action, data)
+		}
+	}
+	// length prefix and frame are written by two Write calls 长度前缀和帧由两次Write写出
+	if writes := out.writes.Load(); writes != 2 {
+		t.Fatalf("expect one frame, got %d writes", writes)
+	}
+	// a truncated record rejects the whole batch 截断的记录会拒绝整个批次
+	bad, _ := encodeBatch(records[:len(records)-3])
+	if _, err = decodeBatch(bad, MaxFrameSize); err == nil || err.Code != core.ErrInvalidMsg {
+		t.Fatalf("truncated batch should be invalid, got %v", err)
+	}
+}
+
+func TestConnInfo(t *testing.T) {
+	server, addr := startTestServer(t)
+	start := btime.UTCStamp()
+	roles := []string{"trader", "dashboard"}
+	for _, role := range roles {
+		client, err := NewClientIO(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DoConnect = nil
+		client.Role = role
+		go client.RunForever()
+		t.Cleanup(func() {
+			_ = client.Close()
+		})
+	}
+	// roles are known once hello arrives 收到hello后角色已知
+	waitFor(t, "hello of clients", func() bool {
+		infos := server.ConnInfo()
+		return len(infos) == 2 && infos[0].Role != "" && infos[1].Role != ""
+	})
+	infos := server.ConnInfo()
+	slices.SortFunc(infos, func(a, b *BanConnInfo) int {
+		return strings.Compare(a.Role, b.Role)
+	})
+	for i, role := range []string{"dashboard", "trader"} {
+		info := infos[i]
+		if info.Role != role || !info.Ready || info.ConnectedAt < start || info.LastSeen < info.ConnectedAt {
+			t.Fatalf("bad info of %s: %+v", role, info)
+		}
+	}
+}
+
+func TestResyncMarker(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	sender := &BanConn{Conn: left, Remote: "left", Ready: true, ResyncMarker: true}
+	recver := &BanConn{Conn: right, Remote: "right", Ready: true, ResyncMarker: true}
+	go func() {
+		_ = sender.WriteMsg(&IOMsg{Action: "a", Data: 1})
+		// a frame whose length is shorter than its body, the rest is garbage 长度小于内容的帧，剩余部分是垃圾数据
+		bad := sender.frameHeader(10)
+		bad = append(bad, bytes.Repeat([]byte{0x5A}, 30)...)
+		// a false marker with an invalid size 带无效大小的误匹配标记
+		bad = append(bad, resyncMagic...)
+		bad = append(bad, 0xFF, 0xFF, 0xFF, 0xFF)
+		_, _ = left.Write(bad)
+		_ = sender.WriteMsg(&IOMsg{Action: "b", Data: 2})
+	}()
+	msg, err := recver.ReadMsg()
+	if err != nil || msg.Action != "a" {
+		t.Fatalf("expect a, got %v %v", msg, err)
+	}
+	fails := 0
+	for {
+		msg, err = recver.ReadMsg()
+		if err == nil {
+			break
+		}
+		// corrupt frames fail decoding, as skipped by RunForever 损坏的帧解码失败，RunForever会跳过
+		if err.Code != core.ErrDeCompressFail && err.Code != core.ErrInvalidMsg || fails > 2 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fails += 1
+	}
+	if msg.Action != "b" || fails != 1 {
+		t.Fatalf("expect b after 1 corrupt frame, got %s after %d", msg.Action, fails)
+	}
+	// without the marker a bad size drops the conn 没有标记时无效大小会断开连接
+	left2, right2 := net.Pipe()
+	defer left2.Close()
+	defer right2.Close()
+	go func() {
+		_, _ = left2.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}()
+	plain := &BanConn{Conn: right2, Remote: "right2", Ready: true}
+	if _, err = plain.ReadMsg(); err == nil || err.Code != core.ErrNetReadFail {
+		t.Fatalf("expect read fail without marker, got %v", err)
+	}
+}
+
+func TestOversizePolicy(t *testing.T) {
+	big := make([]byte, 4096)
+	_, _ = rand.Read(big)
+	read := func(policy string) (*IOMsgRaw, *errs.Error) {
+		left, right := net.Pipe()
+		defer left.Close()
+		defer right.Close()
+		sender := &BanConn{Conn: left, Remote: "left", Ready: true}
+		recver := &BanConn{Conn: right, Remote: "right", Ready: true, MaxMsgSize: 1024, OversizePolicy: policy}
+		go func() {
+			if err := sender.WriteMsg(&IOMsg{Action: "big", RawData: big}); err != nil {
+				return
+			}
+			_ = sender.WriteMsg(&IOMsg{Action: "ok", Data: 1})
+		}()
+		return recver.ReadMsg()
+	}
+	msg, err := read(OversizeSkip)
+	if err != nil || msg.Action != "ok" {
+		t.Fatalf("skip policy should read the valid frame, got %v %v", msg, err)
+	}
+	if _, err = read(""); err == nil || err.Code != core.ErrNetReadFail {
+		t.Fatalf("close policy should fail the read, got %v", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	server, addr := startTestServer(t)
+	clients := []*ClientIO{startTestClient(t, addr), startTestClient(t, addr)}
+	dash, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dash.DoConnect = nil
+	dash.Role = "dashboard"
+	go dash.RunForever()
+	t.Cleanup(func() {
+		_ = dash.Close()
+	})
+	// server conn of each client, by address 按地址找到每个客户端对应的服务端连接
+	srvConn := func(client *ClientIO) *BanConn {
+		local := client.Conn.LocalAddr().String()
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		for _, conn := range server.Conns {
+			if c := conn.(*BanConn); c.RemoteAddr == local {
+				return c
+			}
+		}
+		return nil
+	}
+	waitFor(t, "connect", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		return len(server.Conns) == 3 && server.Conns[2].(*BanConn).PeerRole() != ""
+	})
+	kicked := srvConn(clients[0])
+	if num := server.Disconnect(clients[0].Conn.LocalAddr().String()); num != 1 {
+		t.Fatalf("expect 1 conn disconnected, got %d", num)
+	}
+	if num := server.Disconnect("127.0.0.1:1"); num != 0 {
+		t.Fatalf("unknown remote should disconnect none, got %d", num)
+	}
+	if kicked.getConn() != nil || srvConn(clients[0]) != nil {
+		t.Fatal("kicked conn should be closed and removed")
+	}
+	kept, dashConn := srvConn(clients[1]), srvConn(dash)
+	if kept == nil || kept.getConn() == nil || dashConn == nil {
+		t.Fatal("other conns should remain")
+	}
+	// the kicked client sees the close 被踢的客户端感知到关闭
+	waitFor(t, "client closed", func() bool {
+		return clients[0].getConn() == nil
+	})
+	if num := server.DisconnectRole("dashboard"); num != 1 {
+		t.Fatalf("expect 1 dashboard disconnected, got %d", num)
+	}
+	if dashConn.getConn() != nil || kept.getConn() == nil {
+		t.Fatal("only the dashboard should be disconnected by role")
+	}
+	server.lockConns.Lock()
+	defer server.lockConns.Unlock()
+	if len(server.Conns) != 1 || server.Conns[0] != kept {
+		t.Fatalf("expect only the kept conn left, got %d", len(server.Conns))
+	}
+}
+
+func TestTopology(t *testing.T) {
+	server, addr := startTestServer(t)
+	c1 := startTestClient(t, addr)
+	c2 := startTestClient(t, addr)
+	c3 := startTestClient(t, addr)
+	if err := c1.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"ta", "tb"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"ta"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		subs := server.Subscriptions()
+		return len(subs) == 3 && len(subs[c1.Conn.LocalAddr().String()]) == 2 &&
+			len(subs[c2.Conn.LocalAddr().String()]) == 1
+	})
+	topo := server.Topology()
+	r1, r2, r3 := c1.Conn.LocalAddr().String(), c2.Conn.LocalAddr().String(), c3.Conn.LocalAddr().String()
+	var edges []string
+	for _, e := range topo.Edges {
+		edges = append(edges, e.From+">"+e.To)
+	}
+	want := []string{"conn:" + r1 + ">tag:ta", "conn:" + r1 + ">tag:tb", "conn:" + r2 + ">tag:ta"}
+	slices.Sort(want)
+	if !slices.Equal(edges, want) {
+		t.Fatalf("edges mismatch, got %v, want %v", edges, want)
+	}
+	nodes := make(map[string]*TopoNode)
+	for _, n := range topo.Nodes {
+		nodes[n.ID] = n
+	}
+	if len(nodes) != 5 {
+		t.Fatalf("expect 3 conns and 2 tags, got %d nodes", len(nodes))
+	}
+	degrees := map[string]int{"conn:" + r1: 2, "conn:" + r2: 1, "conn:" + r3: 0, "tag:ta": 2, "tag:tb": 1}
+	for id, degree := range degrees {
+		if n := nodes[id]; n == nil || n.Degree != degree {
+			t.Fatalf("bad node %s: %+v", id, n)
+		}
+	}
+	if topo.Nodes[0].Kind != TopoNodeConn || topo.Nodes[len(topo.Nodes)-1].Kind != TopoNodeTag {
+		t.Fatal("nodes should be sorted by kind")
+	}
+	raw, err_ := utils.Marshal(topo)
+	if err_ != nil || !strings.Contains(string(raw), `"from":"conn:`+r2+`","to":"tag:ta"`) {
+		t.Fatalf("bad json: %s %v", raw, err_)
+	}
+}
+
+func TestClientCacheVal(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	server.SetVal(&KeyValExpire{Key: "cfg", Val: "a"})
+	server.SetVal(&KeyValExpire{Key: "raw", Val: "a"})
+	client.CacheVal("cfg", time.Millisecond*200)
+	for _, key := range []string{"cfg", "raw"} {
+		if val, err := client.GetVal(key, 3); err != nil || val != "a" {
+			t.Fatalf("first read of %s: %v %v", key, val, err)
+		}
+	}
+	server.SetVal(&KeyValExpire{Key: "cfg", Val: "b"})
+	server.SetVal(&KeyValExpire{Key: "raw", Val: "b"})
+	if val, _ := client.GetVal("cfg", 3); val != "a" {
+		t.Fatalf("should hit cache within ttl, got %s", val)
+	}
+	if val, _ := client.GetVal("raw", 3); val != "b" {
+		t.Fatalf("uncached key should read server, got %s", val)
+	}
+	time.Sleep(time.Millisecond * 250)
+	if val, _ := client.GetVal("cfg", 3); val != "b" {
+		t.Fatalf("should miss after ttl, got %s", val)
+	}
+	// the fresh value is cached again 新值再次被缓存
+	server.SetVal(&KeyValExpire{Key: "cfg", Val: "c"})
+	if val, _ := client.GetVal("cfg", 3); val != "b" {
+		t.Fatalf("should cache the fresh value, got %s", val)
+	}
+	if err := client.SetVal(&KeyValExpire{Key: "cfg", Val: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := client.GetVal("cfg", 3); val != "d" {
+		t.Fatalf("SetVal should invalidate the cache, got %s", val)
+	}
+	client.CacheVal("cfg", 0)
+	server.SetVal(&KeyValExpire{Key: "cfg", Val: "e"})
+	if val, _ := client.GetVal("cfg", 3); val != "e" {
+		t.Fatalf("disabled cache should read server, got %s", val)
+	}
+}
+
+func TestBanStream(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	server := NewBanServer(addr, "test")
+	server.StreamWindow = 2
+	release := make(chan struct{})
+	server.InitConn = func(c *BanConn) {
+		c.AsyncHandles = 4
+		for _, id := range []string{"kline", "order"} {
+			st := c.Stream(id)
+			st.Listens["req"] = func(action string, data []byte) {
+				var n int
+				_ = MsgSerializer.Unmarshal(data, &n)
+				if err := st.WriteMsg(&IOMsg{Action: "res", Data: fmt.Sprintf("%s-%d", st.ID, n)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		c.Stream("slow").Listens["req"] = func(action string, data []byte) {
+			<-release
+		}
+	}
+	go server.Serve(ln)
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DoConnect = nil
+	client.StreamWindow = 2
+	var lock sync.Mutex
+	got := make(map[string][]string)
+	for _, id := range []string{"kline", "order"} {
+		client.Stream(id).Listens["res"] = func(action string, data []byte) {
+			var val string
+			_ = MsgSerializer.Unmarshal(data, &val)
+			lock.Lock()
+			got[id] = append(got[id], val)
+			lock.Unlock()
+		}
+	}
+	var crossTalk atomic.Int64
+	client.Listens["res"] = func(action string, data []byte) {
+		crossTalk.Add(1)
+	}
+	go client.RunForever()
+	t.Cleanup(func() {
+		close(release)
+		_ = client.Conn.Close()
+	})
+	var wg sync.WaitGroup
+	for _, id := range []string{"kline", "order"} {
+		wg.Add(1)
+		go func(st *BanStream) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := st.WriteMsg(&IOMsg{Action: "req", Data: i}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(client.Stream(id))
+	}
+	wg.Wait()
+	waitFor(t, "stream replies", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(got["kline"]) == 20 && len(got["order"]) == 20
+	})
+	lock.Lock()
+	for id, vals := range got {
+		for _, v := range vals {
+			if !strings.HasPrefix(v, id+"-") {
+				t.Fatalf("stream %s got reply of another stream: %s", id, v)
+			}
+		}
+	}
+	lock.Unlock()
+	if crossTalk.Load() != 0 {
+		t.Fatal("stream msgs should not reach conn Listens")
+	}
+	// a stuck stream blocks only its own writers 卡住的流只阻塞自身的写入
+	oldWait := StreamWriteWait
+	StreamWriteWait = time.Millisecond * 100
+	defer func() {
+		StreamWriteWait = oldWait
+	}()
+	slow := client.Stream("slow")
+	for i := 0; i < 2; i++ {
+		if err = slow.WriteMsg(&IOMsg{Action: "req", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = slow.WriteMsg(&IOMsg{Action: "req", Data: 2}); err == nil || err.Code != core.ErrTimeout {
+		t.Fatalf("full stream should time out, got %v", err)
+	}
+	if out, window := slow.Credits(); out != 2 || window != 2 {
+		t.Fatalf("bad credits of slow stream: %d %d", out, window)
+	}
+	if err = client.Stream("kline").WriteMsg(&IOMsg{Action: "req", Data: 99}); err != nil {
+		t.Fatalf("other streams should not be blocked: %v", err)
+	}
+	waitFor(t, "reply of kline", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(got["kline"]) == 21
+	})
+}
+
+func TestRejectFull(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	server := NewBanServer(addr, "test")
+	server.MaxConns = 1
+	server.RejectRetryAfter = time.Millisecond * 300
+	go server.Serve(ln)
+	startTestClient(t, addr)
+	waitFor(t, "first client", func() bool {
+		return len(server.ConnInfo()) == 1
+	})
+	type stateEvt struct {
+		state int
+		err   *errs.Error
+		at    time.Time
+	}
+	events := make(chan *stateEvt, 10)
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RetryImmediate = true
+	// gives up once the listener is closed 监听关闭后放弃
+	client.MaxReconnects = 1
+	client.OnStateChange = func(c *BanConn, state int, err *errs.Error) {
+		select {
+		case events <- &stateEvt{state: state, err: err, at: time.Now()}:
+		default:
+		}
+	}
+	go client.RunForever()
+	next := func() *stateEvt {
+		select {
+		case evt := <-events:
+			return evt
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait state change timeout")
+		}
+		return nil
+	}
+	lost := next()
+	if lost.state != ConnStateLost || lost.err == nil || lost.err.Code != core.ErrBusy ||
+		!strings.Contains(lost.err.Short(), "server full") {
+		t.Fatalf("expect lost with the reject reason, got %d %v", lost.state, lost.err)
+	}
+	ready := next()
+	if ready.state != ConnStateReady {
+		t.Fatalf("expect reconnected, got %d", ready.state)
+	}
+	// RetryImmediate is overridden by the hint 重试提示覆盖RetryImmediate
+	if gap := ready.at.Sub(lost.at); gap < time.Millisecond*300 {
+		t.Fatalf("should retry after the hint, retried after %v", gap)
+	}
+	if len(server.ConnInfo()) != 1 {
+		t.Fatal("rejected conn should not be kept")
+	}
+}
+
+func TestLostBuffer(t *testing.T) {
+	core.SetRunMode(core.RunModeLive)
+	ln, err_ := net.Listen("tcp", "127.0.0.1:0")
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	server := NewBanServer(addr, "test")
+	server.LostBuffer = map[string]int{"tk": 2}
+	go server.Serve(ln)
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leave a window to broadcast while it's lost 留出断开期间广播的时间窗口
+	client.RetryWait = time.Millisecond * 300
+	// gives up once the listener is closed 监听关闭后放弃
+	client.MaxReconnects = 2
+	got := make(chan string, 10)
+	onMsg := func(action string, data []byte) {
+		var val string
+		_ = MsgSerializer.Unmarshal(data, &val)
+		got <- action + ":" + val
+	}
+	client.Listens["tk"] = onMsg
+	client.Listens["other"] = onMsg
+	if err = client.SetName("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk", "other"}}); err != nil {
+		t.Fatal(err)
+	}
+	go client.RunForever()
+	t.Cleanup(func() {
+		if conn := client.Conn; conn != nil {
+			_ = conn.Close()
+		}
+	})
+	var srvConn *BanConn
+	waitFor(t, "subscribe", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		if len(server.Conns) == 1 && server.Conns[0].HasTag("other") {
+			srvConn = server.Conns[0].(*BanConn)
+		}
+		return srvConn != nil
+	})
+	_ = client.Conn.Close()
+	waitFor(t, "lost", func() bool {
+		return srvConn.getConn() == nil
+	})
+	for _, msg := range []*IOMsg{{Action: "tk", Data: "a1"}, {Action: "other", Data: "o1"},
+		{Action: "tk", Data: "a2"}, {Action: "tk", Data: "a3"}} {
+		if err = server.Broadcast(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() string {
+		select {
+		case val := <-got:
+			return val
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait msg timeout")
+		}
+		return ""
+	}
+	// the oldest beyond the buffer and tags without a buffer are dropped 超出缓存的最早消息和无缓存的tag被丢弃
+	for _, expect := range []string{"tk:a2", "tk:a3"} {
+		if val := next(); val != expect {
+			t.Fatalf("expect %s, got %s", expect, val)
+		}
+	}
+	// subscriptions are restored for live broadcasts 订阅被恢复以接收实时广播
+	if err = server.Broadcast(&IOMsg{Action: "other", Data: "o2"}); err != nil {
+		t.Fatal(err)
+	}
+	if val := next(); val != "other:o2" {
+		t.Fatalf("expect other:o2, got %s", val)
+	}
+}
+
+func TestDerivedTag(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	vols := make(map[string]float64)
+	_, err := server.Derive("basket_vol", []string{"vol_BTC", "vol_ETH"}, func(msg *IOMsg) *IOMsg {
+		vols[msg.Action] = msg.Data.(float64)
+		total := 0.0
+		for _, v := range vols {
+			total += v
+		}
+		return &IOMsg{Data: total}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Derive("loop", []string{"loop"}, func(msg *IOMsg) *IOMsg { return msg }); err == nil {
+		t.Fatal("a tag deriving from itself should be rejected")
+	}
+	got := make(chan float64, 10)
+	client.Listens["basket_vol"] = func(_ string, data []byte) {
+		var val float64
+		_ = MsgSerializer.Unmarshal(data, &val)
+		got <- val
+	}
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"basket_vol"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		for _, tags := range server.Subscriptions() {
+			return slices.Contains(tags, "basket_vol")
+		}
+		return false
+	})
+	// sources have no subscribers, the aggregate is still updated 来源没有订阅者，聚合值仍被更新
+	updates := []*IOMsg{{Action: "vol_BTC", Data: 10.0}, {Action: "vol_ETH", Data: 5.0},
+		{Action: "other", Data: 100.0}, {Action: "vol_BTC", Data: 12.0}}
+	for _, msg := range updates {
+		if err = server.Broadcast(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expect := range []float64{10, 15, 17} {
+		select {
+		case val := <-got:
+			if val != expect {
+				t.Fatalf("expect %v, got %v", expect, val)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("wait aggregate %v timeout", expect)
+		}
+	}
+	server.RemoveDerived("basket_vol")
+	if err = server.Broadcast(&IOMsg{Action: "vol_ETH", Data: 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case val := <-got:
+		t.Fatalf("removed derived tag should not update, got %v", val)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestDraining(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	got := make(chan string, 10)
+	rejects := make(chan *SubReject, 1)
+	client.OnSubReject = func(rej *SubReject) {
+		rejects <- rej
+	}
+	for _, tag := range []string{"tk", "new"} {
+		client.Listens[tag] = func(action string, _ []byte) {
+			got <- action
+		}
+	}
+	hasTag := func(tag string) bool {
+		for _, tags := range server.Subscriptions() {
+			return slices.Contains(tags, tag)
+		}
+		return false
+	}
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		return hasTag("tk")
+	})
+	server.SetDraining(true)
+	if err := client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk", "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rej := <-rejects:
+		if len(rej.Tags) != 1 || rej.Tags[0] != "new" || rej.Reason != DrainReason {
+			t.Fatalf("bad sub reject: %+v", rej)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("new subscription should be refused")
+	}
+	// established subscriptions keep receiving 已有订阅继续接收
+	for _, tag := range []string{"new", "tk"} {
+		if err := server.Broadcast(&IOMsg{Action: tag, Data: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case action := <-got:
+		if action != "tk" {
+			t.Fatalf("expect tk, got %s", action)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait broadcast timeout")
+	}
+	// new conns are rejected with the reason 新连接带原因被拒绝
+	raw, err_ := net.Dial("tcp", addr)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	defer raw.Close()
+	conn := &BanConn{Conn: raw, Remote: addr, Ready: true}
+	msg, err := conn.ReadMsg()
+	if err != nil || msg.Action != "onReject" || !strings.Contains(string(msg.Data), DrainReason) {
+		t.Fatalf("expect onReject of draining, got %v %v", msg, err)
+	}
+	server.SetDraining(false)
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"new"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe after draining", func() bool {
+		return hasTag("new")
+	})
+}
+
+func TestDrainingRequests(t *testing.T) {
+	server, addr := startTestServer(t)
+	client := startTestClient(t, addr)
+	rejects := make(chan *ReqReject, 1)
+	client.OnReqReject = func(rej *ReqReject) {
+		rejects <- rej
+	}
+	server.SetDraining(true)
+	ctx := context.Background()
+	if _, err := client.IncrBy(ctx, &KeyIncr{Key: "drain_incr", Delta: 1}); err == nil ||
+		!strings.Contains(err.Message(), DrainReason) {
+		t.Fatalf("incr should be refused, got %v", err)
+	}
+	<-rejects
+	if _, err := client.SetValNX(ctx, &KeyValExpire{Key: "drain_nx", Val: "1"}); err == nil {
+		t.Fatal("setNX should be refused")
+	}
+	<-rejects
+	if err := client.SetVal(&KeyValExpire{Key: "drain_set", Val: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rej := <-rejects:
+		if rej.Action != "onSetVal" || rej.Reason != DrainReason {
+			t.Fatalf("bad req reject: %+v", rej)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("setVal should be refused")
+	}
+	if val := server.GetVal("drain_set"); val != "" {
+		t.Fatalf("refused setVal stored %q", val)
+	}
+	server.SetDraining(false)
+	if num, err := client.IncrBy(ctx, &KeyIncr{Key: "drain_incr", Delta: 1}); err != nil || num != 1 {
+		t.Fatalf("incr after draining: %v %v", num, err)
+	}
+}
+
+func TestHandshakeFail(t *testing.T) {
+	server, addr := startTestServer(t)
+	server.AuthToken = "secret"
+	badCodec := DefaultCaps()
+	badCodec.Codecs = []string{"lz4"}
+	oldVer := DefaultCaps()
+	oldVer.Version = 0
+	cases := []struct {
+		name string
+		opts *ClientOpts
+		code int
+	}{
+		{"auth", &ClientOpts{Token: "wrong"}, core.ErrAuthFail},
+		{"no token", &ClientOpts{}, core.ErrAuthFail},
+		{"version", &ClientOpts{Token: "secret", Caps: oldVer}, core.ErrVersionMismatch},
+		{"codec", &ClientOpts{Token: "secret", Caps: badCodec}, core.ErrCodecMismatch},
+	}
+	for _, c := range cases {
+		c.opts.HandshakeTimeout = time.Second * 3
+		client, err := NewClientIOOpts(addr, c.opts)
+		if err == nil {
+			_ = client.Close()
+			t.Fatalf("%s: expect handshake fail", c.name)
+		}
+		if err.Code != c.code {
+			t.Fatalf("%s: expect code %d, got %v", c.name, c.code, err)
+		}
+	}
+	client, err := NewClientIOOpts(addr, &ClientOpts{Token: "secret", HandshakeTimeout: time.Second * 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	got := make(chan int, 1)
+	client.Listens["tk"] = func(_ string, data []byte) {
+		var v int
+		_ = utils.Unmarshal(data, &v, utils.JsonNumDefault)
+		got <- v
+	}
+	go client.RunForever()
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		for _, conn := range server.Conns {
+			if conn.HasTag("tk") {
+				return true
+			}
+		}
+		return false
+	})
+	if err = server.Broadcast(&IOMsg{Action: "tk", Data: 3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-got:
+		if v != 3 {
+			t.Fatalf("expect 3, got %d", v)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait broadcast timeout")
+	}
+}
+
+func TestHandshakeNoRetry(t *testing.T) {
+	server, addr := startTestServer(t)
+	server.AuthToken = "secret"
+	client, err := NewClientIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.AuthToken = "wrong"
+	client.RetryImmediate = true
+	var dials, lastState atomic.Int32
+	client.OnStateChange = func(c *BanConn, state int, err *errs.Error) {
+		lastState.Store(int32(state))
+	}
+	doConnect := client.DoConnect
+	client.DoConnect = func(c *BanConn) {
+		dials.Add(1)
+		doConnect(c)
+	}
+	done := make(chan *errs.Error, 1)
+	go func() {
+		done <- client.RunForever()
+	}()
+	select {
+	case err = <-done:
+		if err == nil || err.Code != core.ErrAuthFail {
+			t.Fatalf("expect auth fail, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("wrong credentials should stop reconnecting")
+	}
+	if num := dials.Load(); num != 0 {
+		t.Fatalf("should not redial, dialed %d times", num)
+	}
+	if state := lastState.Load(); state != ConnStateClosed {
+		t.Fatalf("expect closed, got %d", state)
+	}
+}
+
+func TestBanTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	BanTracer = provider.Tracer("banio")
+	defer func() {
+		BanTracer = nil
+	}()
+	server, addr := startTestServer(t)
+	server.SetVal(&KeyValExpire{Key: "k1", Val: "v1"})
+	client := startTestClient(t, addr)
+	val, err := client.GetVal("k1", 3)
+	if err != nil || val != "v1" {
+		t.Fatalf("get val fail: %s %v", val, err)
+	}
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	waitFor(t, "server spans", func() bool {
+		for _, span := range rec.Ended() {
+			spans[span.Name()] = span
+		}
+		return spans["banio.handle onGetVal"] != nil && spans["banio.decompress"] != nil
+	})
+	req := spans["banio.request onGetVal"]
+	if req == nil || req.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("missing client span, got %v", slices.Collect(maps.Keys(spans)))
+	}
+	for _, name := range []string{"banio.compress", "banio.decompress", "banio.handle onGetVal"} {
+		span := spans[name]
+		if span == nil {
+			t.Fatalf("missing span %s", name)
+		}
+		if span.Parent().SpanID() != req.SpanContext().SpanID() ||
+			span.SpanContext().TraceID() != req.SpanContext().TraceID() {
+			t.Fatalf("%s should be a child of the request span", name)
+		}
+	}
+	if kind := spans["banio.handle onGetVal"].SpanKind(); kind != trace.SpanKindServer {
+		t.Fatalf("handle span should be of server kind, got %v", kind)
+	}
+	// untraced msgs record nothing 不带追踪的消息不记录
+	num := len(rec.Ended())
+	if err = client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"tk"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe", func() bool {
+		server.lockConns.Lock()
+		defer server.lockConns.Unlock()
+		return len(server.Conns) == 1 && server.Conns[0].HasTag("tk")
+	})
+	if len(rec.Ended()) != num {
+		t.Fatal("untraced msgs should not record spans")
+	}
+}
+
+func TestLegacyRawFallback(t *testing.T) {
+	obCore, logs := observer.New(zap.WarnLevel)
+	log.Setup("info", "", obCore)
+	defer log.Setup("info", "")
+	binMsg, err := encodeMsg(&IOMsg{Action: "b1", RawData: []byte{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	data = append(data, lenFrame([]byte(`{"action":"a1","data":1}`))...)
+	data = append(data, lenFrame(binMsg)...)
+	data = append(data, lenFrame([]byte(`{"action":"a2","data":2}`))...)
+	// neither compressed nor a valid msg 既非压缩帧也非有效消息
+	data = append(data, lenFrame([]byte(`{"action":`))...)
+	data = append(data, lenFrame([]byte{0x42, 'x'})...)
+	msgs, err := readAllMsgs(data)
+	if err == nil || err.Code != core.ErrNetConnect {
+		t.Fatalf("expect EOF at last, got %v", err)
+	}
+	if len(msgs) != 3 || msgs[0].Action != "a1" || string(msgs[0].Data) != "1" || msgs[1].Action != "b1" ||
+		!msgs[1].Binary || !bytes.Equal(msgs[1].Data, []byte{1, 2, 3}) || msgs[2].Action != "a2" {
+		t.Fatalf("uncompressed frames should be read by fallback, got %d msgs", len(msgs))
+	}
+	if num := logs.FilterMessage("decompress fail, read as uncompressed legacy frame").Len(); num != 1 {
+		t.Fatalf("fallback should be logged once per conn, got %d", num)
+	}
+}
+
+func TestMaxTagSubs(t *testing.T) {
+	server, addr := startTestServer(t)
+	server.MaxTagSubs = map[string]int{"book.": 2}
+	type tagClient struct {
+		client  *ClientIO
+		got     chan string
+		rejects chan *SubReject
+	}
+	newClient := func() *tagClient {
+		client, err := NewClientIO(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DoConnect = nil
+		res := &tagClient{client: client, got: make(chan string, 10), rejects: make(chan *SubReject, 10)}
+		client.OnSubReject = func(rej *SubReject) {
+			res.rejects <- rej
+		}
+		client.Listens["book."] = func(action string, _ []byte) {
+			res.got <- action
+		}
+		go client.RunForever()
+		t.Cleanup(func() {
+			_ = client.Close()
+		})
+		return res
+	}
+	subNum := func(tag string) int {
+		num := 0
+		for _, tags := range server.Subscriptions() {
+			if slices.Contains(tags, tag) {
+				num += 1
+			}
+		}
+		return num
+	}
+	clients := []*tagClient{newClient(), newClient(), newClient()}
+	for i, c := range clients {
+		if err := c.client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"book.BTC", "tk"}}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "subscribe", func() bool {
+			return subNum("tk") == i+1
+		})
+	}
+	if num := subNum("book.BTC"); num != 2 {
+		t.Fatalf("expect 2 subscribers of book.BTC, got %d", num)
+	}
+	select {
+	case rej := <-clients[2].rejects:
+		if len(rej.Tags) != 1 || rej.Tags[0] != "book.BTC" || rej.Reason != TagFullReason {
+			t.Fatalf("bad sub reject: %+v", rej)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("the third subscription should be refused")
+	}
+	// subscribing again by existing subscribers is not limited 已有订阅者再次订阅不受限制
+	if err := clients[0].client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"book.BTC"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Broadcast(&IOMsg{Action: "book.BTC", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clients[:2] {
+		select {
+		case <-c.got:
+		case <-time.After(time.Second * 3):
+			t.Fatalf("client %d should keep receiving", i)
+		}
+	}
+	select {
+	case <-clients[2].got:
+		t.Fatal("refused client should not receive")
+	case rej := <-clients[0].rejects:
+		t.Fatalf("existing subscriber should not be refused: %+v", rej)
+	case <-time.After(time.Millisecond * 100):
+	}
+	// a slot is freed once a subscriber leaves 订阅者离开后释放名额
+	if err := clients[0].client.WriteMsg(&IOMsg{Action: "unsubscribe", Data: []string{"book.BTC"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unsubscribe", func() bool {
+		return subNum("book.BTC") == 1
+	})
+	if err := clients[2].client.WriteMsg(&IOMsg{Action: "subscribe", Data: []string{"book.BTC"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribe after freed", func() bool {
+		return subNum("book.BTC") == 2
+	})
+}
+
+func TestCursorResume(t *testing.T) {
+	oldSize := ChunkSize
+	ChunkSize = 1 << 10
+	defer func() {
+		ChunkSize = oldSize
+	}()
+	server, addr := startTestServer(t)
+	klines := makeTestKlines(100)
+	server.RegCursorStream("bt", func(sinceMS int64) ([]*banexg.Kline, *errs.Error) {
+		return klines, nil
+	})
+	var lock sync.Mutex
+	var processed []int64
+	// the worker processes limit candles then crashes 工作者处理limit根K线后崩溃
+	runWorker := func(limit int) {
+		client, err := NewClientIO(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.DoConnect = nil
+		defer client.Close()
+		done := make(chan struct{})
+		err = client.ReplayCursor("bt", "w1", func(stream string, arr []*banexg.Kline) {
+			defer close(done)
+			for i, k := range arr {
+				if i >= limit {
+					return
+				}
+				lock.Lock()
+				processed = append(processed, k.Time)
+				lock.Unlock()
+				if err := client.Checkpoint(stream, "w1", k.Time); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.RunForever()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait replay timeout")
+		}
+		lock.Lock()
+		last := processed[len(processed)-1]
+		lock.Unlock()
+		waitFor(t, "checkpoint", func() bool {
+			return server.GetVal(CursorKey("bt", "w1")) == strconv.FormatInt(last, 10)
+		})
+	}
+	runWorker(50)
+	if cur, err := LoadCursor("bt", "w1"); err != nil || cur != klines[49].Time {
+		t.Fatalf("cursor should be the 50th candle, got %d %v", cur, err)
+	}
+	runWorker(len(klines))
+	if len(processed) != len(klines) {
+		t.Fatalf("expect %d candles processed once, got %d", len(klines), len(processed))
+	}
+	for i, k := range klines {
+		if processed[i] != k.Time {
+			t.Fatalf("candle %d reprocessed or skipped: %d != %d", i, processed[i], k.Time)
+		}
+	}
+	if cur, err := LoadCursor("bt", "w2"); err != nil || cur != 0 {
+		t.Fatalf("cursor of a new worker should be 0, got %d %v", cur, err)
+	}
+}
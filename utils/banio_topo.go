@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"sort"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+)
+
+const (
+	TopoNodeConn = "conn"
+	TopoNodeTag  = "tag"
+)
+
+// TopoNode a conn or tag of SubTopology, ID is prefixed by Kind to keep conns and tags apart 订阅拓扑的连接或tag节点
+type TopoNode struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Label  string `json:"label"`
+	Role   string `json:"role,omitempty"` // Role announced by hello, only for conns 通过hello宣告的角色，仅连接节点
+	Degree int    `json:"degree"`         // Subscribed tags of a conn, or subscribers of a tag 连接订阅的tag数，或tag的订阅者数
+}
+
+// TopoEdge a conn From subscribes the tag To 连接From订阅了tag To
+type TopoEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+/*
+SubTopology
+The broadcast subscription graph of the server, nodes are live conns and tags, edges are subscriptions.
+服务器的广播订阅图，节点为活跃连接和tag，边为订阅关系。
+*/
+type SubTopology struct {
+	Nodes []*TopoNode `json:"nodes"`
+	Edges []*TopoEdge `json:"edges"`
+}
+
+/*
+Topology
+Return the subscription graph of live connections for dashboards. Nodes are sorted by kind then label, conns
+without subscriptions are kept as isolated nodes.
+返回活跃连接的订阅图，用于仪表盘展示。节点按类型再按名称排序，没有订阅的连接作为孤立节点保留。
+*/
+func (s *ServerIO) Topology() *SubTopology {
+	s.lockConns.Lock()
+	conns := make([]*BanConn, 0, len(s.Conns))
+	for _, conn := range s.Conns {
+		if c, ok := conn.(*BanConn); ok && !c.IsClosed() {
+			conns = append(conns, c)
+		}
+	}
+	s.lockConns.Unlock()
+	res := &SubTopology{Nodes: make([]*TopoNode, 0), Edges: make([]*TopoEdge, 0)}
+	tagNodes := make(map[string]*TopoNode)
+	for _, c := range conns {
+		c.lockTag.Lock()
+		tags := make([]string, 0, len(c.Tags))
+		for tag := range c.Tags {
+			tags = append(tags, tag)
+		}
+		c.lockTag.Unlock()
+		sort.Strings(tags)
+		remote := c.GetRemote()
+		node := &TopoNode{ID: TopoNodeConn + ":" + remote, Kind: TopoNodeConn, Label: remote, Role: c.PeerRole(),
+			Degree: len(tags)}
+		res.Nodes = append(res.Nodes, node)
+		for _, tag := range tags {
+			tagNode, ok := tagNodes[tag]
+			if !ok {
+				tagNode = &TopoNode{ID: TopoNodeTag + ":" + tag, Kind: TopoNodeTag, Label: tag}
+				tagNodes[tag] = tagNode
+			}
+			tagNode.Degree += 1
+			res.Edges = append(res.Edges, &TopoEdge{From: node.ID, To: tagNode.ID})
+		}
+	}
+	for _, node := range tagNodes {
+		res.Nodes = append(res.Nodes, node)
+	}
+	sort.Slice(res.Nodes, func(i, j int) bool {
+		a, b := res.Nodes[i], res.Nodes[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Label < b.Label
+	})
+	sort.Slice(res.Edges, func(i, j int) bool {
+		a, b := res.Edges[i], res.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return res
+}
+
+/*
+DumpTopology
+Return the subscription graph of the local ban server, see ServerIO.Topology
+返回本地ban服务器的订阅图，见ServerIO.Topology
+*/
+func DumpTopology() (*SubTopology, *errs.Error) {
+	if banServer == nil {
+		return nil, errs.NewMsg(core.ErrRunTime, "banServer not load")
+	}
+	return banServer.Topology(), nil
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/banbox/banexg/errs"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// BanTracer records spans of banio requests, compress, decompress and handlers, nil to disable
+	// 记录banio请求、压缩、解压和处理函数的span，nil表示禁用
+	BanTracer trace.Tracer
+	// traceProp carries the trace context in IOMsg.Trace by W3C traceparent 通过W3C traceparent在IOMsg.Trace中传递追踪上下文
+	traceProp = propagation.TraceContext{}
+)
+
+/*
+startRequestSpan
+Start a client span of the request msg and inject its context into msg.Trace, so the peer continues the trace.
+Return a nil span when BanTracer is not set.
+为请求消息开始一个客户端span并将其上下文注入msg.Trace，使对端延续该追踪。未设置BanTracer时返回nil span。
+*/
+func startRequestSpan(ctx context.Context, msg *IOMsg) trace.Span {
+	tracer := BanTracer
+	if tracer == nil {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer.Start(ctx, "banio.request "+msg.Action, trace.WithSpanKind(trace.SpanKindClient))
+	msg.Trace = make(map[string]string)
+	traceProp.Inject(ctx, propagation.MapCarrier(msg.Trace))
+	return span
+}
+
+// endSpan end the span and record err, span can be nil 结束span并记录err，span可以为nil
+func endSpan(span trace.Span, err *errs.Error, opts ...trace.SpanEndOption) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Short())
+	}
+	span.End(opts...)
+}
+
+/*
+startMsgSpan
+Start a span continuing the trace carried by a msg, nil when BanTracer is not set or the msg carries no trace.
+开始一个延续消息所携带追踪的span，未设置BanTracer或消息不带追踪时为nil。
+*/
+func startMsgSpan(carrier map[string]string, name string, opts ...trace.SpanStartOption) trace.Span {
+	tracer := BanTracer
+	if tracer == nil || len(carrier) == 0 {
+		return nil
+	}
+	ctx := traceProp.Extract(context.Background(), propagation.MapCarrier(carrier))
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	_, span := tracer.Start(ctx, name, opts...)
+	return span
+}
+
+// traceDecompress record the decompress of a traced msg already done in [start, end) 记录已在[start, end)完成的带追踪消息的解压
+func traceDecompress(msg *IOMsgRaw, start, end time.Time) {
+	span := startMsgSpan(msg.Trace, "banio.decompress", trace.WithTimestamp(start))
+	endSpan(span, nil, trace.WithTimestamp(end))
+}
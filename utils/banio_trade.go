@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"go.uber.org/zap"
+)
+
+// TradeTagPrefix tag prefix of trade broadcasts, followed by the symbol 逐笔交易广播的tag前缀，后跟品种
+const TradeTagPrefix = "trade."
+
+// TradeTag tag of trade broadcasts for the symbol 品种逐笔交易广播的tag
+func TradeTag(symbol string) string {
+	return TradeTagPrefix + symbol
+}
+
+/*
+NewTradesMsg
+Build an IOMsg carrying trades of the symbol, subscribers receive it by SubscribeTrades
+构建携带品种逐笔交易的IOMsg，订阅者通过SubscribeTrades接收
+*/
+func NewTradesMsg(symbol string, trades []*banexg.Trade) *IOMsg {
+	return &IOMsg{Action: TradeTag(symbol), Data: trades}
+}
+
+// BroadcastTrades broadcast trades of the symbol to subscribers of TradeTag 向TradeTag的订阅者广播品种的逐笔交易
+func (s *ServerIO) BroadcastTrades(symbol string, trades []*banexg.Trade) *errs.Error {
+	return s.Broadcast(NewTradesMsg(symbol, trades))
+}
+
+/*
+SubscribeTrades
+Subscribe trades of the symbols, cb is called with the decoded trades of each broadcast. The handler is shared by
+all symbols and replaced by later calls, call it before RunForever.
+订阅这些品种的逐笔交易，每次广播解码后调用cb。所有品种共用一个处理函数，后续调用会替换它，应在RunForever之前调用。
+*/
+func (c *ClientIO) SubscribeTrades(cb func(symbol string, trades []*banexg.Trade), symbols ...string) *errs.Error {
+	c.Listens[TradeTagPrefix] = func(action string, data []byte) {
+		var trades []*banexg.Trade
+		err_ := MsgSerializer.Unmarshal(data, &trades)
+		if err_ != nil {
+			log.Warn("receive invalid trades", zap.String("action", action), zap.Error(err_))
+			return
+		}
+		cb(strings.TrimPrefix(action, TradeTagPrefix), trades)
+	}
+	tags := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		tags = append(tags, TradeTag(symbol))
+	}
+	return c.WriteMsg(&IOMsg{Action: "subscribe", Data: tags})
+}
@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sync"
+)
+
+/*
+Transport
+Create listeners and connections for ServerIO and ClientIO, allows running banio over non-TCP backends.
+为ServerIO和ClientIO创建监听和连接，允许banio运行在非TCP的后端上。
+*/
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// DefaultTransport is used when no Transport is given 未指定Transport时使用
+var DefaultTransport Transport = TCPTransport{}
+
+/*
+MemTransport
+In-process transport based on net.Pipe, addresses are only visible within the same MemTransport.
+基于net.Pipe的进程内传输，地址仅在同一个MemTransport内可见。
+*/
+type MemTransport struct {
+	listeners map[string]*memListener
+	lock      deadlock.Mutex
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{listeners: make(map[string]*memListener)}
+}
+
+func (t *MemTransport) Listen(addr string) (net.Listener, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(addr), Err: errAddrInUse}
+	}
+	ln := &memListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{}), tr: t}
+	t.listeners[addr] = ln
+	return ln, nil
+}
+
+func (t *MemTransport) Dial(addr string) (net.Conn, error) {
+	t.lock.Lock()
+	ln, ok := t.listeners[addr]
+	t.lock.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errConnRefused}
+	}
+	local, remote := net.Pipe()
+	select {
+	case ln.conns <- remote:
+		return local, nil
+	case <-ln.done:
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errConnRefused}
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memError string
+
+func (e memError) Error() string { return string(e) }
+
+const (
+	errAddrInUse   = memError("address already in use")
+	errConnRefused = memError("connection refused")
+)
+
+type memListener struct {
+	addr  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	tr    *MemTransport
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.tr.lock.Lock()
+		delete(l.tr.listeners, l.addr)
+		l.tr.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
+
+/*
+setNoDelay
+Set TCP_NODELAY on the underlying *net.TCPConn of conn, return false for non-TCP conns which are left untouched.
+设置conn底层*net.TCPConn的TCP_NODELAY，非TCP连接不做处理并返回false。
+*/
+func setNoDelay(conn net.Conn, on bool) bool {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c.SetNoDelay(on) == nil
+		case interface{ NetConn() net.Conn }:
+			// wrappers like tls.Conn 类似tls.Conn的包装
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+/*
+SetNoDelay
+Update NoDelay and apply it to the current conn, it's also applied to conns created by reconnecting.
+更新NoDelay并应用到当前连接，重连创建的连接也会应用。
+*/
+func (c *BanConn) SetNoDelay(on bool) {
+	c.NoDelay = on
+	c.lockConn.RLock()
+	conn := c.Conn
+	c.lockConn.RUnlock()
+	setNoDelay(conn, on)
+}
+
+// ConnBufSize default ReadBufSize and WriteBufSize of conns 连接默认的ReadBufSize和WriteBufSize
+var ConnBufSize = 16 << 10
+
+/*
+bufReader
+Return the reader of conn, buffered by ReadBufSize. The buffer is recreated when conn is replaced by reconnecting,
+bytes left from the old conn are dropped with it.
+返回conn的读取器，按ReadBufSize缓冲。重连替换conn后重新创建缓冲，旧连接的剩余字节随之丢弃。
+*/
+func (c *BanConn) bufReader(conn net.Conn) io.Reader {
+	if c.ReadBufSize <= 0 {
+		return conn
+	}
+	if c.rbuf == nil || c.rbufConn != conn {
+		c.rbuf = bufio.NewReaderSize(conn, c.ReadBufSize)
+		c.rbufConn = conn
+	}
+	return c.rbuf
+}
+
+/*
+DrainBuffered
+Return msgs of the complete frames left in the read buffer without reading the conn, a partial frame is kept. Call
+it from the read loop before tearing the conn down by yourself, so fully received msgs are not dropped with the
+buffer. A read error never needs it: Read returns all complete buffered frames before the error.
+返回读缓冲中剩余完整帧的消息，不读取连接，不完整的帧被保留。在读取循环中自行断开连接前调用，使完整接收的消息不随缓冲丢弃。
+读取错误时无需调用：Read在返回错误前会先返回所有已缓冲的完整帧。
+*/
+func (c *BanConn) DrainBuffered() ([]*IOMsgRaw, *errs.Error) {
+	var res []*IOMsgRaw
+	for {
+		msg := c.popBatch()
+		if msg == nil {
+			frame := c.bufferedFrame()
+			if frame == nil {
+				return res, nil
+			}
+			var err *errs.Error
+			if frame[0] == codecBatch {
+				msg, err = c.parseBatch(frame)
+			} else {
+				msg, err = c.parseMsg(frame)
+			}
+			if err != nil {
+				return res, err
+			}
+		}
+		if msg.Action != "onDict" {
+			res = append(res, msg)
+		}
+	}
+}
+
+// bufferedFrame take the body of the next frame if it's complete in the read buffer, nil otherwise
+// 下一帧在读缓冲中完整时取出其内容，否则返回nil
+func (c *BanConn) bufferedFrame() []byte {
+	if c.rbuf == nil {
+		return nil
+	}
+	headLen := len(c.frameHeader(0))
+	head, err_ := c.rbuf.Peek(headLen)
+	if err_ != nil || (c.ResyncMarker && !bytes.Equal(head[:len(resyncMagic)], resyncMagic)) {
+		return nil
+	}
+	dataLen := int(binary.LittleEndian.Uint32(head[headLen-4:]))
+	if dataLen == 0 || c.rbuf.Buffered() < headLen+dataLen {
+		return nil
+	}
+	_, _ = c.rbuf.Discard(headLen)
+	buf := make([]byte, dataLen)
+	_, _ = io.ReadFull(c.rbuf, buf)
+	return buf
+}
+
+/*
+bufWriter
+Return the write buffer of conn when a frame of size fits in WriteBufSize, nil to write it to conn directly.
+The buffer is recreated when conn is replaced by reconnecting. Should be called with lockWrite.
+帧大小在WriteBufSize以内时返回conn的写缓冲，返回nil时直接写入conn。重连替换conn后重新创建缓冲。应在持有lockWrite时调用。
+*/
+func (c *BanConn) bufWriter(conn net.Conn, size int) *bufio.Writer {
+	if c.WriteBufSize <= 0 || size > c.WriteBufSize {
+		return nil
+	}
+	if c.wbuf == nil || c.wbufConn != conn {
+		c.wbuf = bufio.NewWriterSize(conn, c.WriteBufSize)
+		c.wbufConn = conn
+	}
+	return c.wbuf
+}
+
+/*
+writeBuffered
+Write the length header and body of a frame to w and flush, so they go out in one write. Like Write, reconnect and
+resend when nothing of the frame is sent. w is always flushed, nothing is pending when the conn is closed.
+将帧的长度头和内容写入w并刷新，使其一次写出。与Write相同，帧未发出任何字节时重连并重发。w总是被刷新，关闭连接时没有待写数据。
+*/
+func (c *BanConn) writeBuffered(conn net.Conn, w *bufio.Writer, lenBt, data []byte) *errs.Error {
+	_, _ = w.Write(lenBt)
+	_, _ = w.Write(data)
+	err_ := w.Flush()
+	if err_ == nil {
+		return nil
+	}
+	// errors are sticky in bufio.Writer 错误在bufio.Writer中会保留
+	unsent := w.Buffered()
+	c.wbuf = nil
+	errCode, errType := getErrType(err_)
+	if unsent == len(lenBt)+len(data) && c.DoConnect != nil && errCode == core.ErrNetConnect {
+		log.Warn("write fail, wait and retry", zap.String("type", errType))
+		if err := c.connect(conn); err != nil {
+			return err
+		}
+		return c.Write(data, true)
+	}
+	c.setReady(false)
+	return errs.New(errCode, err_)
+}
+
+// resyncMagic written ahead of the length of each frame when ResyncMarker is on 启用ResyncMarker时写在每帧长度之前
+var resyncMagic = []byte{0xBA, 0x17, 0xC0, 0xDE}
+
+// frameHeader the header of a frame of size: [resyncMagic] + len(4, little endian) 大小为size的帧头
+func (c *BanConn) frameHeader(size int) []byte {
+	if !c.ResyncMarker {
+		return binary.LittleEndian.AppendUint32(make([]byte, 0, 4), uint32(size))
+	}
+	head := append(make([]byte, 0, 8), resyncMagic...)
+	return binary.LittleEndian.AppendUint32(head, uint32(size))
+}
+
+/*
+resync
+Scan the stream for the next resyncMagic, head holds the bytes of the header just read and is updated in place to
+the header found. At most MaxFrameSize bytes are skipped before giving up.
+在数据流中扫描下一个resyncMagic，head为刚读取的帧头字节，原地更新为找到的帧头。最多跳过MaxFrameSize字节后放弃。
+*/
+func (c *BanConn) resync(in io.Reader, head []byte) *errs.Error {
+	skipped := 0
+	one := make([]byte, 1)
+	for !bytes.Equal(head[:len(resyncMagic)], resyncMagic) {
+		if skipped >= MaxFrameSize {
+			return errs.NewMsg(core.ErrNetReadFail, "resync fail, no marker in %d bytes from %s", skipped,
+				c.GetRemote())
+		}
+		if _, err_ := io.ReadFull(in, one); err_ != nil {
+			return errs.New(core.ErrNetReadFail, err_)
+		}
+		copy(head, head[1:])
+		head[len(head)-1] = one[0]
+		skipped += 1
+	}
+	log.Warn("banio stream resynced", zap.String("remote", c.GetRemote()), zap.Int("skipped", skipped))
+	return nil
+}
@@ -1,10 +1,13 @@
 package base
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/banbox/banbot/core"
+	"github.com/banbox/banbot/utils"
 	"strings"
+	"time"
 
 	"github.com/banbox/banexg/errs"
 	"github.com/banbox/banexg/log"
@@ -15,6 +18,18 @@ import (
 
 var val *validator.Validate
 
+var (
+	// DefaultReqTimeout deadline of requests on routes not in RouteTimeouts, 0 for no deadline 未在RouteTimeouts中的路由的请求期限，0表示不限
+	DefaultReqTimeout = 2 * time.Minute
+	// RouteTimeouts deadline of requests by route path, 0 for no deadline 按路由路径配置的请求期限，0表示不限
+	RouteTimeouts = map[string]time.Duration{
+		"/symbols": 10 * time.Second,
+		"/hists":   5 * time.Minute,
+		"/warmup":  5 * time.Minute,
+		"/export":  30 * time.Minute,
+	}
+)
+
 func init() {
 	val = validator.New(validator.WithRequiredStructEnabled())
 }
@@ -97,6 +112,29 @@ func (f *BadFields) Error() string {
 	return strings.Join(texts, ", ")
 }
 
+/*
+SendEncoded
+Send data as json, compressed by the content coding negotiated from Accept-Encoding (zstd, gzip, deflate or none).
+将data以json发送，按从Accept-Encoding协商的内容编码（zstd, gzip, deflate或不压缩）压缩。
+*/
+func SendEncoded(c *fiber.Ctx, data interface{}) error {
+	raw, err_ := c.App().Config().JSONEncoder(data)
+	if err_ != nil {
+		return err_
+	}
+	enc := utils.NegotiateEncoding(c.Get(fiber.HeaderAcceptEncoding))
+	body, err := utils.EncodeBody(nil, raw, enc)
+	if err != nil {
+		return err
+	}
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if enc != utils.EncodingIdentity {
+		c.Set(fiber.HeaderContentEncoding, enc)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(body)
+}
+
 func ErrHandler(c *fiber.Ctx, err error) error {
 	code := fiber.StatusInternalServerError
 	errText := err.Error()
@@ -112,6 +150,10 @@ func ErrHandler(c *fiber.Ctx, err error) error {
 		eCode := banErr.Code
 		if eCode == errs.CodeParamInvalid || eCode == errs.CodeParamRequired || eCode == core.ErrBadConfig {
 			code = fiber.StatusBadRequest
+		} else if eCode == core.ErrBusy {
+			code = fiber.StatusServiceUnavailable
+		} else if eCode == core.ErrTimeout {
+			code = fiber.StatusGatewayTimeout
 		} else if name, ok := core.ErrCodeNames[eCode]; ok && strings.HasPrefix(name, "Invalid") {
 			code = fiber.StatusBadRequest
 		}
@@ -129,3 +171,30 @@ func ErrHandler(c *fiber.Ctx, err error) error {
 
 	return c.Status(code).SendString(errText)
 }
+
+/*
+ReqTimeout
+Middleware setting a deadline on the user context of requests to route, by RouteTimeouts or DefaultReqTimeout.
+Handlers pass c.UserContext() down to slow fetches, errors after the deadline are returned as 504.
+为route的请求的用户上下文设置期限，取自RouteTimeouts或DefaultReqTimeout。处理函数将c.UserContext()传给耗时的下载，
+超过期限后的错误以504返回。
+*/
+func ReqTimeout(route string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		timeout, ok := RouteTimeouts[route]
+		if !ok {
+			timeout = DefaultReqTimeout
+		}
+		if timeout <= 0 {
+			return c.Next()
+		}
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		err := c.Next()
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fiber.NewError(fiber.StatusGatewayTimeout, fmt.Sprintf("request timeout after %v", timeout))
+		}
+		return err
+	}
+}
@@ -0,0 +1,52 @@
+package base
+
+import (
+	"net"
+
+	"github.com/banbox/banbot/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// DebugKVRedacts values of keys with these prefixes are masked in /debug/kv
+	DebugKVRedacts = []string{"auth_", "token_", "secret_"}
+)
+
+func RegApiDebug(api fiber.Router) {
+	api.Get("/kv", getDebugKV)
+	api.Get("/events", getEvents)
+	api.Get("/topology", getDebugTopology)
+}
+
+/*
+LocalOnly 仅允许本机访问
+*/
+func LocalOnly(c *fiber.Ctx) error {
+	ip := net.ParseIP(c.IP())
+	if ip == nil || !ip.IsLoopback() {
+		return fiber.NewError(fiber.StatusForbidden, "only allowed from localhost")
+	}
+	return c.Next()
+}
+
+/*
+getDebugKV 获取banio服务器当前的KV数据
+*/
+func getDebugKV(c *fiber.Ctx) error {
+	items, err := utils.DumpServerData(DebugKVRedacts...)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Short())
+	}
+	return c.JSON(fiber.Map{"data": items})
+}
+
+/*
+getDebugTopology 获取banio服务器的广播订阅拓扑，节点为连接和tag，边为订阅关系
+*/
+func getDebugTopology(c *fiber.Ctx) error {
+	topo, err := utils.DumpTopology()
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Short())
+	}
+	return c.JSON(topo)
+}
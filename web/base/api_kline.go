@@ -1,23 +1,75 @@
 package base
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 
+	"github.com/banbox/banbot/btime"
+	"github.com/banbox/banbot/core"
 	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	utils2 "github.com/banbox/banexg/utils"
 	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Headers of /hist describing the returned candles, set before the body 描述/hist返回K线的响应头，在响应体之前设置
+const (
+	HeaderKlineCount     = "X-Kline-Count"
+	HeaderKlineFrom      = "X-Kline-From" // Time of the earliest candle in ms 最早K线的毫秒时间
+	HeaderKlineTo        = "X-Kline-To"   // End of the latest candle in ms, exclusive 最新K线的结束毫秒时间，不包含
+	HeaderKlineTruncated = "X-Kline-Truncated"
 )
 
 func RegApiKline(api fiber.Router) {
-	api.Get("/symbols", getSymbols)
-	api.Get("/hist", getHist)
-	api.Get("/all_inds", getTaInds)
-	api.Post("/calc_ind", postCalcInd)
+	api.Get("/symbols", ReqTimeout("/symbols"), getSymbols)
+	api.Get("/hist", ReqTimeout("/hist"), getHist)
+	api.Post("/hists", ReqTimeout("/hists"), postHists)
+	api.Get("/validate", ReqTimeout("/validate"), getValidate)
+	api.Get("/vwap", ReqTimeout("/vwap"), getVwap)
+	api.Get("/pivots", ReqTimeout("/pivots"), getPivots)
+	api.Get("/returns", ReqTimeout("/returns"), getReturns)
+	api.Get("/compare", ReqTimeout("/compare"), getCompare)
+	api.Get("/book", ReqTimeout("/book"), getBook)
+	api.Get("/all_inds", ReqTimeout("/all_inds"), getTaInds)
+	api.Post("/calc_ind", ReqTimeout("/calc_ind"), postCalcInd)
+	api.Post("/calc_ind_stream", ReqTimeout("/calc_ind_stream"), postCalcIndStream)
+	api.Post("/calc_ind_tf", ReqTimeout("/calc_ind_tf"), postCalcIndTF)
+	api.Post("/correlation", ReqTimeout("/correlation"), postCorrelation)
+	api.Post("/export", ReqTimeout("/export"), postExport)
+	api.Post("/warmup", ReqTimeout("/warmup"), postWarmup)
+	api.Post("/backfill", ReqTimeout("/backfill"), postBackfill)
+	api.Get("/backfill", ReqTimeout("/backfill"), getBackfills)
+	api.Delete("/backfill/:id", ReqTimeout("/backfill/:id"), delBackfill)
 }
 
 func getSymbols(c *fiber.Ctx) error {
-	exsList := orm.GetAllExSymbols()
+	type SymbolArgs struct {
+		Group bool   `query:"group"`
+		Query string `query:"q"` // search by symbol, alias spellings like btc-usdt are accepted
+		// name(default), list, see SymbolSortName 排序方式
+		Sort string `query:"sort" validate:"omitempty,oneof=name list"`
+	}
+	var data = new(SymbolArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	exsList := allowedSymbols(orm.GetAllExSymbols())
+	if data.Query != "" {
+		exsList = searchSymbols(exsList, data.Query)
+	}
+	if data.Group {
+		return c.JSON(fiber.Map{"data": groupSymbols(exsList)})
+	}
 	res := make([]map[string]interface{}, 0)
-	for _, exs := range exsList {
+	for _, exs := range sortSymbols(exsList, data.Sort) {
 		res = append(res, map[string]interface{}{
 			"exchange":   exs.Exchange,
 			"market":     exs.Market,
@@ -35,30 +87,420 @@ func getHist(c *fiber.Ctx) error {
 		TimeFrame string `query:"timeframe" validate:"required"`
 		FromMS    int64  `query:"from" validate:"required"`
 		ToMS      int64  `query:"to" validate:"required"`
+		SinceMS   int64  `query:"since"` // last candle time of the client 客户端已有的最后K线时间
+		// time encoding of candles: ms(default), s, rfc3339 K线时间的编码方式
+		TimeFmt string `query:"time_fmt" validate:"omitempty,oneof=ms s rfc3339"`
+		// order of returned candles: asc(default), desc 返回K线的顺序
+		Order string `query:"order" validate:"omitempty,oneof=asc desc"`
+		// report (flag) or also clip (smooth) spike candles 报告(flag)或同时裁剪(smooth)异常K线
+		Filter       string  `query:"filter" validate:"omitempty,oneof=flag smooth"`
+		FilterWindow int     `query:"filter_window" validate:"omitempty,min=2,max=1000"`
+		FilterStd    float64 `query:"filter_std" validate:"omitempty,gt=0"`
+		// store(default), exchange, store_only, exchange_only, see HistStore 数据来源
+		Source string `query:"source" validate:"omitempty,oneof=store exchange store_only exchange_only"`
+		// insert flat candles for missing intervals, indexes returned in "filled" 为缺失周期插入平K线
+		Fill bool `query:"fill"`
+		// also return native fields of the exchange in "native" when available 可用时同时在native中返回交易所原生字段
+		Native bool `query:"native"`
 	}
 	var data = new(HistArgs)
 	if err := VerifyArg(c, data, ArgQuery); err != nil {
 		return err
 	}
+	tf := data.TimeFrame
+	toMS, clampMsg := clampHistRange(tf, data.FromMS, data.ToMS)
+	adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", tf, data.FromMS, toMS,
+		&FetchOpts{Source: data.Source})
+	if err != nil {
+		return err
+	}
+	var spikeMS map[int64]bool
+	if data.Filter != "" {
+		idxs, limits := findSpikes(klines, data.FilterWindow, data.FilterStd)
+		spikeMS = make(map[int64]bool, len(idxs))
+		for _, i := range idxs {
+			spikeMS[klines[i].Time] = true
+		}
+		if data.Filter == SpikeSmooth {
+			klines = smoothSpikes(klines, idxs, limits)
+		}
+	}
+	var filledMS map[int64]bool
+	if data.Fill {
+		klines, filledMS = fillGaps(klines, int64(utils2.TFToSecs(tf)*1000))
+	}
+	klines, full := klinesSince(klines, adjs, data.SinceMS)
+	klines = orderKlines(klines, data.Order)
+	res := fiber.Map{
+		"adjs": adjs,
+		"full": full,
+		"data": arrKlinesFmt(klines, data.TimeFmt),
+	}
+	if spikeMS != nil {
+		// indexes in data 在data中的索引
+		spikes := make([]int, 0, len(spikeMS))
+		for i, k := range klines {
+			if spikeMS[k.Time] {
+				spikes = append(spikes, i)
+			}
+		}
+		res["spikes"] = spikes
+	}
+	if clampMsg != "" {
+		// more bars than HistMaxBars were requested 请求的K线超过HistMaxBars
+		res["clamped"] = fiber.Map{"to": toMS, "msg": clampMsg}
+	}
+	if filledMS != nil {
+		// indexes of flat candles in data 平K线在data中的索引
+		filled := make([]int, 0, len(filledMS))
+		for i, k := range klines {
+			if filledMS[k.Time] {
+				filled = append(filled, i)
+			}
+		}
+		res["filled"] = filled
+	}
+	if data.Native {
+		// aligned with data, nil for candles without native fields 与data对齐，没有原生字段的K线为nil
+		// already validated by FetchKlines 已由FetchKlines校验
+		exs, err_ := resolveShort(data.Exchange, data.Symbol)
+		if err_ != nil {
+			return err_
+		}
+		exchange, err2 := GetExg(exs.Exchange, exs.Market, "", true)
+		if err2 != nil {
+			return err2
+		}
+		native, ok, err2 := nativeFields(c.UserContext(), exchange, exs.Symbol, tf, klines)
+		if err2 != nil {
+			return err2
+		}
+		if ok {
+			res["native"] = native
+		}
+	}
+	setKlineHeaders(c, klines, tf, clampMsg != "")
+	return SendEncoded(c, res)
+}
+
+/*
+setKlineHeaders
+Set the count, covered range and truncation of returned candles as headers, so clients can size buffers and detect
+truncation before parsing the body. The range is omitted when there is no candle.
+将返回K线的数量、覆盖范围和是否截断设置为响应头，使客户端在解析响应体前即可分配缓冲区和发现截断。没有K线时省略范围。
+*/
+func setKlineHeaders(c *fiber.Ctx, klines []*banexg.Kline, tf string, truncated bool) {
+	c.Set(HeaderKlineCount, strconv.Itoa(len(klines)))
+	c.Set(HeaderKlineTruncated, strconv.FormatBool(truncated))
+	if len(klines) == 0 {
+		return
+	}
+	fromMS, toMS := klines[0].Time, klines[0].Time
+	for _, k := range klines[1:] {
+		fromMS = min(fromMS, k.Time)
+		toMS = max(toMS, k.Time)
+	}
+	toMS += int64(utils2.TFToSecs(tf) * 1000)
+	c.Set(HeaderKlineFrom, strconv.FormatInt(fromMS, 10))
+	c.Set(HeaderKlineTo, strconv.FormatInt(toMS, 10))
+}
+
+/*
+postHists 获取多个品种的K线，失败的品种在errors中返回，不影响其他品种
+*/
+func postHists(c *fiber.Ctx) error {
+	type HistsArgs struct {
+		Exchange  string   `json:"exchange" validate:"required"`
+		Symbols   []string `json:"symbols" validate:"required,min=1,max=100"`
+		TimeFrame string   `json:"timeframe" validate:"required"`
+		FromMS    int64    `json:"from" validate:"required"`
+		ToMS      int64    `json:"to" validate:"required"`
+		TimeFmt   string   `json:"time_fmt" validate:"omitempty,oneof=ms s rfc3339"`
+	}
+	var data = new(HistsArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
 	if data.ToMS <= data.FromMS {
 		return errors.New("`from` must less than `to`")
 	}
-	exs, err2 := orm.ParseShort(data.Exchange, data.Symbol)
-	if err2 != nil {
-		return err2
+	ctx := c.UserContext()
+	res, fails := loadEach(data.Symbols, func(symbol string) (fiber.Map, error) {
+		adjs, klines, err := FetchKlines(ctx, data.Exchange, symbol, "", data.TimeFrame, data.FromMS, data.ToMS, nil)
+		if err != nil {
+			return nil, err
+		}
+		return fiber.Map{
+			"adjs": adjs,
+			"data": arrKlinesFmt(klines, data.TimeFmt),
+		}, nil
+	})
+	return SendEncoded(c, fiber.Map{
+		"data":   res,
+		"errors": fails,
+	})
+}
+
+/*
+histReaders
+Readers of the store, the store filled from exchange, and the exchange, see loadHistFrom. Fetches from the exchange
+give up with ErrTimeout once ctx is done.
+本地存储、从交易所补全的存储、交易所三种读取函数，见loadHistFrom。ctx结束后从交易所的下载以ErrTimeout放弃。
+*/
+func histReaders(ctx context.Context, exchange banexg.BanExchange, exs *orm.ExSymbol, tf string) (histReader, histReader, histReader) {
+	if histReadersHook != nil {
+		return histReadersHook(ctx, exchange, exs, tf)
 	}
-	exchange, err2 := GetExg(exs.Exchange, exs.Market, "", true)
-	if err2 != nil {
-		return err2
+	read := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		return orm.GetOHLCV(exs, tf, startMS, stopMS, 0, false)
 	}
-	startMS, stopMS, tf := data.FromMS, data.ToMS, data.TimeFrame
-	adjs, klines, err2 := orm.AutoFetchOHLCV(exchange, exs, tf, startMS, stopMS, 0, true, nil)
-	if err2 != nil {
-		return err2
+	fetch := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		type fetchRes struct {
+			adjs   []*orm.AdjInfo
+			klines []*banexg.Kline
+		}
+		res, err := withCtx(ctx, exs.Symbol, func() (*fetchRes, *errs.Error) {
+			return fetchWithRetry(ctx, exs.Symbol, func() (*fetchRes, *errs.Error) {
+				fAdjs, fKlines, err := orm.AutoFetchOHLCVCtx(ctx, exchange, exs, tf, startMS, stopMS, 0, true, nil)
+				return &fetchRes{adjs: fAdjs, klines: fKlines}, err
+			})
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return res.adjs, res.klines, nil
+	}
+	live := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		klines, err := withCtx(ctx, exs.Symbol, func() ([]*banexg.Kline, *errs.Error) {
+			return fetchWithRetry(ctx, exs.Symbol, func() ([]*banexg.Kline, *errs.Error) {
+				out := make(chan []*banexg.Kline, 10)
+				done := make(chan []*banexg.Kline)
+				go func() {
+					var res []*banexg.Kline
+					for batch := range out {
+						res = append(res, batch...)
+					}
+					done <- res
+				}()
+				err := orm.FetchApiOHLCV(ctx, exchange, exs.Symbol, tf, startMS, stopMS, out)
+				close(out)
+				return <-done, err
+			})
+		})
+		return nil, klines, err
+	}
+	return read, fetch, live
+}
+
+/*
+getValidate 检查本地存储K线的OHLC合法性
+*/
+func getValidate(c *fiber.Ctx) error {
+	type ValidateArgs struct {
+		Exchange  string `query:"exchange" validate:"required"`
+		Symbol    string `query:"symbol" validate:"required"`
+		TimeFrame string `query:"timeframe" validate:"required"`
+		FromMS    int64  `query:"from" validate:"required"`
+		ToMS      int64  `query:"to" validate:"required"`
+	}
+	var data = new(ValidateArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	_, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, data.FromMS,
+		data.ToMS, &FetchOpts{Source: HistStoreOnly})
+	if err != nil {
+		return err
 	}
 	return c.JSON(fiber.Map{
-		"adjs": adjs,
-		"data": ArrKLines(klines),
+		"num":  len(klines),
+		"data": validateKlines(klines),
+	})
+}
+
+/*
+getVwap 计算VWAP和TWAP序列，可指定会话起始时间anchor
+*/
+func getVwap(c *fiber.Ctx) error {
+	type VwapArgs struct {
+		Exchange  string `query:"exchange" validate:"required"`
+		Symbol    string `query:"symbol" validate:"required"`
+		TimeFrame string `query:"timeframe" validate:"required"`
+		FromMS    int64  `query:"from" validate:"required"`
+		ToMS      int64  `query:"to" validate:"required"`
+		AnchorMS  int64  `query:"anchor"` // session start, averages start from here 会话起始时间，从此处开始计算均价
+		// store(default), exchange, store_only, exchange_only, see HistStore 数据来源
+		Source string `query:"source" validate:"omitempty,oneof=store exchange store_only exchange_only"`
+	}
+	var data = new(VwapArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, data.FromMS,
+		data.ToMS, &FetchOpts{Source: data.Source})
+	if err != nil {
+		return err
+	}
+	if len(adjs) > 0 {
+		klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+	}
+	return c.JSON(fiber.Map{
+		"data": calcAvgPrices(klines, data.AnchorMS),
+	})
+}
+
+/*
+getReturns 计算窗口内每根K线对数收益率的直方图和统计量：均值、标准差、偏度、峰度
+*/
+func getReturns(c *fiber.Ctx) error {
+	type ReturnsArgs struct {
+		Exchange  string `query:"exchange" validate:"required"`
+		Symbol    string `query:"symbol" validate:"required"`
+		TimeFrame string `query:"timeframe" validate:"required"`
+		FromMS    int64  `query:"from" validate:"required"`
+		ToMS      int64  `query:"to" validate:"required"`
+		Bins      int    `query:"bins" validate:"omitempty,min=1,max=1000"` // default 20
+		// store(default), exchange, store_only, exchange_only, see HistStore 数据来源
+		Source string `query:"source" validate:"omitempty,oneof=store exchange store_only exchange_only"`
+	}
+	var data = new(ReturnsArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	if data.Bins == 0 {
+		data.Bins = 20
+	}
+	adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, data.FromMS,
+		data.ToMS, &FetchOpts{Source: data.Source})
+	if err != nil {
+		return err
+	}
+	if len(adjs) > 0 {
+		klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+	}
+	return c.JSON(fiber.Map{
+		"data": calcReturnsDist(klines, data.Bins),
+	})
+}
+
+/*
+getPivots 计算每个周期的枢轴位：classic、fibonacci、camarilla
+*/
+func getPivots(c *fiber.Ctx) error {
+	type PivotArgs struct {
+		Exchange  string `query:"exchange" validate:"required"`
+		Symbol    string `query:"symbol" validate:"required"`
+		TimeFrame string `query:"timeframe" validate:"required"`
+		FromMS    int64  `query:"from" validate:"required"`
+		ToMS      int64  `query:"to" validate:"required"`
+		Method    string `query:"method" validate:"omitempty,oneof=classic fibonacci camarilla"` // default classic
+		// store(default), exchange, store_only, exchange_only, see HistStore 数据来源
+		Source string `query:"source" validate:"omitempty,oneof=store exchange store_only exchange_only"`
+	}
+	var data = new(PivotArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	if data.Method == "" {
+		data.Method = PivotClassic
+	}
+	adjs, klines, err_ := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, data.FromMS,
+		data.ToMS, &FetchOpts{Source: data.Source})
+	if err_ != nil {
+		return err_
+	}
+	if len(adjs) > 0 {
+		klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+	}
+	levels, err := calcPivots(klines, int64(utils2.TFToSecs(data.TimeFrame)*1000), data.Method)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"method": data.Method,
+		"data":   levels,
+	})
+}
+
+/*
+getCompare 对比同一品种的两个时间范围，按相对偏移对齐（第0根为各范围起点），较长的范围截断为较短的长度
+*/
+func getCompare(c *fiber.Ctx) error {
+	type CompareArgs struct {
+		Exchange  string `query:"exchange" validate:"required"`
+		Symbol    string `query:"symbol" validate:"required"`
+		TimeFrame string `query:"timeframe" validate:"required"`
+		FromA     int64  `query:"from1" validate:"required"`
+		ToA       int64  `query:"to1" validate:"required"`
+		FromB     int64  `query:"from2" validate:"required"`
+		ToB       int64  `query:"to2" validate:"required"`
+	}
+	var data = new(CompareArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	load := func(fromMS, toMS int64) ([]*banexg.Kline, error) {
+		adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, fromMS, toMS,
+			nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(adjs) > 0 {
+			klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+		}
+		return klines, nil
+	}
+	klinesA, err := load(data.FromA, data.ToA)
+	if err != nil {
+		return err
+	}
+	klinesB, err := load(data.FromB, data.ToB)
+	if err != nil {
+		return err
+	}
+	// the timeframe is validated by FetchKlines 周期已由FetchKlines校验
+	num, seriesA, seriesB := compareRanges(klinesA, klinesB, [2]int64{data.FromA, data.ToA},
+		[2]int64{data.FromB, data.ToB}, int64(utils2.TFToSecs(data.TimeFrame)*1000))
+	return c.JSON(fiber.Map{
+		"bars": num,
+		"a":    seriesA,
+		"b":    seriesB,
+	})
+}
+
+/*
+getBook 获取订单簿最优的N档买卖盘
+*/
+func getBook(c *fiber.Ctx) error {
+	type BookArgs struct {
+		Exchange string `query:"exchange" validate:"required"`
+		Symbol   string `query:"symbol" validate:"required"`
+		Depth    int    `query:"depth" validate:"omitempty,min=1"` // levels of each side, default 20 每侧档数
+	}
+	var data = new(BookArgs)
+	if err := VerifyArg(c, data, ArgQuery); err != nil {
+		return err
+	}
+	if data.Depth == 0 {
+		data.Depth = 20
+	}
+	exs, err_ := resolveShort(data.Exchange, data.Symbol)
+	if err_ != nil {
+		return err_
+	}
+	exchange, err := GetExg(exs.Exchange, exs.Market, "", true)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s_%s_%s", exs.Exchange, exs.Market, exs.Symbol)
+	book, err := loadBook(key, data.Depth, func() (*banexg.OrderBook, *errs.Error) {
+		return exchange.FetchOrderBook(exs.Symbol, BookMaxDepth, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"data": book,
 	})
 }
 
@@ -79,11 +521,21 @@ func postCalcInd(c *fiber.Ctx) error {
 		Name   string      `json:"name" validate:"required"`
 		Kline  [][]float64 `json:"kline" validate:"required"`
 		Params []float64   `json:"params" validate:"required"`
+		// json(default), csv: time and one column per figure, empty in warmup 时间列和每个图形一列，预热期为空
+		Format string `json:"format" validate:"omitempty,oneof=json csv"`
 	}
 	var data = new(CalcArgs)
 	if err := VerifyArg(c, data, ArgBody); err != nil {
 		return err
 	}
+	if data.Format == "csv" {
+		var b bytes.Buffer
+		if err := CalcIndCSV(&b, data.Name, data.Kline, data.Params); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, "text/csv")
+		return c.Send(b.Bytes())
+	}
 	res, err := CalcInd(data.Name, data.Kline, data.Params)
 	if err != nil {
 		return err
@@ -93,3 +545,313 @@ func postCalcInd(c *fiber.Ctx) error {
 		"data": res,
 	})
 }
+
+/*
+postCalcIndStream 计算云端指标，按时间顺序分块以NDJSON流式返回
+*/
+func postCalcIndStream(c *fiber.Ctx) error {
+	type CalcArgs struct {
+		Name   string      `json:"name" validate:"required"`
+		Kline  [][]float64 `json:"kline" validate:"required"`
+		Params []float64   `json:"params" validate:"required"`
+		Chunk  int         `json:"chunk"`
+	}
+	var data = new(CalcArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	if data.Chunk <= 0 {
+		data.Chunk = 500
+	}
+	_, isBase := baseInds[data.Name]
+	if _, isAdv := advInds[data.Name]; !isBase && !isAdv {
+		return fiber.NewError(fiber.StatusBadRequest, "unsupported indicator: "+data.Name)
+	}
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		start := 0
+		err := CalcIndStream(data.Name, data.Kline, data.Params, data.Chunk, func(items interface{}) error {
+			line, err := utils2.Marshal(fiber.Map{"start": start, "data": items})
+			if err != nil {
+				return err
+			}
+			if arr, ok := items.([]map[string]float64); ok {
+				start += len(arr)
+			}
+			if _, err = w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			log.Warn("stream calc_ind fail", zap.String("name", data.Name), zap.Error(err))
+		}
+	})
+	return nil
+}
+
+/*
+postCalcIndTF
+Calculate an indicator of a symbol on candles of target resampled from the stored timeframe, e.g. RMA of 4h from 1h
+candles. Warmup bars of target before from are loaded so values at from are settled, only bars from `from` are
+returned. Only base indicators are supported.
+基于从已存储周期重采样得到的target周期K线计算品种的指标，如从1h K线计算4h的RMA。会加载from之前target周期的预热K线，使from处的值
+已稳定，仅返回from之后的K线。仅支持基础指标。
+*/
+func postCalcIndTF(c *fiber.Ctx) error {
+	type CalcTFArgs struct {
+		Exchange  string    `json:"exchange" validate:"required"`
+		Symbol    string    `json:"symbol" validate:"required"`
+		TimeFrame string    `json:"timeframe" validate:"required"` // base timeframe to load 加载的基础周期
+		Target    string    `json:"target" validate:"required"`    // multiple of timeframe 为timeframe的整数倍
+		FromMS    int64     `json:"from" validate:"required"`
+		ToMS      int64     `json:"to" validate:"required"`
+		Name      string    `json:"name" validate:"required"`
+		Params    []float64 `json:"params" validate:"required"`
+		// bars of target loaded before from, default 100 在from之前加载的target周期K线数，默认100
+		Warmup int    `json:"warmup" validate:"omitempty,min=1,max=5000"`
+		Source string `json:"source" validate:"omitempty,oneof=store exchange store_only exchange_only"`
+	}
+	var data = new(CalcTFArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	ind, ok := baseInds[data.Name]
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "unsupported indicator: "+data.Name)
+	}
+	// validate before loading 加载前校验
+	if _, err := resampleKlines(nil, data.TimeFrame, data.Target); err != nil {
+		return err
+	}
+	if data.Warmup == 0 {
+		data.Warmup = 100
+	}
+	tgtMSecs := int64(utils2.TFToSecs(data.Target) * 1000)
+	loadMS := utils2.AlignTfMSecs(data.FromMS, tgtMSecs) - int64(data.Warmup)*tgtMSecs
+	toMS, clampMsg := clampHistRange(data.TimeFrame, loadMS, data.ToMS)
+	adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, data.Symbol, "", data.TimeFrame, loadMS, toMS,
+		&FetchOpts{Source: data.Source})
+	if err != nil {
+		return err
+	}
+	if len(adjs) > 0 {
+		klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+	}
+	klines, err2 := resampleKlines(klines, data.TimeFrame, data.Target)
+	if err2 != nil {
+		return err2
+	}
+	vals, err_ := ind.Calc(ArrKLines(klines), data.Params)
+	if err_ != nil {
+		return err_
+	}
+	start := sort.Search(len(klines), func(i int) bool {
+		return klines[i].Time >= data.FromMS
+	})
+	res := fiber.Map{
+		"code":  200,
+		"kline": ArrKLines(klines[start:]),
+		"data":  []map[string]float64{},
+	}
+	if start < len(vals) {
+		res["data"] = vals[start:]
+	}
+	if clampMsg != "" {
+		// more bars than HistMaxBars of timeframe were required 需要的K线超过timeframe的HistMaxBars
+		res["clamped"] = fiber.Map{"to": toMS, "msg": clampMsg}
+	}
+	return c.JSON(res)
+}
+
+/*
+postCorrelation 计算多个品种对数收益率的相关系数矩阵
+*/
+func postCorrelation(c *fiber.Ctx) error {
+	type CorrArgs struct {
+		Exchange  string   `json:"exchange" validate:"required"`
+		Symbols   []string `json:"symbols" validate:"required,min=2,max=100"`
+		TimeFrame string   `json:"timeframe" validate:"required"`
+		FromMS    int64    `json:"from" validate:"required"`
+		ToMS      int64    `json:"to" validate:"required"`
+	}
+	var data = new(CorrArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	series := make([][]*banexg.Kline, 0, len(data.Symbols))
+	for _, symbol := range data.Symbols {
+		adjs, klines, err := FetchKlines(c.UserContext(), data.Exchange, symbol, "", data.TimeFrame, data.FromMS,
+			data.ToMS, nil)
+		if err != nil {
+			return err
+		}
+		if len(adjs) > 0 {
+			klines = orm.ApplyAdj(adjs, klines, core.AdjFront, 0, 0)
+		}
+		series = append(series, klines)
+	}
+	res, num, err := calcReturnsCorr(series)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"symbols": data.Symbols,
+		"num":     num,
+		"data":    res,
+	})
+}
+
+/*
+postExport 下载多个品种K线的zip压缩包，每个品种周期一个csv
+*/
+func postExport(c *fiber.Ctx) error {
+	type ExportArgs struct {
+		Specs []*ExportSpec `json:"specs" validate:"required,dive"`
+	}
+	var data = new(ExportArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	if err := checkExportSpecs(data.Specs); err != nil {
+		return err
+	}
+	// resolve all before streaming, so bad symbols fail with a status 流式返回前全部解析，使错误品种能返回状态码
+	symbols := make(map[*ExportSpec]*orm.ExSymbol, len(data.Specs))
+	for _, s := range data.Specs {
+		exs, err_ := resolveShort(s.Exchange, s.Symbol)
+		if err_ != nil {
+			return err_
+		}
+		symbols[s] = exs
+	}
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="klines.zip"`)
+	// the body is streamed after return, keep the deadline of the request 响应体在返回后流式写入，沿用请求的期限
+	deadline, hasDeadline := c.UserContext().Deadline()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx := context.Background()
+		if hasDeadline {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		err := writeKlineZip(w, data.Specs, func(s *ExportSpec) ([]*banexg.Kline, *errs.Error) {
+			exs := symbols[s]
+			exchange, err := GetExg(exs.Exchange, exs.Market, "", true)
+			if err != nil {
+				return nil, err
+			}
+			return withCtx(ctx, exs.Symbol, func() ([]*banexg.Kline, *errs.Error) {
+				_, klines, err := orm.AutoFetchOHLCVCtx(ctx, exchange, exs, s.TimeFrame, s.FromMS, s.ToMS, 0, false, nil)
+				return klines, err
+			})
+		})
+		if err != nil {
+			log.Warn("export klines fail", zap.Int("specs", len(data.Specs)), zap.Error(err))
+		} else if err_ := w.Flush(); err_ != nil {
+			log.Warn("flush klines zip fail", zap.Error(err_))
+		}
+	})
+	return nil
+}
+
+/*
+postWarmup 预热多个品种的元数据和最新K线，降低交易时段首次请求的延迟，返回每项的成功或失败
+*/
+func postWarmup(c *fiber.Ctx) error {
+	type WarmupArgs struct {
+		Items []*WarmupItem `json:"items" validate:"required,min=1,dive"`
+		Bars  int           `json:"bars" validate:"omitempty,min=1"` // latest bars of each item, default 300
+	}
+	var data = new(WarmupArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	if len(data.Items) > WarmupMaxItems {
+		return errs.NewMsg(errs.CodeParamInvalid, "too many items: %d > %d", len(data.Items), WarmupMaxItems)
+	}
+	bars := min(WarmupMaxBars, data.Bars)
+	if bars == 0 {
+		bars = 300
+	}
+	ctx := c.UserContext()
+	res := warmupAll(data.Items, WarmupPerExg, func(item *WarmupItem) (int, error) {
+		tfSecs, err := utils2.ParseTimeFrame(item.TimeFrame)
+		if err != nil || tfSecs <= 0 {
+			return 0, errs.NewMsg(errs.CodeParamInvalid, "invalid timeframe: %s", item.TimeFrame)
+		}
+		exs, err_ := resolveShort(item.Exchange, item.Symbol)
+		if err_ != nil {
+			return 0, err_
+		}
+		// load markets of the exchange 加载交易所的市场信息
+		exchange, err := GetExg(exs.Exchange, exs.Market, "", true)
+		if err != nil {
+			return 0, err
+		}
+		tfMSecs := int64(tfSecs * 1000)
+		toMS := utils2.AlignTfMSecs(btime.UTCStamp(), tfMSecs)
+		_, fetch, _ := histReaders(ctx, exchange, exs, item.TimeFrame)
+		// saved to the local store, later /hist reads it from there 保存到本地存储，之后/hist从中读取
+		_, klines, err := fetch(toMS-tfMSecs*int64(bars), toMS)
+		if err != nil {
+			return 0, err
+		}
+		return len(klines), nil
+	})
+	return c.JSON(fiber.Map{"data": res})
+}
+
+/*
+postBackfill 后台异步下载K线到本地
+*/
+func postBackfill(c *fiber.Ctx) error {
+	type BackfillArgs struct {
+		Exchange  string `json:"exchange" validate:"required"`
+		Symbol    string `json:"symbol" validate:"required"`
+		TimeFrame string `json:"timeframe" validate:"required"`
+		FromMS    int64  `json:"from" validate:"required"`
+		ToMS      int64  `json:"to" validate:"required"`
+	}
+	var data = new(BackfillArgs)
+	if err := VerifyArg(c, data, ArgBody); err != nil {
+		return err
+	}
+	if data.ToMS <= data.FromMS {
+		return errors.New("`from` must less than `to`")
+	}
+	tfSecs, err_ := utils2.ParseTimeFrame(data.TimeFrame)
+	if err_ != nil || tfSecs <= 0 {
+		return errs.NewMsg(errs.CodeParamInvalid, "invalid timeframe: %s", data.TimeFrame)
+	}
+	exs, err := resolveShort(data.Exchange, data.Symbol)
+	if err != nil {
+		return err
+	}
+	job := startBackfill(&BackfillJob{
+		Exchange:  data.Exchange,
+		Symbol:    data.Symbol,
+		TimeFrame: data.TimeFrame,
+		FromMS:    data.FromMS,
+		ToMS:      data.ToMS,
+	}, int64(tfSecs*1000), downKlineChunk(exs, data.TimeFrame))
+	return c.JSON(fiber.Map{"id": job.ID})
+}
+
+/*
+getBackfills 获取运行中和最近的补全任务
+*/
+func getBackfills(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"data": listBackfills()})
+}
+
+/*
+delBackfill 取消补全任务
+*/
+func delBackfill(c *fiber.Ctx) error {
+	if !cancelBackfill(c.Params("id")) {
+		return fiber.NewError(fiber.StatusNotFound, "backfill job not found")
+	}
+	return c.JSON(fiber.Map{"code": 200})
+}
@@ -0,0 +1,741 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banbot/utils"
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+	utils2 "github.com/banbox/banexg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+/*
+mockExchange
+In-process exchange with deterministic candles, only FetchOHLCV is implemented, other methods panic on the nil
+embedded interface. The close of the bar at time t is 100 + t/tf%50.
+进程内的模拟交易所，K线是确定的，仅实现FetchOHLCV，其他方法因内嵌接口为nil而panic。时间t的K线收盘价为100 + t/tf%50。
+*/
+type mockExchange struct {
+	banexg.BanExchange
+	fails map[string]*errs.Error // error returned for each symbol 每个品种返回的错误
+	delay time.Duration          // sleep before each fetch 每次下载前的等待
+	lock  sync.Mutex
+	calls int
+}
+
+func (e *mockExchange) FetchOHLCV(symbol, timeframe string, since int64, limit int, params map[string]interface{}) ([]*banexg.Kline, *errs.Error) {
+	e.lock.Lock()
+	e.calls += 1
+	e.lock.Unlock()
+	time.Sleep(e.delay)
+	if err, ok := e.fails[symbol]; ok {
+		return nil, err
+	}
+	tfMSecs := int64(utils2.TFToSecs(timeframe) * 1000)
+	start := utils2.AlignTfMSecs(since, tfMSecs)
+	if start < since {
+		start += tfMSecs
+	}
+	res := make([]*banexg.Kline, 0, limit)
+	for i := 0; i < limit; i++ {
+		t := start + int64(i)*tfMSecs
+		price := 100 + float64(t/tfMSecs%50)
+		res = append(res, &banexg.Kline{Time: t, Open: price - 1, High: price + 1, Low: price - 2, Close: price,
+			Volume: 10})
+	}
+	return res, nil
+}
+
+func (e *mockExchange) callNum() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.calls
+}
+
+// useMockExchange serve symbols of exchange "mock" by a mockExchange until the test ends 测试结束前由mockExchange提供mock交易所的品种
+func useMockExchange(t *testing.T, fails map[string]*errs.Error) *mockExchange {
+	exchange := &mockExchange{fails: fails}
+	orm.CacheExSymbols(
+		&orm.ExSymbol{ID: 9001, Exchange: "mock", Market: banexg.MarketSpot, Symbol: "BTC/USDT"},
+		&orm.ExSymbol{ID: 9002, Exchange: "mock", Market: banexg.MarketSpot, Symbol: "ETH/USDT"},
+	)
+	getExgHook = func(name, market, ctType string) (banexg.BanExchange, *errs.Error) {
+		if name != "mock" {
+			return nil, errs.NewMsg(core.ErrExgNotInit, "unknown exchange: %s", name)
+		}
+		return exchange, nil
+	}
+	t.Cleanup(func() {
+		getExgHook = nil
+	})
+	return exchange
+}
+
+func TestHistMockExchange(t *testing.T) {
+	exchange := useMockExchange(t, map[string]*errs.Error{
+		"ETH/USDT": errs.NewMsg(core.ErrInvalidSymbol, "symbol delisted"),
+	})
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", getHist)
+	tfMS, fromMS := int64(60000), int64(1700000000000)
+	get := func(symbol string, bars int) (int, [][]float64) {
+		url := fmt.Sprintf("/hist?exchange=mock&symbol=%s&timeframe=1m&from=%d&to=%d&source=exchange_only",
+			symbol, fromMS, fromMS+int64(bars)*tfMS)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var res struct {
+			Data [][]float64 `json:"data"`
+		}
+		if resp.StatusCode == fiber.StatusOK {
+			if err_ = json.Unmarshal(body, &res); err_ != nil {
+				t.Fatalf("bad body: %s", body)
+			}
+		}
+		return resp.StatusCode, res.Data
+	}
+	code, rows := get("BTC/USDT", 30)
+	if code != fiber.StatusOK || len(rows) != 30 {
+		t.Fatalf("expect 30 bars, got %d %d", code, len(rows))
+	}
+	startMS := utils2.AlignTfMSecs(fromMS, tfMS)
+	for i, row := range rows {
+		t0 := startMS + int64(i)*tfMS
+		if int64(row[0]) != t0 || row[4] != 100+float64(t0/tfMS%50) {
+			t.Fatalf("bar %d mismatch: %v", i, row)
+		}
+	}
+	// more bars than one request, fetched in pages of KBatchSize 超过单次请求的K线按KBatchSize分页下载
+	before := exchange.callNum()
+	code, rows = get("BTC/USDT", core.KBatchSize*2+100)
+	if code != fiber.StatusOK || len(rows) != core.KBatchSize*2+100 {
+		t.Fatalf("expect %d bars, got %d %d", core.KBatchSize*2+100, code, len(rows))
+	}
+	if pages := exchange.callNum() - before; pages != 3 {
+		t.Fatalf("expect 3 pages, got %d", pages)
+	}
+	for i := 1; i < len(rows); i++ {
+		if int64(rows[i][0]-rows[i-1][0]) != tfMS {
+			t.Fatalf("gap between page bars at %d", i)
+		}
+	}
+	// errors of the exchange and unknown symbols 交易所错误和未知品种
+	if code, _ = get("ETH/USDT", 30); code != fiber.StatusBadRequest {
+		t.Fatalf("exchange error should be 400, got %d", code)
+	}
+	if code, _ = get("XRP/USDT", 30); code != fiber.StatusNotFound {
+		t.Fatalf("unknown symbol should be 404, got %d", code)
+	}
+}
+
+func TestHistStoreGaps(t *testing.T) {
+	useMockExchange(t, nil)
+	tfMS, fromMS := int64(60000), int64(1700000040000)
+	toMS := fromMS + 20*tfMS
+	var stored []*banexg.Kline
+	var fetches [][2]int64
+	histReadersHook = func(ctx context.Context, exchange banexg.BanExchange, exs *orm.ExSymbol, tf string) (histReader, histReader, histReader) {
+		read := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			return nil, rangeKlines(stored, startMS, stopMS), nil
+		}
+		fetch := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			fetches = append(fetches, [2]int64{startMS, stopMS})
+			return nil, makeBars(startMS, tfMS, int((stopMS-startMS)/tfMS), 2), nil
+		}
+		return read, fetch, nil
+	}
+	t.Cleanup(func() {
+		histReadersHook = nil
+	})
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", getHist)
+	cases := []struct {
+		name       string
+		stored     []*banexg.Kline
+		fetchStart int64
+	}{
+		{"tail", makeBars(fromMS, tfMS, 10, 1), fromMS + 9*tfMS},
+		{"head", makeBars(fromMS+10*tfMS, tfMS, 10, 1), fromMS},
+		{"hole", append(makeBars(fromMS, tfMS, 5, 1), makeBars(fromMS+10*tfMS, tfMS, 10, 1)...), fromMS + 4*tfMS},
+	}
+	for _, c := range cases {
+		stored, fetches = c.stored, nil
+		url := fmt.Sprintf("/hist?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&source=store", fromMS, toMS)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var res struct {
+			Data [][]float64 `json:"data"`
+		}
+		if resp.StatusCode != fiber.StatusOK || json.Unmarshal(body, &res) != nil {
+			t.Fatalf("%s: bad response %d %s", c.name, resp.StatusCode, body)
+		}
+		if len(fetches) != 1 || fetches[0] != [2]int64{c.fetchStart, toMS} {
+			t.Fatalf("%s: expect fetch from %d, got %v", c.name, c.fetchStart, fetches)
+		}
+		if len(res.Data) != 20 {
+			t.Fatalf("%s: expect 20 bars, got %d", c.name, len(res.Data))
+		}
+		for i, row := range res.Data {
+			if int64(row[0]) != fromMS+int64(i)*tfMS {
+				t.Fatalf("%s: bar %d at %v, should be contiguous", c.name, i, row[0])
+			}
+		}
+	}
+}
+
+// nativeMockExchange a mockExchange also returning native fields 同时返回原生字段的mockExchange
+type nativeMockExchange struct {
+	*mockExchange
+}
+
+func (e *nativeMockExchange) FetchOHLCVNative(symbol, timeframe string, since int64, limit int, params map[string]interface{}) ([]map[string]interface{}, *errs.Error) {
+	klines, err := e.FetchOHLCV(symbol, timeframe, since, limit, params)
+	if err != nil {
+		return nil, err
+	}
+	tfMSecs := int64(utils2.TFToSecs(timeframe) * 1000)
+	res := make([]map[string]interface{}, 0, len(klines))
+	for _, k := range klines {
+		res = append(res, map[string]interface{}{"time": k.Time, "trades": k.Time / tfMSecs % 7, "taker_buy_volume": 4.0})
+	}
+	return res, nil
+}
+
+func TestHistNative(t *testing.T) {
+	exchange := useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", getHist)
+	tfMS, fromMS := int64(60000), int64(1700000000000)
+	get := func(query string) map[string]json.RawMessage {
+		url := fmt.Sprintf("/hist?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&source=exchange_only%s",
+			fromMS, fromMS+int64(core.KBatchSize+10)*tfMS, query)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var res map[string]json.RawMessage
+		if resp.StatusCode != fiber.StatusOK || json.Unmarshal(body, &res) != nil {
+			t.Fatalf("bad response %d: %s", resp.StatusCode, body)
+		}
+		return res
+	}
+	// the default shape is unchanged, exchanges without native fields return none 默认格式不变，无原生字段的交易所不返回
+	if _, ok := get("")["native"]; ok {
+		t.Fatal("native should be absent by default")
+	}
+	if _, ok := get("&native=true")["native"]; ok {
+		t.Fatal("native should be absent for exchanges without native fields")
+	}
+	getExgHook = func(name, market, ctType string) (banexg.BanExchange, *errs.Error) {
+		return &nativeMockExchange{mockExchange: exchange}, nil
+	}
+	res := get("&native=true&order=desc")
+	var rows [][]float64
+	var native []map[string]interface{}
+	if json.Unmarshal(res["data"], &rows) != nil || json.Unmarshal(res["native"], &native) != nil {
+		t.Fatal("bad data or native")
+	}
+	if len(rows) != core.KBatchSize+10 || len(native) != len(rows) || len(rows[0]) != 7 {
+		t.Fatalf("native should align with data, got %d %d", len(rows), len(native))
+	}
+	for i, row := range rows {
+		item := native[i]
+		if item == nil || int64(item["time"].(float64)) != int64(row[0]) ||
+			item["trades"] != float64(int64(row[0])/tfMS%7) || item["taker_buy_volume"] != 4.0 {
+			t.Fatalf("native %d mismatch: %v %v", i, row, item)
+		}
+	}
+}
+
+func TestSymbolRules(t *testing.T) {
+	useMockExchange(t, nil)
+	oldAllows, oldBlocks := SymbolAllows, SymbolBlocks
+	SymbolAllows, SymbolBlocks = []string{"*USDT"}, []string{"ETH*"}
+	defer func() {
+		SymbolAllows, SymbolBlocks = oldAllows, oldBlocks
+	}()
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/symbols", getSymbols)
+	app.Get("/hist", getHist)
+	resp, err_ := app.Test(httptest.NewRequest("GET", "/symbols", nil), -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	var res struct {
+		Data []map[string]string `json:"data"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if err_ = json.Unmarshal(body, &res); err_ != nil {
+		t.Fatalf("bad body: %s", body)
+	}
+	mocks := make([]string, 0)
+	for _, item := range res.Data {
+		if item["exchange"] == "mock" {
+			mocks = append(mocks, item["symbol"])
+		}
+	}
+	if len(mocks) != 1 || mocks[0] != "BTC/USDT" {
+		t.Fatalf("blocked symbols should be hidden, got %v", mocks)
+	}
+	hist := func(symbol string) int {
+		url := "/hist?exchange=mock&symbol=" + symbol + "&timeframe=1m&from=1700000000000&to=1700000600000&source=exchange_only"
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		return resp.StatusCode
+	}
+	if code := hist("BTC/USDT"); code != fiber.StatusOK {
+		t.Fatalf("allowed symbol should pass, got %d", code)
+	}
+	if code := hist("ETH/USDT"); code != fiber.StatusForbidden {
+		t.Fatalf("blocked symbol should be 403, got %d", code)
+	}
+	// alias spellings are rejected too 别名写法同样被拒绝
+	if code := hist("ethusdt"); code != fiber.StatusForbidden {
+		t.Fatalf("blocked alias should be 403, got %d", code)
+	}
+	SymbolAllows = []string{"*/BTC"}
+	if code := hist("BTC/USDT"); code != fiber.StatusForbidden {
+		t.Fatalf("symbol out of allows should be 403, got %d", code)
+	}
+}
+
+func TestHistMaxBars(t *testing.T) {
+	useMockExchange(t, nil)
+	old := HistMaxBars
+	HistMaxBars = map[string]int{"1m": 100}
+	defer func() {
+		HistMaxBars = old
+	}()
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", getHist)
+	fromMS := int64(1699920000000) // aligned to days 按天对齐
+	get := func(tf string, bars int) (int, map[string]interface{}) {
+		tfMS := int64(utils2.TFToSecs(tf) * 1000)
+		url := fmt.Sprintf("/hist?exchange=mock&symbol=BTC/USDT&timeframe=%s&from=%d&to=%d&source=exchange_only",
+			tf, fromMS, fromMS+int64(bars)*tfMS)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var res struct {
+			Data    [][]float64            `json:"data"`
+			Clamped map[string]interface{} `json:"clamped"`
+		}
+		if err_ = json.Unmarshal(body, &res); err_ != nil {
+			t.Fatalf("bad body: %s", body)
+		}
+		return len(res.Data), res.Clamped
+	}
+	num, clamped := get("1m", 300)
+	if num != 100 || clamped == nil {
+		t.Fatalf("1m should be clamped to 100, got %d %v", num, clamped)
+	}
+	// the next page starts from the returned end 下一页从返回的终点开始
+	if int64(clamped["to"].(float64)) != fromMS+100*60000 {
+		t.Fatalf("bad clamped end: %v", clamped)
+	}
+	if num, clamped = get("1m", 100); num != 100 || clamped != nil {
+		t.Fatalf("1m within limit should not be clamped, got %d %v", num, clamped)
+	}
+	if num, clamped = get("1d", 300); num != 300 || clamped != nil {
+		t.Fatalf("1d should be unrestricted, got %d %v", num, clamped)
+	}
+}
+
+func TestHistHeaders(t *testing.T) {
+	useMockExchange(t, nil)
+	old := HistMaxBars
+	HistMaxBars = map[string]int{"1m": 100}
+	defer func() {
+		HistMaxBars = old
+	}()
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", getHist)
+	fromMS := int64(1699920000000)
+	check := func(tf string, bars int, order string, truncated bool) {
+		tfMS := int64(utils2.TFToSecs(tf) * 1000)
+		url := fmt.Sprintf("/hist?exchange=mock&symbol=BTC/USDT&timeframe=%s&from=%d&to=%d&source=exchange_only"+
+			"&order=%s", tf, fromMS, fromMS+int64(bars)*tfMS, order)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		var res struct {
+			Data [][]float64 `json:"data"`
+		}
+		if err_ = json.Unmarshal(body, &res); err_ != nil || len(res.Data) == 0 {
+			t.Fatalf("bad body: %s", body)
+		}
+		minMS, maxMS := int64(res.Data[0][0]), int64(res.Data[0][0])
+		for _, row := range res.Data {
+			minMS = min(minMS, int64(row[0]))
+			maxMS = max(maxMS, int64(row[0]))
+		}
+		expects := map[string]string{
+			HeaderKlineCount:     fmt.Sprint(len(res.Data)),
+			HeaderKlineFrom:      fmt.Sprint(minMS),
+			HeaderKlineTo:        fmt.Sprint(maxMS + tfMS),
+			HeaderKlineTruncated: fmt.Sprint(truncated),
+		}
+		for key, val := range expects {
+			if got := resp.Header.Get(key); got != val {
+				t.Fatalf("%s %d bars: header %s should be %s, got %s", tf, bars, key, val, got)
+			}
+		}
+	}
+	check("1d", 30, "desc", false)
+	check("1m", 300, "asc", true)
+}
+
+func TestReturnsMockExchange(t *testing.T) {
+	useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/returns", getReturns)
+	// closes are 100..149 from a time aligned to 50 bars 从对齐50根K线的时间开始，收盘价为100..149
+	fromMS := int64(1699920000000)
+	url := fmt.Sprintf("/returns?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&bins=7&source=exchange_only",
+		fromMS, fromMS+50*60000)
+	resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	var res struct {
+		Data ReturnsDist `json:"data"`
+	}
+	if err_ = json.Unmarshal(body, &res); err_ != nil || resp.StatusCode != 200 {
+		t.Fatalf("bad resp %d: %s", resp.StatusCode, body)
+	}
+	dist := res.Data
+	if dist.Count != 49 || len(dist.Bins) != 7 {
+		t.Fatalf("expect 49 returns in 7 bins, got %d %d", dist.Count, len(dist.Bins))
+	}
+	if want := math.Log(149.0/100) / 49; math.Abs(dist.Mean-want) > 1e-12 {
+		t.Fatalf("mean expect %v, got %v", want, dist.Mean)
+	}
+	// returns shrink from ln(101/100) to ln(149/148), so the distribution skews right 收益率逐渐减小，分布右偏
+	if dist.Std <= 0 || dist.Skew <= 0 {
+		t.Fatalf("bad stats: %+v", dist)
+	}
+	url = fmt.Sprintf("/returns?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&bins=0", fromMS, fromMS-1)
+	if resp, err_ = app.Test(httptest.NewRequest("GET", url, nil), -1); err_ != nil || resp.StatusCode == 200 {
+		t.Fatalf("invalid range should fail: %v", err_)
+	}
+}
+
+func TestVwapMockExchange(t *testing.T) {
+	useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/vwap", getVwap)
+	fromMS := int64(1699920000000)
+	// nothing is stored, the candles are fetched 本地无存储，K线从交易所下载
+	url := fmt.Sprintf("/vwap?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&source=exchange_only",
+		fromMS, fromMS+10*60000)
+	resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	var res struct {
+		Data []*AvgPrice `json:"data"`
+	}
+	if err_ = json.Unmarshal(body, &res); err_ != nil || resp.StatusCode != 200 || len(res.Data) != 10 {
+		t.Fatalf("expect 10 points, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPivotsMockExchange(t *testing.T) {
+	useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/pivots", getPivots)
+	fromMS := int64(1699920000000)
+	get := func(tf string) (int, []byte) {
+		url := fmt.Sprintf("/pivots?exchange=mock&symbol=BTC/USDT&timeframe=%s&from=%d&to=%d&source=exchange_only",
+			tf, fromMS, fromMS+10*60000)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	code, body := get("1m")
+	var res struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err_ := json.Unmarshal(body, &res); err_ != nil || code != 200 || len(res.Data) == 0 {
+		t.Fatalf("bad resp %d: %s", code, body)
+	}
+	if code, body = get("x"); code != fiber.StatusBadRequest {
+		t.Fatalf("invalid timeframe should be 400, got %d: %s", code, body)
+	}
+}
+
+func TestCompareDeadline(t *testing.T) {
+	useMockExchange(t, nil)
+	oldTimeouts := RouteTimeouts
+	RouteTimeouts = map[string]time.Duration{"/compare": 50 * time.Millisecond}
+	canceled := make(chan struct{}, 2)
+	histReadersHook = func(ctx context.Context, exchange banexg.BanExchange, exs *orm.ExSymbol, tf string) (histReader, histReader, histReader) {
+		read := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			return nil, nil, nil
+		}
+		fetch := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			select {
+			case <-ctx.Done():
+				canceled <- struct{}{}
+				return nil, nil, errs.NewMsg(core.ErrTimeout, "canceled")
+			case <-time.After(time.Second * 3):
+				return nil, nil, nil
+			}
+		}
+		return read, fetch, nil
+	}
+	t.Cleanup(func() {
+		RouteTimeouts = oldTimeouts
+		histReadersHook = nil
+	})
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/compare", ReqTimeout("/compare"), getCompare)
+	fromMS := int64(1700000040000)
+	url := fmt.Sprintf("/compare?exchange=mock&symbol=BTC/USDT&timeframe=1m&from1=%d&to1=%d&from2=%d&to2=%d",
+		fromMS, fromMS+10*60000, fromMS+20*60000, fromMS+30*60000)
+	resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	if resp.StatusCode != fiber.StatusGatewayTimeout {
+		t.Fatalf("expect 504, got %d", resp.StatusCode)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the fetch should be canceled at the deadline")
+	}
+}
+
+func TestValidateStore(t *testing.T) {
+	useMockExchange(t, nil)
+	tfMS, fromMS := int64(60000), int64(1700000040000)
+	histReadersHook = func(ctx context.Context, exchange banexg.BanExchange, exs *orm.ExSymbol, tf string) (histReader, histReader, histReader) {
+		read := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			return nil, rangeKlines(makeBars(fromMS, tfMS, 5, 1), startMS, stopMS), nil
+		}
+		fetch := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			t.Error("validate should read the store only")
+			return nil, nil, nil
+		}
+		return read, fetch, fetch
+	}
+	t.Cleanup(func() {
+		histReadersHook = nil
+	})
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/validate", getValidate)
+	get := func(tf string, from int64) (int, []byte) {
+		url := fmt.Sprintf("/validate?exchange=mock&symbol=BTC/USDT&timeframe=%s&from=%d&to=%d", tf, from,
+			fromMS+10*tfMS)
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	code, body := get("1m", fromMS)
+	var res struct {
+		Num int `json:"num"`
+	}
+	if err_ := json.Unmarshal(body, &res); err_ != nil || code != 200 || res.Num != 5 {
+		t.Fatalf("expect 5 stored bars, got %d: %s", code, body)
+	}
+	if code, _ = get("x", fromMS); code != fiber.StatusBadRequest {
+		t.Fatalf("invalid timeframe should be 400, got %d", code)
+	}
+	if code, _ = get("1m", fromMS/1000); code != fiber.StatusBadRequest {
+		t.Fatalf("`from` in seconds should be 400, got %d", code)
+	}
+}
+
+func TestCorrelationMaxSymbols(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Post("/correlation", postCorrelation)
+	symbols := make([]string, 101)
+	for i := range symbols {
+		symbols[i] = fmt.Sprintf("S%d/USDT", i)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"exchange": "mock", "symbols": symbols, "timeframe": "1m",
+		"from": 1700000000000, "to": 1700000600000})
+	req := httptest.NewRequest("POST", "/correlation", strings.NewReader(string(body)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err_ := app.Test(req, -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("too many symbols should be 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestFetchKlines(t *testing.T) {
+	useMockExchange(t, nil)
+	ctx := context.Background()
+	fromMS := int64(1700000000000)
+	toMS := fromMS + 30*60000
+	opts := &FetchOpts{Source: HistExchangeOnly}
+	cases := []struct {
+		name      string
+		symbol    string
+		market    string
+		tf        string
+		from, to  int64
+		paramFail bool // fails with CodeParamInvalid 以CodeParamInvalid失败
+	}{
+		{"bad timeframe", "BTC/USDT", "", "7x", fromMS, toMS, true},
+		{"secs from", "BTC/USDT", "", "1m", fromMS / 1000, toMS, true},
+		{"empty range", "BTC/USDT", "", "1m", fromMS, fromMS, true},
+		{"wrong market", "BTC/USDT", banexg.MarketLinear, "1m", fromMS, toMS, true},
+		{"unknown symbol", "DOGE/USDT", "", "1m", fromMS, toMS, false},
+	}
+	for _, c := range cases {
+		_, _, err := FetchKlines(ctx, "mock", c.symbol, c.market, c.tf, c.from, c.to, opts)
+		if err == nil {
+			t.Fatalf("%s: should fail", c.name)
+		}
+		var banErr *errs.Error
+		if c.paramFail && (!errors.As(err, &banErr) || banErr.Code != errs.CodeParamInvalid) {
+			t.Fatalf("%s: expect param invalid, got %v", c.name, err)
+		}
+	}
+	_, klines, err := FetchKlines(ctx, "mock", "BTC/USDT", banexg.MarketSpot, "1m", fromMS, toMS, opts)
+	if err != nil || len(klines) != 30 {
+		t.Fatalf("expect 30 bars, got %d %v", len(klines), err)
+	}
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = FetchKlines(done, "mock", "BTC/USDT", "", "1m", fromMS, toMS, opts)
+	var banErr *errs.Error
+	if !errors.As(err, &banErr) || banErr.Code != core.ErrTimeout {
+		t.Fatalf("expect timeout when ctx is done, got %v", err)
+	}
+}
+
+func TestCalcIndTF(t *testing.T) {
+	useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Post("/calc_ind_tf", postCalcIndTF)
+	fromMS := int64(1699920000000) // aligned to days 按天对齐
+	toMS := fromMS + 30*4*3600000
+	post := func(body string) (int, []byte) {
+		req := httptest.NewRequest("POST", "/calc_ind_tf", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err_ := app.Test(req, -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+	code, body := post(fmt.Sprintf(`{"exchange":"mock","symbol":"BTC/USDT","timeframe":"1h","target":"4h","from":%d,`+
+		`"to":%d,"name":"RMA","params":[14],"warmup":50,"source":"exchange_only"}`, fromMS, toMS))
+	var res struct {
+		Kline [][]float64          `json:"kline"`
+		Data  []map[string]float64 `json:"data"`
+	}
+	if err_ := json.Unmarshal(body, &res); err_ != nil || code != 200 {
+		t.Fatalf("bad resp %d: %s", code, body)
+	}
+	if len(res.Kline) != 30 || len(res.Data) != 30 || int64(res.Kline[0][0]) != fromMS {
+		t.Fatalf("expect 30 bars of 4h from %d, got %d %d", fromMS, len(res.Kline), len(res.Data))
+	}
+	// resample then calc separately 分别重采样和计算
+	loadMS := fromMS - 50*4*3600000
+	_, klines, err := FetchKlines(context.Background(), "mock", "BTC/USDT", "", "1h", loadMS, toMS,
+		&FetchOpts{Source: HistExchangeOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigs, _ := utils.BuildOHLCV(klines, 4*3600000, 0, nil, 3600000, 0, "sum")
+	want, err := CalcInd("RMA", ArrKLines(bigs), []float64{14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVals := want.([]map[string]float64)[50:]
+	for i, row := range res.Kline {
+		big := bigs[50+i]
+		if int64(row[0]) != big.Time || row[1] != big.Open || row[2] != big.High || row[3] != big.Low ||
+			row[4] != big.Close || row[5] != big.Volume {
+			t.Fatalf("bar %d mismatch: %v %+v", i, row, big)
+		}
+		if math.Abs(res.Data[i]["1"]-wantVals[i]["1"]) > 1e-9 {
+			t.Fatalf("value %d mismatch: %v %v", i, res.Data[i], wantVals[i])
+		}
+	}
+	if big := bigs[50]; big.Volume != 40 {
+		t.Fatalf("4h bar should sum 4 bars of 1h: %+v", big)
+	}
+	code, body = post(fmt.Sprintf(`{"exchange":"mock","symbol":"BTC/USDT","timeframe":"1h","target":"90m",`+
+		`"from":%d,"to":%d,"name":"RMA","params":[14],"source":"exchange_only"}`, fromMS, toMS))
+	if code != 400 || !strings.Contains(string(body), "multiple") {
+		t.Fatalf("target not a multiple should fail, got %d: %s", code, body)
+	}
+}
+
+func TestReqTimeout(t *testing.T) {
+	exchange := useMockExchange(t, nil)
+	exchange.delay = 300 * time.Millisecond
+	oldTimeouts := RouteTimeouts
+	RouteTimeouts = map[string]time.Duration{"/hist": 50 * time.Millisecond, "/slow_ok": 5 * time.Second}
+	t.Cleanup(func() {
+		RouteTimeouts = oldTimeouts
+	})
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", ReqTimeout("/hist"), getHist)
+	app.Get("/slow_ok", ReqTimeout("/slow_ok"), getHist)
+	fromMS := int64(1700000000000)
+	get := func(path string) (int, time.Duration) {
+		url := fmt.Sprintf("%s?exchange=mock&symbol=BTC/USDT&timeframe=1m&from=%d&to=%d&source=exchange_only",
+			path, fromMS, fromMS+30*60000)
+		start := time.Now()
+		resp, err_ := app.Test(httptest.NewRequest("GET", url, nil), -1)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		return resp.StatusCode, time.Since(start)
+	}
+	// the slow fetch is abandoned at the deadline 慢速下载在期限到达时被放弃
+	code, cost := get("/hist")
+	if code != fiber.StatusGatewayTimeout {
+		t.Fatalf("expect 504, got %d", code)
+	}
+	if cost >= exchange.delay {
+		t.Fatalf("expect return at deadline, cost %v", cost)
+	}
+	// a longer deadline of another route lets it finish 另一路由的更长期限可以正常完成
+	if code, _ = get("/slow_ok"); code != fiber.StatusOK {
+		t.Fatalf("expect 200 within deadline, got %d", code)
+	}
+}
@@ -0,0 +1,175 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/banbox/banbot/btime"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	"github.com/sasha-s/go-deadlock"
+	"go.uber.org/zap"
+)
+
+const (
+	BackfillRunning   = "running"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+
+	backfillChunkBars = 1000 // bars downloaded per chunk, cancellation is checked between chunks
+	backfillKeepNum   = 100  // max finished jobs kept for listing
+)
+
+type BackfillJob struct {
+	ID        string `json:"id"`
+	Exchange  string `json:"exchange"`
+	Symbol    string `json:"symbol"`
+	TimeFrame string `json:"timeframe"`
+	FromMS    int64  `json:"from"`
+	ToMS      int64  `json:"to"`
+	DoneMS    int64  `json:"done_ms"` // progress: data before this timestamp has been fetched
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	StartAt   int64  `json:"start_at"`
+	StopAt    int64  `json:"stop_at,omitempty"`
+	cancel    context.CancelFunc
+}
+
+// backfillFetch fetch klines of [startMS, endMS) into the local store 下载[startMS, endMS)的K线到本地存储
+type backfillFetch func(ctx context.Context, startMS, endMS int64) *errs.Error
+
+var (
+	backfillJobs = map[string]*BackfillJob{}
+	backfillLock deadlock.Mutex
+	backfillID   = 0
+)
+
+/*
+startBackfill
+Start a backfill job in background, fetch is called with consecutive chunks of [from, to), and should return soon
+after ctx is done, so cancelling doesn't wait for the whole chunk
+在后台启动补全任务，fetch会以[from, to)的连续分块被调用，ctx结束后应尽快返回，使取消无需等待整个分块
+*/
+func startBackfill(job *BackfillJob, tfMSecs int64, fetch backfillFetch) *BackfillJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	backfillLock.Lock()
+	backfillID += 1
+	job.ID = fmt.Sprintf("%d", backfillID)
+	job.Status = BackfillRunning
+	job.StartAt = btime.UTCStamp()
+	job.DoneMS = job.FromMS
+	job.cancel = cancel
+	backfillJobs[job.ID] = job
+	backfillLock.Unlock()
+	go func() {
+		defer cancel()
+		err := runBackfill(ctx, job, tfMSecs*backfillChunkBars, fetch)
+		backfillLock.Lock()
+		defer backfillLock.Unlock()
+		job.StopAt = btime.UTCStamp()
+		if ctx.Err() != nil {
+			job.Status = BackfillCancelled
+		} else if err != nil {
+			job.Status = BackfillFailed
+			job.Error = err.Short()
+			log.Warn("backfill fail", zap.String("id", job.ID), zap.String("symbol", job.Symbol), zap.Error(err))
+		} else {
+			job.Status = BackfillDone
+		}
+		trimBackfillJobs()
+	}()
+	return job
+}
+
+func runBackfill(ctx context.Context, job *BackfillJob, chunkMS int64, fetch backfillFetch) *errs.Error {
+	for curMS := job.FromMS; curMS < job.ToMS; curMS += chunkMS {
+		if ctx.Err() != nil {
+			return errs.New(core.ErrRunTime, ctx.Err())
+		}
+		endMS := min(curMS+chunkMS, job.ToMS)
+		err := fetch(ctx, curMS, endMS)
+		if err != nil {
+			return err
+		}
+		backfillLock.Lock()
+		job.DoneMS = endMS
+		backfillLock.Unlock()
+	}
+	return nil
+}
+
+// trimBackfillJobs drop the oldest finished jobs, must be called with backfillLock held
+func trimBackfillJobs() {
+	finished := make([]*BackfillJob, 0, len(backfillJobs))
+	for _, j := range backfillJobs {
+		if j.Status != BackfillRunning {
+			finished = append(finished, j)
+		}
+	}
+	if len(finished) <= backfillKeepNum {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StopAt < finished[j].StopAt
+	})
+	for _, j := range finished[:len(finished)-backfillKeepNum] {
+		delete(backfillJobs, j.ID)
+	}
+}
+
+/*
+cancelBackfill
+Cancel a running job, returns false if the job not exists
+取消运行中的任务，任务不存在时返回false
+*/
+func cancelBackfill(id string) bool {
+	backfillLock.Lock()
+	job, ok := backfillJobs[id]
+	backfillLock.Unlock()
+	if !ok {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// listBackfills return copies of active and recent jobs, newest first
+func listBackfills() []BackfillJob {
+	backfillLock.Lock()
+	defer backfillLock.Unlock()
+	res := make([]BackfillJob, 0, len(backfillJobs))
+	for _, j := range backfillJobs {
+		item := *j
+		item.cancel = nil
+		res = append(res, item)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].StartAt > res[j].StartAt
+	})
+	return res
+}
+
+// downKlineChunk download klines of [startMS, endMS) into the local store
+func downKlineChunk(exs *orm.ExSymbol, timeFrame string) backfillFetch {
+	return func(ctx context.Context, startMS, endMS int64) *errs.Error {
+		exchange, err := GetExg(exs.Exchange, exs.Market, "", true)
+		if err != nil {
+			return err
+		}
+		downTF, err := orm.GetDownTF(timeFrame)
+		if err != nil {
+			return err
+		}
+		sess, conn, err := orm.Conn(nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		_, err = sess.DownOHLCV2DBCtx(ctx, exchange, exs, downTF, startMS, endMS, nil)
+		return err
+	}
+}
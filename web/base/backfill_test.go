@@ -0,0 +1,101 @@
+package base
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/banbox/banexg/errs"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBackfillCancel(t *testing.T) {
+	calls := make(chan int64, 100)
+	fetch := func(_ context.Context, startMS, endMS int64) *errs.Error {
+		calls <- startMS
+		time.Sleep(time.Millisecond * 20)
+		return nil
+	}
+	job := startBackfill(&BackfillJob{Symbol: "BTC/USDT", TimeFrame: "1m", FromMS: 0, ToMS: 60000 * 100000},
+		60000, fetch)
+	<-calls
+	found := false
+	for _, j := range listBackfills() {
+		if j.ID == job.ID {
+			found = j.Status == BackfillRunning
+		}
+	}
+	if !found {
+		t.Fatal("running job should be listed")
+	}
+	if !cancelBackfill(job.ID) {
+		t.Fatal("cancel should find the job")
+	}
+	stopAt := time.Now().Add(time.Second)
+	for time.Now().Before(stopAt) {
+		backfillLock.Lock()
+		status := job.Status
+		backfillLock.Unlock()
+		if status == BackfillCancelled {
+			break
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if job.Status != BackfillCancelled {
+		t.Fatalf("job should be cancelled, got %s", job.Status)
+	}
+	callNum := len(calls)
+	time.Sleep(time.Millisecond * 60)
+	if len(calls) != callNum || callNum > 2 {
+		t.Fatalf("fetch should stop after cancel, calls: %d -> %d", callNum, len(calls))
+	}
+	if cancelBackfill("not-exist") {
+		t.Fatal("cancel unknown job should fail")
+	}
+}
+
+func TestBackfillCancelInChunk(t *testing.T) {
+	started := make(chan struct{})
+	fetch := func(ctx context.Context, startMS, endMS int64) *errs.Error {
+		close(started)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 10):
+			t.Error("fetch should see the cancel")
+		}
+		return nil
+	}
+	job := startBackfill(&BackfillJob{Symbol: "BTC/USDT", TimeFrame: "1m", FromMS: 0, ToMS: 60000 * 100},
+		60000, fetch)
+	<-started
+	cancelBackfill(job.ID)
+	stopAt := time.Now().Add(time.Second)
+	for time.Now().Before(stopAt) {
+		backfillLock.Lock()
+		status := job.Status
+		backfillLock.Unlock()
+		if status == BackfillCancelled {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatal("cancel should stop the running chunk")
+}
+
+func TestBackfillBadTimeFrame(t *testing.T) {
+	useMockExchange(t, nil)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Post("/backfill", postBackfill)
+	body := `{"exchange":"mock","symbol":"BTC/USDT","timeframe":"x","from":1700000000000,"to":1700000600000}`
+	req := httptest.NewRequest("POST", "/backfill", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err_ := app.Test(req, -1)
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("bad timeframe should be 400, got %d", resp.StatusCode)
+	}
+}
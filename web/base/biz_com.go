@@ -1,19 +1,34 @@
 package base
 
 import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
 	"fmt"
 	"github.com/sasha-s/go-deadlock"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
+	"github.com/banbox/banbot/btime"
 	"github.com/banbox/banbot/config"
 	"github.com/banbox/banbot/core"
 	"github.com/banbox/banbot/data"
 	"github.com/banbox/banbot/exg"
 	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banbot/utils"
 	"github.com/banbox/banexg"
 	"github.com/banbox/banexg/errs"
 	"github.com/banbox/banexg/log"
 	utils2 "github.com/banbox/banexg/utils"
 	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 )
 
@@ -23,6 +38,44 @@ var (
 	receiver    *data.KLineWatcher
 	wsSubs      = map[string]map[*WsClient]bool{}
 	wsSubLock   deadlock.Mutex
+	wsHists     = map[string]*wsHist{}       // recent kline updates of each ws key, guarded by wsSubLock 每个ws key最近的K线更新
+	adjCache    = map[int32][]*orm.AdjInfo{} // adjustment factors served by /hist of each symbol 每个品种/hist返回的复权因子
+	adjLock     deadlock.Mutex
+	bookCache   = map[string]*bookSnap{} // recent order books served by /book 最近/book返回的订单簿
+	bookLock    deadlock.Mutex
+	// getExgHook replaces GetExg when set, tests inject mock exchanges by it 设置时替换GetExg，测试通过它注入模拟交易所
+	getExgHook func(name, market, ctType string) (banexg.BanExchange, *errs.Error)
+	// histReadersHook replaces histReaders when set, tests inject a mock store by it 设置时替换histReaders，测试通过它注入模拟存储
+	histReadersHook func(ctx context.Context, exchange banexg.BanExchange, exs *orm.ExSymbol, tf string) (histReader, histReader, histReader)
+
+	// BookMaxDepth max levels of each side returned by /book 每侧最多返回的深度档数
+	BookMaxDepth = 100
+	// BookCacheTTL order books are fetched again after this 超过此时间后重新获取订单簿
+	BookCacheTTL = 2 * time.Second
+
+	// HistSources data source of /hist for each symbol, see HistStore 每个品种/hist的数据来源，见HistStore
+	HistSources = map[string]string{}
+	// FetchRetries max retries of fetching klines from exchange on transient errors 下载K线遇到临时错误时的最大重试次数
+	FetchRetries = 3
+	// FetchBackoff wait before the first retry, doubled for each later one 首次重试前的等待时间，之后每次翻倍
+	FetchBackoff = 500 * time.Millisecond
+	// FetchConcurrency max fetches from exchange running at once across requests, 0 for unlimited
+	// 所有请求同时从交易所下载的最大数量，0表示不限制
+	FetchConcurrency = 4
+	// FetchQueueWait max wait for a fetch slot, fail with ErrBusy (503) after this 等待下载名额的最长时间，超时返回ErrBusy(503)
+	FetchQueueWait = 10 * time.Second
+	fetchSem       chan struct{} // slots of FetchConcurrency FetchConcurrency的名额
+	fetchSemLock   deadlock.Mutex
+	// fetchRetryCodes transient error codes worth retrying 值得重试的临时错误码
+	fetchRetryCodes = map[int]bool{
+		errs.CodeNetFail:     true,
+		errs.CodeConnectFail: true,
+		core.ErrTimeout:      true,
+		core.ErrNetReadFail:  true,
+		core.ErrNetTimeout:   true,
+		core.ErrNetTemporary: true,
+		core.ErrNetConnect:   true,
+	}
 )
 
 func InitExg(exchange banexg.BanExchange) *errs.Error {
@@ -40,6 +93,9 @@ func InitExg(exchange banexg.BanExchange) *errs.Error {
 }
 
 func GetExg(name, market, ctType string, load bool) (banexg.BanExchange, *errs.Error) {
+	if getExgHook != nil {
+		return getExgHook(name, market, ctType)
+	}
 	exchange, err := exg.GetWith(name, market, ctType)
 	if err != nil {
 		return nil, err
@@ -58,6 +114,1504 @@ func ArrKLines(klines []*banexg.Kline) [][]float64 {
 	return res
 }
 
+/*
+NativeKlineFetcher
+Implemented by exchanges able to return native kline fields discarded by FetchOHLCV, like trade count or taker buy
+volume. Each item of the result holds the fields of one candle, with the candle time under "time".
+由能返回FetchOHLCV丢弃的原生K线字段（如成交笔数、主动买入量）的交易所实现。结果的每一项为一根K线的字段，K线时间在"time"中。
+*/
+type NativeKlineFetcher interface {
+	FetchOHLCVNative(symbol, timeframe string, since int64, limit int, params map[string]interface{}) ([]map[string]interface{}, *errs.Error)
+}
+
+/*
+nativeFields
+Fetch native fields of klines in pages of KBatchSize, the result is aligned with klines, nil for candles the
+exchange returns nothing for. ok is false when the exchange provides no native fields.
+按KBatchSize分页获取klines的原生字段，结果与klines对齐，交易所未返回的K线为nil。交易所不提供原生字段时ok为false。
+*/
+func nativeFields(ctx context.Context, exchange banexg.BanExchange, symbol, tf string, klines []*banexg.Kline) ([]map[string]interface{}, bool, *errs.Error) {
+	fetcher, ok := exchange.(NativeKlineFetcher)
+	if !ok {
+		return nil, false, nil
+	}
+	res := make([]map[string]interface{}, len(klines))
+	if len(klines) == 0 {
+		return res, true, nil
+	}
+	index := make(map[int64]int, len(klines))
+	minMS, maxMS := klines[0].Time, klines[0].Time
+	for i, k := range klines {
+		index[k.Time] = i
+		minMS, maxMS = min(minMS, k.Time), max(maxMS, k.Time)
+	}
+	tfMSecs := int64(utils2.TFToSecs(tf) * 1000)
+	for since := minMS; since <= maxMS; since += int64(core.KBatchSize) * tfMSecs {
+		limit := int(min(int64(core.KBatchSize), (maxMS-since)/tfMSecs+1))
+		items, err := fetchWithRetry(ctx, symbol, func() ([]map[string]interface{}, *errs.Error) {
+			return fetcher.FetchOHLCVNative(symbol, tf, since, limit, nil)
+		})
+		if err != nil {
+			return nil, true, err
+		}
+		for _, item := range items {
+			stamp := utils2.GetMapVal(item, "time", int64(0))
+			if i, ok := index[stamp]; ok {
+				res[i] = item
+			}
+		}
+	}
+	return res, true, nil
+}
+
+const (
+	TimeFmtMs      = "ms"
+	TimeFmtSecs    = "s"
+	TimeFmtRFC3339 = "rfc3339"
+)
+
+/*
+arrKlinesFmt
+Same as ArrKLines, but the time of each candle is encoded by timeFmt: TimeFmtMs (default), TimeFmtSecs or
+TimeFmtRFC3339 (UTC).
+同ArrKLines，但每个K线的时间按timeFmt编码：TimeFmtMs（默认），TimeFmtSecs或TimeFmtRFC3339（UTC）。
+*/
+func arrKlinesFmt(klines []*banexg.Kline, timeFmt string) interface{} {
+	if timeFmt == "" || timeFmt == TimeFmtMs {
+		return ArrKLines(klines)
+	}
+	res := make([][]interface{}, 0, len(klines))
+	for _, k := range klines {
+		var stamp interface{}
+		if timeFmt == TimeFmtSecs {
+			stamp = k.Time / 1000
+		} else {
+			stamp = time.UnixMilli(k.Time).UTC().Format(time.RFC3339)
+		}
+		res = append(res, []interface{}{stamp, k.Open, k.High, k.Low, k.Close, k.Volume, k.Info})
+	}
+	return res
+}
+
+/*
+orderKlines
+Return ascending klines in the given order, a reversed copy for "desc". Only for output, computations should
+always use the ascending input.
+按指定顺序返回升序的klines，"desc"时返回逆序的副本。仅用于输出，计算应始终使用升序输入。
+*/
+func orderKlines(klines []*banexg.Kline, order string) []*banexg.Kline {
+	if order != "desc" {
+		return klines
+	}
+	res := slices.Clone(klines)
+	slices.Reverse(res)
+	return res
+}
+
+/*
+mergeKlines
+Stitch stored candles with fetched ones, candles at the seam are deduplicated (fetched wins),
+the result is strictly increasing by time.
+拼接本地存储和新下载的K线，接缝处去重（以新下载为准），结果按时间严格递增。
+*/
+func mergeKlines(stored, fetched []*banexg.Kline) []*banexg.Kline {
+	if len(fetched) == 0 {
+		return stored
+	}
+	res := make([]*banexg.Kline, 0, len(stored)+len(fetched))
+	firstMS := fetched[0].Time
+	for _, k := range stored {
+		if k.Time >= firstMS {
+			break
+		}
+		if len(res) > 0 && k.Time <= res[len(res)-1].Time {
+			continue
+		}
+		res = append(res, k)
+	}
+	for _, k := range fetched {
+		if len(res) > 0 && k.Time <= res[len(res)-1].Time {
+			continue
+		}
+		res = append(res, k)
+	}
+	return res
+}
+
+/*
+rangeKlines
+Return the sub slice of sorted klines within [startMS, stopMS), positions are located by binary search.
+返回已排序klines中位于[startMS, stopMS)的子切片，通过二分查找定位起止位置。
+*/
+func rangeKlines(klines []*banexg.Kline, startMS, stopMS int64) []*banexg.Kline {
+	start := sort.Search(len(klines), func(i int) bool {
+		return klines[i].Time >= startMS
+	})
+	stop := start + sort.Search(len(klines)-start, func(i int) bool {
+		return klines[start+i].Time >= stopMS
+	})
+	return klines[start:stop]
+}
+
+type histReader = func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error)
+
+/*
+loadHist
+Read stored candles within [fromMS, toMS) by read (fromMS aligned to tf). When any bar is missing (head, holes or
+tail), fetch once from the first missing one to the end, then stitch them at the seam. Bounds are pushed down to read
+and fetch so no extra rows are loaded.
+通过read读取[fromMS, toMS)内（fromMS按tf对齐）已存储的K线。有缺失的K线时（头部、中间空洞或尾部），从第一个缺失处到结束下载一次，
+然后在接缝处拼接。边界下推到read和fetch，不加载多余的行。
+*/
+func loadHist(tf string, fromMS, toMS int64, read, fetch histReader) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+	tfMSecs := int64(utils2.TFToSecs(tf) * 1000)
+	startMS, stopMS := utils2.AlignTfMSecs(fromMS, tfMSecs), toMS
+	adjs, klines, err := read(startMS, stopMS)
+	if err != nil {
+		return nil, nil, err
+	}
+	fetchStart := firstMissing(klines, startMS, tfMSecs)
+	if fetchStart+tfMSecs < stopMS || len(klines) == 0 {
+		fetchAdjs, fetched, err := fetch(fetchStart, stopMS)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(fetchAdjs) > 0 {
+			adjs = fetchAdjs
+		}
+		klines = mergeKlines(klines, fetched)
+	}
+	return adjs, rangeKlines(klines, startMS, stopMS), nil
+}
+
+/*
+firstMissing
+Return where to fetch from for stored klines starting at startMS: startMS when the head is missing, else the bar
+before the first hole, or the last bar when there is no hole. The stored bar is overlapped as it may be revised.
+返回从startMS开始的已存储klines应从何处下载：头部缺失时为startMS，否则为第一个空洞前的K线，无空洞时为最后一根K线。
+重叠已存储的K线，因为它可能被修正。
+*/
+func firstMissing(klines []*banexg.Kline, startMS, tfMSecs int64) int64 {
+	if len(klines) == 0 || klines[0].Time > startMS {
+		return startMS
+	}
+	for i := 1; i < len(klines); i++ {
+		if klines[i].Time-klines[i-1].Time > tfMSecs {
+			return klines[i-1].Time
+		}
+	}
+	return klines[len(klines)-1].Time
+}
+
+// Data sources of /hist /hist的数据来源
+const (
+	HistStore        = "store"         // local store first, fetch the missing tail 优先本地存储，下载缺失的尾部
+	HistExchange     = "exchange"      // exchange first, local store on failure 优先交易所，失败时用本地存储
+	HistStoreOnly    = "store_only"    // local store only, never fetch 仅本地存储，不下载
+	HistExchangeOnly = "exchange_only" // exchange only, the store is untouched 仅交易所，不访问本地存储
+)
+
+/*
+histSource
+Return the data source of symbol: the source param if given, then HistSources of the symbol, default HistStore.
+返回symbol的数据来源：优先使用参数source，然后是HistSources中的配置，默认HistStore。
+*/
+func histSource(symbol, source string) string {
+	if source != "" {
+		return source
+	}
+	if src, ok := HistSources[symbol]; ok {
+		return src
+	}
+	return HistStore
+}
+
+var (
+	// HistMaxBars max bars of each timeframe returned by one /hist request, absent or 0 for unlimited
+	// 每个周期单次/hist请求返回的最大K线数，不存在或为0表示不限制
+	HistMaxBars = map[string]int{"1m": 50000, "5m": 50000, "15m": 50000}
+)
+
+/*
+clampHistRange
+Limit [fromMS, toMS) to HistMaxBars of tf, the start is kept so clients can page on from the returned end. Return
+the new end and a message when clamped.
+将[fromMS, toMS)限制在tf的HistMaxBars内，保留起点以便客户端从返回的终点继续分页。被截断时返回新的终点和提示信息。
+*/
+func clampHistRange(tf string, fromMS, toMS int64) (int64, string) {
+	limit := HistMaxBars[tf]
+	if limit <= 0 {
+		return toMS, ""
+	}
+	tfMSecs := int64(utils2.TFToSecs(tf) * 1000)
+	startMS := utils2.AlignTfMSecs(fromMS, tfMSecs)
+	if (toMS-startMS+tfMSecs-1)/tfMSecs <= int64(limit) {
+		return toMS, ""
+	}
+	endMS := startMS + int64(limit)*tfMSecs
+	return endMS, fmt.Sprintf("at most %d bars of %s per request, the rest starts from %d", limit, tf, endMS)
+}
+
+/*
+loadHistFrom
+Load candles within [fromMS, toMS) from the source. read and fetch are for the local store (see loadHist), live reads
+straight from the exchange without touching the store.
+从source加载[fromMS, toMS)内的K线。read和fetch用于本地存储（见loadHist），live直接从交易所读取，不访问本地存储。
+*/
+func loadHistFrom(source, tf string, fromMS, toMS int64, read, fetch, live histReader) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+	tfMSecs := int64(utils2.TFToSecs(tf) * 1000)
+	startMS := utils2.AlignTfMSecs(fromMS, tfMSecs)
+	switch source {
+	case HistStore, "":
+		return loadHist(tf, fromMS, toMS, read, fetch)
+	case HistStoreOnly:
+		adjs, klines, err := read(startMS, toMS)
+		if err != nil {
+			return nil, nil, err
+		}
+		return adjs, rangeKlines(klines, startMS, toMS), nil
+	case HistExchange, HistExchangeOnly:
+		adjs, klines, err := live(startMS, toMS)
+		if err == nil {
+			return adjs, rangeKlines(klines, startMS, toMS), nil
+		}
+		if source == HistExchangeOnly {
+			return nil, nil, err
+		}
+		log.Warn("load hist from exchange fail, use store", zap.Error(err))
+		return loadHist(tf, fromMS, toMS, read, fetch)
+	default:
+		return nil, nil, errs.NewMsg(errs.CodeParamInvalid, "unknown hist source: %s", source)
+	}
+}
+
+// FetchOpts optional args of FetchKlines FetchKlines的可选参数
+type FetchOpts struct {
+	Source string // see HistStore, empty for histSource of the symbol 见HistStore，为空时使用品种的histSource
+}
+
+/*
+FetchKlines
+Validate args and load candles of symbol within [fromMS, toMS) from the source, the one entry for endpoints reading
+candles, so they reject bad args alike: the symbol must exist (and be of market if given), the timeframe valid, and
+fromMS a 13-digit timestamp less than toMS. Adjustment factors are kept by cacheAdjs. Fetches give up once ctx is done.
+校验参数并从数据来源加载symbol在[fromMS, toMS)内的K线，是读取K线的接口的统一入口，使其以相同方式拒绝错误参数：品种必须存在
+（指定market时需属于该市场），周期有效，fromMS为小于toMS的13位时间戳。复权因子由cacheAdjs保存。ctx结束后放弃下载。
+*/
+func FetchKlines(ctx context.Context, exchange, symbol, market, timeframe string, fromMS, toMS int64,
+	opts *FetchOpts) ([]*orm.AdjInfo, []*banexg.Kline, error) {
+	if opts == nil {
+		opts = &FetchOpts{}
+	}
+	if tfSecs, err_ := utils2.ParseTimeFrame(timeframe); err_ != nil || tfSecs <= 0 {
+		return nil, nil, errs.NewMsg(errs.CodeParamInvalid, "invalid timeframe: %s", timeframe)
+	}
+	if fromMS < 1000000000000 {
+		return nil, nil, errs.NewMsg(errs.CodeParamInvalid, "`from` should be 13-digit timestamp: %d", fromMS)
+	}
+	if toMS <= fromMS {
+		return nil, nil, errs.NewMsg(errs.CodeParamInvalid, "`from` must less than `to`")
+	}
+	exs, err_ := resolveShort(exchange, symbol)
+	if err_ != nil {
+		return nil, nil, err_
+	}
+	if market != "" && exs.Market != market {
+		return nil, nil, errs.NewMsg(errs.CodeParamInvalid, "%s is of market %s, not %s", symbol, exs.Market, market)
+	}
+	exg, err := GetExg(exs.Exchange, exs.Market, "", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	read, fetch, live := histReaders(ctx, exg, exs, timeframe)
+	adjs, klines, err := loadHistFrom(histSource(exs.Symbol, opts.Source), timeframe, fromMS, toMS, read, fetch, live)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cacheAdjs(exs.ID, adjs), klines, nil
+}
+
+// isTransientErr whether the fetch error is transient (network or rate limit) 下载错误是否为临时错误（网络或限流）
+func isTransientErr(err *errs.Error) bool {
+	if fetchRetryCodes[err.Code] {
+		return true
+	}
+	msg := strings.ToLower(err.Short())
+	return strings.Contains(msg, "429") || strings.Contains(msg, "rate limit") ||
+		strings.Contains(msg, "too many requests")
+}
+
+/*
+acquireFetch
+Take a slot of FetchConcurrency before fetching from exchange, so bursts of requests don't exceed rate limits of the
+shared exchange. Wait up to FetchQueueWait, return ErrBusy on timeout, or ErrTimeout once ctx is done. Call release
+after fetching.
+从交易所下载前占用一个FetchConcurrency名额，避免突发请求超出共享交易所的频率限制。最多等待FetchQueueWait，超时返回ErrBusy，
+ctx结束时返回ErrTimeout。下载后调用release。
+*/
+func acquireFetch(ctx context.Context) (func(), *errs.Error) {
+	fetchSemLock.Lock()
+	if FetchConcurrency <= 0 {
+		fetchSemLock.Unlock()
+		return func() {}, nil
+	}
+	if fetchSem == nil || cap(fetchSem) != FetchConcurrency {
+		fetchSem = make(chan struct{}, FetchConcurrency)
+	}
+	sem := fetchSem
+	fetchSemLock.Unlock()
+	timer := time.NewTimer(FetchQueueWait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-timer.C:
+		return nil, errs.NewMsg(core.ErrBusy, "too many fetches from exchange, no slot in %v", FetchQueueWait)
+	case <-ctx.Done():
+		return nil, errs.NewMsg(core.ErrTimeout, "wait fetch slot: %v", ctx.Err())
+	}
+}
+
+/*
+fetchWithRetry
+Call fetch, retry with exponential backoff on transient errors, permanent errors are returned immediately.
+No more retry once ctx is done, fetch should also watch ctx so the slot is freed soon.
+调用fetch，遇到临时错误时指数退避重试，永久性错误立即返回。ctx结束后不再重试，fetch也应关注ctx以便尽快释放名额。
+*/
+func fetchWithRetry[T any](ctx context.Context, name string, fetch func() (T, *errs.Error)) (T, *errs.Error) {
+	wait := FetchBackoff
+	for attempt := 0; ; attempt++ {
+		release, err := acquireFetch(ctx)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		res, err := fetch()
+		release()
+		if err == nil || attempt >= FetchRetries || !isTransientErr(err) {
+			return res, err
+		}
+		log.Warn("fetch fail, retry later", zap.String("name", name), zap.Int("attempt", attempt+1),
+			zap.Duration("wait", wait), zap.Error(err))
+		if !sleepCtx(ctx, wait) {
+			return res, err
+		}
+		wait *= 2
+	}
+}
+
+// sleepCtx sleep for d, return false early when ctx or the bot is done 休眠d，ctx或机器人结束时提前返回false
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var stop <-chan struct{}
+	if core.Ctx != nil {
+		stop = core.Ctx.Done()
+	}
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+/*
+withCtx
+Run fn and wait until it returns or ctx is done. On ctx done ErrTimeout is returned at once, and fn's result is
+dropped. fn should be given the same ctx, so it stops soon after instead of holding a fetch slot.
+运行fn并等待其返回或ctx结束。ctx结束时立即返回ErrTimeout，fn的结果被丢弃。fn应使用同一ctx，以便随后尽快停止而不是占用下载名额。
+*/
+func withCtx[T any](ctx context.Context, name string, fn func() (T, *errs.Error)) (T, *errs.Error) {
+	var zero T
+	if err_ := ctx.Err(); err_ != nil {
+		return zero, errs.NewMsg(core.ErrTimeout, "%s: %v", name, err_)
+	}
+	type result struct {
+		val T
+		err *errs.Error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		done <- result{val: val, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.val, res.err
+	case <-ctx.Done():
+		return zero, errs.NewMsg(core.ErrTimeout, "%s: %v", name, ctx.Err())
+	}
+}
+
+/*
+alignCloses
+Inner join candle series on common times, return the common times and close prices of each series.
+按共同时间内连接多个K线序列，返回共同时间和每个序列的收盘价。
+*/
+func alignCloses(series [][]*banexg.Kline) ([]int64, [][]float64) {
+	if len(series) == 0 {
+		return nil, nil
+	}
+	counts := make(map[int64]int)
+	for _, arr := range series {
+		for _, k := range arr {
+			counts[k.Time] += 1
+		}
+	}
+	times := make([]int64, 0, len(series[0]))
+	for _, k := range series[0] {
+		if counts[k.Time] == len(series) {
+			times = append(times, k.Time)
+		}
+	}
+	closes := make([][]float64, len(series))
+	for i, arr := range series {
+		idx := 0
+		col := make([]float64, 0, len(times))
+		for _, k := range arr {
+			if idx < len(times) && k.Time == times[idx] {
+				col = append(col, k.Close)
+				idx += 1
+			}
+		}
+		closes[i] = col
+	}
+	return times, closes
+}
+
+/*
+loadEach
+Load each key by load, keys failed are reported in the error map with their messages rather than failing all.
+逐个加载key，失败的key及其错误信息在错误map中返回，而不是全部失败。
+*/
+func loadEach[T any](keys []string, load func(key string) (T, error)) (map[string]T, map[string]string) {
+	res := make(map[string]T, len(keys))
+	fails := make(map[string]string)
+	for _, key := range keys {
+		val, err := load(key)
+		if err != nil {
+			fails[key] = err.Error()
+			continue
+		}
+		res[key] = val
+	}
+	return res, fails
+}
+
+const (
+	// WarmupMaxItems max symbol timeframes in one /warmup request 每个/warmup请求最多的品种周期数
+	WarmupMaxItems = 200
+	// WarmupMaxBars max latest bars warmed for each item 每项最多预热的最新K线数
+	WarmupMaxBars = 1000
+)
+
+var (
+	// WarmupPerExg max items warmed at once for each exchange 每个交易所同时预热的最大项数
+	WarmupPerExg = 4
+)
+
+// WarmupItem a symbol timeframe to warm by /warmup /warmup中要预热的一个品种周期
+type WarmupItem struct {
+	Exchange  string `json:"exchange" validate:"required"`
+	Symbol    string `json:"symbol" validate:"required"`
+	TimeFrame string `json:"timeframe" validate:"required"`
+}
+
+// WarmupResult result of a WarmupItem, Error is empty on success WarmupItem的结果，成功时Error为空
+type WarmupResult struct {
+	WarmupItem
+	Bars  int    `json:"bars"`
+	Error string `json:"error,omitempty"`
+}
+
+/*
+warmupAll
+Warm items in parallel, at most perExg items of the same exchange at once, so one slow exchange doesn't hold the
+others. Return results in the order of items.
+并行预热items，同一交易所最多同时预热perExg项，避免一个慢交易所拖住其他交易所。按items的顺序返回结果。
+*/
+func warmupAll(items []*WarmupItem, perExg int, warm func(item *WarmupItem) (int, error)) []*WarmupResult {
+	perExg = max(1, perExg)
+	res := make([]*WarmupResult, len(items))
+	sems := make(map[string]chan struct{})
+	var wg sync.WaitGroup
+	for i, item := range items {
+		sem, ok := sems[item.Exchange]
+		if !ok {
+			sem = make(chan struct{}, perExg)
+			sems[item.Exchange] = sem
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := &WarmupResult{WarmupItem: *item}
+			bars, err := warm(item)
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Bars = bars
+			}
+			res[i] = r
+		}()
+	}
+	wg.Wait()
+	return res
+}
+
+/*
+calcReturnsCorr
+Pearson correlation matrix of log returns, candles are inner joined on common times first. Steps with a zero or
+negative close in any series are skipped for all series, like calcReturnsDist.
+Return the matrix and number of common candles.
+计算对数收益率的皮尔逊相关系数矩阵，K线先按共同时间内连接。任一序列收盘价为0或负数的步骤在所有序列中跳过，同calcReturnsDist。
+返回矩阵和共同K线数量。
+*/
+func calcReturnsCorr(series [][]*banexg.Kline) ([][]float64, int, *errs.Error) {
+	times, closes := alignCloses(series)
+	if len(times) < 3 {
+		return nil, len(times), errs.NewMsg(errs.CodeParamInvalid, "too few common candles: %d", len(times))
+	}
+	rets := make([][]float64, len(closes))
+	for j := 1; j < len(times); j++ {
+		valid := true
+		for _, col := range closes {
+			if col[j-1] <= 0 || col[j] <= 0 {
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		for i, col := range closes {
+			rets[i] = append(rets[i], math.Log(col[j]/col[j-1]))
+		}
+	}
+	if len(rets[0]) < 2 {
+		return nil, len(times), errs.NewMsg(errs.CodeParamInvalid, "too few valid returns: %d", len(rets[0]))
+	}
+	corrMat, _, err_ := utils.CalcCorrMat(len(rets[0]), rets, false)
+	if err_ != nil {
+		return nil, len(times), errs.New(errs.CodeRunTime, err_)
+	}
+	res := make([][]float64, len(rets))
+	for i := range res {
+		res[i] = make([]float64, len(rets))
+		for j := range res[i] {
+			res[i][j] = corrMat.At(i, j)
+		}
+	}
+	return res, len(times), nil
+}
+
+// ReturnsBin a histogram bin of returns in [Low, High), the last bin includes High 收益率直方图的一个区间
+type ReturnsBin struct {
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+	Count int     `json:"count"`
+}
+
+// ReturnsDist distribution of per-bar log returns 每根K线对数收益率的分布
+type ReturnsDist struct {
+	Count   int           `json:"count"`
+	Skipped int           `json:"skipped"` // returns skipped for zero or negative prices 因价格为0或负数跳过的收益率
+	Mean    float64       `json:"mean"`
+	Std     float64       `json:"std"`
+	Skew    float64       `json:"skew"`
+	Kurt    float64       `json:"kurt"` // excess kurtosis, 0 for normal distribution 超额峰度，正态分布为0
+	Bins    []*ReturnsBin `json:"bins"`
+}
+
+/*
+calcReturnsDist
+Histogram of log returns between closes of adjacent candles in `bins` equal-width bins, with population moments.
+Returns involving a zero or negative close are skipped and counted in Skipped.
+相邻K线收盘价对数收益率的直方图，分为bins个等宽区间，并计算总体矩。涉及0或负数收盘价的收益率被跳过并计入Skipped。
+*/
+func calcReturnsDist(klines []*banexg.Kline, bins int) *ReturnsDist {
+	res := &ReturnsDist{Bins: make([]*ReturnsBin, 0)}
+	rets := make([]float64, 0, len(klines))
+	for i := 1; i < len(klines); i++ {
+		prev, cur := klines[i-1].Close, klines[i].Close
+		if prev <= 0 || cur <= 0 {
+			res.Skipped += 1
+			continue
+		}
+		rets = append(rets, math.Log(cur/prev))
+	}
+	res.Count = len(rets)
+	if len(rets) == 0 || bins <= 0 {
+		return res
+	}
+	var sum float64
+	for _, r := range rets {
+		sum += r
+	}
+	res.Mean = sum / float64(len(rets))
+	var m2, m3, m4 float64
+	for _, r := range rets {
+		d := r - res.Mean
+		m2 += d * d
+		m3 += d * d * d
+		m4 += d * d * d * d
+	}
+	n := float64(len(rets))
+	m2, m3, m4 = m2/n, m3/n, m4/n
+	res.Std = math.Sqrt(m2)
+	if m2 > 0 {
+		res.Skew = m3 / math.Pow(m2, 1.5)
+		res.Kurt = m4/(m2*m2) - 3
+	}
+	low, high := slices.Min(rets), slices.Max(rets)
+	if high == low {
+		// all equal, one bin holds them 全部相等，放入一个区间
+		res.Bins = append(res.Bins, &ReturnsBin{Low: low, High: high, Count: len(rets)})
+		return res
+	}
+	width := (high - low) / float64(bins)
+	for i := 0; i < bins; i++ {
+		res.Bins = append(res.Bins, &ReturnsBin{Low: low + width*float64(i), High: low + width*float64(i+1)})
+	}
+	res.Bins[bins-1].High = high
+	for _, r := range rets {
+		idx := min(int((r-low)/width), bins-1)
+		res.Bins[idx].Count += 1
+	}
+	return res
+}
+
+/*
+klinesSince
+Return candles from sinceMS (the revised last candle of the client included), or all candles with full=true
+when an adjustment starts after sinceMS, as previous candles of the client are rescaled.
+返回从sinceMS开始的K线（包含客户端可能被修正的最后一个K线）；如果sinceMS之后有新的复权，客户端之前的K线已被重新缩放，返回全部K线并full=true。
+*/
+func klinesSince(klines []*banexg.Kline, adjs []*orm.AdjInfo, sinceMS int64) ([]*banexg.Kline, bool) {
+	if sinceMS <= 0 {
+		return klines, true
+	}
+	for _, adj := range adjs {
+		if adj.StartMS > sinceMS && adj.Factor != 0 && adj.Factor != 1 {
+			return klines, true
+		}
+	}
+	idx := sort.Search(len(klines), func(i int) bool {
+		return klines[i].Time >= sinceMS
+	})
+	return klines[idx:], false
+}
+
+/*
+sameAdjs
+Whether two adjustment lists have the same factors. StopMS of the last one is ignored as it follows the current time.
+两个复权列表的因子是否相同。最后一个的StopMS跟随当前时间，忽略。
+*/
+func sameAdjs(a, b []*orm.AdjInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, x := range a {
+		y := b[i]
+		if x.StartMS != y.StartMS || x.Factor != y.Factor || x.CumFactor != y.CumFactor {
+			return false
+		}
+		if (x.ExSymbol == nil) != (y.ExSymbol == nil) || x.ExSymbol != nil && x.ExSymbol.ID != y.ExSymbol.ID {
+			return false
+		}
+		if i+1 < len(a) && x.StopMS != y.StopMS {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+cacheAdjs
+Return the cached adjustment factors of sid if unchanged, or replace the cache with fresh when new factors appear.
+Empty fresh keeps the cache, as the candles may come from a path without factors.
+sid的复权因子未变化时返回缓存的，出现新因子时用fresh替换缓存。fresh为空时保留缓存，因K线可能来自不带因子的途径。
+*/
+func cacheAdjs(sid int32, fresh []*orm.AdjInfo) []*orm.AdjInfo {
+	adjLock.Lock()
+	defer adjLock.Unlock()
+	old, ok := adjCache[sid]
+	if len(fresh) == 0 || ok && sameAdjs(old, fresh) {
+		return old
+	}
+	adjCache[sid] = fresh
+	return fresh
+}
+
+type AvgPrice struct {
+	Time int64   `json:"time"`
+	VWAP float64 `json:"vwap"`
+	TWAP float64 `json:"twap"`
+}
+
+/*
+calcAvgPrices
+Cumulative VWAP and TWAP of typical price (high+low+close)/3 for candles from anchorMS. Zero-volume candles
+add nothing to VWAP, which equals TWAP until some volume is traded.
+从anchorMS开始的K线，按典型价格(high+low+close)/3计算累计VWAP和TWAP。零成交量K线不影响VWAP，在有成交前VWAP等于TWAP。
+*/
+func calcAvgPrices(klines []*banexg.Kline, anchorMS int64) []*AvgPrice {
+	res := make([]*AvgPrice, 0, len(klines))
+	var sumPV, sumVol, sumPrice float64
+	for _, k := range klines {
+		if k.Time < anchorMS {
+			continue
+		}
+		price := (k.High + k.Low + k.Close) / 3
+		sumPrice += price
+		if k.Volume > 0 {
+			sumPV += price * k.Volume
+			sumVol += k.Volume
+		}
+		twap := sumPrice / float64(len(res)+1)
+		vwap := twap
+		if sumVol > 0 {
+			vwap = sumPV / sumVol
+		}
+		res = append(res, &AvgPrice{Time: k.Time, VWAP: vwap, TWAP: twap})
+	}
+	return res
+}
+
+const (
+	SpikeFlag   = "flag"   // only report spike candles 仅报告异常K线
+	SpikeSmooth = "smooth" // also clip wicks of spike candles 同时裁剪异常K线的影线
+)
+
+var (
+	// SpikeWindow default number of previous candles used to judge a spike 判断异常K线默认使用的前序K线数量
+	SpikeWindow = 20
+	// SpikeStdDevs default standard deviations above the mean range to be a spike 超过平均振幅多少个标准差视为异常
+	SpikeStdDevs = 4.0
+)
+
+/*
+findSpikes
+Return indexes of candles whose range (high-low) exceeds the mean of the previous `window` normal candles by more
+than nStd standard deviations, and the max normal range at each of them. Spikes are left out of later windows, the
+first `window` candles are never flagged.
+返回振幅(high-low)超过前window根正常K线平均值nStd个标准差以上的K线索引，以及每个位置的正常振幅上限。
+异常K线不计入后续窗口，前window根K线不会被标记。
+*/
+func findSpikes(klines []*banexg.Kline, window int, nStd float64) ([]int, []float64) {
+	if window <= 0 {
+		window = SpikeWindow
+	}
+	if nStd <= 0 {
+		nStd = SpikeStdDevs
+	}
+	var idxs []int
+	var limits []float64
+	ranges := make([]float64, 0, window)
+	var sum, sumSq float64
+	for i, k := range klines {
+		rng := k.High - k.Low
+		if len(ranges) == window {
+			mean := sum / float64(window)
+			std := math.Sqrt(max(0, sumSq/float64(window)-mean*mean))
+			limit := mean + nStd*std
+			if rng > limit {
+				idxs = append(idxs, i)
+				limits = append(limits, limit)
+				continue
+			}
+			sum -= ranges[0]
+			sumSq -= ranges[0] * ranges[0]
+			ranges = ranges[1:]
+		}
+		ranges = append(ranges, rng)
+		sum += rng
+		sumSq += rng * rng
+	}
+	return idxs, limits
+}
+
+/*
+smoothSpikes
+Return a copy of klines where wicks of spike candles are clipped in proportion so that the range is at most the
+limit, the body (open/close) is kept. klines are not modified.
+返回klines的副本，其中异常K线的影线按比例裁剪使振幅不超过limit，保留实体(open/close)。不修改klines。
+*/
+func smoothSpikes(klines []*banexg.Kline, idxs []int, limits []float64) []*banexg.Kline {
+	res := slices.Clone(klines)
+	for n, i := range idxs {
+		k := *klines[i]
+		top, bot := max(k.Open, k.Close), min(k.Open, k.Close)
+		up, down := k.High-top, bot-k.Low
+		if extra := limits[n] - (top - bot); extra <= 0 || up+down <= 0 {
+			k.High, k.Low = top, bot
+		} else {
+			rate := min(1, extra/(up+down))
+			k.High, k.Low = top+up*rate, bot-down*rate
+		}
+		res[i] = &k
+	}
+	return res
+}
+
+// methods of /pivots /pivots的计算方法
+const (
+	PivotClassic   = "classic"
+	PivotFibonacci = "fibonacci"
+	PivotCamarilla = "camarilla"
+)
+
+// PivotLevels pivot levels of the period starting at Time 从Time开始的周期的枢轴位
+type PivotLevels struct {
+	Time int64   `json:"time"`
+	P    float64 `json:"p"`
+	R1   float64 `json:"r1"`
+	R2   float64 `json:"r2"`
+	R3   float64 `json:"r3"`
+	S1   float64 `json:"s1"`
+	S2   float64 `json:"s2"`
+	S3   float64 `json:"s3"`
+}
+
+/*
+calcPivots
+Pivot levels of each period computed from the high, low and close of the previous kline. The levels of the last
+kline are for the period after it, so the current period is covered.
+每个周期的枢轴位，由上一根K线的最高、最低和收盘价计算。最后一根K线的结果属于其后的周期，从而覆盖当前周期。
+*/
+func calcPivots(klines []*banexg.Kline, tfMSecs int64, method string) ([]*PivotLevels, *errs.Error) {
+	res := make([]*PivotLevels, 0, len(klines))
+	for _, k := range klines {
+		h, l, c := k.High, k.Low, k.Close
+		rng := h - l
+		lv := &PivotLevels{Time: k.Time + tfMSecs, P: (h + l + c) / 3}
+		switch method {
+		case PivotClassic:
+			lv.R1, lv.S1 = 2*lv.P-l, 2*lv.P-h
+			lv.R2, lv.S2 = lv.P+rng, lv.P-rng
+			lv.R3, lv.S3 = h+2*(lv.P-l), l-2*(h-lv.P)
+		case PivotFibonacci:
+			lv.R1, lv.S1 = lv.P+0.382*rng, lv.P-0.382*rng
+			lv.R2, lv.S2 = lv.P+0.618*rng, lv.P-0.618*rng
+			lv.R3, lv.S3 = lv.P+rng, lv.P-rng
+		case PivotCamarilla:
+			lv.R1, lv.S1 = c+rng*1.1/12, c-rng*1.1/12
+			lv.R2, lv.S2 = c+rng*1.1/6, c-rng*1.1/6
+			lv.R3, lv.S3 = c+rng*1.1/4, c-rng*1.1/4
+		default:
+			return nil, errs.NewMsg(errs.CodeParamInvalid, "unknown pivot method: %s", method)
+		}
+		res = append(res, lv)
+	}
+	return res, nil
+}
+
+/*
+resampleKlines
+Aggregate sorted candles of baseTF into targetTF, which must be a multiple of baseTF. The last bar is dropped when
+its period is not complete yet.
+将baseTF的已排序K线聚合为targetTF，targetTF必须是baseTF的整数倍。最后一根K线的周期尚未完整时被丢弃。
+*/
+func resampleKlines(klines []*banexg.Kline, baseTF, targetTF string) ([]*banexg.Kline, *errs.Error) {
+	baseSecs, err_ := utils2.ParseTimeFrame(baseTF)
+	if err_ != nil || baseSecs <= 0 {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "invalid timeframe: %s", baseTF)
+	}
+	targetSecs, err_ := utils2.ParseTimeFrame(targetTF)
+	if err_ != nil || targetSecs <= 0 {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "invalid target timeframe: %s", targetTF)
+	}
+	if targetSecs < baseSecs || targetSecs%baseSecs != 0 {
+		return nil, errs.NewMsg(errs.CodeParamInvalid, "target timeframe %s should be a multiple of %s", targetTF,
+			baseTF)
+	}
+	if len(klines) == 0 || targetSecs == baseSecs {
+		return klines, nil
+	}
+	res, lastDone := utils.BuildOHLCV(klines, int64(targetSecs*1000), 0, nil, int64(baseSecs*1000), 0, "sum")
+	if !lastDone && len(res) > 0 {
+		res = res[:len(res)-1]
+	}
+	return res, nil
+}
+
+const (
+	// ExportMaxSpecs max csv files in one /export archive 每个/export压缩包最多的csv文件数
+	ExportMaxSpecs = 50
+	// ExportMaxBars max bars of all specs in one /export archive 每个/export压缩包所有文件的最大K线数
+	ExportMaxBars = 2000000
+)
+
+// ExportSpec one csv file of /export /export中的一个csv文件
+type ExportSpec struct {
+	Exchange  string `json:"exchange" validate:"required"`
+	Symbol    string `json:"symbol" validate:"required"`
+	TimeFrame string `json:"timeframe" validate:"required"`
+	FromMS    int64  `json:"from" validate:"required"`
+	ToMS      int64  `json:"to" validate:"required"`
+}
+
+var exportNameRep = strings.NewReplacer("/", "_", ":", "_")
+
+// FileName name of the csv in the archive 在压缩包中的csv文件名
+func (s *ExportSpec) FileName() string {
+	return fmt.Sprintf("%s_%s_%s_%d_%d.csv", s.Exchange, exportNameRep.Replace(s.Symbol), s.TimeFrame,
+		s.FromMS, s.ToMS)
+}
+
+var exportHeader = []string{"time", "open", "high", "low", "close", "volume"}
+
+/*
+checkExportSpecs
+Check ranges and timeframes of specs, and bound the number of specs and the total bars.
+检查specs的时间范围和周期，并限制文件数和总K线数。
+*/
+func checkExportSpecs(specs []*ExportSpec) *errs.Error {
+	if len(specs) == 0 {
+		return errs.NewMsg(errs.CodeParamRequired, "specs is required")
+	}
+	if len(specs) > ExportMaxSpecs {
+		return errs.NewMsg(errs.CodeParamInvalid, "too many specs: %d > %d", len(specs), ExportMaxSpecs)
+	}
+	var total int64
+	for _, s := range specs {
+		if s.ToMS <= s.FromMS {
+			return errs.NewMsg(errs.CodeParamInvalid, "`from` must less than `to`: %s", s.FileName())
+		}
+		tfSecs, err := utils2.ParseTimeFrame(s.TimeFrame)
+		if err != nil || tfSecs <= 0 {
+			return errs.NewMsg(errs.CodeParamInvalid, "invalid timeframe: %s", s.TimeFrame)
+		}
+		total += (s.ToMS - s.FromMS) / int64(tfSecs*1000)
+	}
+	if total > ExportMaxBars {
+		return errs.NewMsg(errs.CodeParamInvalid, "too many bars: %d > %d", total, ExportMaxBars)
+	}
+	return nil
+}
+
+/*
+writeKlineZip
+Write a zip to w with one csv for each spec, klines of the spec are loaded by load.
+向w写入zip，每个spec一个csv，spec的K线通过load加载。
+*/
+func writeKlineZip(w io.Writer, specs []*ExportSpec, load func(s *ExportSpec) ([]*banexg.Kline, *errs.Error)) *errs.Error {
+	zipWriter := zip.NewWriter(w)
+	for _, s := range specs {
+		klines, err := load(s)
+		if err != nil {
+			return err
+		}
+		out, err_ := zipWriter.Create(s.FileName())
+		if err_ != nil {
+			return errs.New(errs.CodeIOWriteFail, err_)
+		}
+		csvWriter := csv.NewWriter(out)
+		err_ = csvWriter.Write(exportHeader)
+		for _, k := range klines {
+			if err_ != nil {
+				break
+			}
+			err_ = csvWriter.Write([]string{
+				strconv.FormatInt(k.Time, 10),
+				strconv.FormatFloat(k.Open, 'f', -1, 64),
+				strconv.FormatFloat(k.High, 'f', -1, 64),
+				strconv.FormatFloat(k.Low, 'f', -1, 64),
+				strconv.FormatFloat(k.Close, 'f', -1, 64),
+				strconv.FormatFloat(k.Volume, 'f', -1, 64),
+			})
+		}
+		csvWriter.Flush()
+		if err_ == nil {
+			err_ = csvWriter.Error()
+		}
+		if err_ != nil {
+			return errs.New(errs.CodeIOWriteFail, err_)
+		}
+	}
+	if err_ := zipWriter.Close(); err_ != nil {
+		return errs.New(errs.CodeIOWriteFail, err_)
+	}
+	return nil
+}
+
+/*
+fillGaps
+Insert flat candles (OHLC = previous close, volume 0) for missing intervals between klines, for charts assuming
+continuous time. Return the filled klines and times of inserted candles.
+在K线之间缺失的周期插入平K线（OHLC = 前一收盘价，成交量0），用于假设时间连续的图表。返回填充后的K线和插入K线的时间。
+*/
+func fillGaps(klines []*banexg.Kline, tfMSecs int64) ([]*banexg.Kline, map[int64]bool) {
+	filled := make(map[int64]bool)
+	if len(klines) < 2 || tfMSecs <= 0 {
+		return klines, filled
+	}
+	res := make([]*banexg.Kline, 0, len(klines))
+	for i, k := range klines {
+		if i > 0 {
+			prev := klines[i-1]
+			for t := prev.Time + tfMSecs; t < k.Time; t += tfMSecs {
+				res = append(res, &banexg.Kline{Time: t, Open: prev.Close, High: prev.Close, Low: prev.Close,
+					Close: prev.Close})
+				filled[t] = true
+			}
+		}
+		res = append(res, k)
+	}
+	return res, filled
+}
+
+/*
+relativeKlines
+Index klines of the range starting at fromMS by their bar offset from the aligned start, keep offsets below num.
+Missing bars leave gaps in offsets instead of shifting later ones. Each row is [offset, time, open, high, low, close,
+volume].
+按K线距对齐后起点的偏移索引从fromMS开始的K线，保留小于num的偏移。缺失的K线在偏移中留空而不是使后续K线前移。
+每行为[偏移, 时间, 开, 高, 低, 收, 量]。
+*/
+func relativeKlines(klines []*banexg.Kline, fromMS, tfMSecs int64, num int) [][]float64 {
+	startMS := utils2.AlignTfMSecs(fromMS, tfMSecs)
+	if startMS < fromMS {
+		startMS += tfMSecs
+	}
+	res := make([][]float64, 0, min(len(klines), num))
+	for _, k := range klines {
+		offset := (k.Time - startMS) / tfMSecs
+		if k.Time < startMS || offset >= int64(num) {
+			continue
+		}
+		res = append(res, []float64{float64(offset), float64(k.Time), k.Open, k.High, k.Low, k.Close, k.Volume})
+	}
+	return res
+}
+
+/*
+compareRanges
+Align klines of two ranges of the same symbol by relative offset, bar 0 is the start of each range. The longer range
+is truncated to the bars of the shorter one. Return the number of bars and both series, see relativeKlines.
+按相对偏移对齐同一品种两个时间范围的K线，第0根为各范围的起点。较长的范围被截断为较短范围的K线数。返回K线数和两个序列，
+见relativeKlines。
+*/
+func compareRanges(a, b []*banexg.Kline, rangeA, rangeB [2]int64, tfMSecs int64) (int, [][]float64, [][]float64) {
+	barsOf := func(r [2]int64) int64 {
+		startMS := utils2.AlignTfMSecs(r[0], tfMSecs)
+		if startMS < r[0] {
+			startMS += tfMSecs
+		}
+		return max(0, (r[1]-startMS+tfMSecs-1)/tfMSecs)
+	}
+	num := int(min(barsOf(rangeA), barsOf(rangeB)))
+	return num, relativeKlines(a, rangeA[0], tfMSecs, num), relativeKlines(b, rangeB[0], tfMSecs, num)
+}
+
+type BookDepth struct {
+	Symbol string       `json:"symbol"`
+	Time   int64        `json:"time"`
+	Bids   [][2]float64 `json:"bids"` // [price, size], price desc 价格降序
+	Asks   [][2]float64 `json:"asks"` // [price, size], price asc 价格升序
+}
+
+type bookSnap struct {
+	book    *banexg.OrderBook
+	fetchMS int64
+}
+
+// bookLevels top depth levels of one side, best price first 一侧最优的depth档，最优价格在前
+func bookLevels(side *banexg.OdBookSide, isBuy bool, depth int) [][2]float64 {
+	if side == nil {
+		return [][2]float64{}
+	}
+	side.Lock.Lock()
+	res := make([][2]float64, 0, min(len(side.Price), len(side.Size)))
+	for i := 0; i < len(side.Price) && i < len(side.Size); i++ {
+		res = append(res, [2]float64{side.Price[i], side.Size[i]})
+	}
+	side.Lock.Unlock()
+	sort.SliceStable(res, func(i, j int) bool {
+		if isBuy {
+			return res[i][0] > res[j][0]
+		}
+		return res[i][0] < res[j][0]
+	})
+	if len(res) > depth {
+		res = res[:depth]
+	}
+	return res
+}
+
+/*
+topBook
+Top depth bids and asks of the book, sorted by price from the best regardless of the order from the exchange.
+订单簿最优的depth档买卖盘，无论交易所返回的顺序如何，都按价格从最优开始排序。
+*/
+func topBook(book *banexg.OrderBook, depth int) *BookDepth {
+	return &BookDepth{
+		Symbol: book.Symbol,
+		Time:   book.TimeStamp,
+		Bids:   bookLevels(book.Bids, true, depth),
+		Asks:   bookLevels(book.Asks, false, depth),
+	}
+}
+
+/*
+loadBook
+Return the top depth levels of the book cached by key, fetch it again when older than BookCacheTTL.
+depth is bounded to [1, BookMaxDepth].
+返回key缓存的订单簿最优depth档，超过BookCacheTTL时重新获取。depth限制在[1, BookMaxDepth]。
+*/
+func loadBook(key string, depth int, fetch func() (*banexg.OrderBook, *errs.Error)) (*BookDepth, *errs.Error) {
+	depth = max(1, min(depth, BookMaxDepth))
+	curMS := btime.UTCStamp()
+	bookLock.Lock()
+	snap, ok := bookCache[key]
+	bookLock.Unlock()
+	if !ok || snap.fetchMS+BookCacheTTL.Milliseconds() <= curMS {
+		book, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		snap = &bookSnap{book: book, fetchMS: curMS}
+		bookLock.Lock()
+		bookCache[key] = snap
+		bookLock.Unlock()
+	}
+	return topBook(snap.book, depth), nil
+}
+
+const (
+	KlineHighLtLow     = "high_lt_low"
+	KlineOpenOutRange  = "open_out_range"
+	KlineCloseOutRange = "close_out_range"
+	KlineNegVolume     = "neg_volume"
+)
+
+type KlineIssue struct {
+	Time int64  `json:"time"`
+	Rule string `json:"rule"`
+}
+
+/*
+validateKlines
+Check OHLC invariants of each candle, return every violation with the broken rule.
+检查每个K线的OHLC不变量，返回每个违规及其违反的规则。
+*/
+func validateKlines(klines []*banexg.Kline) []*KlineIssue {
+	res := make([]*KlineIssue, 0)
+	for _, k := range klines {
+		if k.High < k.Low {
+			res = append(res, &KlineIssue{Time: k.Time, Rule: KlineHighLtLow})
+		} else {
+			if k.Open < k.Low || k.Open > k.High {
+				res = append(res, &KlineIssue{Time: k.Time, Rule: KlineOpenOutRange})
+			}
+			if k.Close < k.Low || k.Close > k.High {
+				res = append(res, &KlineIssue{Time: k.Time, Rule: KlineCloseOutRange})
+			}
+		}
+		if k.Volume < 0 {
+			res = append(res, &KlineIssue{Time: k.Time, Rule: KlineNegVolume})
+		}
+	}
+	return res
+}
+
+// compactSymbol uppercase and strip separators: btc-usdt -> BTCUSDT
+func compactSymbol(symbol string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(symbol) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// editDistance levenshtein distance of two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+/*
+matchSymbolAlias
+Find the canonical short symbol for alias spellings like BTCUSDT, btc-usdt, BTC_USDT.
+Return the match, or at most 5 nearest candidates as suggestions when no match.
+为BTCUSDT、btc-usdt、BTC_USDT等别名查找标准短符号。返回匹配项，无匹配时返回最多5个最接近的候选作为建议。
+*/
+func matchSymbolAlias(alias string, shorts []string) (string, []string) {
+	key := compactSymbol(alias)
+	if key == "" {
+		return "", nil
+	}
+	dists := make(map[string]int)
+	for _, short := range shorts {
+		cur := compactSymbol(short)
+		if cur == key {
+			return short, nil
+		}
+		if dist := editDistance(key, cur); dist <= 2 || strings.HasPrefix(cur, key) {
+			dists[short] = dist
+		}
+	}
+	res := utils2.KeysOfMap(dists)
+	sort.Slice(res, func(i, j int) bool {
+		if dists[res[i]] != dists[res[j]] {
+			return dists[res[i]] < dists[res[j]]
+		}
+		return res[i] < res[j]
+	})
+	if len(res) > 5 {
+		res = res[:5]
+	}
+	return "", res
+}
+
+// searchSymbols filter symbols whose compact short name contains the compact query 按紧凑形式搜索品种
+func searchSymbols(exsMap map[int32]*orm.ExSymbol, query string) map[int32]*orm.ExSymbol {
+	key := compactSymbol(query)
+	res := make(map[int32]*orm.ExSymbol)
+	for id, exs := range exsMap {
+		if strings.Contains(compactSymbol(exs.ToShort()), key) {
+			res[id] = exs
+		}
+	}
+	return res
+}
+
+/*
+checkShortSyntax
+Return why the short symbol is malformed, empty if it's well-formed. Only letters, digits and /:._- are allowed,
+with at most one "/" not at either end.
+返回简短品种名格式错误的原因，格式正确时返回空。只允许字母、数字和/:._-，最多一个不在两端的"/"。
+*/
+func checkShortSyntax(short string) string {
+	if strings.TrimSpace(short) == "" {
+		return "empty"
+	}
+	for _, r := range short {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("/:._-", r)) {
+			continue
+		}
+		return fmt.Sprintf("invalid char %q", r)
+	}
+	if strings.Count(short, "/") > 1 {
+		return "too many '/'"
+	}
+	if strings.HasPrefix(short, "/") || strings.HasSuffix(short, "/") {
+		return "missing base or quote"
+	}
+	return ""
+}
+
+/*
+resolveShort
+Parse the short symbol like orm.ParseShort, alias spellings are normalized to the canonical form.
+Return a 400 error if malformed, a 404 error with suggestions if not found, a 403 error if not allowed by
+SymbolAllows or SymbolBlocks.
+同orm.ParseShort解析短符号，别名会被规范化为标准形式。格式错误返回400，未找到时返回带建议的404错误，
+不被SymbolAllows或SymbolBlocks允许时返回403错误。
+*/
+func resolveShort(exgName, short string) (*orm.ExSymbol, error) {
+	if reason := checkShortSyntax(short); reason != "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("malformed symbol %q: %s", short, reason))
+	}
+	exs, err := orm.ParseShort(exgName, short)
+	if err == nil {
+		return checkAllowed(exs)
+	}
+	shorts := make([]string, 0)
+	blocked := make(map[string]bool)
+	for _, item := range orm.GetAllExSymbols() {
+		if item.Exchange == exgName {
+			shorts = append(shorts, item.ToShort())
+			if !symbolAllowed(item) {
+				blocked[item.ToShort()] = true
+			}
+		}
+	}
+	match, suggests := matchSymbolAlias(short, shorts)
+	// never suggest disallowed symbols 从不建议不允许的品种
+	suggests = slices.DeleteFunc(suggests, func(s string) bool {
+		return blocked[s]
+	})
+	if match != "" {
+		exs, err = orm.ParseShort(exgName, match)
+		if err != nil {
+			// the match comes from the symbol cache, failing here is an internal inconsistency
+			// 匹配项来自品种缓存，此处失败属于内部不一致
+			return nil, errs.NewMsg(errs.CodeRunTime, "resolve alias %s -> %s fail: %s", short, match, err.Short())
+		}
+		return checkAllowed(exs)
+	}
+	msg := "unknown symbol: " + short
+	if len(suggests) > 0 {
+		msg += ", did you mean: " + strings.Join(suggests, ", ")
+	}
+	return nil, fiber.NewError(fiber.StatusNotFound, msg)
+}
+
+var (
+	// SymbolAllows only symbols matching any of these patterns are served, empty to allow all. * and ? are supported
+	// 仅提供匹配其中任一模式的品种，为空时允许全部。支持*和?
+	SymbolAllows []string
+	// SymbolBlocks symbols matching any of these patterns are never served, checked before SymbolAllows
+	// 匹配其中任一模式的品种从不提供，先于SymbolAllows检查
+	SymbolBlocks []string
+)
+
+/*
+symbolAllowed
+Report whether exs may be served by the API. Patterns are matched against both the symbol and its short name, like
+"*USDT" or "BTC/*".
+判断exs是否可由API提供。模式同时匹配品种及其短名称，如"*USDT"或"BTC/*"。
+*/
+func symbolAllowed(exs *orm.ExSymbol) bool {
+	match := func(patterns []string) bool {
+		short := exs.ToShort()
+		for _, p := range patterns {
+			if utils.MatchTag(p, exs.Symbol) || utils.MatchTag(p, short) {
+				return true
+			}
+		}
+		return false
+	}
+	if match(SymbolBlocks) {
+		return false
+	}
+	return len(SymbolAllows) == 0 || match(SymbolAllows)
+}
+
+func checkAllowed(exs *orm.ExSymbol) (*orm.ExSymbol, error) {
+	if !symbolAllowed(exs) {
+		return nil, fiber.NewError(fiber.StatusForbidden, "symbol not allowed: "+exs.Symbol)
+	}
+	return exs, nil
+}
+
+// allowedSymbols filter symbols allowed by symbolAllowed 过滤symbolAllowed允许的品种
+func allowedSymbols(exsMap map[int32]*orm.ExSymbol) map[int32]*orm.ExSymbol {
+	if len(SymbolAllows) == 0 && len(SymbolBlocks) == 0 {
+		return exsMap
+	}
+	res := make(map[int32]*orm.ExSymbol, len(exsMap))
+	for id, exs := range exsMap {
+		if symbolAllowed(exs) {
+			res[id] = exs
+		}
+	}
+	return res
+}
+
+// sort orders of /symbols /symbols的排序方式
+const (
+	SymbolSortName = "name" // by exchange, market, then symbol 按交易所、市场、品种排序
+	SymbolSortList = "list" // newest listed first 最新上市的在前
+)
+
+/*
+sortSymbols
+Return symbols of exsMap in a stable order, see SymbolSortName. Ties of SymbolSortList are ordered by name.
+按稳定的顺序返回exsMap中的品种，见SymbolSortName。SymbolSortList相同时按名称排序。
+*/
+func sortSymbols(exsMap map[int32]*orm.ExSymbol, by string) []*orm.ExSymbol {
+	res := make([]*orm.ExSymbol, 0, len(exsMap))
+	for _, exs := range exsMap {
+		res = append(res, exs)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if by == SymbolSortList && a.ListMs != b.ListMs {
+			return a.ListMs > b.ListMs
+		}
+		if a.Exchange != b.Exchange {
+			return a.Exchange < b.Exchange
+		}
+		if a.Market != b.Market {
+			return a.Market < b.Market
+		}
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		return a.ID < b.ID
+	})
+	return res
+}
+
+type SymbolSource struct {
+	Exchange string `json:"exchange"`
+	Market   string `json:"market"`
+	Symbol   string `json:"symbol"`
+}
+
+type SymbolGroup struct {
+	Base    string          `json:"base"`
+	Quote   string          `json:"quote"`
+	Sources []*SymbolSource `json:"sources"`
+}
+
+/*
+groupSymbols
+Group symbols by base/quote asset, listing which exchanges and markets offer each one
+按基础/计价资产分组，列出每组由哪些交易所和市场提供
+*/
+func groupSymbols(exsMap map[int32]*orm.ExSymbol) []*SymbolGroup {
+	groups := make(map[string]*SymbolGroup)
+	for _, exs := range exsMap {
+		base, quote := exs.Symbol, ""
+		if parts := strings.SplitN(exs.Symbol, "/", 2); len(parts) == 2 {
+			base = parts[0]
+			quote = strings.SplitN(parts[1], ":", 2)[0]
+		}
+		key := base + "/" + quote
+		gp, ok := groups[key]
+		if !ok {
+			gp = &SymbolGroup{Base: base, Quote: quote}
+			groups[key] = gp
+		}
+		gp.Sources = append(gp.Sources, &SymbolSource{Exchange: exs.Exchange, Market: exs.Market, Symbol: exs.Symbol})
+	}
+	res := make([]*SymbolGroup, 0, len(groups))
+	for _, gp := range groups {
+		sort.Slice(gp.Sources, func(i, j int) bool {
+			a, b := gp.Sources[i], gp.Sources[j]
+			if a.Exchange != b.Exchange {
+				return a.Exchange < b.Exchange
+			}
+			if a.Market != b.Market {
+				return a.Market < b.Market
+			}
+			return a.Symbol < b.Symbol
+		})
+		res = append(res, gp)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Base != res[j].Base {
+			return res[i].Base < res[j].Base
+		}
+		return res[i].Quote < res[j].Quote
+	})
+	return res
+}
+
 func SetKlineSub(client *WsClient, isSub, lock bool, keys ...string) {
 	if lock {
 		wsSubLock.Lock()
@@ -114,7 +1668,8 @@ func klineHandler(msg *data.KLineMsg) {
 	defer wsSubLock.Unlock()
 	key := fmt.Sprintf("%s_%s_%s", msg.ExgName, msg.Market, msg.Pair)
 	clients, _ := wsSubs[key]
-	if len(clients) == 0 {
+	if _, ok := wsHists[key]; !ok && len(clients) == 0 {
+		// history is retained only for keys ever subscribed 只为订阅过的key保留历史
 		return
 	}
 	wsMsg := map[string]interface{}{
@@ -123,9 +1678,8 @@ func klineHandler(msg *data.KLineMsg) {
 		"secs": msg.TFSecs,
 		"upd":  msg.Interval,
 	}
-	raw, err := utils2.Marshal(wsMsg)
-	if err != nil {
-		log.Warn("marshal ws kline fail", zap.Error(err))
+	raw := pushWsHist(key, wsMsg)
+	if raw == nil {
 		return
 	}
 
@@ -138,3 +1692,58 @@ func klineHandler(msg *data.KLineMsg) {
 		}
 	}
 }
+
+type wsHist struct {
+	seq  int64    // seq of the latest update 最新更新的序号
+	msgs [][]byte // latest updates, the last one has seq 最近的更新，最后一个的序号为seq
+}
+
+/*
+pushWsHist
+Assign the next seq of key to wsMsg, encode and retain it for resuming, return nil if encoding fails.
+Caller should hold wsSubLock.
+为wsMsg分配key的下一个序号，编码并保留以便恢复，编码失败返回nil。调用方需持有wsSubLock。
+*/
+func pushWsHist(key string, wsMsg map[string]interface{}) []byte {
+	h, ok := wsHists[key]
+	if !ok {
+		h = &wsHist{}
+		wsHists[key] = h
+	}
+	wsMsg["seq"] = h.seq + 1
+	raw, err := utils2.Marshal(wsMsg)
+	if err != nil {
+		log.Warn("marshal ws kline fail", zap.Error(err))
+		return nil
+	}
+	h.seq += 1
+	h.msgs = append(h.msgs, raw)
+	if len(h.msgs) > WsHistSize {
+		h.msgs = h.msgs[len(h.msgs)-WsHistSize:]
+	}
+	return raw
+}
+
+/*
+replayWsHist
+Send updates of key after seq `resume` to the client, or a resync msg when they are no longer retained, the client
+should reload from /hist then. Caller should hold wsSubLock.
+向客户端发送key在序号resume之后的更新，如果已不再保留则发送resync消息，客户端应从/hist重新加载。调用方需持有wsSubLock。
+*/
+func (c *WsClient) replayWsHist(key string, resume int64) {
+	h, ok := wsHists[key]
+	if !ok || resume > h.seq || resume < h.seq-int64(len(h.msgs)) {
+		var seq int64
+		if ok {
+			seq = h.seq
+		}
+		c.WriteMsg(map[string]interface{}{"a": "resync", "key": key, "seq": seq})
+		return
+	}
+	for _, raw := range h.msgs[len(h.msgs)-int(h.seq-resume):] {
+		if err := c.Conn.WriteMessage(websocket.TextMessage, raw); err != nil {
+			log.Debug("replay to ws fail", zap.Error(err))
+			return
+		}
+	}
+}
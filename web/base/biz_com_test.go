@@ -0,0 +1,1053 @@
+package base
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/banbox/banbot/core"
+	"github.com/banbox/banbot/orm"
+	"github.com/banbox/banbot/utils"
+	"io"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/banbox/banexg"
+	"github.com/banbox/banexg/errs"
+	utils2 "github.com/banbox/banexg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+func makeBars(startMS, tfMS int64, num int, close float64) []*banexg.Kline {
+	res := make([]*banexg.Kline, 0, num)
+	for i := 0; i < num; i++ {
+		res = append(res, &banexg.Kline{Time: startMS + int64(i)*tfMS, Open: close, High: close,
+			Low: close, Close: close, Volume: 1})
+	}
+	return res
+}
+
+func TestMergeKlines(t *testing.T) {
+	tfMS := int64(60000)
+	stored := makeBars(0, tfMS, 10, 1)
+	// fetched overlaps the last stored bar, which was revised
+	fetched := makeBars(9*tfMS, tfMS, 10, 2)
+	res := mergeKlines(stored, fetched)
+	if len(res) != 19 {
+		t.Fatalf("expect 19 bars, got %d", len(res))
+	}
+	for i, k := range res {
+		if k.Time != int64(i)*tfMS {
+			t.Fatalf("bar %d time %d not contiguous", i, k.Time)
+		}
+	}
+	if res[8].Close != 1 || res[9].Close != 2 {
+		t.Fatalf("seam bar should come from fetched, got %v %v", res[8].Close, res[9].Close)
+	}
+	// fetched starting before the stored end, duplicates dropped
+	res = mergeKlines(stored, makeBars(5*tfMS, tfMS, 8, 3))
+	if len(res) != 13 || res[4].Close != 1 || res[5].Close != 3 {
+		t.Fatalf("bad merge for overlapped range: %d", len(res))
+	}
+	if len(mergeKlines(nil, fetched)) != 10 || len(mergeKlines(stored, nil)) != 10 {
+		t.Fatal("merge with empty side fail")
+	}
+}
+
+func TestGroupSymbols(t *testing.T) {
+	exsMap := map[int32]*orm.ExSymbol{
+		1: {ID: 1, Exchange: "okx", Market: "spot", Symbol: "BTC/USDT"},
+		2: {ID: 2, Exchange: "binance", Market: "spot", Symbol: "BTC/USDT"},
+		3: {ID: 3, Exchange: "binance", Market: "linear", Symbol: "BTC/USDT:USDT"},
+		4: {ID: 4, Exchange: "binance", Market: "spot", Symbol: "ETH/USDT"},
+		5: {ID: 5, Exchange: "china", Market: "spot", Symbol: "000001"},
+	}
+	res := groupSymbols(exsMap)
+	if len(res) != 3 {
+		t.Fatalf("expect 3 groups, got %d", len(res))
+	}
+	if res[0].Base != "000001" || res[1].Base != "BTC" || res[2].Base != "ETH" {
+		t.Fatalf("bad group order: %s %s %s", res[0].Base, res[1].Base, res[2].Base)
+	}
+	btc := res[1]
+	if btc.Quote != "USDT" || len(btc.Sources) != 3 {
+		t.Fatalf("BTC/USDT should have 3 sources, got %d", len(btc.Sources))
+	}
+	exgs := []string{btc.Sources[0].Exchange + ":" + btc.Sources[0].Market,
+		btc.Sources[1].Exchange + ":" + btc.Sources[1].Market, btc.Sources[2].Exchange + ":" + btc.Sources[2].Market}
+	if exgs[0] != "binance:linear" || exgs[1] != "binance:spot" || exgs[2] != "okx:spot" {
+		t.Fatalf("bad sources: %v", exgs)
+	}
+}
+
+func TestSortSymbols(t *testing.T) {
+	exsMap := map[int32]*orm.ExSymbol{
+		1: {ID: 1, Exchange: "okx", Market: "spot", Symbol: "BTC/USDT", ListMs: 300},
+		2: {ID: 2, Exchange: "binance", Market: "spot", Symbol: "ETH/USDT", ListMs: 100},
+		3: {ID: 3, Exchange: "binance", Market: "linear", Symbol: "BTC/USDT:USDT", ListMs: 300},
+		4: {ID: 4, Exchange: "binance", Market: "spot", Symbol: "BTC/USDT", ListMs: 200},
+		5: {ID: 5, Exchange: "china", Market: "spot", Symbol: "000001"},
+	}
+	cases := map[string][]int32{
+		"":             {3, 4, 2, 5, 1},
+		SymbolSortName: {3, 4, 2, 5, 1},
+		SymbolSortList: {3, 1, 4, 2, 5},
+	}
+	for by, want := range cases {
+		// map iteration differs between calls, the order should not 每次调用map遍历顺序不同，结果顺序应相同
+		for n := 0; n < 20; n++ {
+			res := sortSymbols(exsMap, by)
+			ids := make([]int32, 0, len(res))
+			for _, exs := range res {
+				ids = append(ids, exs.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(want) {
+				t.Fatalf("sort %q expect %v, got %v", by, want, ids)
+			}
+		}
+	}
+}
+
+func TestCalcReturnsCorr(t *testing.T) {
+	tfMS := int64(60000)
+	base := makeBars(0, tfMS, 50, 1)
+	double := makeBars(0, tfMS, 50, 1)
+	inverse := makeBars(0, tfMS, 50, 1)
+	for i := range base {
+		price := 100 + 10*math.Sin(float64(i)/3)
+		base[i].Close = price
+		double[i].Close = price * 2
+		inverse[i].Close = 1 / price
+	}
+	// misaligned candle times are inner joined 不对齐的K线时间会被内连接
+	double = append(double[:10], double[11:]...)
+	res, num, err := calcReturnsCorr([][]*banexg.Kline{base, double, inverse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 49 {
+		t.Fatalf("expect 49 common candles, got %d", num)
+	}
+	if math.Abs(res[0][1]-1) > 1e-9 || math.Abs(res[1][0]-1) > 1e-9 {
+		t.Fatalf("expect correlation ~1, got %v", res[0][1])
+	}
+	if math.Abs(res[0][2]+1) > 1e-9 {
+		t.Fatalf("expect correlation ~-1, got %v", res[0][2])
+	}
+	if _, _, err = calcReturnsCorr([][]*banexg.Kline{base[:2], double[:2]}); err == nil {
+		t.Fatal("too few candles should fail")
+	}
+	// zero closes are skipped, no NaN or Inf leaks into the matrix 0收盘价被跳过，矩阵中不会出现NaN或Inf
+	zero := makeBars(0, tfMS, 50, 1)
+	for i := range zero {
+		zero[i].Close = base[i].Close * 3
+	}
+	zero[20].Close = 0
+	res, _, err = calcReturnsCorr([][]*banexg.Kline{base, zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(res[0][1]-1) > 1e-9 {
+		t.Fatalf("expect correlation ~1 with zero closes skipped, got %v", res[0][1])
+	}
+}
+
+func TestValidateKlines(t *testing.T) {
+	tfMS := int64(60000)
+	bars := makeBars(0, tfMS, 6, 10)
+	for _, k := range bars {
+		k.High, k.Low = 11, 9
+	}
+	bars[1].High, bars[1].Low = 8, 9
+	bars[2].Open = 12
+	bars[3].Close = 8
+	bars[4].Volume = -1
+	issues := validateKlines(bars)
+	expects := []KlineIssue{
+		{Time: tfMS, Rule: KlineHighLtLow},
+		{Time: 2 * tfMS, Rule: KlineOpenOutRange},
+		{Time: 3 * tfMS, Rule: KlineCloseOutRange},
+		{Time: 4 * tfMS, Rule: KlineNegVolume},
+	}
+	if len(issues) != len(expects) {
+		t.Fatalf("expect %d issues, got %d", len(expects), len(issues))
+	}
+	for i, exp := range expects {
+		if *issues[i] != exp {
+			t.Fatalf("issue %d: expect %+v, got %+v", i, exp, *issues[i])
+		}
+	}
+}
+
+func TestKlinesSince(t *testing.T) {
+	tfMS := int64(60000)
+	bars := makeBars(0, tfMS, 10, 1)
+	res, full := klinesSince(bars, nil, 6*tfMS)
+	if full || len(res) != 4 || res[0].Time != 6*tfMS {
+		t.Fatalf("expect 4 bars from since, got %d, full: %v", len(res), full)
+	}
+	res, full = klinesSince(bars, nil, 0)
+	if !full || len(res) != 10 {
+		t.Fatalf("no since should return all, got %d", len(res))
+	}
+	adjs := []*orm.AdjInfo{{Factor: 1, StartMS: 0, StopMS: 8 * tfMS}, {Factor: 1.2, StartMS: 8 * tfMS}}
+	res, full = klinesSince(bars, adjs, 6*tfMS)
+	if !full || len(res) != 10 {
+		t.Fatalf("adjustment after since should require full refresh, got %d, full: %v", len(res), full)
+	}
+	res, full = klinesSince(bars, adjs, 9*tfMS)
+	if full || len(res) != 1 {
+		t.Fatalf("adjustment before since should not require full refresh, got %d, full: %v", len(res), full)
+	}
+}
+
+func TestMatchSymbolAlias(t *testing.T) {
+	shorts := []string{"BTC/USDT", "BTC/USDT.P", "ETH/USDT", "ETH/BTC", "SOL/USDT"}
+	for _, alias := range []string{"BTCUSDT", "btc/usdt", "BTC-USDT", "btc_usdt", "BTC/USDT"} {
+		match, _ := matchSymbolAlias(alias, shorts)
+		if match != "BTC/USDT" {
+			t.Fatalf("%s should resolve to BTC/USDT, got %q", alias, match)
+		}
+	}
+	if match, _ := matchSymbolAlias("btcusdt.p", shorts); match != "BTC/USDT.P" {
+		t.Fatalf("btcusdt.p should resolve to BTC/USDT.P, got %q", match)
+	}
+	match, suggests := matchSymbolAlias("ETHUSD", shorts)
+	if match != "" || len(suggests) == 0 || suggests[0] != "ETH/USDT" {
+		t.Fatalf("near miss should suggest ETH/USDT, got %q %v", match, suggests)
+	}
+	exsMap := map[int32]*orm.ExSymbol{
+		1: {ID: 1, Exchange: "binance", Market: "spot", Symbol: "BTC/USDT"},
+		2: {ID: 2, Exchange: "binance", Market: "spot", Symbol: "ETH/USDT"},
+	}
+	if res := searchSymbols(exsMap, "btc-usdt"); len(res) != 1 || res[1] == nil {
+		t.Fatalf("search btc-usdt fail: %v", res)
+	}
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	oldBackoff := FetchBackoff
+	FetchBackoff = time.Millisecond
+	defer func() {
+		FetchBackoff = oldBackoff
+	}()
+	calls := 0
+	res, err := fetchWithRetry(context.Background(), "flaky", func() (int, *errs.Error) {
+		calls += 1
+		if calls <= 2 {
+			return 0, errs.NewMsg(errs.CodeNetFail, "connection reset")
+		}
+		return 7, nil
+	})
+	if err != nil || res != 7 || calls != 3 {
+		t.Fatalf("expect success after 2 retries, got res %d, calls %d, err %v", res, calls, err)
+	}
+	calls = 0
+	_, err = fetchWithRetry(context.Background(), "bad", func() (int, *errs.Error) {
+		calls += 1
+		return 0, errs.NewMsg(core.ErrInvalidSymbol, "unknown symbol")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("permanent error should not retry, calls %d", calls)
+	}
+	calls = 0
+	_, err = fetchWithRetry(context.Background(), "limited", func() (int, *errs.Error) {
+		calls += 1
+		return 0, errs.NewMsg(errs.CodeInvalidResponse, "http 429 too many requests")
+	})
+	if err == nil || calls != FetchRetries+1 {
+		t.Fatalf("rate limit should retry %d times, calls %d", FetchRetries, calls)
+	}
+}
+
+func TestFetchRetryCtx(t *testing.T) {
+	oldBackoff := FetchBackoff
+	FetchBackoff = time.Second * 10
+	defer func() {
+		FetchBackoff = oldBackoff
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	calls := 0
+	start := time.Now()
+	_, err := fetchWithRetry(ctx, "flaky", func() (int, *errs.Error) {
+		calls += 1
+		return 0, errs.NewMsg(errs.CodeNetFail, "connection reset")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("should give up after ctx is done, calls %d, err %v", calls, err)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("backoff should stop at ctx done, cost %v", cost)
+	}
+}
+
+func TestCacheAdjs(t *testing.T) {
+	sid := int32(-678)
+	defer delete(adjCache, sid)
+	exs := &orm.ExSymbol{ID: sid}
+	makeAdjs := func(stop int64, factors ...float64) []*orm.AdjInfo {
+		res := make([]*orm.AdjInfo, 0, len(factors))
+		for i, f := range factors {
+			res = append(res, &orm.AdjInfo{ExSymbol: exs, Factor: f, StartMS: int64(i) * 1000, StopMS: int64(i+1) * 1000})
+		}
+		res[len(res)-1].StopMS = stop
+		return res
+	}
+	first := cacheAdjs(sid, makeAdjs(5000, 1, 1.1))
+	again := cacheAdjs(sid, makeAdjs(9000, 1, 1.1))
+	if &again[0] != &first[0] {
+		t.Fatal("unchanged factors should reuse the cached adjs")
+	}
+	if res := cacheAdjs(sid, nil); &res[0] != &first[0] {
+		t.Fatal("empty fresh should keep the cached adjs")
+	}
+	changed := cacheAdjs(sid, makeAdjs(9000, 1, 1.1, 0.9))
+	if len(changed) != 3 || &changed[0] == &first[0] {
+		t.Fatal("new factors should invalidate the cache")
+	}
+	if res := cacheAdjs(sid, makeAdjs(9000, 1, 1.1, 0.9)); &res[0] != &changed[0] {
+		t.Fatal("cache should hold the new factors")
+	}
+}
+
+func TestCalcAvgPrices(t *testing.T) {
+	bars := []*banexg.Kline{
+		{Time: 0, Open: 9, High: 12, Low: 8, Close: 10, Volume: 100},
+		{Time: 60000, Open: 10, High: 13, Low: 11, Close: 12, Volume: 0},
+		{Time: 120000, Open: 12, High: 15, Low: 12, Close: 15, Volume: 300},
+	}
+	check := func(name string, got []*AvgPrice, vwaps, twaps []float64) {
+		if len(got) != len(vwaps) {
+			t.Fatalf("%s: expect %d points, got %d", name, len(vwaps), len(got))
+		}
+		for i, p := range got {
+			if math.Abs(p.VWAP-vwaps[i]) > 1e-9 || math.Abs(p.TWAP-twaps[i]) > 1e-9 {
+				t.Fatalf("%s: point %d expect vwap %v twap %v, got %v %v", name, i, vwaps[i], twaps[i], p.VWAP, p.TWAP)
+			}
+		}
+	}
+	// typical prices 10, 12, 14; vwap at last = (10*100+14*300)/400 = 13
+	check("all", calcAvgPrices(bars, 0), []float64{10, 10, 13}, []float64{10, 11, 12})
+	// anchored at the zero-volume bar, vwap falls back to twap until volume is traded
+	check("anchor", calcAvgPrices(bars, 60000), []float64{12, 14}, []float64{12, 13})
+}
+
+func TestCalcReturnsDist(t *testing.T) {
+	// log returns alternate +0.1 and -0.1: mean 0, std 0.1, skew 0, kurt -2
+	bars := makeBars(0, 60000, 11, 100)
+	for i := 1; i < len(bars); i++ {
+		sign := 1.0
+		if i%2 == 0 {
+			sign = -1
+		}
+		bars[i].Close = bars[i-1].Close * math.Exp(0.1*sign)
+	}
+	// a zero close skips the returns before and after it 0收盘价跳过前后两个收益率
+	bars = append(bars, &banexg.Kline{Close: 0}, &banexg.Kline{Close: 50})
+	res := calcReturnsDist(bars, 4)
+	if res.Count != 10 || res.Skipped != 2 {
+		t.Fatalf("expect 10 returns and 2 skipped, got %d %d", res.Count, res.Skipped)
+	}
+	for name, pair := range map[string][2]float64{"mean": {res.Mean, 0}, "std": {res.Std, 0.1},
+		"skew": {res.Skew, 0}, "kurt": {res.Kurt, -2}} {
+		if math.Abs(pair[0]-pair[1]) > 1e-9 {
+			t.Fatalf("%s expect %v, got %v", name, pair[1], pair[0])
+		}
+	}
+	counts := make([]int, 0, len(res.Bins))
+	for _, b := range res.Bins {
+		counts = append(counts, b.Count)
+	}
+	if !slices.Equal(counts, []int{5, 0, 0, 5}) || math.Abs(res.Bins[0].Low+0.1) > 1e-9 ||
+		math.Abs(res.Bins[3].High-0.1) > 1e-9 {
+		t.Fatalf("bad bins: %v", counts)
+	}
+	if res = calcReturnsDist(makeBars(0, 60000, 5, 0), 4); res.Count != 0 || res.Skipped != 4 || len(res.Bins) != 0 {
+		t.Fatalf("zero prices should be skipped: %+v", res)
+	}
+}
+
+func TestLoadHistBounds(t *testing.T) {
+	tfMS, base := int64(60000), int64(1699999200000)
+	store := makeBars(base, tfMS, 100000, 1)
+	var rowsRead int
+	var bounds [][2]int64
+	read := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		bounds = append(bounds, [2]int64{startMS, stopMS})
+		rows := rangeKlines(store, startMS, stopMS)
+		rowsRead += len(rows)
+		return nil, rows, nil
+	}
+	fetch := func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		t.Fatalf("stored range is complete, should not fetch [%d, %d)", startMS, stopMS)
+		return nil, nil, nil
+	}
+	// unaligned from is aligned down to the bar containing it
+	fromMS, toMS := base+50000*tfMS+123, base+50010*tfMS
+	_, klines, err := loadHist("1m", fromMS, toMS, read, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounds) != 1 || bounds[0] != [2]int64{base + 50000*tfMS, toMS} {
+		t.Fatalf("bounds should be pushed down to store, got %v", bounds)
+	}
+	if rowsRead != 10 || len(klines) != 10 || klines[0].Time != base+50000*tfMS || klines[9].Time != base+50009*tfMS {
+		t.Fatalf("expect only 10 rows read, got read %d, return %d", rowsRead, len(klines))
+	}
+	// the missing tail is fetched from the last stored bar only
+	var fetchBounds [2]int64
+	fetch = func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+		fetchBounds = [2]int64{startMS, stopMS}
+		return nil, makeBars(startMS, tfMS, int((stopMS-startMS)/tfMS), 2), nil
+	}
+	_, klines, err = loadHist("1m", base+99995*tfMS, base+100005*tfMS, read, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchBounds != [2]int64{base + 99999*tfMS, base + 100005*tfMS} || len(klines) != 10 {
+		t.Fatalf("expect tail fetched from last stored bar, got %v, %d bars", fetchBounds, len(klines))
+	}
+	// the missing head is fetched from the start
+	_, klines, err = loadHist("1m", base-5*tfMS, base+5*tfMS, read, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchBounds != [2]int64{base - 5*tfMS, base + 5*tfMS} || len(klines) != 10 {
+		t.Fatalf("expect head fetched from start, got %v, %d bars", fetchBounds, len(klines))
+	}
+}
+
+func TestRangeKlines(t *testing.T) {
+	bars := makeBars(0, 10, 10, 1)
+	cases := []struct {
+		start, stop int64
+		num         int
+	}{
+		{0, 100, 10}, {15, 45, 3}, {-5, 0, 0}, {95, 200, 0}, {50, 50, 0},
+	}
+	for _, c := range cases {
+		if res := rangeKlines(bars, c.start, c.stop); len(res) != c.num {
+			t.Fatalf("range [%d, %d) expect %d, got %d", c.start, c.stop, c.num, len(res))
+		}
+	}
+}
+
+func TestArrKlinesFmt(t *testing.T) {
+	bars := []*banexg.Kline{{Time: 1700000000000, Open: 1, High: 2, Low: 0.5, Close: 1.5, Volume: 10}}
+	cases := []struct {
+		fmt  string
+		want string
+	}{
+		{"", "1700000000000"},
+		{TimeFmtMs, "1700000000000"},
+		{TimeFmtSecs, "1700000000"},
+		{TimeFmtRFC3339, `"2023-11-14T22:13:20Z"`},
+	}
+	for _, c := range cases {
+		raw, err_ := json.Marshal(arrKlinesFmt(bars, c.fmt))
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		want := "[[" + c.want + ",1,2,0.5,1.5,10,0]]"
+		if string(raw) != want {
+			t.Fatalf("fmt %q expect %s, got %s", c.fmt, want, raw)
+		}
+	}
+}
+
+func TestOrderKlines(t *testing.T) {
+	bars := makeBars(1700000000000, 60000, 5, 1)
+	for i, b := range bars {
+		b.Close = float64(i)
+	}
+	asc := arrKlinesFmt(orderKlines(bars, "asc"), "").([][]float64)
+	desc := arrKlinesFmt(orderKlines(bars, "desc"), "").([][]float64)
+	if len(asc) != 5 || len(desc) != 5 {
+		t.Fatalf("unexpected length: %d %d", len(asc), len(desc))
+	}
+	for i := range asc {
+		if fmt.Sprint(asc[i]) != fmt.Sprint(desc[len(desc)-1-i]) {
+			t.Fatalf("desc should be the exact reverse of asc at %d: %v %v", i, asc[i], desc[len(desc)-1-i])
+		}
+	}
+	if bars[0].Close != 0 || bars[4].Close != 4 {
+		t.Fatal("input should stay ascending")
+	}
+}
+
+func TestResolveShortStatus(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/sym", func(c *fiber.Ctx) error {
+		_, err := resolveShort("binance", c.Query("s"))
+		return err
+	})
+	app.Get("/backend", func(c *fiber.Ctx) error {
+		return errs.NewMsg(core.ErrDbReadFail, "db down")
+	})
+	cases := []struct {
+		url  string
+		code int
+	}{
+		{"/sym?s=" + url.QueryEscape("BTC/USDT/X"), fiber.StatusBadRequest},
+		{"/sym?s=" + url.QueryEscape("BTC USDT"), fiber.StatusBadRequest},
+		{"/sym?s=" + url.QueryEscape("/USDT"), fiber.StatusBadRequest},
+		{"/sym?s=NOPE/USDT", fiber.StatusNotFound},
+		{"/backend", fiber.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		resp, err_ := app.Test(httptest.NewRequest("GET", c.url, nil))
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		if resp.StatusCode != c.code {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s expect %d, got %d: %s", c.url, c.code, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestLoadBook(t *testing.T) {
+	key := "test_book"
+	defer delete(bookCache, key)
+	fetchNum := 0
+	// mock exchange returning levels out of order 模拟交易所返回乱序的档位
+	fetch := func() (*banexg.OrderBook, *errs.Error) {
+		fetchNum += 1
+		return &banexg.OrderBook{
+			Symbol:    "BTC/USDT",
+			TimeStamp: 1699999200000,
+			Bids:      &banexg.OdBookSide{IsBuy: true, Price: []float64{99, 100, 97, 98}, Size: []float64{2, 1, 4, 3}},
+			Asks:      &banexg.OdBookSide{Price: []float64{103, 101, 102}, Size: []float64{30, 10, 20}},
+		}, nil
+	}
+	book, err := loadBook(key, 2, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBids := [][2]float64{{100, 1}, {99, 2}}
+	wantAsks := [][2]float64{{101, 10}, {102, 20}}
+	if fmt.Sprint(book.Bids) != fmt.Sprint(wantBids) || fmt.Sprint(book.Asks) != fmt.Sprint(wantAsks) {
+		t.Fatalf("bad top book, bids: %v, asks: %v", book.Bids, book.Asks)
+	}
+	if book.Symbol != "BTC/USDT" || book.Time != 1699999200000 {
+		t.Fatalf("bad book meta: %+v", book)
+	}
+	// served from cache, depth is bounded 从缓存返回，深度有上限
+	book, err = loadBook(key, 1000, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchNum != 1 {
+		t.Fatalf("book should be cached, fetched %d times", fetchNum)
+	}
+	if len(book.Bids) != 4 || len(book.Asks) != 3 || book.Bids[3][0] != 97 {
+		t.Fatalf("all levels expected, bids: %v, asks: %v", book.Bids, book.Asks)
+	}
+	if book, _ = loadBook(key, 0, fetch); len(book.Bids) != 1 {
+		t.Fatalf("depth should be at least 1, got: %v", book.Bids)
+	}
+	oldTTL := BookCacheTTL
+	BookCacheTTL = 0
+	defer func() {
+		BookCacheTTL = oldTTL
+	}()
+	if _, err = loadBook(key, 5, fetch); err != nil || fetchNum != 2 {
+		t.Fatalf("expired book should be fetched again, fetched %d times, err: %v", fetchNum, err)
+	}
+	_, err = loadBook(key, 5, func() (*banexg.OrderBook, *errs.Error) {
+		return nil, errs.NewMsg(core.ErrNetReadFail, "down")
+	})
+	if err == nil || err.Code != core.ErrNetReadFail {
+		t.Fatalf("fetch error should be returned, got: %v", err)
+	}
+}
+
+func TestSendEncoded(t *testing.T) {
+	bars := makeBars(1699999200000, 60000, 50, 100)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", func(c *fiber.Ctx) error {
+		return SendEncoded(c, fiber.Map{"data": arrKlinesFmt(bars, TimeFmtMs)})
+	})
+	want, _ := json.Marshal(fiber.Map{"data": arrKlinesFmt(bars, TimeFmtMs)})
+	cases := []struct {
+		accept string
+		enc    string
+	}{
+		{"zstd", utils.EncodingZstd},
+		{"gzip, deflate, br, zstd", utils.EncodingZstd},
+		{"gzip, zstd;q=0.5", utils.EncodingGzip},
+		{"br", utils.EncodingIdentity},
+		{"", utils.EncodingIdentity},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/hist", nil)
+		if c.accept != "" {
+			req.Header.Set("Accept-Encoding", c.accept)
+		}
+		resp, err_ := app.Test(req)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		got := resp.Header.Get("Content-Encoding")
+		if c.enc == utils.EncodingIdentity && got != "" || c.enc != utils.EncodingIdentity && got != c.enc {
+			t.Fatalf("accept %q expect %s, got %q", c.accept, c.enc, got)
+		}
+		raw, err := utils.DecodeBody(nil, body, c.enc)
+		if err != nil {
+			t.Fatalf("accept %q decode fail: %v", c.accept, err)
+		}
+		if string(raw) != string(want) {
+			t.Fatalf("accept %q body mismatch: %s", c.accept, raw)
+		}
+	}
+}
+
+func TestFindSpikes(t *testing.T) {
+	bars := makeBars(1699999200000, 60000, 60, 100)
+	rnd := []float64{0.8, 1.1, 0.9, 1.2, 1.0, 0.7, 1.3}
+	for i, b := range bars {
+		// ranges between 1.4 and 2.6 振幅在1.4到2.6之间
+		b.High = 100 + rnd[i%len(rnd)]
+		b.Low = 100 - rnd[(i+3)%len(rnd)]
+		b.Open, b.Close = 99.8, 100.2
+	}
+	spike := 40
+	bars[spike].High = 130
+	bars[spike].Low = 95
+	idxs, limits := findSpikes(bars, 20, 4)
+	if len(idxs) != 1 || idxs[0] != spike {
+		t.Fatalf("expect spike at %d, got: %v", spike, idxs)
+	}
+	if limits[0] < 1.4 || limits[0] > 5 {
+		t.Fatalf("bad limit: %v", limits[0])
+	}
+	smoothed := smoothSpikes(bars, idxs, limits)
+	if bars[spike].High != 130 || bars[spike].Low != 95 {
+		t.Fatal("input klines should not be modified")
+	}
+	k := smoothed[spike]
+	if k.High-k.Low > limits[0]+1e-9 || k.High < k.Close || k.Low > k.Open {
+		t.Fatalf("spike not clipped to %v: %+v", limits[0], *k)
+	}
+	// wick clipped in proportion, the up wick is the longer 影线按比例裁剪，上影线更长
+	if k.High-k.Close <= k.Open-k.Low {
+		t.Fatalf("wicks should keep their proportion: %+v", *k)
+	}
+	for i, b := range smoothed {
+		if i != spike && b != bars[i] {
+			t.Fatalf("normal candle %d should be untouched", i)
+		}
+	}
+	// flat candles are never spikes 平稳的K线不会被标记
+	if idxs, _ = findSpikes(makeBars(1699999200000, 60000, 50, 100), 0, 0); len(idxs) != 0 {
+		t.Fatalf("flat candles flagged: %v", idxs)
+	}
+}
+
+func TestLoadHistFrom(t *testing.T) {
+	tfMS, base := int64(60000), int64(1699999200000)
+	var calls []string
+	var liveErr *errs.Error
+	mock := func(name string, num int, close float64) histReader {
+		return func(startMS, stopMS int64) ([]*orm.AdjInfo, []*banexg.Kline, *errs.Error) {
+			calls = append(calls, name)
+			if name == "live" && liveErr != nil {
+				return nil, nil, liveErr
+			}
+			return nil, makeBars(startMS, tfMS, min(num, int((stopMS-startMS)/tfMS)), close), nil
+		}
+	}
+	// store holds 5 of 10 bars 本地存储有10根中的5根
+	read, fetch, live := mock("read", 5, 1), mock("fetch", 100, 2), mock("live", 100, 3)
+	fromMS, toMS := base, base+10*tfMS
+	cases := []struct {
+		source string
+		fail   bool
+		calls  string
+		num    int
+		close  float64
+	}{
+		{HistStore, false, "read,fetch", 10, 2},
+		{HistStoreOnly, false, "read", 5, 1},
+		{HistExchange, false, "live", 10, 3},
+		{HistExchangeOnly, false, "live", 10, 3},
+		{HistExchange, true, "live,read,fetch", 10, 2},
+		{HistExchangeOnly, true, "live", 0, 0},
+	}
+	for _, c := range cases {
+		calls = nil
+		liveErr = nil
+		if c.fail {
+			liveErr = errs.NewMsg(core.ErrNetReadFail, "exchange down")
+		}
+		_, klines, err := loadHistFrom(c.source, "1m", fromMS, toMS, read, fetch, live)
+		if got := strings.Join(calls, ","); got != c.calls {
+			t.Fatalf("%s (fail: %v) expect calls %s, got %s", c.source, c.fail, c.calls, got)
+		}
+		if c.num == 0 {
+			if err == nil {
+				t.Fatalf("%s should return the exchange error", c.source)
+			}
+			continue
+		}
+		if err != nil || len(klines) != c.num || klines[c.num-1].Close != c.close {
+			t.Fatalf("%s (fail: %v) expect %d bars closing %v, got %d, err: %v", c.source, c.fail, c.num,
+				c.close, len(klines), err)
+		}
+	}
+	if _, _, err := loadHistFrom("bad", "1m", fromMS, toMS, read, fetch, live); err == nil {
+		t.Fatal("unknown source should fail")
+	}
+	HistSources["ETH/USDT"] = HistExchangeOnly
+	defer delete(HistSources, "ETH/USDT")
+	if histSource("ETH/USDT", "") != HistExchangeOnly || histSource("ETH/USDT", HistStore) != HistStore ||
+		histSource("BTC/USDT", "") != HistStore {
+		t.Fatal("source param should override HistSources, which overrides the default")
+	}
+}
+
+func TestWriteKlineZip(t *testing.T) {
+	base := int64(1699999200000)
+	specs := []*ExportSpec{
+		{Exchange: "binance", Symbol: "BTC/USDT:USDT", TimeFrame: "1m", FromMS: base, ToMS: base + 5*60000},
+		{Exchange: "binance", Symbol: "ETH/USDT", TimeFrame: "1h", FromMS: base, ToMS: base + 3*3600000},
+	}
+	if err := checkExportSpecs(specs); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err := writeKlineZip(&buf, specs, func(s *ExportSpec) ([]*banexg.Kline, *errs.Error) {
+		tfMS := int64(utils2.TFToSecs(s.TimeFrame) * 1000)
+		return makeBars(s.FromMS, tfMS, int((s.ToMS-s.FromMS)/tfMS), 2), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err_ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	names := []string{"binance_BTC_USDT_USDT_1m_1699999200000_1699999500000.csv",
+		"binance_ETH_USDT_1h_1699999200000_1700010000000.csv"}
+	rowNums := []int{6, 4}
+	if len(r.File) != len(names) {
+		t.Fatalf("expect %d files, got %d", len(names), len(r.File))
+	}
+	for i, f := range r.File {
+		if f.Name != names[i] {
+			t.Fatalf("expect file %s, got %s", names[i], f.Name)
+		}
+		rd, err_ := f.Open()
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		rows, err_ := csv.NewReader(rd).ReadAll()
+		_ = rd.Close()
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		if len(rows) != rowNums[i] || strings.Join(rows[0], ",") != "time,open,high,low,close,volume" {
+			t.Fatalf("%s expect %d rows with header, got %v", f.Name, rowNums[i], rows)
+		}
+		if rows[1][0] != "1699999200000" || rows[1][4] != "2" {
+			t.Fatalf("%s bad first row: %v", f.Name, rows[1])
+		}
+	}
+	// bounded by specs and bars 受文件数和K线数限制
+	if checkExportSpecs(nil) == nil {
+		t.Fatal("empty specs should fail")
+	}
+	big := []*ExportSpec{{Exchange: "binance", Symbol: "BTC/USDT", TimeFrame: "1m", FromMS: base,
+		ToMS: base + (ExportMaxBars+1)*60000}}
+	if checkExportSpecs(big) == nil {
+		t.Fatal("too many bars should fail")
+	}
+	many := make([]*ExportSpec, ExportMaxSpecs+1)
+	for i := range many {
+		many[i] = specs[0]
+	}
+	if checkExportSpecs(many) == nil {
+		t.Fatal("too many specs should fail")
+	}
+}
+
+func TestLoadEach(t *testing.T) {
+	bars := makeBars(1699999200000, 60000, 3, 5)
+	load := func(symbol string) ([]*banexg.Kline, error) {
+		if symbol == "BTC/USDT" {
+			return bars, nil
+		}
+		_, err := resolveShort("binance", symbol)
+		if err == nil {
+			t.Fatalf("%s should fail to resolve", symbol)
+		}
+		return nil, err
+	}
+	res, fails := loadEach([]string{"BTC/USDT", "BTC USDT"}, load)
+	if len(res) != 1 || len(res["BTC/USDT"]) != 3 || res["BTC/USDT"][2].Close != 5 {
+		t.Fatalf("valid symbol should return its bars, got %v", res)
+	}
+	if len(fails) != 1 || fails["BTC USDT"] == "" {
+		t.Fatalf("invalid symbol should be reported, got %v", fails)
+	}
+	if _, ok := res["BTC USDT"]; ok {
+		t.Fatal("failed symbol should not be in data")
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	tfMS, base := int64(60000), int64(1699999200000)
+	bars := makeBars(base, tfMS, 6, 1)
+	for i, k := range bars {
+		k.Close = float64(i + 1)
+		k.Volume = 10
+	}
+	// missing base+2m, base+3m and base+5m 缺失base+2m、base+3m和base+5m
+	gapped := []*banexg.Kline{bars[0], bars[1], bars[4]}
+	last := *bars[5]
+	last.Time = base + 6*tfMS
+	gapped = append(gapped, &last)
+	res, filled := fillGaps(gapped, tfMS)
+	if len(res) != 7 || len(filled) != 3 {
+		t.Fatalf("expect 7 bars with 3 filled, got %d, %d", len(res), len(filled))
+	}
+	for i, k := range res {
+		if k.Time != base+int64(i)*tfMS {
+			t.Fatalf("bar %d bad time %d", i, k.Time)
+		}
+	}
+	flats := map[int64]float64{base + 2*tfMS: 2, base + 3*tfMS: 2, base + 5*tfMS: 5}
+	for i, k := range res {
+		close, isFlat := flats[k.Time]
+		if filled[k.Time] != isFlat {
+			t.Fatalf("bar %d flagged %v, expect %v", i, filled[k.Time], isFlat)
+		}
+		if !isFlat {
+			if k.Volume != 10 {
+				t.Fatalf("real bar %d changed: %+v", i, k)
+			}
+			continue
+		}
+		if k.Open != close || k.High != close || k.Low != close || k.Close != close || k.Volume != 0 {
+			t.Fatalf("flat bar %d expect close %v, got %+v", i, close, k)
+		}
+	}
+	if res, filled = fillGaps(bars, tfMS); len(res) != len(bars) || len(filled) != 0 {
+		t.Fatal("continuous bars should be unchanged")
+	}
+}
+
+func TestCalcPivots(t *testing.T) {
+	tfMS, base := int64(86400000), int64(1699920000000)
+	klines := []*banexg.Kline{
+		{Time: base, Open: 100, High: 110, Low: 90, Close: 105},
+		{Time: base + tfMS, Open: 10, High: 12, Low: 8, Close: 9},
+	}
+	res, err := calcPivots(klines, tfMS, PivotClassic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// P=(H+L+C)/3, R1=2P-L, S1=2P-H, R2=P+(H-L), S2=P-(H-L), R3=H+2(P-L), S3=L-2(H-P)
+	wants := [][7]float64{
+		{101.6667, 113.3333, 121.6667, 133.3333, 93.3333, 81.6667, 73.3333},
+		{9.6667, 11.3333, 13.6667, 15.3333, 7.3333, 5.6667, 3.3333},
+	}
+	if len(res) != len(wants) {
+		t.Fatalf("expect %d levels, got %d", len(wants), len(res))
+	}
+	for i, lv := range res {
+		if lv.Time != klines[i].Time+tfMS {
+			t.Fatalf("levels %d should be for the next period, got %d", i, lv.Time)
+		}
+		got := [7]float64{lv.P, lv.R1, lv.R2, lv.R3, lv.S1, lv.S2, lv.S3}
+		for j, v := range got {
+			if math.Abs(v-wants[i][j]) > 1e-4 {
+				t.Fatalf("levels %d: expect %v, got %v", i, wants[i], got)
+			}
+		}
+	}
+	fib, _ := calcPivots(klines[:1], tfMS, PivotFibonacci)
+	cam, _ := calcPivots(klines[:1], tfMS, PivotCamarilla)
+	if math.Abs(fib[0].R1-(101.6667+0.382*20)) > 1e-4 || math.Abs(cam[0].S3-(105-20*1.1/4)) > 1e-4 {
+		t.Fatalf("bad fibonacci or camarilla levels: %+v %+v", fib[0], cam[0])
+	}
+	if _, err = calcPivots(klines, tfMS, "woodie"); err == nil || err.Code != errs.CodeParamInvalid {
+		t.Fatalf("unknown method should fail with param invalid, got %v", err)
+	}
+}
+
+func TestAcquireFetch(t *testing.T) {
+	oldNum, oldWait := FetchConcurrency, FetchQueueWait
+	defer func() {
+		FetchConcurrency, FetchQueueWait = oldNum, oldWait
+	}()
+	FetchConcurrency, FetchQueueWait = 2, time.Second*3
+	block := make(chan struct{})
+	started := make(chan int, 3)
+	done := make(chan *errs.Error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			_, err := fetchWithRetry(context.Background(), "test", func() (int, *errs.Error) {
+				started <- i
+				<-block
+				return i, nil
+			})
+			done <- err
+		}(i)
+	}
+	<-started
+	<-started
+	// the third one is queued 第三个在排队
+	select {
+	case i := <-started:
+		t.Fatalf("fetch %d should wait for a slot", i)
+	case <-time.After(time.Millisecond * 100):
+	}
+	block <- struct{}{}
+	select {
+	case <-started:
+	case <-time.After(time.Second * 2):
+		t.Fatal("queued fetch should proceed after a slot is released")
+	}
+	close(block)
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// saturated, queued ones time out with 503 占满后排队的请求超时返回503
+	FetchQueueWait = time.Millisecond * 50
+	hold := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go fetchWithRetry(context.Background(), "hold", func() (int, *errs.Error) {
+			started <- i
+			<-hold
+			return 0, nil
+		})
+	}
+	<-started
+	<-started
+	defer close(hold)
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/hist", func(c *fiber.Ctx) error {
+		_, err := fetchWithRetry(context.Background(), "test", func() (int, *errs.Error) {
+			return 0, nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.SendString("ok")
+	})
+	resp, err_ := app.Test(httptest.NewRequest("GET", "/hist", nil))
+	if err_ != nil {
+		t.Fatal(err_)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("expect 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestWarmupAll(t *testing.T) {
+	items := make([]*WarmupItem, 0)
+	for _, exg := range []string{"binance", "okx"} {
+		for _, symbol := range []string{"BTC/USDT", "ETH/USDT", "SOL/USDT", "BNB/USDT"} {
+			items = append(items, &WarmupItem{Exchange: exg, Symbol: symbol, TimeFrame: "1m"})
+		}
+	}
+	items = append(items, &WarmupItem{Exchange: "binance", Symbol: "BTC USDT", TimeFrame: "1m"})
+	var lock sync.Mutex
+	running := map[string]int{}
+	peaks := map[string]int{}
+	cache := map[string][]*banexg.Kline{}
+	res := warmupAll(items, 2, func(item *WarmupItem) (int, error) {
+		if _, err := resolveShort(item.Exchange, item.Symbol); item.Symbol == "BTC USDT" {
+			return 0, err
+		}
+		lock.Lock()
+		running[item.Exchange] += 1
+		peaks[item.Exchange] = max(peaks[item.Exchange], running[item.Exchange])
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 30)
+		bars := makeBars(1699999200000, 60000, 5, 1)
+		lock.Lock()
+		running[item.Exchange] -= 1
+		cache[item.Exchange+":"+item.Symbol] = bars
+		lock.Unlock()
+		return len(bars), nil
+	})
+	if len(res) != len(items) {
+		t.Fatalf("expect %d results, got %d", len(items), len(res))
+	}
+	for i, r := range res {
+		if r.Symbol != items[i].Symbol || r.Exchange != items[i].Exchange {
+			t.Fatalf("result %d out of order: %+v", i, r)
+		}
+		if r.Symbol == "BTC USDT" {
+			if r.Error == "" || r.Bars != 0 {
+				t.Fatalf("invalid symbol should fail: %+v", r)
+			}
+			continue
+		}
+		if r.Error != "" || r.Bars != 5 || len(cache[r.Exchange+":"+r.Symbol]) != 5 {
+			t.Fatalf("%s %s should be warmed: %+v", r.Exchange, r.Symbol, r)
+		}
+	}
+	for exg, peak := range peaks {
+		if peak > 2 {
+			t.Fatalf("%s warmed %d at once, limit 2", exg, peak)
+		}
+	}
+	if peaks["binance"] < 2 || peaks["okx"] < 2 {
+		t.Fatalf("items should be warmed in parallel, peaks: %v", peaks)
+	}
+}
+
+func TestCompareRanges(t *testing.T) {
+	tfMS, base := int64(60000), int64(1699999200000)
+	all := makeBars(base, tfMS, 20, 0)
+	for i, k := range all {
+		k.Close = float64(i)
+	}
+	rangeA := [2]int64{base, base + 10*tfMS}
+	rangeB := [2]int64{base + 3*tfMS, base + 8*tfMS}
+	klinesA := rangeKlines(all, rangeA[0], rangeA[1])
+	// bar 5 is missing from the second range 第二个范围缺少第5根K线
+	klinesB := slices.DeleteFunc(slices.Clone(rangeKlines(all, rangeB[0], rangeB[1])), func(k *banexg.Kline) bool {
+		return k.Time == base+5*tfMS
+	})
+	num, seriesA, seriesB := compareRanges(klinesA, klinesB, rangeA, rangeB, tfMS)
+	if num != 5 {
+		t.Fatalf("should truncate to the shorter range, got %d bars", num)
+	}
+	if len(seriesA) != 5 || len(seriesB) != 4 {
+		t.Fatalf("expect 5 and 4 rows, got %d %d", len(seriesA), len(seriesB))
+	}
+	for i, row := range seriesA {
+		if row[0] != float64(i) || row[1] != float64(base+int64(i)*tfMS) || row[5] != float64(i) {
+			t.Fatalf("range a row %d misaligned: %v", i, row)
+		}
+	}
+	// the gap keeps later bars at their offsets 缺口不会使后续K线偏移
+	wantOffsets := []float64{0, 1, 3, 4}
+	for i, row := range seriesB {
+		off := wantOffsets[i]
+		if row[0] != off || row[5] != off+3 || row[1] != float64(base+int64(off+3)*tfMS) {
+			t.Fatalf("range b row %d misaligned: %v", i, row)
+		}
+	}
+	// an unaligned start begins at the next bar 未对齐的起点从下一根K线开始
+	_, seriesA, _ = compareRanges(all, klinesB, [2]int64{base + 1000, base + 10*tfMS}, rangeB, tfMS)
+	if seriesA[0][0] != 0 || seriesA[0][1] != float64(base+tfMS) {
+		t.Fatalf("unaligned start should use the next bar: %v", seriesA[0])
+	}
+}
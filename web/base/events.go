@@ -0,0 +1,321 @@
+package base
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banbox/banbot/btime"
+	"github.com/banbox/banbot/utils"
+	"github.com/banbox/banexg/errs"
+	"github.com/banbox/banexg/log"
+	utils2 "github.com/banbox/banexg/utils"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// EventBufSize latest events retained to replay for new streams 保留的最新事件数量，用于新连接重放
+	EventBufSize = 500
+	// EventSubBuf events queued for each stream, later ones are dropped when full 每个流排队的事件数，满后丢弃
+	EventSubBuf = 200
+	// EventMinLevel logs below this level are not relayed 低于此级别的日志不转发
+	EventMinLevel = zapcore.InfoLevel
+	// EventPingInterval interval of keep-alive comments on idle streams 空闲流发送保活注释的间隔
+	EventPingInterval = 15 * time.Second
+	// EventBanioActions banio msgs with these action prefixes are relayed 转发这些action前缀的banio消息
+	EventBanioActions []string
+
+	events = newEventHub()
+)
+
+const (
+	EventSrcLog   = "log"
+	EventSrcBanio = "banio"
+)
+
+/*
+WebEvent
+A log entry or banio event relayed to the web UI, Seq increases by one for each event.
+转发到web界面的日志或banio事件，Seq每个事件递增1。
+*/
+type WebEvent struct {
+	Seq    int64                  `json:"seq"`
+	Time   int64                  `json:"time"`
+	Source string                 `json:"source"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Caller string                 `json:"caller,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	level  zapcore.Level
+}
+
+type eventSub struct {
+	ch      chan *WebEvent
+	level   zapcore.Level
+	dropped int // guarded by eventHub.lock 由eventHub.lock保护
+}
+
+type eventHub struct {
+	lock sync.Mutex
+	buf  []*WebEvent // ring buffer, event seq is stored at seq%len 环形缓冲，序号seq存储在seq%len
+	seq  int64
+	subs map[*eventSub]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*eventSub]bool)}
+}
+
+/*
+emit
+Retain the event and fan it out without blocking, streams whose queue is full drop it and count the drops.
+保留事件并非阻塞地分发，队列已满的流丢弃该事件并计数。
+*/
+func (h *eventHub) emit(evt *WebEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq += 1
+	evt.Seq = h.seq
+	if len(h.buf) != EventBufSize {
+		// resized, start over 大小已变，重新开始
+		h.buf = make([]*WebEvent, EventBufSize)
+	}
+	if len(h.buf) > 0 {
+		h.buf[evt.Seq%int64(len(h.buf))] = evt
+	}
+	for sub := range h.subs {
+		if evt.level < sub.level {
+			continue
+		}
+		select {
+		case sub.ch <- evt:
+		default:
+			sub.dropped += 1
+		}
+	}
+}
+
+/*
+subscribe
+Register a stream for events at or above level, and return the retained ones after seq `after` together, so none
+is missed or duplicated.
+注册接收不低于level的事件的流，并同时返回序号after之后保留的事件，不会遗漏或重复。
+*/
+func (h *eventHub) subscribe(level zapcore.Level, after int64) (*eventSub, []*WebEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	sub := &eventSub{ch: make(chan *WebEvent, EventSubBuf), level: level}
+	h.subs[sub] = true
+	var backlog []*WebEvent
+	size := int64(len(h.buf))
+	for seq := max(after, h.seq-size) + 1; seq <= h.seq; seq++ {
+		evt := h.buf[seq%size]
+		if evt != nil && evt.Seq == seq && evt.level >= level {
+			backlog = append(backlog, evt)
+		}
+	}
+	return sub, backlog
+}
+
+func (h *eventHub) unsubscribe(sub *eventSub) {
+	h.lock.Lock()
+	delete(h.subs, sub)
+	h.lock.Unlock()
+}
+
+// takeDropped return and reset the number of events dropped for sub 返回并重置sub丢弃的事件数
+func (h *eventHub) takeDropped(sub *eventSub) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	num := sub.dropped
+	sub.dropped = 0
+	return num
+}
+
+// EmitEvent relay an event to the web UI 向web界面转发事件
+func EmitEvent(source string, level zapcore.Level, msg string, fields map[string]interface{}) {
+	events.emit(&WebEvent{
+		Time:   btime.UTCStamp(),
+		Source: source,
+		Level:  level.String(),
+		Msg:    msg,
+		Fields: fields,
+		level:  level,
+	})
+}
+
+/*
+EventCore
+A zap core relaying log entries to the web UI through the event ring buffer.
+通过事件环形缓冲将日志转发到web界面的zap核心。
+*/
+type EventCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func NewEventCore(level zapcore.LevelEnabler) *EventCore {
+	return &EventCore{LevelEnabler: level}
+}
+
+func (h *EventCore) With(fields []zapcore.Field) zapcore.Core {
+	return &EventCore{
+		LevelEnabler: h.LevelEnabler,
+		fields:       append(h.fields[:len(h.fields):len(h.fields)], fields...),
+	}
+}
+
+func (h *EventCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if h.Enabled(ent.Level) {
+		return ce.AddCore(ent, h)
+	}
+	return ce
+}
+
+func (h *EventCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	var data map[string]interface{}
+	if len(h.fields)+len(fields) > 0 {
+		enc := zapcore.NewMapObjectEncoder()
+		for _, f := range h.fields {
+			f.AddTo(enc)
+		}
+		for _, f := range fields {
+			f.AddTo(enc)
+		}
+		data = enc.Fields
+	}
+	events.emit(&WebEvent{
+		Time:   ent.Time.UnixMilli(),
+		Source: EventSrcLog,
+		Level:  ent.Level.String(),
+		Msg:    ent.Message,
+		Caller: ent.Caller.TrimmedPath(),
+		Fields: data,
+		level:  ent.Level,
+	})
+	return nil
+}
+
+func (h *EventCore) Sync() error {
+	return nil
+}
+
+/*
+TeeEventLog
+Tee the global logger into the event ring buffer, logs at or above EventMinLevel are relayed.
+将全局日志同时写入事件环形缓冲，不低于EventMinLevel的日志会被转发。
+*/
+func TeeEventLog() {
+	core := zapcore.NewTee(log.L().Core(), NewEventCore(EventMinLevel))
+	log.ReplaceGlobals(log.L().WithOptions(zap.WrapCore(func(zapcore.Core) zapcore.Core {
+		return core
+	})), &log.ZapProperties{Core: core, Level: log.Level()})
+}
+
+/*
+RelayBanio
+Relay state changes of the client, and msgs with actions prefixed by any of actions to the web UI.
+Call before RunForever.
+将客户端的状态变化，以及action以actions任一项为前缀的消息转发到web界面。需在RunForever之前调用。
+*/
+func RelayBanio(client *utils.ClientIO, actions ...string) {
+	prevOnState := client.OnStateChange
+	client.OnStateChange = func(c *utils.BanConn, state int, err *errs.Error) {
+		if prevOnState != nil {
+			prevOnState(c, state, err)
+		}
+		level, text := zapcore.InfoLevel, "connected"
+		if state == utils.ConnStateLost {
+			level, text = zapcore.WarnLevel, "connection lost, reconnecting"
+		} else if state == utils.ConnStateClosed {
+			level, text = zapcore.ErrorLevel, "connection closed"
+		}
+		fields := map[string]interface{}{"remote": c.GetRemote()}
+		if err != nil {
+			fields["error"] = err.Short()
+		}
+		EmitEvent(EventSrcBanio, level, text, fields)
+	}
+	if len(actions) == 0 {
+		return
+	}
+	prevOnMsg := client.OnMsg
+	client.OnMsg = func(msg *utils.IOMsgRaw) {
+		if prevOnMsg != nil {
+			prevOnMsg(msg)
+		}
+		for _, prefix := range actions {
+			if strings.HasPrefix(msg.Action, prefix) {
+				var fields map[string]interface{}
+				if !msg.Binary {
+					fields = map[string]interface{}{"data": json.RawMessage(msg.Data)}
+				}
+				EmitEvent(EventSrcBanio, zapcore.InfoLevel, msg.Action, fields)
+				return
+			}
+		}
+	}
+}
+
+/*
+getEvents 以SSE流的方式推送日志和banio事件，level过滤最低级别，断线重连时通过Last-Event-ID续传
+*/
+func getEvents(c *fiber.Ctx) error {
+	level, err_ := zapcore.ParseLevel(c.Query("level", "info"))
+	if err_ != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid level: "+c.Query("level"))
+	}
+	after := int64(c.QueryInt("after", 0))
+	if lastID := c.Get("Last-Event-ID"); lastID != "" {
+		fmt.Sscan(lastID, &after)
+	}
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	sub, backlog := events.subscribe(level, after)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer events.unsubscribe(sub)
+		for _, evt := range backlog {
+			writeSSE(w, evt.Source, evt.Seq, evt)
+		}
+		if w.Flush() != nil {
+			return
+		}
+		ticker := time.NewTicker(EventPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case evt := <-sub.ch:
+				if num := events.takeDropped(sub); num > 0 {
+					// tell the client the stream is incomplete 告知客户端流不完整
+					writeSSE(w, "dropped", 0, map[string]int{"num": num})
+				}
+				writeSSE(w, evt.Source, evt.Seq, evt)
+			case <-ticker.C:
+				_, _ = w.WriteString(": ping\n\n")
+			}
+			if w.Flush() != nil {
+				// client gone 客户端已断开
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func writeSSE(w *bufio.Writer, name string, seq int64, data interface{}) {
+	raw, err := utils2.Marshal(data)
+	if err != nil {
+		log.Warn("marshal event fail", zap.String("name", name), zap.Error(err))
+		return
+	}
+	if seq > 0 {
+		_, _ = fmt.Fprintf(w, "id: %d\n", seq)
+	}
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, raw)
+}
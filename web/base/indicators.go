@@ -1,6 +1,9 @@
 package base
 
 import (
+	"encoding/csv"
+	"io"
+
 	utils2 "github.com/banbox/banexg/utils"
 	ta "github.com/banbox/banta"
 	"github.com/gofiber/fiber/v2"
@@ -238,8 +241,29 @@ func CalcInd(name string, kline [][]float64, params []float64) (interface{}, err
 }
 
 func (d *DrawInd) Calc(kline [][]float64, params []float64) ([]map[string]float64, error) {
+	res := make([]map[string]float64, 0, len(kline))
+	err := d.CalcStream(kline, params, len(kline), func(items []map[string]float64) error {
+		res = append(res, items...)
+		return nil
+	})
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+CalcStream
+Calculate bar by bar and emit results in time-ordered chunks of at most chunk items.
+The indicator state carries over between chunks, so warmup is respected.
+逐根K线计算，并按时间顺序分块输出，每块最多chunk个。指标状态跨块延续，因此预热期不受影响。
+*/
+func (d *DrawInd) CalcStream(kline [][]float64, params []float64, chunk int, emit func([]map[string]float64) error) error {
 	if len(kline) < 2 {
-		return nil, nil
+		return nil
+	}
+	if chunk <= 0 {
+		chunk = len(kline)
 	}
 	tfMSecs := int64(kline[1][0] - kline[0][0])
 	timeFrame := utils2.SecsToTF(int(tfMSecs / 1000))
@@ -250,18 +274,8 @@ func (d *DrawInd) Calc(kline [][]float64, params []float64) ([]map[string]float6
 		Exchange:   "binance",
 		MarketType: "linear",
 	}
-	figures := d.Figures
-	if d.FigureTpl != "" {
-		if strings.Contains(d.FigureTpl, "{i}") {
-			for i := range params {
-				key := strings.Replace(d.FigureTpl, "{i}", strconv.Itoa(i+1), 1)
-				figures = append(figures, &Figure{Key: key})
-			}
-		} else {
-			figures = append(figures, &Figure{Key: d.FigureTpl})
-		}
-	}
-	res := make([]map[string]float64, 0, len(kline))
+	figures := d.figures(params)
+	res := make([]map[string]float64, 0, min(chunk, len(kline)))
 	for _, k := range kline {
 		var info = float64(0)
 		if len(k) > 6 {
@@ -269,7 +283,7 @@ func (d *DrawInd) Calc(kline [][]float64, params []float64) ([]map[string]float6
 		}
 		err := env.OnBar(int64(k[0]), k[1], k[2], k[3], k[4], k[5], info)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		arr := d.doCalc(env, params)
 		data := make(map[string]float64)
@@ -283,8 +297,94 @@ func (d *DrawInd) Calc(kline [][]float64, params []float64) ([]map[string]float6
 			data[figures[i].Key] = v
 		}
 		res = append(res, data)
+		if len(res) >= chunk {
+			if err = emit(res); err != nil {
+				return err
+			}
+			res = make([]map[string]float64, 0, chunk)
+		}
 	}
-	return res, nil
+	if len(res) > 0 {
+		return emit(res)
+	}
+	return nil
+}
+
+// figures output figures of the params, in the order of values returned by doCalc 参数对应的输出图形，顺序与doCalc返回值一致
+func (d *DrawInd) figures(params []float64) []*Figure {
+	figures := d.Figures
+	if d.FigureTpl != "" {
+		if strings.Contains(d.FigureTpl, "{i}") {
+			for i := range params {
+				key := strings.Replace(d.FigureTpl, "{i}", strconv.Itoa(i+1), 1)
+				figures = append(figures, &Figure{Key: key})
+			}
+		} else {
+			figures = append(figures, &Figure{Key: d.FigureTpl})
+		}
+	}
+	return figures
+}
+
+/*
+CalcIndCSV
+Calculate like CalcInd and write a csv with the time column and one column for each figure, values in warmup are
+left empty. Only base indicators are supported.
+同CalcInd计算并写入csv，包含时间列和每个图形一列，预热期的值留空。仅支持基础指标。
+*/
+func CalcIndCSV(w io.Writer, name string, kline [][]float64, params []float64) error {
+	ind, ok := baseInds[name]
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "csv unsupported for indicator: "+name)
+	}
+	figures := ind.figures(params)
+	header := make([]string, 0, len(figures)+1)
+	header = append(header, "time")
+	for _, f := range figures {
+		header = append(header, f.Key)
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	err := ind.CalcStream(kline, params, 0, func(items []map[string]float64) error {
+		for i, item := range items {
+			row := make([]string, len(header))
+			row[0] = strconv.FormatInt(int64(kline[i][0]), 10)
+			for j, f := range figures {
+				if v, ok := item[f.Key]; ok {
+					row[j+1] = strconv.FormatFloat(v, 'f', -1, 64)
+				}
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+/*
+CalcIndStream
+Same as CalcInd, but emit results in chunks. advanced indicators are calculated at once and then split.
+同CalcInd，但分块输出结果。高级指标一次性计算后再拆分。
+*/
+func CalcIndStream(name string, kline [][]float64, params []float64, chunk int, emit func(interface{}) error) error {
+	if ind, ok := baseInds[name]; ok {
+		return ind.CalcStream(kline, params, chunk, func(items []map[string]float64) error {
+			return emit(items)
+		})
+	}
+	res, err := CalcInd(name, kline, params)
+	if err != nil {
+		return err
+	}
+	return emit(res)
 }
 
 func (d *DrawInd) ToMap() map[string]interface{} {
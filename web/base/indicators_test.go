@@ -0,0 +1,90 @@
+package base
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCalcStream(t *testing.T) {
+	kline := make([][]float64, 0, 200)
+	for i := 0; i < 200; i++ {
+		price := 100 + float64(i%17)
+		kline = append(kline, []float64{float64(1700000000000 + i*60000), price, price + 2, price - 2, price + 1, 10})
+	}
+	params := []float64{5, 30}
+	ind := baseInds["RMA"]
+	expect, err := ind.Calc(kline, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]float64
+	chunkNum := 0
+	err = ind.CalcStream(kline, params, 64, func(items []map[string]float64) error {
+		chunkNum += 1
+		got = append(got, items...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunkNum != 4 {
+		t.Fatalf("expect 4 chunks, got %d", chunkNum)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatal("streamed result differs from Calc")
+	}
+}
+
+func TestCalcIndCSV(t *testing.T) {
+	kline := make([][]float64, 0, 50)
+	for i := 0; i < 50; i++ {
+		price := 100 + float64(i%7)
+		kline = append(kline, []float64{float64(1700000000000 + i*60000), price, price + 2, price - 2, price + 1, 10})
+	}
+	params := []float64{5, 30}
+	expect, err := baseInds["WMA"].Calc(kline, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err = CalcIndCSV(&b, "WMA", kline, params); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(kline)+1 || strings.Join(rows[0], ",") != "time,1,2" {
+		t.Fatalf("expect header time,1,2 and %d rows, got %v, %d", len(kline), rows[0], len(rows)-1)
+	}
+	warmNum := 0
+	for i, row := range rows[1:] {
+		if row[0] != strconv.FormatInt(int64(kline[i][0]), 10) {
+			t.Fatalf("row %d bad time %s", i, row[0])
+		}
+		for j, key := range rows[0][1:] {
+			val, ok := expect[i][key]
+			if !ok {
+				if row[j+1] != "" {
+					t.Fatalf("row %d %s should be empty in warmup, got %s", i, key, row[j+1])
+				}
+				warmNum += 1
+				continue
+			}
+			got, err := strconv.ParseFloat(row[j+1], 64)
+			if err != nil || got != val {
+				t.Fatalf("row %d %s expect %v, got %s", i, key, val, row[j+1])
+			}
+		}
+	}
+	if warmNum == 0 {
+		t.Fatal("expect empty warmup values")
+	}
+	if err = CalcIndCSV(&b, "NOPE", kline, params); err == nil {
+		t.Fatal("unknown indicator should fail")
+	}
+}
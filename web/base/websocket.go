@@ -8,6 +8,16 @@ import (
 	"github.com/banbox/banexg/utils"
 	"github.com/gofiber/contrib/websocket"
 	"go.uber.org/zap"
+	"time"
+)
+
+var (
+	// WsPingInterval interval to send ping frames to ws clients, 0 to disable 向ws客户端发送ping的间隔，0禁用
+	WsPingInterval = 30 * time.Second
+	// WsPongWait close the ws client if no pong or msg received within this duration 此时间内未收到pong或消息则关闭ws客户端
+	WsPongWait = 75 * time.Second
+	// WsHistSize kline updates retained for each key to resume ws streams 每个key保留的K线更新数量，用于恢复ws流
+	WsHistSize = 500
 )
 
 type WsClient struct {
@@ -22,6 +32,11 @@ func NewWsClient(c *websocket.Conn) *WsClient {
 
 func (c *WsClient) HandleForever() {
 	log.Debug("ws client joined", zap.String("ip", c.remote))
+	if WsPingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		c.keepAlive(done)
+	}
 	for {
 		if c.Conn == nil {
 			break
@@ -32,6 +47,9 @@ func (c *WsClient) HandleForever() {
 			c.Close(true)
 			break
 		}
+		if WsPingInterval > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(WsPongWait))
+		}
 		if mt == websocket.CloseMessage {
 			c.Close(true)
 			break
@@ -61,6 +79,35 @@ func (c *WsClient) HandleForever() {
 	}
 }
 
+/*
+keepAlive
+Send ping frames periodically until done, reading fails and the client is closed if no pong arrives within WsPongWait.
+定期发送ping直到done，如果WsPongWait内未收到pong，读取失败并关闭客户端。
+*/
+func (c *WsClient) keepAlive(done chan struct{}) {
+	conn := c.Conn
+	_ = conn.SetReadDeadline(time.Now().Add(WsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WsPongWait))
+	})
+	go func() {
+		ticker := time.NewTicker(WsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WsPingInterval))
+				if err != nil {
+					log.Debug("ws ping fail", zap.String("ip", c.remote), zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+}
+
 func (c *WsClient) WriteMsg(msg map[string]interface{}) {
 	if c.Conn == nil {
 		return
@@ -81,9 +128,33 @@ func (c *WsClient) Subscribe(msg map[string]interface{}) {
 	if exs == nil {
 		return
 	}
+	if !symbolAllowed(exs) {
+		c.WriteMsg(map[string]interface{}{"error": "symbol not allowed: " + exs.Symbol})
+		return
+	}
 	key := fmt.Sprintf("%s_%s_%s", exs.Exchange, exs.Market, exs.Symbol)
+	// last seq received before reconnecting 重连前收到的最后序号
+	resume := utils.GetMapVal(msg, "resume", int64(0))
+	c.subscribeKey(key, resume)
+}
+
+/*
+subscribeKey
+Subscribe kline updates of key, updates after seq `resume` are replayed first when resume > 0. Subscribing and
+replaying hold wsSubLock together, so no update is missed or duplicated.
+订阅key的K线更新，resume>0时先重放序号resume之后的更新。订阅和重放一起持有wsSubLock，不会遗漏或重复更新。
+*/
+func (c *WsClient) subscribeKey(key string, resume int64) {
+	wsSubLock.Lock()
+	defer wsSubLock.Unlock()
 	c.Subs[key] = true
-	SetKlineSub(c, true, true, key)
+	SetKlineSub(c, true, false, key)
+	if _, ok := wsHists[key]; !ok {
+		wsHists[key] = &wsHist{}
+	}
+	if resume > 0 {
+		c.replayWsHist(key, resume)
+	}
 }
 
 func parseExSymbol(msg map[string]interface{}) *orm.ExSymbol {
@@ -0,0 +1,272 @@
+package base
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/banbox/banbot/data"
+	"github.com/banbox/banexg"
+	fws "github.com/fasthttp/websocket"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestWsKeepAlive(t *testing.T) {
+	oldIntv, oldWait := WsPingInterval, WsPongWait
+	WsPingInterval, WsPongWait = 20*time.Millisecond, 150*time.Millisecond
+	defer func() {
+		WsPingInterval, WsPongWait = oldIntv, oldWait
+	}()
+	subKey := "binance_spot_KEEP/USDT"
+	app := fiber.New()
+	app.Get("/ohlcv", websocket.New(func(c *websocket.Conn) {
+		client := NewWsClient(c)
+		client.Subs[subKey] = true
+		SetKlineSub(client, true, true, subKey)
+		client.HandleForever()
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+	conn, _, err := fws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/ohlcv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// never reply pong 从不回复pong
+	var pings atomic.Int32
+	conn.SetPingHandler(func(string) error {
+		pings.Add(1)
+		return nil
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("non-responding client should be closed")
+	}
+	if pings.Load() == 0 {
+		t.Fatal("no ping received")
+	}
+	wsSubLock.Lock()
+	subNum := len(wsSubs[subKey])
+	wsSubLock.Unlock()
+	if subNum != 0 {
+		t.Fatalf("closed client should be unsubscribed, got %d", subNum)
+	}
+}
+
+func TestWsResume(t *testing.T) {
+	oldSize := WsHistSize
+	WsHistSize = 3
+	defer func() {
+		WsHistSize = oldSize
+	}()
+	const exg, market, pair = "binance", "spot", "RESUME/USDT"
+	key := exg + "_" + market + "_" + pair
+	app := fiber.New()
+	app.Get("/ohlcv", websocket.New(func(c *websocket.Conn) {
+		client := NewWsClient(c)
+		resume, _ := strconv.ParseInt(c.Query("resume"), 10, 64)
+		client.subscribeKey(key, resume)
+		client.HandleForever()
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+	defer func() {
+		wsSubLock.Lock()
+		delete(wsHists, key)
+		wsSubLock.Unlock()
+	}()
+	push := func(i int) {
+		klineHandler(&data.KLineMsg{ExgName: exg, Market: market, Pair: pair,
+			NotifyKLines: data.NotifyKLines{TFSecs: 60, Interval: 60,
+				Arr: []*banexg.Kline{{Time: 1700000000000 + int64(i)*60000, Close: float64(i)}}}})
+	}
+	dial := func(resume int64) *fws.Conn {
+		conn, _, err := fws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ohlcv?resume=%d", ln.Addr(), resume), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitSubs(t, key, 1)
+		return conn
+	}
+	type update struct {
+		A    string      `json:"a"`
+		Seq  int64       `json:"seq"`
+		Bars [][]float64 `json:"bars"`
+	}
+	read := func(conn *fws.Conn) *update {
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var res update
+		if err := conn.ReadJSON(&res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+	var closes []float64
+	conn := dial(0)
+	for i := 1; i <= 3; i++ {
+		push(i)
+		if u := read(conn); u.Seq != int64(i) {
+			t.Fatalf("expect seq %d, got %d", i, u.Seq)
+		} else {
+			closes = append(closes, u.Bars[0][4])
+		}
+	}
+	// drop the stream, updates keep coming 断开流，更新继续到来
+	_ = conn.Close()
+	waitSubs(t, key, 0)
+	push(4)
+	push(5)
+	conn = dial(3)
+	push(6)
+	for i := 4; i <= 6; i++ {
+		u := read(conn)
+		if u.Seq != int64(i) {
+			t.Fatalf("expect resumed seq %d, got %d", i, u.Seq)
+		}
+		closes = append(closes, u.Bars[0][4])
+	}
+	if fmt.Sprint(closes) != "[1 2 3 4 5 6]" {
+		t.Fatalf("candles missed or duplicated: %v", closes)
+	}
+	_ = conn.Close()
+	waitSubs(t, key, 0)
+	// seq 1 is no longer retained, the client should resync 序号1已不再保留，客户端应重新同步
+	conn = dial(1)
+	defer conn.Close()
+	if u := read(conn); u.A != "resync" || u.Seq != 6 {
+		t.Fatalf("expect resync at seq 6, got %+v", u)
+	}
+}
+
+func waitSubs(t *testing.T, key string, num int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		wsSubLock.Lock()
+		cur := len(wsSubs[key])
+		wsSubLock.Unlock()
+		if cur == num {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("wait %d subscribers of %s timeout", num, key)
+}
+
+func TestEventStream(t *testing.T) {
+	oldHub, oldIntv := events, EventPingInterval
+	events, EventPingInterval = newEventHub(), 50*time.Millisecond
+	defer func() {
+		events, EventPingInterval = oldHub, oldIntv
+	}()
+	logger := zap.New(NewEventCore(zapcore.DebugLevel))
+	app := fiber.New(fiber.Config{ErrorHandler: ErrHandler})
+	app.Get("/events", getEvents)
+	resp, err := app.Test(httptest.NewRequest("GET", "/events?level=bad", nil))
+	if err != nil || resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("invalid level should be 400, got %v %v", resp, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+	// retained before connecting, replayed by level 连接前保留的事件，按级别重放
+	logger.Info("info before")
+	logger.Warn("warn before", zap.Int("num", 3))
+	resp, err = http.Get("http://" + ln.Addr().String() + "/events?level=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("bad content type: %s", ct)
+	}
+	logger.Debug("debug after")
+	logger.Error("error after")
+	logger.Info("info after")
+	EmitEvent(EventSrcBanio, zapcore.ErrorLevel, "connection closed", nil)
+	got := make([]*WebEvent, 0, 3)
+	scanner := bufio.NewScanner(resp.Body)
+	for len(got) < 3 && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var evt WebEvent
+		if err = json.Unmarshal([]byte(line[6:]), &evt); err != nil {
+			t.Fatalf("bad event: %s", line)
+		}
+		got = append(got, &evt)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(got))
+	}
+	if got[0].Msg != "warn before" || got[0].Fields["num"] != float64(3) || got[0].Source != EventSrcLog {
+		t.Fatalf("bad replayed event: %+v", got[0])
+	}
+	if got[1].Msg != "error after" || got[1].Level != "error" {
+		t.Fatalf("bad live event: %+v", got[1])
+	}
+	if got[2].Msg != "connection closed" || got[2].Source != EventSrcBanio {
+		t.Fatalf("bad banio event: %+v", got[2])
+	}
+}
+
+func TestEventSlowSub(t *testing.T) {
+	oldHub, oldSize, oldSub := events, EventBufSize, EventSubBuf
+	events, EventBufSize, EventSubBuf = newEventHub(), 4, 2
+	defer func() {
+		events, EventBufSize, EventSubBuf = oldHub, oldSize, oldSub
+	}()
+	sub, _ := events.subscribe(zapcore.InfoLevel, 0)
+	for i := 0; i < 6; i++ {
+		EmitEvent(EventSrcLog, zapcore.InfoLevel, strconv.Itoa(i), nil)
+	}
+	// the emitter never blocks, the queue keeps the oldest 发送方从不阻塞，队列保留最早的
+	if num := events.takeDropped(sub); num != 4 {
+		t.Fatalf("expect 4 dropped, got %d", num)
+	}
+	if evt := <-sub.ch; evt.Msg != "0" {
+		t.Fatalf("expect first event queued, got %s", evt.Msg)
+	}
+	events.unsubscribe(sub)
+	// the ring buffer keeps the latest EventBufSize 环形缓冲保留最新的EventBufSize个
+	_, backlog := events.subscribe(zapcore.InfoLevel, 0)
+	if len(backlog) != 4 || backlog[0].Msg != "2" || backlog[3].Msg != "5" {
+		t.Fatalf("bad backlog: %d", len(backlog))
+	}
+	_, backlog = events.subscribe(zapcore.InfoLevel, 4)
+	if len(backlog) != 2 || backlog[0].Seq != 5 {
+		t.Fatalf("resume after seq 4 should replay 2, got %d", len(backlog))
+	}
+}
@@ -89,12 +89,18 @@ func Run(args []string) error {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
+		ExposeHeaders: base.HeaderKlineCount + ", " + base.HeaderKlineFrom + ", " + base.HeaderKlineTo + ", " +
+			base.HeaderKlineTruncated,
 	}))
 
+	// 将日志转发到web界面
+	base.TeeEventLog()
+
 	// 注册API路由
 	base.RegApiKline(app.Group("/api/kline"))
 	base.RegApiWebsocket(app.Group("/api/ws"))
 	regApiDev(app.Group("/api/dev"))
+	base.RegApiDebug(app.Group("/api/debug", base.LocalOnly))
 
 	// 添加静态文件服务
 	err_ = ui.ServeStatic(app)
@@ -34,10 +34,16 @@ func StartApi() *errs.Error {
 		ExposeHeaders:    "*",
 	}))
 
+	base.SymbolAllows, base.SymbolBlocks = cfg.SymbolAllows, cfg.SymbolBlocks
+
+	// relay logs to the web UI 将日志转发到web界面
+	base.TeeEventLog()
+
 	// register routes 注册路由
 	base.RegApiKline(app.Group("/api/kline"))
 	base.RegApiWebsocket(app.Group("/api/ws"))
 	regApiBiz(app.Group("/api/bot", AuthMiddleware(cfg.JWTSecretKey)))
+	base.RegApiDebug(app.Group("/api/debug", AuthMiddleware(cfg.JWTSecretKey)))
 	regApiPub(app.Group("/api"))
 
 	// 添加静态文件服务